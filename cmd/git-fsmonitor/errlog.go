@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+)
+
+// git runs the hook for nearly every command and a failing hook fails the
+// command, so once the arguments check out, trouble with the backend is
+// recorded in a log file and git is told that everything changed. The log is
+// $GIT_FSMONITOR_LOG, or fsmonitor.log in the git dir. When it grows past
+// hookLogMaxSize it is moved to <log>.1, replacing the previous one.
+const (
+	hookLogFile    = "fsmonitor.log"
+	hookLogMaxSize = 1 << 20
+)
+
+// Return the git dir of the workdir the hook runs in.
+func findGitDir() (string, error) {
+	out, err := exec.Command("git", "rev-parse", "--absolute-git-dir").Output()
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+func hookLogPath() string {
+	if fname := os.Getenv("GIT_FSMONITOR_LOG"); fname != "" {
+		return fname
+	}
+	gitDir, err := findGitDir()
+	if err != nil {
+		// git changes the working dir to the workdir before running the hook.
+		gitDir = ".git"
+	}
+	return path.Join(gitDir, hookLogFile)
+}
+
+// Append a message to the hook log. If even that fails, it goes to stderr.
+func logHookError(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fname := hookLogPath()
+	if fi, err := os.Stat(fname); err == nil && fi.Size() > hookLogMaxSize {
+		os.Rename(fname, fname+".1")
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Print(msg)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s git-fsmonitor[%d]: %s\n", time.Now().Format(time.RFC3339), os.Getpid(), msg)
+}
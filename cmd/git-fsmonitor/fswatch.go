@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fswatch only streams events, it can't be asked what changed since a given
+// time. So the fswatch backend starts a background fswatch for the workdir
+// that appends "<unix seconds> <absolute path>" records, NUL-terminated, to a
+// journal in the git dir, and each hook call reads the records from the
+// requested time on. The first call only starts fswatch and reports that
+// everything changed, as does any call asking about a time before the
+// current fswatch started.
+const (
+	fswatchJournalFile = "fsmonitor-fswatch.journal"
+	fswatchPidFile     = "fsmonitor-fswatch.pid"
+	// A larger journal is emptied and git told that everything changed,
+	// which bounds the cost of reading it.
+	fswatchJournalMaxSize = 64 << 20
+	fswatchTokenPrefix    = "fswatch:"
+)
+
+type fswatchBackend struct{}
+
+func (fswatchBackend) changedSince(gitWorkdir string, tsNs int64) []string {
+	// Like watchman, the journal only has 1 second accuracy.
+	return fswatchChanges(gitWorkdir, tsNs/1e9)
+}
+
+// The token is the unix time of the call that returned it.
+func (fswatchBackend) changedSinceToken(gitWorkdir string, token string) (string, []string) {
+	// Take the time before reading the journal so the next call sees any
+	// record written meanwhile.
+	newToken := fswatchTokenPrefix + strconv.FormatInt(time.Now().Unix(), 10)
+	since, err := strconv.ParseInt(strings.TrimPrefix(token, fswatchTokenPrefix), 10, 64)
+	if !strings.HasPrefix(token, fswatchTokenPrefix) || err != nil {
+		since = -1
+	}
+	return newToken, fswatchChanges(gitWorkdir, since)
+}
+
+// Return the paths changed since the given unix time, or "/" if the journal
+// can't answer. A negative time means there is no starting point.
+func fswatchChanges(gitWorkdir string, since int64) []string {
+	gitDir, err := findGitDir()
+	if err != nil {
+		logHookError("unable to find the git dir: %s", err)
+		return []string{"/"}
+	}
+	journalFile := path.Join(gitDir, fswatchJournalFile)
+
+	started, err := ensureFswatch(gitWorkdir, gitDir, journalFile)
+	if err != nil {
+		logHookError("fswatch unavailable: %s", err)
+		return []string{"/"}
+	}
+	if since < 0 || since <= started {
+		return []string{"/"}
+	}
+	files, err := readFswatchJournal(gitWorkdir, journalFile, since)
+	if err != nil {
+		logHookError("unable to read the fswatch journal: %s", err)
+		return []string{"/"}
+	}
+	return files
+}
+
+// Start fswatch for the workdir unless it is already running, and return the
+// unix time it started. The pid file is locked so concurrent hook calls
+// start only one.
+func ensureFswatch(gitWorkdir string, gitDir string, journalFile string) (int64, error) {
+	pidFile, err := os.OpenFile(path.Join(gitDir, fswatchPidFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer pidFile.Close()
+	if err := syscall.Flock(int(pidFile.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+
+	data, err := ioutil.ReadAll(pidFile)
+	if err != nil {
+		return 0, err
+	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 {
+		if syscall.Kill(pid, 0) == nil {
+			fi, err := pidFile.Stat()
+			if err != nil {
+				return 0, err
+			}
+			return fi.ModTime().Unix(), nil
+		}
+	}
+
+	// Events from a previous fswatch are of no use after a gap.
+	journal, err := os.OpenFile(journalFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer journal.Close()
+	cmd := exec.Command("fswatch", "-0", "-r", "-t", "-f", "%s",
+		"--exclude", regexp.QuoteMeta(path.Join(gitWorkdir, ".git"))+"(/|$)",
+		gitWorkdir)
+	cmd.Stdout = journal
+	// Outlive the hook and git, and don't get their signals.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("unable to start fswatch: %w", err)
+	}
+	started := time.Now().Unix()
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	if err := pidFile.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := pidFile.WriteAt([]byte(strconv.Itoa(pid)+"\n"), 0); err != nil {
+		return 0, err
+	}
+	return started, nil
+}
+
+// Return the workdir paths in the journal recorded at or after since.
+func readFswatchJournal(gitWorkdir string, journalFile string, since int64) ([]string, error) {
+	fi, err := os.Stat(journalFile)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > fswatchJournalMaxSize {
+		// fswatch appends, so it carries on at the new end.
+		if err := os.Truncate(journalFile, 0); err != nil {
+			return nil, err
+		}
+		return []string{"/"}, nil
+	}
+	data, err := ioutil.ReadFile(journalFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// fswatch may report paths with symlinks in the workdir resolved.
+	prefixes := []string{gitWorkdir + "/"}
+	if resolved, err := filepath.EvalSymlinks(gitWorkdir); err == nil && resolved != gitWorkdir {
+		prefixes = append(prefixes, resolved+"/")
+	}
+
+	seen := make(map[string]bool)
+	files := make([]string, 0, 64)
+	records := bytes.Split(data, []byte{0})
+	// The last record is either empty or still being written.
+	for _, record := range records[:len(records)-1] {
+		fields := strings.SplitN(string(record), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		ts, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || ts < since {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if fname := strings.TrimPrefix(fields[1], prefix); fname != fields[1] {
+				if !seen[fname] {
+					seen[fname] = true
+					files = append(files, fname)
+				}
+				break
+			}
+		}
+	}
+	return dropGitPaths(files), nil
+}
@@ -6,17 +6,37 @@
 // Enable it via:
 //
 //	git config core.fsmonitor git-fsmonitor
+//
+// Both hook protocol versions are supported; git picks one with
+// core.fsmonitorhookversion. Version 1 passes a timestamp in nanoseconds,
+// version 2 the token returned by the previous call.
+//
+// Changes come from watchman unless GIT_FSMONITOR_BACKEND says otherwise:
+//
+//	watchman  query the watchman daemon (the default).
+//	fswatch   journal events from a background fswatch process.
+//	none      always report that everything changed.
+//
+// Backend failures never fail the hook, and so git: they are logged to
+// .git/fsmonitor.log, or $GIT_FSMONITOR_LOG, and git is told that
+// everything changed.
+//
+// If sync.fsmonitorMaxChanges is set, more changes than that are reported as
+// "/" too. git-sync falls back to git status above the same limit, so a push
+// and git agree on when the list is too long to be worth filtering.
 package main
 
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type watchmanReply interface {
@@ -38,12 +58,15 @@ func watchmanCmd(req interface{}, reply watchmanReply) error {
 		return err
 	}
 
-	cmd := exec.Command("watchman", "-j")
-	cmd.Stdin = bytes.NewReader(reqData)
-
-	replyData, err := cmd.Output()
+	// Spawning the CLI is the fallback if the socket can't be reached.
+	replyData, err := watchmanSocketCall(reqData)
 	if err != nil {
-		return err
+		cmd := exec.Command("watchman", "-j")
+		cmd.Stdin = bytes.NewReader(reqData)
+		replyData, err = cmd.Output()
+		if err != nil {
+			return err
+		}
 	}
 
 	if err := json.Unmarshal(replyData, reply); err != nil {
@@ -58,34 +81,48 @@ func watchmanCmd(req interface{}, reply watchmanReply) error {
 	return nil
 }
 
-// git-fsmonitor <protocol> <timestamp_nanoseconds>
-func main() {
-	log.SetFlags(0)
-	log.SetPrefix("git-fsmonitor: ")
-
-	if len(os.Args) < 3 {
-		log.Fatal("Not enough arguments: git-fsmonitor <protocol> <timestamp_nanoseconds>")
-	}
+// A root watchman doesn't know about can't be fixed by asking again, it
+// needs a watch-project.
+func isNotWatched(err error) bool {
+	return strings.Contains(err.Error(), "unable to resolve root") &&
+		strings.HasSuffix(err.Error(), "is not watched")
+}
 
-	version := os.Args[1]
-	if version != "1" {
-		log.Fatalf("Unsupported fsmonitor hook version %s", version)
-	}
+const (
+	// Total attempts for a watchman command, which can fail transiently
+	// while watchman is busy, for instance recrawling after a burst of
+	// changes.
+	watchmanAttempts = 3
+	// Wait this long before the first retry, doubling after each attempt.
+	watchmanRetryBackoff = 50 * time.Millisecond
+)
 
-	tsNs, err := strconv.ParseInt(os.Args[2], 0, 64)
-	if err != nil {
-		log.Fatalf("Timestamp cannot be parsed: %s", err)
+// Call attempt until it succeeds, up to watchmanAttempts times. A root that
+// is not watched or a missing watchman binary fails at once since retrying
+// won't help. A failure here makes git treat everything as dirty, which is
+// far more expensive than a short wait.
+func retryWatchman(attempt func() error) error {
+	backoff := watchmanRetryBackoff
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil || i >= watchmanAttempts || isNotWatched(err) || errors.Is(err, exec.ErrNotFound) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	// Watchman only has 1 second accuracy.
-	// FIXME(msolo) Should we rewind one full second to catch edit races?
-	ts := tsNs / 1e9
+}
 
-	// git changes the working dir before executing the hook.
-	gitWorkdir, err := os.Getwd()
-	if err != nil {
-		log.Fatalf("Cannot get working directory: %s", err)
-	}
+type queryReply struct {
+	wReply           // handle error capture.
+	Clock   string   `json:"clock"`
+	Files   []string `json:"files"`
+	IsFresh bool     `json:"is_fresh_instance"`
+}
 
+// Return the files and symlinks under gitWorkdir changed since the given
+// clockspec, either a unix timestamp or a watchman clock string.
+func queryChanges(gitWorkdir string, since interface{}) (*queryReply, error) {
 	query := []interface{}{
 		"query",
 		gitWorkdir,
@@ -95,49 +132,236 @@ func main() {
 			// Ignore transient files since the last timestamp.
 			"expression": []interface{}{"allof",
 				[]interface{}{"anyof", []interface{}{"type", "f"}, []interface{}{"type", "l"}},
-				[]interface{}{"not", []interface{}{"allof", []interface{}{"since", ts, "cclock"}, []interface{}{"not", "exists"}}},
+				[]interface{}{"not", []interface{}{"allof", []interface{}{"since", since, "cclock"}, []interface{}{"not", "exists"}}},
 			},
-			"since": ts,
+			"since": since,
 		},
 	}
+	var qReply *queryReply
+	err := retryWatchman(func() error {
+		// Start each attempt afresh, a reply without an error field would
+		// not clear the last one.
+		qReply = &queryReply{}
+		return watchmanCmd(query, qReply)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return qReply, nil
+}
+
+// Ask watchman to watch a root it doesn't know about yet, so the next query
+// can answer.
+func watchProject(gitWorkdir string) error {
+	watchProject := []interface{}{
+		"watch-project",
+		gitWorkdir,
+	}
+	err := retryWatchman(func() error {
+		return watchmanCmd(watchProject, &wReply{})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add project to watchman: %w", err)
+	}
+	return nil
+}
+
+// Return the current watchman clock for gitWorkdir, adding the root to
+// watchman first if need be.
+func watchmanClock(gitWorkdir string) (string, error) {
+	var cReply *queryReply
+	clock := func() error {
+		cReply = &queryReply{}
+		return watchmanCmd([]interface{}{"clock", gitWorkdir}, cReply)
+	}
+	err := retryWatchman(clock)
+	if err != nil && isNotWatched(err) {
+		if err := watchProject(gitWorkdir); err != nil {
+			return "", err
+		}
+		err = retryWatchman(clock)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get watchman clock: %w", err)
+	}
+	return cReply.Clock, nil
+}
+
+// Only send information about the working directory, not git internals.
+func dropGitPaths(fnames []string) []string {
+	files := make([]string, 0, len(fnames))
+	for _, fname := range fnames {
+		if fname == ".git" || strings.HasPrefix(fname, ".git/") {
+			continue
+		}
+		files = append(files, fname)
+	}
+	return files
+}
+
+// A source of file system changes. Paths are relative to the workdir and "/"
+// means everything may have changed, which git handles with a full scan.
+type backend interface {
+	// Protocol version 1: return the paths changed since the given time in
+	// nanoseconds.
+	changedSince(gitWorkdir string, tsNs int64) []string
+	// Protocol version 2: return a new token and the paths changed since the
+	// point token names. git passes an empty token, or a v1 timestamp after an
+	// upgrade, when it has none.
+	changedSinceToken(gitWorkdir string, token string) (string, []string)
+}
 
-	type queryReply struct {
-		wReply          // handle error capture.
-		Files  []string `json:"files"`
+// Select a backend by the name in GIT_FSMONITOR_BACKEND, watchman if unset.
+func newBackend(name string) (backend, error) {
+	switch name {
+	case "", "watchman":
+		return watchmanBackend{}, nil
+	case "fswatch":
+		return fswatchBackend{}, nil
+	case "none":
+		return noneBackend{}, nil
 	}
-	qReply := &queryReply{}
-	err = watchmanCmd(query, qReply)
+	return nil, errors.New("unknown GIT_FSMONITOR_BACKEND " + strconv.Quote(name) + ", want watchman, fswatch or none")
+}
+
+type watchmanBackend struct{}
+
+func (watchmanBackend) changedSince(gitWorkdir string, tsNs int64) []string {
+	// Watchman only has 1 second accuracy.
+	// FIXME(msolo) Should we rewind one full second to catch edit races?
+	ts := tsNs / 1e9
+
+	qReply, err := queryChanges(gitWorkdir, ts)
 
 	// The first call to watchman always returns all files; emulate that by
 	// telling git that everything is dirty in any error case.
-	files := []string{"/"}
 	if err != nil {
-		if strings.Contains(err.Error(), "unable to resolve root") &&
-			strings.HasSuffix(err.Error(), "is not watched") {
-			watchProject := []interface{}{
-				"watch-project",
-				gitWorkdir,
-			}
-			reply := &wReply{}
-			err = watchmanCmd(watchProject, reply)
-			if err != nil {
-				log.Fatalf("Failed to add project to watchman: %s", err)
-			}
-		} else {
-			log.Fatalf("Unknown watchman error: %s", err)
+		if isNotWatched(err) {
+			err = watchProject(gitWorkdir)
 		}
-	} else {
-		files = make([]string, 0, len(qReply.Files))
-		for _, fname := range qReply.Files {
-			// Only send information about the working directory, not git internals.
-			if fname == ".git" || strings.HasPrefix(fname, ".git/") {
-				continue
-			}
-			files = append(files, fname)
+		if err != nil {
+			logHookError("watchman query failed: %s", err)
 		}
+		return []string{"/"}
 	}
+	return dropGitPaths(qReply.Files)
+}
 
-	fmt.Print(joinNullTerminated(files))
+// The token is a watchman clock. Anything else, and any reply watchman
+// can't answer incrementally, gets the current clock and "/". If watchman
+// fails outright the token is handed back, so the next call covers this one.
+func (watchmanBackend) changedSinceToken(gitWorkdir string, token string) (string, []string) {
+	currentClock := func() (string, []string) {
+		clock, err := watchmanClock(gitWorkdir)
+		if err != nil {
+			logHookError("%s", err)
+			return token, []string{"/"}
+		}
+		return clock, []string{"/"}
+	}
+	if !strings.HasPrefix(token, "c:") {
+		return currentClock()
+	}
+
+	qReply, err := queryChanges(gitWorkdir, token)
+	if err != nil {
+		if !isNotWatched(err) {
+			logHookError("watchman query failed: %s", err)
+			return token, []string{"/"}
+		}
+		return currentClock()
+	}
+	// A fresh instance means watchman lost track, for instance after a
+	// restart, and lists every file. Saying so is cheaper for git.
+	if qReply.IsFresh {
+		return qReply.Clock, []string{"/"}
+	}
+	return qReply.Clock, dropGitPaths(qReply.Files)
+}
+
+// The git config key shared with git-sync. Unlike git-sync, the hook has no
+// default limit, so git is only affected if it is set.
+const maxChangesKey = "sync.fsmonitorMaxChanges"
+
+// Return the limit set by sync.fsmonitorMaxChanges, or 0 if there is none.
+func maxChanges() int {
+	out, err := exec.Command("git", "config", "--int", "--get", maxChangesKey).Output()
+	if err != nil {
+		// git config exits 1 for a missing key.
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			logHookError("unable to read %s: %s", maxChangesKey, err)
+		}
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || n < 0 {
+		logHookError("invalid %s: %s", maxChangesKey, bytes.TrimSpace(out))
+		return 0
+	}
+	return n
+}
+
+// Replace a list of more than sync.fsmonitorMaxChanges changes with "/".
+// The config is only read when there are changes to count.
+func limitChanges(files []string) []string {
+	if len(files) < 2 {
+		return files
+	}
+	if limit := maxChanges(); limit > 0 && len(files) > limit {
+		return []string{"/"}
+	}
+	return files
+}
+
+// Report that everything changed, every time. git still works, it just scans
+// the whole workdir as if there were no fsmonitor.
+type noneBackend struct{}
+
+func (noneBackend) changedSince(gitWorkdir string, tsNs int64) []string {
+	return []string{"/"}
+}
+
+func (noneBackend) changedSinceToken(gitWorkdir string, token string) (string, []string) {
+	return "none", []string{"/"}
+}
+
+// git-fsmonitor <protocol> <timestamp_nanoseconds | token>
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("git-fsmonitor: ")
+
+	if len(os.Args) < 3 {
+		log.Fatal("Not enough arguments: git-fsmonitor <protocol> <timestamp_nanoseconds | token>")
+	}
+
+	b, err := newBackend(os.Getenv("GIT_FSMONITOR_BACKEND"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// git changes the working dir before executing the hook.
+	gitWorkdir, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Cannot get working directory: %s", err)
+	}
+
+	switch version := os.Args[1]; version {
+	case "1":
+		// The reply is the NUL-terminated changed paths.
+		tsNs, err := strconv.ParseInt(os.Args[2], 0, 64)
+		if err != nil {
+			log.Fatalf("Timestamp cannot be parsed: %s", err)
+		}
+		fmt.Print(joinNullTerminated(limitChanges(b.changedSince(gitWorkdir, tsNs))))
+	case "2":
+		// The reply is a new token followed by a NUL and the NUL-terminated
+		// changed paths.
+		token, files := b.changedSinceToken(gitWorkdir, os.Args[2])
+		fmt.Print(token + "\000" + joinNullTerminated(limitChanges(files)))
+	default:
+		log.Fatalf("Unsupported fsmonitor hook version %s", version)
+	}
 }
 
 func joinNullTerminated(ss []string) string {
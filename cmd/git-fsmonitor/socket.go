@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+)
+
+// git runs the hook for nearly every command, so spawning watchman -j each
+// time adds up. Instead requests go as JSON lines over the watchman socket,
+// one connection per hook call. Finding the socket needs watchman
+// get-sockname, itself a spawn, so the answer is cached in the user's cache
+// dir. WATCHMAN_SOCK, if set, wins as it does for the watchman CLI.
+
+var (
+	// The connection for this process, nil until the first request.
+	watchmanConn *bufio.ReadWriter
+	// Set once the socket can't be reached, so later requests go straight to
+	// the CLI.
+	watchmanSocketFailed bool
+)
+
+const watchmanSocknameCacheFile = "git-fsmonitor/watchman-sockname"
+
+// Send a JSON request over the watchman socket and return the reply. If
+// there is no connection yet the cached socket name is tried first, then a
+// fresh one from watchman get-sockname.
+func watchmanSocketCall(reqData []byte) ([]byte, error) {
+	if watchmanSocketFailed {
+		return nil, errors.New("watchman socket unavailable")
+	}
+	if watchmanConn == nil {
+		if err := dialWatchman(); err != nil {
+			watchmanSocketFailed = true
+			return nil, err
+		}
+	}
+	if _, err := watchmanConn.Write(append(reqData, '\n')); err != nil {
+		watchmanConn = nil
+		return nil, err
+	}
+	if err := watchmanConn.Flush(); err != nil {
+		watchmanConn = nil
+		return nil, err
+	}
+	replyData, err := watchmanConn.ReadBytes('\n')
+	if err != nil {
+		watchmanConn = nil
+		return nil, err
+	}
+	return replyData, nil
+}
+
+func dialWatchman() error {
+	if sockname := os.Getenv("WATCHMAN_SOCK"); sockname != "" {
+		return dialWatchmanSocket(sockname)
+	}
+	cacheFile := ""
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		cacheFile = path.Join(cacheDir, watchmanSocknameCacheFile)
+		if data, err := ioutil.ReadFile(cacheFile); err == nil {
+			if dialWatchmanSocket(string(bytes.TrimSpace(data))) == nil {
+				return nil
+			}
+		}
+	}
+
+	// The cache is missing or stale, say after watchman moved its state dir.
+	sockname, err := watchmanSockname()
+	if err != nil {
+		return err
+	}
+	if err := dialWatchmanSocket(sockname); err != nil {
+		return err
+	}
+	if cacheFile != "" {
+		writeSocknameCache(cacheFile, sockname)
+	}
+	return nil
+}
+
+func dialWatchmanSocket(sockname string) error {
+	conn, err := net.Dial("unix", sockname)
+	if err != nil {
+		return err
+	}
+	// The connection lives as long as the process.
+	watchmanConn = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	return nil
+}
+
+// Ask the watchman CLI where its socket is. This also starts the watchman
+// server if it is not running.
+func watchmanSockname() (string, error) {
+	out, err := exec.Command("watchman", "get-sockname").Output()
+	if err != nil {
+		return "", err
+	}
+	reply := &struct {
+		wReply
+		Sockname string `json:"sockname"`
+		// Newer versions name each kind of socket.
+		UnixDomain string `json:"unix_domain"`
+	}{}
+	if err := json.Unmarshal(out, reply); err != nil {
+		return "", err
+	}
+	if reply.Error() != "" {
+		return "", &reply.wReply
+	}
+	if reply.UnixDomain != "" {
+		return reply.UnixDomain, nil
+	}
+	return reply.Sockname, nil
+}
+
+// Caching is only an optimization, so failures are ignored. The file is
+// replaced atomically so a concurrent hook never reads half a name.
+func writeSocknameCache(cacheFile string, sockname string) {
+	if err := os.MkdirAll(path.Dir(cacheFile), 0755); err != nil {
+		return
+	}
+	tmpFile, err := ioutil.TempFile(path.Dir(cacheFile), "watchman-sockname-")
+	if err != nil {
+		return
+	}
+	_, err = tmpFile.WriteString(sockname + "\n")
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), cacheFile)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+}
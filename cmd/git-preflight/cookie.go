@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/msolo/git-mg/gitapi"
+	log "github.com/msolo/go-bis/glug"
+	"github.com/pkg/errors"
+)
+
+// A cookie older than this is ignored and all changed files are evaluated.
+const preflightCookieMaxAge = 24 * time.Hour
+
+// Record the state of the last successful preflight run so the next run can
+// skip files that haven't changed since. Like the git-sync cookie, the Last*
+// fields are persisted and the private fields describe the current run.
+type preflightCookie struct {
+	LastHeadHash      string
+	LastMergeBaseHash string
+	LastConfigHash    string
+	LastTriggerNames  []string
+	LastRunNs         int64
+	// Content hash of every changed file, keyed by path. Deleted files hash to "".
+	LastFileHashes map[string]string
+
+	headHash      string
+	mergeBaseHash string
+	configHash    string
+	triggerNames  []string
+	runNs         int64
+}
+
+func preflightCookiePath(workdir string) string {
+	return path.Join(gitapi.GitDir(workdir), "git-preflight-cookie.json")
+}
+
+// Return true if the previous run's file hashes can be trusted for this run.
+func (pc *preflightCookie) valid() bool {
+	if pc.LastHeadHash != pc.headHash || pc.LastMergeBaseHash != pc.mergeBaseHash {
+		return false
+	}
+	if pc.LastConfigHash != pc.configHash {
+		return false
+	}
+	if strings.Join(pc.LastTriggerNames, " ") != strings.Join(pc.triggerNames, " ") {
+		return false
+	}
+	return time.Duration(pc.runNs-pc.LastRunNs) < preflightCookieMaxAge
+}
+
+func hashConfigFile(fname string) (string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func readPreflightCookie(workdir string, mergeBaseHash string, configFile string, triggerNames []string) (*preflightCookie, error) {
+	headHash, err := gitapi.GetHeadCommitHash(workdir)
+	if err != nil {
+		return nil, err
+	}
+	configHash, err := hashConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	sortedNames := make([]string, len(triggerNames))
+	copy(sortedNames, triggerNames)
+	sort.Strings(sortedNames)
+	pc := &preflightCookie{
+		headHash:      headHash,
+		mergeBaseHash: mergeBaseHash,
+		configHash:    configHash,
+		triggerNames:  sortedNames,
+		runNs:         time.Now().UnixNano(),
+	}
+	data, err := ioutil.ReadFile(preflightCookiePath(workdir))
+	if err == nil {
+		if err := json.Unmarshal(data, pc); err != nil {
+			// A corrupt cookie only costs a full evaluation.
+			log.Warningf("ignoring unreadable preflight cookie: %s", err)
+			return pc, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func writePreflightCookie(workdir string, pc *preflightCookie, fileHashes map[string]string) error {
+	tmpPc := &preflightCookie{
+		LastHeadHash:      pc.headHash,
+		LastMergeBaseHash: pc.mergeBaseHash,
+		LastConfigHash:    pc.configHash,
+		LastTriggerNames:  pc.triggerNames,
+		LastRunNs:         pc.runNs,
+		LastFileHashes:    fileHashes,
+	}
+	data, err := json.Marshal(tmpPc)
+	if err != nil {
+		return errors.Wrap(err, "failed marshaling preflight cookie")
+	}
+	return ioutil.WriteFile(preflightCookiePath(workdir), data, 0644)
+}
+
+// Return the content hash of each file. Files that no longer exist hash to "".
+func hashChangedFiles(workdir string, fnames []string) (map[string]string, error) {
+	fileHashes := make(map[string]string, len(fnames))
+	existing := make([]string, 0, len(fnames))
+	for _, fname := range fnames {
+		fi, err := os.Stat(path.Join(workdir, fname))
+		if err != nil || fi.IsDir() {
+			fileHashes[fname] = ""
+			continue
+		}
+		existing = append(existing, fname)
+	}
+	if len(existing) == 0 {
+		return fileHashes, nil
+	}
+	hashes, err := gitapi.HashFiles(workdir, existing)
+	if err != nil {
+		return nil, err
+	}
+	for i, fname := range existing {
+		fileHashes[fname] = hashes[i]
+	}
+	return fileHashes, nil
+}
+
+// Return the subset of changedFiles whose content differs from the last
+// successful run. If the cookie is not valid, all files are returned.
+func filterSinceCookie(pc *preflightCookie, fileHashes map[string]string, changedFiles []string) []string {
+	if !pc.valid() {
+		log.Infof("preflight cookie is stale, evaluating all changed files")
+		return changedFiles
+	}
+	filtered := make([]string, 0, len(changedFiles))
+	for _, fname := range changedFiles {
+		lastHash, ok := pc.LastFileHashes[fname]
+		if ok && lastHash == fileHashes[fname] {
+			continue
+		}
+		filtered = append(filtered, fname)
+	}
+	return filtered
+}
@@ -1,6 +1,10 @@
 /*
 	{
 	  // Comments are allowed, this is a JSONR file. See github.com/msolo/jsonr for more details.
+	  // Run up to this many triggers at once. The default of 1 runs them in order.
+	  "parallelism": 1,
+	  // Stop at the first failing trigger instead of running them all.
+	  "fail_fast": false,
 	  "triggers": [
 	    {
 	      // A short name to disambiguate.
@@ -14,10 +18,31 @@
 	      // Run this command when files are matched.
 	      "cmd": ["gofmt", "-w"],
 	      // Run on modified files that match the given glob. See fnmatch for more details.
-	      // Note that ** is not supported.
+	      // A ** path component matches any number of directories.
 	      "includes": ["*.go"],
-	      // Skip included files that match any of these globs. ** is not supported.
-	      "excludes": ["vendor/*"]
+	      // Skip included files that match these globs. Later patterns win and a
+	      // leading ! re-includes files excluded by an earlier pattern.
+	      "excludes": ["vendor/*"],
+	      // Drop every file under these directories before trying any
+	      // pattern. Cheaper than a ** glob for large generated trees.
+	      "exclude_dirs": ["third_party/"],
+	      // Drop files that look binary, with a NUL byte in the first 8KB.
+	      "skip_binary": true,
+	      // Set to "dir" to run the command once per directory holding matched
+	      // files, in that directory, with paths relative to it.
+	      "group_by": "",
+	      // Only run if the commit message matches this regexp, or with a
+	      // leading ! only if it doesn't. Meant for a commit-msg hook.
+	      "commit_message_match": "!^WIP:",
+	      // Run the command once per matched file, or per dir with args-dirs,
+	      // up to this many at once. Zero passes every file to a single run.
+	      "per_file_parallelism": 0,
+	      // Run in this directory, relative to the repository root, instead of
+	      // the root. Matched files are passed relative to it.
+	      "working_dir": "",
+	      // KEY=VALUE pairs added to the environment. $VAR expands from the
+	      // environment git-preflight runs in.
+	      "env": []
 	    }
 	  ]
 	}
@@ -25,28 +50,49 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/msolo/git-mg/gitapi"
 	log "github.com/msolo/go-bis/glug"
 	"github.com/msolo/jsonr"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/posener/complete/v2"
 	"github.com/posener/complete/v2/predict"
 )
 
+// Values for -output-format.
+const (
+	outputFormatText = "text"
+	outputFormatJSON = "json"
+)
+
 const (
 	InputTypeArgs     = "args"
 	InputTypeArgsDirs = "args-dirs"
 	InputTypeNone     = "none"
 )
 
+// Values for group_by.
+const (
+	GroupByNone = ""
+	GroupByDir  = "dir"
+)
+
 // Define a command that will be executed when a relevant file changed.
 type TriggerConfig struct {
 	Name string   `json:"name"`
@@ -55,16 +101,52 @@ type TriggerConfig struct {
 	InputType string   `json:"input_type"`
 	Includes  []string `json:"includes"`
 	Excludes  []string `json:"excludes"`
+	// Drop files under these directories, relative to the workdir, before
+	// any pattern is tried.
+	ExcludeDirs []string `json:"exclude_dirs"`
+	// Drop matched files that look binary before running the command.
+	SkipBinary bool `json:"skip_binary"`
+	// With GroupByDir, run the command once per directory of matched files.
+	GroupBy string `json:"group_by"`
+	// Only run if the commit message matches this regexp, or with a leading !
+	// only if it doesn't.
+	CommitMessageMatch string `json:"commit_message_match"`
+	// With PerFileParallelism, run the command once per matched file, or per
+	// dir for args-dirs, up to this many at once. Zero runs it once.
+	PerFileParallelism int `json:"per_file_parallelism"`
+	// Run the command in this directory, relative to the workdir, with
+	// matched files named relative to it.
+	WorkingDir string `json:"working_dir"`
+	// KEY=VALUE pairs added to the command's environment. $VAR and ${VAR}
+	// in a value expand from git-preflight's own environment.
+	Env []string `json:"env"`
 }
 
 // Config global include/exclude rules
 type PreflightConfig struct {
-	// Triggers are executed in order.
-	// FIXME(msolo) specify how to run them in parallel? Or just rely on shell scripts underneath?
+	// The maximum number of triggers to run at once. Zero means one.
+	Parallelism int `json:"parallelism"`
+	// Stop at the first failing trigger, killing any still running, rather
+	// than running them all. -fail-fast overrides this.
+	FailFast bool `json:"fail_fast"`
+	// Triggers are started in order. With a parallelism of one, each trigger
+	// finishes before the next starts.
 	Triggers []TriggerConfig `json:"triggers"`
 }
 
 func readConfig(fname string) (*PreflightConfig, error) {
+	cfg, err := decodeConfig(fname)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Read a config without validating it.
+func decodeConfig(fname string) (*PreflightConfig, error) {
 	f, err := os.Open(fname)
 	if err != nil {
 		return nil, err
@@ -76,85 +158,298 @@ func readConfig(fname string) (*PreflightConfig, error) {
 	if err := dec.Decode(cfg); err != nil {
 		return nil, err
 	}
-	if err := validateConfig(cfg); err != nil {
-		return nil, err
-	}
 	return cfg, nil
 }
 
+// A problem found in a config. Trigger is empty for problems that don't
+// belong to a single trigger.
+type validationError struct {
+	Trigger string `json:"trigger,omitempty"`
+	Message string `json:"error"`
+}
+
+func (ve validationError) String() string {
+	if ve.Trigger != "" {
+		return "trigger " + ve.Trigger + ": " + ve.Message
+	}
+	return ve.Message
+}
+
+// Every problem found in a config, so they can all be fixed at once.
+type validationErrors []validationError
+
+func (ve validationErrors) Error() string {
+	msgs := make([]string, 0, len(ve))
+	for _, e := range ve {
+		msgs = append(msgs, e.String())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Return every problem in the config as a validationErrors, or nil.
 func validateConfig(cfg *PreflightConfig) error {
+	if errs := configErrors(cfg); len(errs) > 0 {
+		return validationErrors(errs)
+	}
+	return nil
+}
+
+// Return every problem in the config, in order.
+func configErrors(cfg *PreflightConfig) []validationError {
+	errs := make([]validationError, 0, 4)
+	if cfg.Parallelism < 0 {
+		errs = append(errs, validationError{Message: fmt.Sprintf("invalid parallelism: %d", cfg.Parallelism)})
+	}
 	nameMap := make(map[string]bool)
-	for _, t := range cfg.Triggers {
+	for i := range cfg.Triggers {
+		t := &cfg.Triggers[i]
 		if exists := nameMap[t.Name]; exists {
-			return fmt.Errorf("duplicate trigger name: %s", t.Name)
+			errs = append(errs, validationError{t.Name, fmt.Sprintf("duplicate trigger name: %s", t.Name)})
 		} else {
 			nameMap[t.Name] = true
 		}
-		if err := validateTrigger(&t); err != nil {
-			return err
+		for _, err := range triggerErrors(t) {
+			errs = append(errs, validationError{t.Name, err.Error()})
 		}
 	}
-	return nil
+	return errs
 }
 
-func validateTrigger(tr *TriggerConfig) error {
+func triggerErrors(tr *TriggerConfig) []error {
+	errs := make([]error, 0, 1)
 	// NOTE: Multiple keys with the same name is not an error in JSON, last value wins.
 	if tr.Name == "" {
-		return fmt.Errorf("empty trigger name")
+		errs = append(errs, fmt.Errorf("empty trigger name"))
 	} else if strings.ContainsAny(tr.Name, " \t\r\n") {
-		return fmt.Errorf("invalid trigger name containing whitespace: %q", tr.Name)
+		errs = append(errs, fmt.Errorf("invalid trigger name containing whitespace: %q", tr.Name))
 	}
 
 	switch tr.InputType {
 	case InputTypeNone, InputTypeArgs, InputTypeArgsDirs:
 	default:
-		return fmt.Errorf("invalid trigger input type %q for trigger %s", tr.InputType, tr.Name)
+		errs = append(errs, fmt.Errorf("invalid trigger input type %q for trigger %s", tr.InputType, tr.Name))
+	}
+	switch tr.GroupBy {
+	case GroupByNone, GroupByDir:
+	default:
+		errs = append(errs, fmt.Errorf("invalid group_by %q for trigger %s, expected \"dir\" or nothing", tr.GroupBy, tr.Name))
 	}
 	for _, pat := range tr.Includes {
-		if _, err := path.Match(pat, ""); err != nil {
-			return fmt.Errorf("invalid include pattern %q for trigger %s: %v", pat, tr.Name, err)
+		if _, err := path.Match(strings.TrimPrefix(pat, "!"), ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid include pattern %q for trigger %s: %v", pat, tr.Name, err))
 		}
 	}
 
 	for _, pat := range tr.Excludes {
-		if _, err := path.Match(pat, ""); err != nil {
-			return fmt.Errorf("invalid exclude pattern %q for trigger %s: %v", pat, tr.Name, err)
+		if _, err := path.Match(strings.TrimPrefix(pat, "!"), ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid exclude pattern %q for trigger %s: %v", pat, tr.Name, err))
 		}
 	}
-	return nil
+	for _, dir := range tr.ExcludeDirs {
+		clean := path.Clean(dir)
+		if dir == "" || clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			errs = append(errs, fmt.Errorf("invalid exclude_dirs entry %q for trigger %s, expected a directory inside the repo", dir, tr.Name))
+		}
+	}
+	if _, err := regexp.Compile(strings.TrimPrefix(tr.CommitMessageMatch, "!")); err != nil {
+		errs = append(errs, fmt.Errorf("invalid commit_message_match %q for trigger %s: %v", tr.CommitMessageMatch, tr.Name, err))
+	}
+	switch {
+	case tr.PerFileParallelism < 0:
+		errs = append(errs, fmt.Errorf("invalid per_file_parallelism %d for trigger %s", tr.PerFileParallelism, tr.Name))
+	case tr.PerFileParallelism > 0 && tr.InputType == InputTypeNone:
+		errs = append(errs, fmt.Errorf("per_file_parallelism needs input_type args or args-dirs for trigger %s", tr.Name))
+	case tr.PerFileParallelism > 0 && tr.GroupBy == GroupByDir:
+		errs = append(errs, fmt.Errorf("per_file_parallelism cannot be combined with group_by dir for trigger %s", tr.Name))
+	}
+	if tr.WorkingDir != "" {
+		// Checked from the workdir, where git-preflight runs.
+		dir := path.Clean(tr.WorkingDir)
+		switch {
+		case path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../"):
+			errs = append(errs, fmt.Errorf("working_dir %q is outside the repo for trigger %s", tr.WorkingDir, tr.Name))
+		case !isDir(dir):
+			errs = append(errs, fmt.Errorf("working_dir %q is not a directory for trigger %s", tr.WorkingDir, tr.Name))
+		case tr.GroupBy == GroupByDir:
+			errs = append(errs, fmt.Errorf("working_dir cannot be combined with group_by dir for trigger %s", tr.Name))
+		}
+	}
+	for _, kv := range tr.Env {
+		if strings.Index(kv, "=") <= 0 {
+			errs = append(errs, fmt.Errorf("invalid env %q for trigger %s, expected KEY=VALUE", kv, tr.Name))
+		}
+	}
+	return errs
 }
 
-// Match is similar to fnmatch.
+// The result of -validate -output-format=json.
+type validationResult struct {
+	ConfigFile string            `json:"config_file"`
+	Valid      bool              `json:"valid"`
+	Errors     []validationError `json:"errors"`
+}
+
+// Validate a config, reporting every problem rather than just the first.
+// Return true if the config is valid.
+func runValidate(fname string, outputFormat string) bool {
+	errs := []validationError{}
+	cfg, err := decodeConfig(fname)
+	if err != nil {
+		errs = append(errs, validationError{Message: err.Error()})
+	} else {
+		errs = configErrors(cfg)
+	}
+
+	if outputFormat == outputFormatJSON {
+		result := validationResult{ConfigFile: fname, Valid: len(errs) == 0, Errors: errs}
+		enc := json.NewEncoder(os.Stdout)
+		exitOnError(enc.Encode(result))
+	} else {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", fname, e)
+		}
+	}
+	return len(errs) == 0
+}
+
+// Match a single pattern against a path, similar to fnmatch.
 // Patterns containing no / are only matched against the basename, unlike path.Match.
-// Includes are applied first and then filtered by excludes.
-// FIXME(msolo) Incorporate ideas from gitignore style matching like ** and ! ?
-func match(tr *TriggerConfig, fname string) (bool, error) {
-	for _, pat := range tr.Includes {
-		matchName := fname
-		if !strings.Contains(pat, "/") {
-			matchName = path.Base(fname)
+// A ** path component matches zero or more directories.
+func matchPattern(pat string, fname string) (bool, error) {
+	if !strings.Contains(pat, "/") {
+		return path.Match(pat, path.Base(fname))
+	}
+	return matchComponents(strings.Split(strings.TrimPrefix(pat, "/"), "/"), strings.Split(fname, "/"))
+}
+
+func matchComponents(pats []string, names []string) (bool, error) {
+	for len(pats) > 0 {
+		if pats[0] == "**" {
+			// Try every possible span of directories, including none.
+			for i := 0; i <= len(names); i++ {
+				if ok, err := matchComponents(pats[1:], names[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(names) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(pats[0], names[0])
+		if !ok || err != nil {
+			return false, err
 		}
-		include, err := path.Match(pat, matchName)
-		//fmt.Println("check fname", fname, "matchName", matchName, "pattern", pat, include)
+		pats, names = pats[1:], names[1:]
+	}
+	return len(names) == 0, nil
+}
+
+// Evaluate patterns in order like .gitignore: the last matching pattern
+// wins, and a leading ! negates it.
+func matchPatterns(pats []string, fname string) (bool, error) {
+	matched := false
+	for _, pat := range pats {
+		negate := strings.HasPrefix(pat, "!")
+		ok, err := matchPattern(strings.TrimPrefix(pat, "!"), fname)
 		if err != nil {
 			return false, err
 		}
-		if !include {
+		if ok {
+			matched = !negate
+		}
+	}
+	return matched, nil
+}
+
+// Report whether a file is under one of the trigger's exclude_dirs. This is
+// a plain prefix check, so "vendor" and "vendor/" both drop vendor/x/y.go
+// but not vendored.go.
+func inExcludedDir(tr *TriggerConfig, fname string) bool {
+	if len(tr.ExcludeDirs) == 0 {
+		return false
+	}
+	fname = path.Clean(fname)
+	for _, dir := range tr.ExcludeDirs {
+		if strings.HasPrefix(fname, path.Clean(dir)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether a trigger applies to a changed file.
+// Files in exclude_dirs are dropped first. Includes are applied next and then
+// filtered by excludes. Within each list patterns are evaluated in order, so
+// a !pattern can carve out an exception to an earlier, broader pattern.
+func match(tr *TriggerConfig, fname string) (bool, error) {
+	if inExcludedDir(tr, fname) {
+		return false, nil
+	}
+	include, err := matchPatterns(tr.Includes, fname)
+	if !include || err != nil {
+		return false, err
+	}
+	exclude, err := matchPatterns(tr.Excludes, fname)
+	if err != nil {
+		return false, err
+	}
+	return !exclude, nil
+}
+
+// Report whether a trigger applies to a commit message. A trigger without
+// commit_message_match applies to any message.
+func matchCommitMessage(tr *TriggerConfig, msg string) (bool, error) {
+	if tr.CommitMessageMatch == "" {
+		return true, nil
+	}
+	negate := strings.HasPrefix(tr.CommitMessageMatch, "!")
+	re, err := regexp.Compile(strings.TrimPrefix(tr.CommitMessageMatch, "!"))
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(msg) != negate, nil
+}
+
+// Remove the triggers whose commit_message_match rejects the commit message
+// from enabled. The message is only read if an enabled trigger needs it.
+func dropUnmatchedTriggers(triggers []TriggerConfig, enabled map[string]bool, readMsg func() (string, error)) error {
+	var commitMsg *string
+	for _, tr := range triggers {
+		if !enabled[tr.Name] || tr.CommitMessageMatch == "" {
 			continue
 		}
-		exclude := false
-		for _, pat := range tr.Excludes {
-			exclude, err = path.Match(pat, matchName)
+		if commitMsg == nil {
+			msg, err := readMsg()
 			if err != nil {
-				return false, err
-			}
-			if exclude {
-				return false, nil
+				return err
 			}
+			commitMsg = &msg
 		}
-		return true, nil
+		matched, err := matchCommitMessage(&tr, *commitMsg)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			log.Infof("trigger %s skipped, commit message does not match %q", tr.Name, tr.CommitMessageMatch)
+			delete(enabled, tr.Name)
+		}
+	}
+	return nil
+}
+
+// Return the pending commit message: the -message flag if set, otherwise
+// .git/COMMIT_EDITMSG. That file is only current while git commit runs its
+// hooks; outside of a commit it holds the last message.
+func readCommitMessage(workdir string) (string, error) {
+	if *message != "" {
+		return *message, nil
 	}
-	return false, nil
+	data, err := ioutil.ReadFile(path.Join(gitapi.GitDir(workdir), "COMMIT_EDITMSG"))
+	if err != nil {
+		return "", fmt.Errorf("commit_message_match needs a commit message, pass -message or run from a commit-msg hook: %v", err)
+	}
+	return string(data), nil
 }
 
 func exitOnError(err error) {
@@ -172,6 +467,23 @@ func isDir(fname string) bool {
 	return fi.IsDir()
 }
 
+// Only this much of a file is read to decide if it is binary.
+const binarySniffSize = 8 * 1024
+
+// Report whether a file looks binary, like git does, by the presence of a NUL
+// byte near the start. Files that can't be read, such as deleted files, are
+// not considered binary.
+func isBinaryFile(fname string) bool {
+	f, err := os.Open(fname)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, binarySniffSize)
+	n, _ := io.ReadFull(f, buf)
+	return bytes.IndexByte(buf[:n], 0) >= 0
+}
+
 // Return unique sorted list of parent directories for the given file set.
 func files2dirs(fnames ...string) []string {
 	changedDirSet := make(map[string]bool)
@@ -205,18 +517,83 @@ func runPreflight() {
 	if *configFile == "" {
 		*configFile = path.Join(gitWorkdir, ".git-preflight")
 	}
-	cfg, err := readConfig(*configFile)
-	exitOnError(err)
+	switch *outputFormat {
+	case outputFormatText, outputFormatJSON:
+	default:
+		exitOnError(fmt.Errorf("invalid -output-format %q, expected text or json", *outputFormat))
+	}
 	if *validate {
+		if !runValidate(*configFile, *outputFormat) {
+			os.Exit(1)
+		}
 		return
 	}
+	cfg, err := readConfig(*configFile)
+	exitOnError(err)
+	if *sinceCookie && *commitHash != "" {
+		exitOnError(fmt.Errorf("-since-cookie cannot be combined with -commit-hash"))
+	}
+	if *filesFrom != "" && (*sinceCookie || *commitHash != "") {
+		exitOnError(fmt.Errorf("-files-from cannot be combined with -since-cookie or -commit-hash"))
+	}
+	if *staged && (*commitHash != "" || *filesFrom != "" || *sinceCookie) {
+		exitOnError(fmt.Errorf("-staged cannot be combined with -commit-hash, -files-from or -since-cookie"))
+	}
+	if *commitRange != "" && *commitHash != "" {
+		exitOnError(fmt.Errorf("-commit-range cannot be combined with -commit-hash"))
+	}
+	if *commitRange != "" && (*filesFrom != "" || *sinceCookie || *staged) {
+		exitOnError(fmt.Errorf("-commit-range cannot be combined with -files-from, -since-cookie or -staged"))
+	}
+
+	cfgTriggerMap := make(map[string]*TriggerConfig)
+
+	allTriggerNames := make([]string, 0, len(cfg.Triggers))
+	for _, tr := range cfg.Triggers {
+		cfgTriggerMap[tr.Name] = &tr
+		allTriggerNames = append(allTriggerNames, tr.Name)
+	}
+
+	// If there are no explicit triggers, run them all.
+	if len(triggerNames) == 0 {
+		triggerNames = allTriggerNames
+	}
+
+	enabledTriggers := make(map[string]bool)
+	for _, name := range triggerNames {
+		if _, ok := cfgTriggerMap[name]; !ok {
+			exitOnError(fmt.Errorf("no such trigger: %q", name))
+		}
+		enabledTriggers[name] = true
+	}
+
+	// Triggers skipped for the commit message are dropped up front so they
+	// are left out of the cookie. A later run where they match then sees
+	// different trigger names and evaluates every file.
+	exitOnError(dropUnmatchedTriggers(cfg.Triggers, enabledTriggers, func() (string, error) {
+		return readCommitMessage(gitWorkdir)
+	}))
+	cookieTriggerNames := make([]string, 0, len(enabledTriggers))
+	for name := range enabledTriggers {
+		cookieTriggerNames = append(cookieTriggerNames, name)
+	}
 
 	var changedFiles []string
-	if *commitHash != "" {
+	var mergeBaseHash string
+	if *filesFrom != "" {
+		changedFiles, err = readFileList(*filesFrom)
+		exitOnError(err)
+	} else if *commitHash != "" {
 		changedFiles, err = gitapi.GetGitCommitChanges(gitWorkdir, *commitHash)
 		exitOnError(err)
+	} else if *commitRange != "" {
+		changedFiles, err = getRangeChanges(gitWorkdir, *commitRange)
+		exitOnError(err)
+	} else if *staged {
+		changedFiles, err = gitapi.GetGitStagedChanges(gitWorkdir)
+		exitOnError(err)
 	} else {
-		mergeBaseHash, err := gitapi.GetMergeBaseCommitHash(gitWorkdir)
+		mergeBaseHash, err = gitapi.GetMergeBaseCommitHash(gitWorkdir)
 		exitOnError(err)
 		committedFiles, err := gitapi.GetGitDiffChanges(gitWorkdir, mergeBaseHash)
 		exitOnError(err)
@@ -236,33 +613,23 @@ func runPreflight() {
 
 	sort.Strings(changedFiles)
 
+	// All files changed relative to the merge base, before filtering.
+	allChangedFiles := changedFiles
+	var cookie *preflightCookie
+	if *sinceCookie {
+		cookie, err = readPreflightCookie(gitWorkdir, mergeBaseHash, *configFile, cookieTriggerNames)
+		exitOnError(err)
+		fileHashes, err := hashChangedFiles(gitWorkdir, changedFiles)
+		exitOnError(err)
+		changedFiles = filterSinceCookie(cookie, fileHashes, changedFiles)
+	}
+
 	changedDirs := files2dirs(changedFiles...)
 
 	log.Infof("changedFiles: %s\n", strings.Join(changedFiles, ", "))
 	log.Infof("changedDirs: %s\n", strings.Join(changedDirs, ", "))
 
-	cfgTriggerMap := make(map[string]*TriggerConfig)
-
-	allTriggerNames := make([]string, 0, len(cfg.Triggers))
-	for _, tr := range cfg.Triggers {
-		cfgTriggerMap[tr.Name] = &tr
-		allTriggerNames = append(allTriggerNames, tr.Name)
-	}
-
-	// If there are no explicit triggers, run them all.
-	if len(triggerNames) == 0 {
-		triggerNames = allTriggerNames
-	}
-
-	enabledTriggers := make(map[string]bool)
-	for _, name := range triggerNames {
-		if _, ok := cfgTriggerMap[name]; !ok {
-			exitOnError(fmt.Errorf("no such trigger: %q", name))
-		}
-		enabledTriggers[name] = true
-	}
-
-	hasError := false
+	runs := make([]triggerRun, 0, len(cfg.Triggers))
 	// Iterate over triggers as configured to preserve execution order.
 	for _, tr := range cfg.Triggers {
 		if !enabledTriggers[tr.Name] {
@@ -275,6 +642,10 @@ func runPreflight() {
 			if err != nil {
 				exitOnError(err)
 			}
+			if matched && tr.SkipBinary && isBinaryFile(fname) {
+				log.Infof("trigger %s skipping binary file %s", tr.Name, fname)
+				continue
+			}
 			if matched {
 				fnames = append(fnames, fname)
 			}
@@ -287,37 +658,407 @@ func runPreflight() {
 			fmt.Fprintf(os.Stderr, "run trigger %s: %s\n", tr.Name, strings.Join(fnames, ", "))
 		}
 
-		cmdArgs := make([]string, 0, len(tr.Cmd))
-		cmdArgs = append(cmdArgs, tr.Cmd...)
-		if tr.InputType == InputTypeArgs {
-			cmdArgs = append(cmdArgs, fnames...)
-		} else if tr.InputType == InputTypeArgsDirs {
-			dirs := files2dirs(fnames...)
-			cmdArgs = append(cmdArgs, dirs...)
-		} else if tr.InputType == InputTypeNone {
-			// do nothing.
-		} else {
-			exitOnError(fmt.Errorf("invalid input type %q for trigger %q", tr.InputType, tr.Name))
+		trRuns, err := makeTriggerRuns(&tr, fnames)
+		exitOnError(err)
+		for _, run := range trRuns {
+			if *dryRun {
+				for _, r := range append([]triggerRun{run}, run.perFile...) {
+					if r.cmdArgs != nil {
+						fmt.Fprintf(os.Stderr, "skipping %s: %s\n", r.name, strings.Join(gitapi.BashQuote(r.cmdArgs...), " "))
+					}
+				}
+				continue
+			}
+			runs = append(runs, run)
+		}
+	}
+
+	if hasError := runTriggers(runs, cfg.Parallelism, gitWorkdir, useFailFast(cfg)); hasError {
+		os.Exit(1)
+	}
+
+	// Only a clean run is recorded so failing files are checked again. Hash
+	// after running since triggers may rewrite files, like gofmt -w.
+	if cookie != nil && !*dryRun {
+		fileHashes, err := hashChangedFiles(gitWorkdir, allChangedFiles)
+		exitOnError(err)
+		exitOnError(writePreflightCookie(gitWorkdir, cookie, fileHashes))
+	}
+}
+
+// Read a NUL-terminated list of files relative to the workdir, such as the
+// manifest git-sync passes to sync.preflightCmd. A name of - reads stdin.
+func readFileList(fname string) ([]string, error) {
+	var data []byte
+	var err error
+	if fname == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(fname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gitapi.SplitNullTerminated(string(data)), nil
+}
+
+// Split a revision range, A..B or A...B, into its ends. As with git diff, an
+// omitted end is HEAD. With three dots symmetric is set, since the range then
+// starts from the merge base of A and B.
+func parseCommitRange(commitRange string) (from string, to string, symmetric bool, err error) {
+	sep := ".."
+	if strings.Contains(commitRange, "...") {
+		sep = "..."
+		symmetric = true
+	}
+	ends := strings.SplitN(commitRange, sep, 2)
+	if len(ends) != 2 || ends[0] == "" && ends[1] == "" {
+		return "", "", false, fmt.Errorf("invalid -commit-range %q, expected A..B", commitRange)
+	}
+	from, to = ends[0], ends[1]
+	if from == "" {
+		from = "HEAD"
+	}
+	if to == "" {
+		to = "HEAD"
+	}
+	return from, to, symmetric, nil
+}
+
+// Return the files changed across a revision range, see parseCommitRange.
+func getRangeChanges(workdir string, commitRange string) ([]string, error) {
+	from, to, symmetric, err := parseCommitRange(commitRange)
+	if err != nil {
+		return nil, err
+	}
+	if symmetric {
+		from, err = gitapi.GetMergeBase(workdir, from, to)
+		if err != nil {
+			return nil, err
 		}
+	}
+	return gitapi.GetGitRangeChanges(workdir, from, to)
+}
+
+// A trigger that matched changed files, ready to run.
+type triggerRun struct {
+	name    string
+	cmdArgs []string
+	// The directory to run in, relative to the workdir.
+	dir string
+	// With per_file_parallelism, the run for each file, up to parallelism
+	// at once, in place of cmdArgs.
+	perFile     []triggerRun
+	parallelism int
+	// Added to the environment of the command, see TriggerConfig.Env.
+	env []string
+}
+
+// Return the directory a trigger runs in, relative to the workdir.
+func triggerDir(tr *TriggerConfig) string {
+	if tr.WorkingDir == "" {
+		return "."
+	}
+	return path.Clean(tr.WorkingDir)
+}
 
-		if *dryRun {
-			fmt.Fprintf(os.Stderr, "skipping %s: %s\n", tr.Name, strings.Join(gitapi.BashQuote(cmdArgs...), " "))
+// Return the trigger's env with variables in the values expanded.
+func triggerEnv(tr *TriggerConfig) []string {
+	if len(tr.Env) == 0 {
+		return nil
+	}
+	env := make([]string, 0, len(tr.Env))
+	for _, kv := range tr.Env {
+		env = append(env, os.Expand(kv, os.Getenv))
+	}
+	return env
+}
+
+// Return workdir-relative paths relative to dir instead, which may lead
+// them up out of it.
+func relPaths(dir string, fnames []string) []string {
+	if dir == "." {
+		return fnames
+	}
+	relNames := make([]string, 0, len(fnames))
+	for _, fname := range fnames {
+		relName, err := filepath.Rel(dir, fname)
+		if err != nil {
+			// Both are relative to the workdir, so this can't happen.
+			relName = fname
+		}
+		relNames = append(relNames, relName)
+	}
+	return relNames
+}
+
+// Return the command line for a trigger given its matched files, named
+// relative to dir, the directory it runs in.
+func triggerCmdArgs(tr *TriggerConfig, dir string, fnames []string) ([]string, error) {
+	cmdArgs := make([]string, 0, len(tr.Cmd)+len(fnames))
+	cmdArgs = append(cmdArgs, tr.Cmd...)
+	switch tr.InputType {
+	case InputTypeArgs:
+		cmdArgs = append(cmdArgs, relPaths(dir, fnames)...)
+	case InputTypeArgsDirs:
+		cmdArgs = append(cmdArgs, relPaths(dir, files2dirs(fnames...))...)
+	case InputTypeNone:
+	default:
+		return nil, fmt.Errorf("invalid input type %q for trigger %q", tr.InputType, tr.Name)
+	}
+	return cmdArgs, nil
+}
+
+// Return the runs of a trigger over its matched files. Usually there is one
+// run in the workdir, or working_dir if set, but with group_by dir there is one per directory
+// holding matched files, run in that directory with the files named relative
+// to it. Directories that no longer exist, because every file in them was
+// deleted, are skipped.
+func makeTriggerRuns(tr *TriggerConfig, fnames []string) ([]triggerRun, error) {
+	if tr.PerFileParallelism > 0 {
+		return makePerFileRuns(tr, fnames)
+	}
+	if tr.GroupBy != GroupByDir {
+		dir := triggerDir(tr)
+		cmdArgs, err := triggerCmdArgs(tr, dir, fnames)
+		if err != nil {
+			return nil, err
+		}
+		return []triggerRun{{name: tr.Name, cmdArgs: cmdArgs, dir: dir, env: triggerEnv(tr)}}, nil
+	}
+	groups := make(map[string][]string)
+	for _, fname := range fnames {
+		dir := path.Dir(fname)
+		groups[dir] = append(groups[dir], path.Base(fname))
+	}
+	dirs := make([]string, 0, len(groups))
+	for dir := range groups {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	runs := make([]triggerRun, 0, len(dirs))
+	for _, dir := range dirs {
+		if !isDir(dir) {
+			log.Infof("trigger %s skipping missing dir %s", tr.Name, dir)
 			continue
 		}
+		var cmdArgs []string
+		if tr.InputType == InputTypeArgsDirs {
+			// The group's only dir is the one it runs in.
+			cmdArgs = append(append(cmdArgs, tr.Cmd...), ".")
+		} else {
+			var err error
+			cmdArgs, err = triggerCmdArgs(tr, ".", groups[dir])
+			if err != nil {
+				return nil, err
+			}
+		}
+		runs = append(runs, triggerRun{name: tr.Name + " (" + dir + ")", cmdArgs: cmdArgs, dir: dir, env: triggerEnv(tr)})
+	}
+	return runs, nil
+}
 
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Dir = gitWorkdir
-		if err := cmd.Run(); err != nil {
-			hasError = true
-			fmt.Fprintf(os.Stderr, "failed %s: %s\n", tr.Name, err)
+// Return a single run of a trigger holding one run per matched file, or per
+// existing dir of matched files with args-dirs, each in the workdir or
+// working_dir.
+func makePerFileRuns(tr *TriggerConfig, fnames []string) ([]triggerRun, error) {
+	inputs := fnames
+	if tr.InputType == InputTypeArgsDirs {
+		inputs = files2dirs(fnames...)
+	}
+	dir, env := triggerDir(tr), triggerEnv(tr)
+	perFile := make([]triggerRun, 0, len(inputs))
+	for i, input := range relPaths(dir, inputs) {
+		cmdArgs := make([]string, 0, len(tr.Cmd)+1)
+		cmdArgs = append(append(cmdArgs, tr.Cmd...), input)
+		perFile = append(perFile, triggerRun{name: tr.Name + " (" + inputs[i] + ")", cmdArgs: cmdArgs, dir: dir, env: env})
+	}
+	if len(perFile) == 0 {
+		return nil, nil
+	}
+	return []triggerRun{{name: tr.Name, dir: dir, perFile: perFile, parallelism: tr.PerFileParallelism, env: env}}, nil
+}
+
+// Run triggers in order, at most parallelism at a time. The output of each
+// trigger is captured and only shown, in one piece, if it fails or with -v, so
+// logs don't interleave. With failFast, the first failure kills the commands
+// still running and no more are started. Return true if any failed.
+func runTriggers(runs []triggerRun, parallelism int, workdir string, failFast bool) bool {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := func() {}
+	if failFast {
+		stop = cancel
+	}
+	mu := &sync.Mutex{}
+	hasError := false
+	notRun := 0
+	sem := make(chan struct{}, parallelism)
+	eg := &errgroup.Group{}
+	for i, run := range runs {
+		run := run
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			notRun = len(runs) - i
+			break
 		}
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			var err error
+			if run.perFile != nil {
+				err = runPerFile(ctx, run, workdir, mu, stop)
+			} else {
+				err = runTriggerCmd(ctx, run, workdir, mu)
+			}
+			if err != nil {
+				mu.Lock()
+				hasError = true
+				mu.Unlock()
+				stop()
+			}
+			return nil
+		})
 	}
+	eg.Wait()
+	if notRun > 0 {
+		fmt.Fprintf(os.Stderr, "fail-fast: %d triggers not run\n", notRun)
+	}
+	return hasError
+}
 
-	if hasError {
-		os.Exit(1)
+// Run the per-file runs of a trigger, at most run.parallelism at a time, and
+// fail if any of them fails. A failed run calls stop, which cancels ctx with
+// fail-fast.
+func runPerFile(ctx context.Context, run triggerRun, workdir string, mu *sync.Mutex, stop func()) error {
+	failed := 0
+	sem := make(chan struct{}, run.parallelism)
+	eg := &errgroup.Group{}
+	for _, fileRun := range run.perFile {
+		fileRun := fileRun
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			err := runTriggerCmd(ctx, fileRun, workdir, mu)
+			if err != nil && err != context.Canceled {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				stop()
+			}
+			return nil
+		})
+	}
+	eg.Wait()
+	if failed == 0 {
+		return ctx.Err()
 	}
+	err := fmt.Errorf("%d of %d runs failed", failed, len(run.perFile))
+	mu.Lock()
+	fmt.Fprintf(os.Stderr, "failed %s: %s\n", run.name, err)
+	mu.Unlock()
+	return err
+}
+
+// Run a single trigger command and report a failure along with its output,
+// see triggerFailure. On success the output is dropped unless -v is set. If
+// ctx is cancelled the command is killed and context.Canceled returned.
+func runTriggerCmd(ctx context.Context, run triggerRun, workdir string, mu *sync.Mutex) error {
+	dir := path.Join(workdir, run.dir)
+	name := run.cmdArgs[0]
+	// exec looks the command up in git-preflight's own PATH, not the one
+	// the trigger sets.
+	if pathVal, ok := envValue(run.env, "PATH"); ok && !strings.Contains(name, "/") {
+		if fname, err := lookPathIn(name, pathVal, dir); err == nil {
+			name = fname
+		}
+	}
+	cmd := exec.CommandContext(ctx, name, run.cmdArgs[1:]...)
+	cmd.Args[0] = run.cmdArgs[0]
+	cmd.Dir = dir
+	if run.env != nil {
+		// Later entries win, so the trigger's override the inherited ones.
+		cmd.Env = append(os.Environ(), run.env...)
+	}
+	output := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = output, output
+	err := cmd.Run()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil && ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "cancelled %s\n", run.name)
+		return ctx.Err()
+	}
+	if err != nil {
+		os.Stderr.WriteString(triggerFailure(run, err, output.Bytes()))
+	} else if *verbose {
+		os.Stdout.Write(output.Bytes())
+	}
+	return err
+}
+
+// Format a failed run as a delimited block: the trigger, the command as it
+// could be pasted into a shell and the combined stdout and stderr it wrote.
+func triggerFailure(run triggerRun, err error, output []byte) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "==== failed %s: %s\n", run.name, err)
+	if run.dir != "." && run.dir != "" {
+		fmt.Fprintf(buf, "$ cd %s\n", gitapi.BashQuoteCmd(run.dir))
+	}
+	fmt.Fprintf(buf, "$ %s\n", gitapi.BashQuoteCmd(run.cmdArgs...))
+	if len(output) == 0 {
+		buf.WriteString("(no output)\n")
+	} else {
+		buf.Write(output)
+		if output[len(output)-1] != '\n' {
+			buf.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(buf, "==== end of %s\n", run.name)
+	return buf.String()
+}
+
+// -fail-fast, when given, wins over fail_fast in the config either way.
+func useFailFast(cfg *PreflightConfig) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "fail-fast"
+	})
+	if set {
+		return *failFast
+	}
+	return cfg.FailFast
+}
+
+// Return the last value of key in a KEY=VALUE list.
+func envValue(env []string, key string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if val := strings.TrimPrefix(env[i], key+"="); val != env[i] {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// Find an executable in the directories of a PATH value. Relative
+// directories are relative to cwd, the directory the command runs in.
+func lookPathIn(name string, pathVal string, cwd string) (string, error) {
+	for _, dir := range filepath.SplitList(pathVal) {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(cwd, dir)
+		}
+		fname := filepath.Join(dir, name)
+		if fi, err := os.Stat(fname); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return fname, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in %s", name, pathVal)
 }
 
 func stringSet2Slice(ss map[string]bool) []string {
@@ -355,14 +1096,21 @@ func (*predictTrigger) Predict(prefix string) []string {
 var (
 	// Add variables to the program. Since we are using the compflag library, we can pass options to
 	// enable bash completion to the flag values.
-	commitHash = flag.String("commit-hash", "", "Use a specific commit to generate a list of changed files.")
-	configFile = flag.String("config-file", "", "Use the specified config file.")
-	validate   = flag.Bool("validate", false, "Exit after validating the config.")
-	verbose    = flag.Bool("v", false, "Print more debug data.")
-	dryRun     = flag.Bool("dry-run", false, "Log the triggers and commands that would have been executed.")
+	commitHash   = flag.String("commit-hash", "", "Use a specific commit to generate a list of changed files.")
+	commitRange  = flag.String("commit-range", "", "Use the files changed across a range of commits, A..B or A...B.")
+	configFile   = flag.String("config-file", "", "Use the specified config file.")
+	validate     = flag.Bool("validate", false, "Exit after validating the config.")
+	verbose      = flag.Bool("v", false, "Print more debug data.")
+	dryRun       = flag.Bool("dry-run", false, "Log the triggers and commands that would have been executed.")
+	sinceCookie  = flag.Bool("since-cookie", false, "Only evaluate files changed since the last successful run with this flag.")
+	outputFormat = flag.String("output-format", outputFormatText, "Print -validate results as text or json.")
+	filesFrom    = flag.String("files-from", "", "Read a NUL-terminated list of changed files from this file, or - for stdin, instead of asking git.")
+	message      = flag.String("message", "", "Match commit_message_match against this message instead of .git/COMMIT_EDITMSG.")
+	staged       = flag.Bool("staged", false, "Only evaluate files staged for the next commit.")
+	failFast     = flag.Bool("fail-fast", false, "Stop at the first failing trigger, overriding fail_fast in the config.")
 )
 
-var docPreamble = `git-preflight [-validate] [-config-file] [-v] [-dry-run] [-commit-hash] [<trigger name>, ...]
+var docPreamble = `git-preflight [-validate] [-output-format] [-config-file] [-v] [-dry-run] [-commit-hash] [-commit-range] [-since-cookie] [-files-from] [-message] [-staged] [-fail-fast] [<trigger name>, ...]
 
 Run all triggers for all files changed with respect to the merge base:
   git-preflight
@@ -370,6 +1118,38 @@ Run all triggers for all files changed with respect to the merge base:
 Run a specific trigger for all files changed with respect to the merge base:
 	git-preflight <trigger name>
 
+Run triggers only for files that changed since the last successful run:
+  git-preflight -since-cookie
+
+The state of each run is recorded in .git/git-preflight-cookie.json. All changed
+files are evaluated if HEAD, the merge base, the config or the set of triggers
+changed since then. Triggers skipped by commit_message_match don't count as
+run, so once the message matches they see every changed file.
+
+Run triggers for a NUL-terminated list of files on stdin, as passed by
+git-sync to sync.preflightCmd:
+  git-preflight -files-from -
+
+Run triggers for all files changed across a range of commits, say in CI:
+  git-preflight -commit-range origin/master..HEAD
+
+As with git diff, A..B compares the two commits and A...B compares B with
+its merge base with A. -commit-range cannot be combined with -commit-hash,
+-files-from, -since-cookie or -staged.
+
+Run triggers only for files staged for the next commit, as in a pre-commit hook:
+  git-preflight -staged
+
+Triggers still see the files in the workdir, including any unstaged edits.
+-staged cannot be combined with -commit-hash, -files-from or -since-cookie.
+
+Check the config and report every problem as JSON, for editors:
+  git-preflight -validate -output-format=json
+
+Triggers with commit_message_match check .git/COMMIT_EDITMSG, which holds the
+message being committed while a commit-msg hook runs. Elsewhere pass one:
+  git-preflight -message "WIP: try something"
+
 Setting GIT_TRACE_PERFORMANCE=1 or setting -log.level=INFO shows detailed performance logging.
 
 The config file .git-preflight should be place in the root directory of the repository.
@@ -378,6 +1158,10 @@ This is an annotated sample config that runs gofmt on all changed *.go files tha
 
 {
   // Comments are allowed, this is a JSONR file. See github.com/msolo/jsonr for more details.
+  // Run up to this many triggers at once. The default of 1 runs them in order.
+  "parallelism": 1,
+  // Stop at the first failing trigger instead of running them all.
+  "fail_fast": false,
   "triggers": [
     {
       // A short name to disambiguate.
@@ -391,10 +1175,31 @@ This is an annotated sample config that runs gofmt on all changed *.go files tha
       // Run this command when files are matched.
       "cmd": ["gofmt", "-w"],
       // Run on modified files that match the given glob. See fnmatch for more details.
-      // Note that ** is not supported.
+      // A ** path component matches any number of directories.
       "includes": ["*.go"],
-      // Skip included files that match any of these globs. ** is not supported.
-      "excludes": ["vendor/*"]
+      // Skip included files that match these globs. Later patterns win and a
+      // leading ! re-includes files excluded by an earlier pattern.
+      "excludes": ["vendor/*"],
+      // Drop every file under these directories before trying any
+      // pattern. Cheaper than a ** glob for large generated trees.
+      "exclude_dirs": ["third_party/"],
+      // Drop files that look binary, with a NUL byte in the first 8KB.
+      "skip_binary": true,
+      // Set to "dir" to run the command once per directory holding matched
+      // files, in that directory, with paths relative to it.
+      "group_by": "",
+      // Only run if the commit message matches this regexp, or with a
+      // leading ! only if it doesn't. Meant for a commit-msg hook.
+      "commit_message_match": "!^WIP:",
+      // Run the command once per matched file, or per dir with args-dirs,
+      // up to this many at once. Zero passes every file to a single run.
+      "per_file_parallelism": 0,
+      // Run in this directory, relative to the repository root, instead of
+      // the root. Matched files are passed relative to it.
+      "working_dir": "",
+      // KEY=VALUE pairs added to the environment. $VAR expands from the
+      // environment git-preflight runs in.
+      "env": []
     }
   ]
 }
@@ -423,12 +1228,19 @@ func main() {
 	cmd := &complete.Command{
 		Args: &predictTrigger{},
 		Flags: map[string]complete.Predictor{
-			"commit-hash": predict.Something,
-			"config-file": predict.Files("*"),
-			"validate":    predict.Nothing,
-			"v":           predict.Nothing,
-			"dry-run":     predict.Nothing,
-			"log.level":   predict.Set([]string{"INFO", "WARNING", "ERROR"}),
+			"commit-hash":   predict.Something,
+			"commit-range":  predict.Something,
+			"config-file":   predict.Files("*"),
+			"validate":      predict.Nothing,
+			"v":             predict.Nothing,
+			"dry-run":       predict.Nothing,
+			"since-cookie":  predict.Nothing,
+			"files-from":    predict.Files("*"),
+			"message":       predict.Something,
+			"staged":        predict.Nothing,
+			"fail-fast":     predict.Nothing,
+			"output-format": predict.Set([]string{outputFormatText, outputFormatJSON}),
+			"log.level":     predict.Set([]string{"INFO", "WARNING", "ERROR"}),
 		},
 	}
 
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		includes []string
+		excludes []string
+		fname    string
+		want     bool
+	}{
+		{"basename", []string{"*.go"}, nil, "a/b/c.go", true},
+		{"basename miss", []string{"*.go"}, nil, "a/b/c.txt", false},
+		{"slash anchors", []string{"a/*.go"}, nil, "x/a/b.go", false},
+		{"double star none", []string{"a/**/b.go"}, nil, "a/b.go", true},
+		{"double star one", []string{"a/**/b.go"}, nil, "a/x/b.go", true},
+		{"double star many", []string{"a/**/b.go"}, nil, "a/x/y/b.go", true},
+		{"double star wrong base", []string{"a/**/b.go"}, nil, "a/x/c.go", false},
+		{"double star wrong root", []string{"a/**/b.go"}, nil, "z/x/b.go", false},
+		{"leading double star top", []string{"**/*.txt"}, nil, "a.txt", true},
+		{"leading double star deep", []string{"**/*.txt"}, nil, "a/b/c.txt", true},
+		{"trailing double star", []string{"vendor/**"}, nil, "vendor/a/b.go", true},
+		{"exclude dir", []string{"*.go"}, []string{"vendor/**"}, "vendor/a/b.go", false},
+		{"exclude basename", []string{"*.go"}, []string{"*_gen.go"}, "a/x_gen.go", false},
+		{"negated exclude", []string{"*.go"}, []string{"*.go", "!keep.go"}, "a/keep.go", true},
+		{"negated exclude other", []string{"*.go"}, []string{"*.go", "!keep.go"}, "a/drop.go", false},
+		{"negation order", []string{"*.go"}, []string{"!keep.go", "*.go"}, "a/keep.go", false},
+		{"negated include", []string{"**/*.go", "!gen/**"}, nil, "gen/a.go", false},
+	}
+	for _, tc := range tests {
+		tr := &TriggerConfig{Name: tc.name, Includes: tc.includes, Excludes: tc.excludes}
+		got, err := match(tr, tc.fname)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: match(%q) = %v, want %v", tc.name, tc.fname, got, tc.want)
+		}
+	}
+}
+
+func TestIsBinaryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-preflight-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	textFile := path.Join(dir, "a.txt")
+	binFile := path.Join(dir, "a.dat")
+	if err := ioutil.WriteFile(textFile, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(binFile, []byte("hel\x00lo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if isBinaryFile(textFile) {
+		t.Errorf("%s detected as binary", textFile)
+	}
+	if !isBinaryFile(binFile) {
+		t.Errorf("%s not detected as binary", binFile)
+	}
+	if isBinaryFile(path.Join(dir, "missing")) {
+		t.Errorf("missing file detected as binary")
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	f, err := ioutil.TempFile("", "git-preflight-files-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("a.go\x00dir/b c.go\x00"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fnames, err := readFileList(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fnames) != 2 || fnames[0] != "a.go" || fnames[1] != "dir/b c.go" {
+		t.Fatalf("unexpected files: %q", fnames)
+	}
+}
+
+func TestParseCommitRange(t *testing.T) {
+	for _, tc := range []struct {
+		commitRange string
+		from, to    string
+		symmetric   bool
+	}{
+		{"origin/master..HEAD", "origin/master", "HEAD", false},
+		{"main...topic", "main", "topic", true},
+		{"HEAD~3..", "HEAD~3", "HEAD", false},
+	} {
+		from, to, symmetric, err := parseCommitRange(tc.commitRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != tc.from || to != tc.to || symmetric != tc.symmetric {
+			t.Errorf("%s: got %s %s %v", tc.commitRange, from, to, symmetric)
+		}
+	}
+	for _, commitRange := range []string{"HEAD", "..", "..."} {
+		if _, _, _, err := parseCommitRange(commitRange); err == nil {
+			t.Errorf("%s: no error", commitRange)
+		}
+	}
+}
+
+func TestMatchCommitMessage(t *testing.T) {
+	tests := []struct {
+		pattern string
+		msg     string
+		want    bool
+	}{
+		{"", "anything", true},
+		{"^WIP:", "WIP: half done\n", true},
+		{"^WIP:", "Fix the frobnicator\n", false},
+		{"!^WIP:", "WIP: half done\n", false},
+		{"!^WIP:", "Fix the frobnicator\n", true},
+		{"(?m)^Reviewed-by:", "Fix it\n\nReviewed-by: someone\n", true},
+	}
+	for _, tc := range tests {
+		tr := &TriggerConfig{Name: "t", CommitMessageMatch: tc.pattern}
+		got, err := matchCommitMessage(tr, tc.msg)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.pattern, err)
+		}
+		if got != tc.want {
+			t.Errorf("%q against %q: got %v, want %v", tc.pattern, tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestDropUnmatchedTriggers(t *testing.T) {
+	triggers := []TriggerConfig{
+		{Name: "lint"},
+		{Name: "heavy", CommitMessageMatch: "!^WIP:"},
+		{Name: "release", CommitMessageMatch: "^Release"},
+	}
+	reads := 0
+	readMsg := func() (string, error) {
+		reads++
+		return "WIP: half done\n", nil
+	}
+	enabled := map[string]bool{"lint": true, "heavy": true}
+	if err := dropUnmatchedTriggers(triggers, enabled, readMsg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(enabled, map[string]bool{"lint": true}) || reads != 1 {
+		t.Fatalf("got %v after %d reads", enabled, reads)
+	}
+
+	// The message isn't needed without an enabled trigger matching on it.
+	if err := dropUnmatchedTriggers(triggers, enabled, readMsg); err != nil || reads != 1 {
+		t.Fatalf("message read needlessly: %v, %d reads", err, reads)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	cfg := &PreflightConfig{
+		Parallelism: -1,
+		Triggers: []TriggerConfig{
+			{Name: "ok", InputType: InputTypeArgs, Includes: []string{"*.go"}},
+			{Name: "bad", InputType: "arg", Includes: []string{"[*.go"}},
+			{Name: "ok", InputType: InputTypeNone},
+			{Name: "msg", InputType: InputTypeNone, CommitMessageMatch: "!(WIP"},
+			{Name: "fanout", InputType: InputTypeNone, PerFileParallelism: 4},
+		},
+	}
+	want := []validationError{
+		{"", "invalid parallelism: -1"},
+		{"bad", `invalid trigger input type "arg" for trigger bad`},
+		{"bad", `invalid include pattern "[*.go" for trigger bad: syntax error in pattern`},
+		{"ok", "duplicate trigger name: ok"},
+		{"msg", "invalid commit_message_match \"!(WIP\" for trigger msg: error parsing regexp: missing closing ): `(WIP`"},
+		{"fanout", "per_file_parallelism needs input_type args or args-dirs for trigger fanout"},
+	}
+	errs := configErrors(cfg)
+	if !reflect.DeepEqual(errs, want) {
+		t.Fatalf("unexpected errors:\n got %q\nwant %q", errs, want)
+	}
+	err := validateConfig(cfg)
+	if verrs, ok := err.(validationErrors); !ok || len(verrs) != len(want) {
+		t.Fatalf("validateConfig = %v, want all %d errors", err, len(want))
+	}
+}
+
+func TestMakeTriggerRunsGroupByDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-preflight-group-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Matched files are relative to the workdir, as is the process.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fnames := []string{"a/b/x.go", "a/y.go", "a/z.go", "gone/w.go", "top.go"}
+	tr := &TriggerConfig{Name: "lint", Cmd: []string{"lint"}, InputType: InputTypeArgs, GroupBy: GroupByDir}
+	runs, err := makeTriggerRuns(tr, fnames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []triggerRun{
+		{name: "lint (.)", cmdArgs: []string{"lint", "top.go"}, dir: "."},
+		{name: "lint (a)", cmdArgs: []string{"lint", "y.go", "z.go"}, dir: "a"},
+		{name: "lint (a/b)", cmdArgs: []string{"lint", "x.go"}, dir: "a/b"},
+	}
+	if !reflect.DeepEqual(runs, want) {
+		t.Fatalf("unexpected runs:\n got %+v\nwant %+v", runs, want)
+	}
+
+	tr.InputType = InputTypeArgsDirs
+	runs, err = makeTriggerRuns(tr, fnames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 || !reflect.DeepEqual(runs[1].cmdArgs, []string{"lint", "."}) {
+		t.Fatalf("unexpected args-dirs runs: %+v", runs)
+	}
+
+	tr.GroupBy = GroupByNone
+	tr.InputType = InputTypeArgs
+	runs, err = makeTriggerRuns(tr, fnames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].dir != "." || len(runs[0].cmdArgs) != 1+len(fnames) {
+		t.Fatalf("unexpected ungrouped runs: %+v", runs)
+	}
+}
+
+func TestPerFileParallelism(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-preflight-per-file-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, fname := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(path.Join(dir, fname), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr := &TriggerConfig{Name: "exists", Cmd: []string{"test", "-e"}, InputType: InputTypeArgs, PerFileParallelism: 2}
+	runs, err := makeTriggerRuns(tr, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || len(runs[0].perFile) != 3 || runs[0].parallelism != 2 ||
+		!reflect.DeepEqual(runs[0].perFile[1], triggerRun{name: "exists (b)", cmdArgs: []string{"test", "-e", "b"}, dir: "."}) {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+	if runTriggers(runs, 1, dir, false) {
+		t.Fatalf("per-file runs failed")
+	}
+
+	// A single failing file fails the trigger.
+	runs, err = makeTriggerRuns(tr, []string{"a", "gone", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !runTriggers(runs, 1, dir, false) {
+		t.Fatalf("per-file runs succeeded despite a missing file")
+	}
+}
+
+func TestTriggerWorkingDirEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-preflight-working-dir-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"sub", "tools/bin"} {
+		if err := os.MkdirAll(path.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fname := range []string{"sub/a", "top"} {
+		if err := ioutil.WriteFile(path.Join(dir, fname), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script := "#!/bin/sh\n[ \"$MARK\" = set ] || exit 1\nfor f; do test -e \"$f\" || exit 1; done\n"
+	if err := ioutil.WriteFile(path.Join(dir, "tools/bin/check"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &TriggerConfig{Name: "check", Cmd: []string{"check"}, InputType: InputTypeArgs,
+		WorkingDir: "sub/", Env: []string{"PATH=../tools/bin:$PATH", "MARK=set"}}
+	runs, err := makeTriggerRuns(tr, []string{"sub/a", "top"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].dir != "sub" || !reflect.DeepEqual(runs[0].cmdArgs, []string{"check", "a", "../top"}) {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+	if runTriggers(runs, 1, dir, false) {
+		t.Fatalf("trigger failed in its working dir")
+	}
+
+	tr.WorkingDir = "../elsewhere"
+	tr.Env = []string{"=x"}
+	if errs := triggerErrors(tr); len(errs) != 2 {
+		t.Fatalf("expected errors for working_dir and env, got %v", errs)
+	}
+}
+
+func TestTriggerFailure(t *testing.T) {
+	run := triggerRun{name: "lint", cmdArgs: []string{"lint", "a b.go"}, dir: "sub"}
+	got := triggerFailure(run, errors.New("exit status 1"), []byte("a b.go: bad"))
+	want := "==== failed lint: exit status 1\n$ cd sub\n$ lint 'a b.go'\na b.go: bad\n==== end of lint\n"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestRunTriggersFailFast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-preflight-fail-fast-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runs := []triggerRun{
+		{name: "fail", cmdArgs: []string{"false"}, dir: "."},
+		{name: "mark", cmdArgs: []string{"touch", "marker"}, dir: "."},
+	}
+	if !runTriggers(runs, 1, dir, true) {
+		t.Fatalf("failing trigger not reported")
+	}
+	if _, err := os.Stat(path.Join(dir, "marker")); !os.IsNotExist(err) {
+		t.Fatalf("trigger after a failure ran with fail-fast: %v", err)
+	}
+	if !runTriggers(runs, 1, dir, false) {
+		t.Fatalf("failing trigger not reported")
+	}
+	if _, err := os.Stat(path.Join(dir, "marker")); err != nil {
+		t.Fatalf("trigger after a failure didn't run without fail-fast: %v", err)
+	}
+
+	// A failure kills a trigger running alongside it.
+	runs = []triggerRun{
+		{name: "slow", cmdArgs: []string{"sleep", "30"}, dir: "."},
+		{name: "fail", cmdArgs: []string{"false"}, dir: "."},
+	}
+	start := time.Now()
+	if !runTriggers(runs, 2, dir, true) {
+		t.Fatalf("failing trigger not reported")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("running trigger not cancelled, took %s", elapsed)
+	}
+}
+
+func TestMatchExcludeDirs(t *testing.T) {
+	tr := &TriggerConfig{Name: "gofmt", InputType: InputTypeArgs, Includes: []string{"*.go"}, ExcludeDirs: []string{"vendor/", "./build", "a/gen"}}
+	tests := []struct {
+		fname string
+		want  bool
+	}{
+		{"vendor/x/y.go", false},
+		{"vendor/y.go", false},
+		{"vendored.go", true},
+		{"src/vendor/y.go", true},
+		{"build/out.go", false},
+		{"a/gen/z.go", false},
+		{"a/generated.go", true},
+		{"main.go", true},
+	}
+	for _, tc := range tests {
+		got, err := match(tr, tc.fname)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.fname, err)
+		}
+		if got != tc.want {
+			t.Errorf("match(%q) = %v, want %v", tc.fname, got, tc.want)
+		}
+	}
+
+	tr.ExcludeDirs = []string{"", ".", "../x", "/abs"}
+	if errs := triggerErrors(tr); len(errs) != 4 {
+		t.Fatalf("expected 4 exclude_dirs errors, got %v", errs)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/msolo/git-mg/gitapi"
+	"github.com/tebeka/atexit"
+)
+
+// Synthetic files are written to a new dir in the workdir with this prefix.
+// They have to be in the workdir for a push to see them, but the unique name
+// keeps the bench from clobbering, or later removing, anything already there.
+const benchDirPrefix = ".git-sync-bench-"
+
+type phaseStats struct {
+	MinMs    float64 `json:"min_ms"`
+	MedianMs float64 `json:"median_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+}
+
+type benchReport struct {
+	RemoteName string                `json:"remote_name"`
+	Iterations int                   `json:"iterations"`
+	Files      int                   `json:"files"`
+	Phases     map[string]phaseStats `json:"phases"`
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func computePhaseStats(samples []time.Duration) phaseStats {
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p95 := int(math.Ceil(0.95*float64(len(sorted)))) - 1
+	return phaseStats{
+		MinMs:    durationMs(sorted[0]),
+		MedianMs: durationMs(sorted[len(sorted)/2]),
+		P95Ms:    durationMs(sorted[p95]),
+	}
+}
+
+func writeBenchFiles(dir string, numFiles int, iteration int) error {
+	for i := 0; i < numFiles; i++ {
+		// Change the content every iteration so each push has work to do.
+		data := []byte("git-sync bench " + strconv.Itoa(iteration) + "\n")
+		if err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf("f%06d", i)), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove synthetic files locally and on the remote. Untracked deletions are
+// not otherwise propagated without a full reset.
+func cleanBenchFiles(cfg *config, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	remoteBenchDir := gitapi.BashQuote(path.Join(cfg.remoteDir(), path.Base(dir)))[0]
+	_, err := cfg.transport.remoteCmd(cfg, []string{"rm", "-rf", remoteBenchDir}).Output()
+	return err
+}
+
+// Push iterations times and report timing statistics for each phase. If
+// numFiles is positive, a synthetic change set of that many files is
+// rewritten before every push and removed afterwards.
+func benchSync(cfg *config, workdir string, iterations int, numFiles int) (report *benchReport, err error) {
+	if err := cfg.requireRemoteShell("bench"); err != nil {
+		return nil, err
+	}
+	if err := cfg.checkRemoteDirAllowed(); err != nil {
+		return nil, err
+	}
+	samples := make(map[string][]time.Duration)
+	benchDir := ""
+	if numFiles > 0 {
+		benchDir, err = ioutil.TempDir(workdir, benchDirPrefix)
+		if err != nil {
+			return nil, err
+		}
+		// Also clean up locally if git-sync exits before the bench returns.
+		atexit.Register(func() {
+			_ = os.RemoveAll(benchDir)
+		})
+		defer func() {
+			if cleanErr := cleanBenchFiles(cfg, benchDir); cleanErr != nil && err == nil {
+				err = cleanErr
+			}
+		}()
+	}
+	for i := 0; i < iterations; i++ {
+		if numFiles > 0 {
+			if err := writeBenchFiles(benchDir, numFiles, i); err != nil {
+				return nil, err
+			}
+		}
+		start := time.Now()
+		result, err := fullSync(cfg, workdir)
+		if err != nil {
+			return nil, err
+		}
+		samples["total"] = append(samples["total"], time.Since(start))
+		for _, phase := range []string{phaseChanges, phaseFetch, phaseReset, phaseDelete, phaseRsync, phaseStage, phaseTag} {
+			// A phase that didn't run this iteration counts as zero.
+			samples[phase] = append(samples[phase], result.Durations[phase])
+		}
+	}
+
+	report = &benchReport{
+		RemoteName: cfg.remoteName,
+		Iterations: iterations,
+		Files:      numFiles,
+		Phases:     make(map[string]phaseStats, len(samples)),
+	}
+	for phase, durations := range samples {
+		report.Phases[phase] = computePhaseStats(durations)
+	}
+	return report, nil
+}
+
+func printBenchReport(w io.Writer, report *benchReport, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	fmt.Fprintf(w, "git-sync bench: %d pushes to %s, %d synthetic files\n", report.Iterations, report.RemoteName, report.Files)
+	fmt.Fprintf(w, "%-8s %10s %10s %10s\n", "phase", "min", "median", "p95")
+	for _, phase := range []string{phaseChanges, phaseFetch, phaseReset, phaseDelete, phaseRsync, phaseStage, phaseTag, "total"} {
+		st := report.Phases[phase]
+		fmt.Fprintf(w, "%-8s %8.1fms %8.1fms %8.1fms\n", phase, st.MinMs, st.MedianMs, st.P95Ms)
+	}
+	return nil
+}
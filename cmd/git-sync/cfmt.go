@@ -1,28 +1,124 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Console output levels, as set by -verbosity.
+const (
+	verbositySilent  = 0
+	verbositySummary = 1
+	verbosityPerFile = 2
+	verbosityDebug   = 3
 )
 
 var (
-	verbose bool
-	quiet   bool
+	verbosity  = verbositySummary
+	jsonOutput bool
 )
 
+type verbosityFlag struct{}
+
+func (verbosityFlag) String() string {
+	return strconv.Itoa(verbosity)
+}
+
+func (verbosityFlag) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < verbositySilent || n > verbosityDebug {
+		return errors.Errorf("invalid verbosity %q, expected 0 to 3", s)
+	}
+	verbosity = n
+	return nil
+}
+
+// A boolean flag that sets the verbosity to a fixed level, so -v and -q
+// remain shorthands for -verbosity.
+type verbosityAlias int
+
+func (a verbosityAlias) String() string {
+	return "false"
+}
+
+func (a verbosityAlias) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if b {
+		verbosity = int(a)
+	}
+	return nil
+}
+
+func (a verbosityAlias) IsBoolFlag() bool {
+	return true
+}
+
 func RegisterFlags(fs *flag.FlagSet) {
-	fs.BoolVar(&verbose, "v", false, "Enable more console output")
-	fs.BoolVar(&quiet, "q", false, "Enable less console output")
+	fs.Var(verbosityFlag{}, "verbosity", "Console output level: 0 silent, 1 summary, 2 per-file, 3 debug")
+	fs.Var(verbosityAlias(verbosityPerFile), "v", "Enable more console output, same as -verbosity=2")
+	fs.Var(verbosityAlias(verbositySilent), "q", "Enable less console output, same as -verbosity=0")
+	fs.BoolVar(&jsonOutput, "json", false, "Print the result of push or pull as a JSON object")
 }
 
-func VerbosePrintf(msg string, args ...interface{}) {
-	if verbose {
+// Print if the verbosity is at least level. Human readable output is
+// suppressed in JSON mode so stdout stays parseable.
+func LevelPrintf(level int, msg string, args ...interface{}) {
+	if verbosity >= level && !jsonOutput {
 		fmt.Printf(msg, args...)
 	}
 }
 
+// Print details, such as each file sent.
+func VerbosePrintf(msg string, args ...interface{}) {
+	LevelPrintf(verbosityPerFile, msg, args...)
+}
+
+// Print a summary line, shown unless silenced.
 func NoisyPrintf(msg string, args ...interface{}) {
-	if !quiet {
-		fmt.Printf(msg, args...)
+	LevelPrintf(verbositySummary, msg, args...)
+}
+
+// Print debugging output, such as full manifests.
+func DebugPrintf(msg string, args ...interface{}) {
+	LevelPrintf(verbosityDebug, msg, args...)
+}
+
+// The outcome of a push or pull, as printed in JSON mode.
+type jsonResult struct {
+	Command      string   `json:"command"`
+	RemoteName   string   `json:"remote_name"`
+	RemoteURL    string   `json:"remote_url"`
+	ChangedFiles []string `json:"changed_files"`
+	ChangedCount int      `json:"changed_count"`
+	// Only a push reports the changed files it left out.
+	SkippedFiles []SkippedFile `json:"skipped_files,omitempty"`
+	ElapsedMs    float64       `json:"elapsed_ms"`
+}
+
+// In JSON mode, print the result of a command on stdout.
+func JSONPrintResult(command string, cfg *config, changedFiles []string, skippedFiles []SkippedFile, elapsed time.Duration) error {
+	if !jsonOutput {
+		return nil
+	}
+	if changedFiles == nil {
+		changedFiles = []string{}
 	}
+	return json.NewEncoder(os.Stdout).Encode(&jsonResult{
+		Command:      command,
+		RemoteName:   cfg.remoteName,
+		RemoteURL:    cfg.remoteURL,
+		ChangedFiles: changedFiles,
+		ChangedCount: len(changedFiles),
+		SkippedFiles: skippedFiles,
+		ElapsedMs:    durationMs(elapsed),
+	})
 }
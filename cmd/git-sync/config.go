@@ -1,32 +1,271 @@
 package main
 
 import (
+	"io/ioutil"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/msolo/git-mg/gitapi"
 	"github.com/pkg/errors"
 )
 
+// Values for sync.changeSource.
+const (
+	changeSourceStatus = gitapi.ChangeSourceStatus
+	changeSourceDiff   = gitapi.ChangeSourceDiff
+	changeSourceBoth   = gitapi.ChangeSourceBoth
+)
+
+// Values for sync.mode.
+const (
+	syncModeGit    = gitapi.SyncModeGit
+	syncModeMirror = gitapi.SyncModeMirror
+)
+
+// Values for sync.remoteCleanFlags.
+const (
+	remoteCleanUntracked = gitapi.RemoteCleanUntracked
+	remoteCleanIgnored   = gitapi.RemoteCleanIgnored
+)
+
+// Values for sync.checkExcludes.
+const (
+	checkExcludesOff    = gitapi.CheckExcludesOff
+	checkExcludesLocal  = gitapi.CheckExcludesLocal
+	checkExcludesRemote = gitapi.CheckExcludesRemote
+)
+
 type config struct {
 	// sshControlPath is used to explicitly set the control socket for our usage.
-	sshControlPath     string
-	gitLocalPath       string
-	gitRemotePath      string
-	rsyncLocalPath     string
-	rsyncRemotePath    string
+	sshControlPath string
+	// SSH timeouts, passed to ssh in whole seconds.
+	sshConnectTimeout      time.Duration
+	sshControlPersist      time.Duration
+	sshServerAliveInterval time.Duration
+	// sshStrictHostKeyChecking verifies host keys against known_hosts.
+	sshStrictHostKeyChecking bool
+	// sshExtraOptions override the built-in ssh options.
+	sshExtraOptions map[string]string
+	gitLocalPath    string
+	gitRemotePath   string
+	rsyncLocalPath  string
+	rsyncRemotePath string
+	// rsyncBandwidthLimit caps rsync transfers in KB/s. Zero means unlimited.
+	rsyncBandwidthLimit int
+	// rsyncCompress compresses rsync transfers with -z.
+	rsyncCompress bool
+	// rsyncCompressLevel is passed as --compress-level unless zero.
+	rsyncCompressLevel int
+	// rsyncBatchMode shares one rsync delta when pushing to several remotes.
+	rsyncBatchMode bool
+	// rsyncBatch is the shared batch, set by pushRemotes.
+	rsyncBatch         *rsyncBatch
 	fsmonitorLocalPath string
-	excludePaths       []string
-	remoteName         string
-	remoteURL          string
-	gitConfig          gitapi.GitConfig
+	// fsmonitorMaxChanges is the most changes fsmonitor may report before a
+	// push falls back to git status. Zero means no limit.
+	fsmonitorMaxChanges int
+	// fsmonitorTimeout bounds the fsmonitor query.
+	fsmonitorTimeout time.Duration
+	excludePaths     []string
+	// remoteShell replaces ssh as the transport when set, e.g. docker exec.
+	remoteShell []string
+	// daemonSSHURL reaches the workdir of an rsync daemon remote over ssh,
+	// see shellURL.
+	daemonSSHURL string
+	remoteName   string
+	// maxParallelRemotes caps concurrent syncs when pushing to several remotes.
+	maxParallelRemotes int
+	// maxRetries bounds retries of ssh and rsync after transport failures.
+	maxRetries int
+	// skipUnchangedOnReset drops files matching the reset commit from the manifest.
+	skipUnchangedOnReset bool
+	// changeSource picks git status, git diff or both to find changed files.
+	changeSource string
+	// checkExcludes warns about exclude patterns that match nothing.
+	checkExcludes string
+	// mode is mirror for a remote that is not a git workdir, see
+	// runsRemoteGit.
+	mode string
+	// upstreamBranch is the branch of origin the merge base is computed
+	// against, see originUpstreamBranch.
+	upstreamBranch string
+	// remoteSkipSubmodules leaves remote submodules alone after a reset.
+	remoteSkipSubmodules bool
+	// remoteCleanFlags picks what the remote clean removes, see
+	// remoteCleanFlag.
+	remoteCleanFlags string
+	// preflightCmd checks the files about to be pushed, see runPreflightCmd.
+	preflightCmd string
+	// pullAutoStage stages pulled files with git add.
+	pullAutoStage bool
+	// detectRemoteDirty refuses to push over changes made on the remote.
+	detectRemoteDirty bool
+	// explicitDeletes removes files deleted locally with a remote git rm in
+	// a phase of its own, rather than through rsync --delete-missing-args.
+	explicitDeletes bool
+	// foregroundFetch waits for the speculative remote fetch, see
+	// remoteGitFetchCmd.
+	foregroundFetch bool
+	// tagRemote points remoteTagRef on the remote at the merge base of each
+	// push, see remoteTagCmd.
+	tagRemote bool
+	// remoteLockPath is flocked on the remote around the reset, see
+	// remoteLockFile.
+	remoteLockPath    string
+	remoteLockTimeout time.Duration
+	// allowedRemoteDirs lists the directories a remote workdir must be under.
+	allowedRemoteDirs []string
+	// allowAnyRemoteDir bypasses allowedRemoteDirs, as set by a command flag.
+	allowAnyRemoteDir bool
+	// dryRun prints what a push or pull would run instead of running it, as
+	// set by a command flag. See printPushPlan.
+	dryRun bool
+	// deleteExcluded removes local copies of remote files a pull leaves out
+	// because sync.excludePaths spares them, as set by a command flag. See
+	// remoteExcludedFiles.
+	deleteExcluded bool
+	// force pushes over remote changes found by detectRemoteDirty, as set by
+	// a command flag.
+	force bool
+	// pathspecs limit a push to part of the workdir, as given on the command line.
+	pathspecs []*pathspec
+	remoteURL string
+	transport transport
+}
+
+// Return the URL remote commands run against: the remote URL itself, or
+// sync.daemonSSHURL for an rsync daemon. It is nil for a daemon without one,
+// which leaves git-sync only able to copy files, see requireRemoteShell.
+func (cfg config) shellURL() *remoteURL {
+	ru, err := parseRemoteURL(cfg.remoteURL)
+	if err != nil {
+		return nil
+	}
+	if !ru.daemon {
+		return ru
+	}
+	if cfg.daemonSSHURL == "" {
+		return nil
+	}
+	ru, err = parseRemoteURL(cfg.daemonSSHURL)
+	if err != nil || ru.daemon {
+		return nil
+	}
+	return ru
+}
+
+// Return true if the remote is an rsync daemon.
+func (cfg config) isDaemon() bool {
+	ru, err := parseRemoteURL(cfg.remoteURL)
+	return err == nil && ru.daemon
+}
+
+// Return true if git can be run in the remote workdir.
+func (cfg config) hasRemoteShell() bool {
+	return cfg.shellURL() != nil
+}
+
+// Refuse a feature that runs commands in the remote workdir when the remote
+// is an rsync daemon without sync.daemonSSHURL.
+func (cfg config) requireRemoteShell(feature string) error {
+	if cfg.hasRemoteShell() {
+		return nil
+	}
+	return errors.Errorf("%s needs ssh access to the remote, but remote %s is an rsync daemon (%s), set sync.daemonSSHURL",
+		feature, cfg.remoteName, cfg.remoteURL)
 }
 
+// Return true if the remote is a git workdir git-sync can reset and stage
+// in. Otherwise it is a mirror that only receives files.
+func (cfg config) runsRemoteGit() bool {
+	return cfg.mode != syncModeMirror && cfg.hasRemoteShell()
+}
+
+// Refuse a feature that runs git in the remote workdir when there is none.
+func (cfg config) requireRemoteGit(feature string) error {
+	if cfg.mode == syncModeMirror {
+		return errors.Errorf("%s needs git on the remote, but remote %s has sync.mode=mirror", feature, cfg.remoteName)
+	}
+	return cfg.requireRemoteShell(feature)
+}
+
+// The remote URL is validated by readConfigFromGit, so these only return
+// empty strings for a config built by hand with a bad URL, or for a daemon
+// without a shell.
 func (cfg config) remoteSSHAddr() string {
-	return strings.Split(cfg.remoteURL, ":")[0]
+	ru := cfg.shellURL()
+	if ru == nil {
+		return ""
+	}
+	return ru.sshAddr()
 }
 
 func (cfg config) remoteDir() string {
-	return strings.Split(cfg.remoteURL, ":")[1]
+	ru := cfg.shellURL()
+	if ru == nil {
+		return ""
+	}
+	return ru.dir
+}
+
+// The ssh port, empty unless an ssh:// URL gives one.
+func (cfg config) remotePort() string {
+	ru := cfg.shellURL()
+	if ru == nil {
+		return ""
+	}
+	return ru.port
+}
+
+// The file flocked on the remote while it is reset, or "" if
+// sync.remoteLockPath is none. A relative path is below the remote dir.
+func (cfg config) remoteLockFile() string {
+	if cfg.remoteLockPath == "" || cfg.remoteLockPath == "none" {
+		return ""
+	}
+	if path.IsAbs(cfg.remoteLockPath) {
+		return cfg.remoteLockPath
+	}
+	return path.Join(cfg.remoteDir(), cfg.remoteLockPath)
+}
+
+// The remote URL in the host:path or rsync:// form rsync understands.
+func (cfg config) rsyncRemoteURL() string {
+	ru, err := parseRemoteURL(cfg.remoteURL)
+	if err != nil {
+		return cfg.remoteURL
+	}
+	return ru.rsyncURL()
+}
+
+// Refuse to touch a remote directory outside of sync.allowedRemoteDirs, since
+// a full sync runs git checkout -f and git clean -fdx there. The remote dir
+// must be strictly below an allowed dir, never the allowed dir itself. An
+// rsync daemon without a shell is never reset or cleaned, and its modules
+// already confine it.
+func (cfg config) checkRemoteDirAllowed() error {
+	if len(cfg.allowedRemoteDirs) == 0 || cfg.allowAnyRemoteDir || !cfg.hasRemoteShell() {
+		return nil
+	}
+	remoteDir := path.Clean(cfg.remoteDir())
+	for _, allowedDir := range cfg.allowedRemoteDirs {
+		allowedDir = path.Clean(allowedDir)
+		if strings.HasPrefix(remoteDir, strings.TrimSuffix(allowedDir, "/")+"/") {
+			return nil
+		}
+	}
+	return errors.Errorf("remote dir %q is not below any of sync.allowedRemoteDirs (%s), use -allow-any-remote-dir to override",
+		remoteDir, strings.Join(cfg.allowedRemoteDirs, ":"))
+}
+
+// The git clean flag for the remote reset, x to remove untracked and ignored
+// files or X for only ignored ones.
+func (cfg config) remoteCleanFlag() string {
+	if cfg.remoteCleanFlags == remoteCleanIgnored {
+		return "X"
+	}
+	return "x"
 }
 
 func (cfg config) fsmonitorEnabled() bool {
@@ -35,45 +274,236 @@ func (cfg config) fsmonitorEnabled() bool {
 
 var defaultConfig = config{
 	// ssh -G <host> | awk '/^controlpath/{print $2}'
-	sshControlPath:  "/tmp/ssh_mux_%h_%p_%r",
-	gitRemotePath:   "git",
-	gitLocalPath:    "git",
-	rsyncRemotePath: "rsync",
-	rsyncLocalPath:  "rsync", // Assume a satisfactory rsync is in the path.
-	remoteName:      "sync",
+	sshControlPath:         gitapi.DefaultSyncSettings.SSHControlPath,
+	sshConnectTimeout:      gitapi.DefaultSyncSettings.SSHConnectTimeout,
+	sshControlPersist:      gitapi.DefaultSyncSettings.SSHControlPersist,
+	sshServerAliveInterval: gitapi.DefaultSyncSettings.SSHServerAliveInterval,
+	gitRemotePath:          "git",
+	gitLocalPath:           "git",
+	rsyncRemotePath:        gitapi.DefaultSyncSettings.RsyncRemotePath,
+	rsyncLocalPath:         "rsync", // Assume a satisfactory rsync is in the path.
+	rsyncCompress:          gitapi.DefaultSyncSettings.RsyncCompress,
+	remoteName:             gitapi.DefaultSyncSettings.RemoteName,
+	maxParallelRemotes:     gitapi.DefaultSyncSettings.MaxParallelRemotes,
+	maxRetries:             gitapi.DefaultSyncSettings.MaxRetries,
+	skipUnchangedOnReset:   gitapi.DefaultSyncSettings.SkipUnchangedOnReset,
+	changeSource:           gitapi.DefaultSyncSettings.ChangeSource,
+	mode:                   gitapi.DefaultSyncSettings.Mode,
+	upstreamBranch:         "master",
+	remoteCleanFlags:       gitapi.DefaultSyncSettings.RemoteCleanFlags,
+	checkExcludes:          gitapi.DefaultSyncSettings.CheckExcludes,
+	remoteLockPath:         gitapi.DefaultSyncSettings.RemoteLockPath,
+	remoteLockTimeout:      gitapi.DefaultSyncSettings.RemoteLockTimeout,
+	fsmonitorMaxChanges:    gitapi.DefaultSyncSettings.FsmonitorMaxChanges,
+	fsmonitorTimeout:       time.Duration(gitapi.DefaultSyncSettings.FsmonitorTimeoutMs) * time.Millisecond,
+	transport:              sshTransport{},
 }
 
-func readConfigFromGit(remoteName string) (*config, error) {
-	wd := gitapi.NewGitWorkdir()
-	gitConfig, err := wd.GitConfig()
-	if err != nil {
-		return nil, err
+// Return the branch of origin the current branch tracks, or master if it
+// tracks nothing. The remote fetches the merge base from its own origin, so
+// an upstream on another remote also falls back to master.
+func originUpstreamBranch(workdir string) (string, error) {
+	upstream, err := gitapi.GetUpstreamRef(workdir)
+	if err == gitapi.ErrNoUpstream {
+		return defaultConfig.upstreamBranch, nil
+	} else if err != nil {
+		return "", err
 	}
-	cfg := defaultConfig
-	cfg.gitConfig = gitConfig
+	if branch := strings.TrimPrefix(upstream, "origin/"); branch != upstream {
+		return branch, nil
+	}
+	return defaultConfig.upstreamBranch, nil
+}
 
-	if remoteName == "" {
-		remoteName = gitConfig.Get("sync.remotename")
+// Read exclude patterns from a file, one per line. Blank lines and lines
+// starting with # are skipped.
+func readExcludePathsFile(fname string) ([]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read sync.excludePathsFile")
+	}
+	patterns := make([]string, 0, 16)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
 	}
-	if remoteName != "" {
-		cfg.remoteName = remoteName
+	patterns, err = gitapi.ExpandBracesAll(patterns)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sync.excludePathsFile")
 	}
+	return patterns, nil
+}
 
-	if excludePaths := gitConfig.Get("sync.excludepaths"); excludePaths != "" {
-		cfg.excludePaths = strings.Split(strings.TrimSpace(excludePaths), ":")
+// Merge the patterns from sync.excludePathsFile after those from
+// sync.excludePaths, dropping duplicates.
+func mergeExcludePaths(excludePaths []string, filePatterns []string) []string {
+	merged := make([]string, 0, len(excludePaths)+len(filePatterns))
+	seen := make(map[string]bool, cap(merged))
+	for _, xp := range append(append([]string{}, excludePaths...), filePatterns...) {
+		if !seen[xp] {
+			seen[xp] = true
+			merged = append(merged, xp)
+		}
 	}
+	return merged
+}
 
-	if rpath := gitConfig.Get("sync.rsyncremotepath"); rpath != "" {
-		cfg.rsyncRemotePath = rpath
+func readConfigFromGit(remoteName string) (*config, error) {
+	workdir := gitapi.GitWorkdir()
+	if workdir == "" {
+		return nil, errors.New("not in a git workdir, a bare repository has nothing to sync")
+	}
+	// Every problem is collected, as ParseSyncSettings does, so they can all
+	// be fixed at once.
+	var errs gitapi.ConfigErrors
+	settings, err := gitapi.NewGitWorkdir().SyncConfig(remoteName)
+	if ce, ok := err.(gitapi.ConfigErrors); ok {
+		errs = append(errs, ce...)
+	} else if err != nil {
+		return nil, err
+	}
+	cfg := defaultConfig
+	if cfg.upstreamBranch, err = originUpstreamBranch(workdir); err != nil {
+		return nil, err
+	}
+	cfg.remoteName = settings.RemoteName
+	cfg.remoteURL = settings.RemoteURL
+	// A missing URL is already reported.
+	ru, err := parseRemoteURL(cfg.remoteURL)
+	if err != nil && cfg.remoteURL != "" {
+		errs = append(errs, errors.Wrapf(err, "remote.%s.url", cfg.remoteName))
+	}
+	cfg.excludePaths = settings.ExcludePaths
+	if settings.ExcludePathsFile != "" {
+		fname := settings.ExcludePathsFile
+		if !path.IsAbs(fname) {
+			fname = path.Join(workdir, fname)
+		}
+		filePatterns, err := readExcludePathsFile(fname)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		cfg.excludePaths = mergeExcludePaths(cfg.excludePaths, filePatterns)
 	}
+	cfg.allowedRemoteDirs = settings.AllowedRemoteDirs
+	cfg.rsyncRemotePath = settings.RsyncRemotePath
+	cfg.rsyncBandwidthLimit = settings.RsyncBandwidthLimit
+	cfg.rsyncCompress = settings.RsyncCompress
+	cfg.rsyncCompressLevel = settings.RsyncCompressLevel
+	cfg.rsyncBatchMode = settings.RsyncBatchMode
+	cfg.maxParallelRemotes = settings.MaxParallelRemotes
+	cfg.maxRetries = settings.MaxRetries
+	cfg.skipUnchangedOnReset = settings.SkipUnchangedOnReset
+	cfg.changeSource = settings.ChangeSource
+	cfg.checkExcludes = settings.CheckExcludes
+	cfg.mode = settings.Mode
+	errs = append(errs, checkMirrorSettings(settings)...)
+	cfg.remoteShell = settings.RemoteShell
+	if ru != nil && ru.daemon {
+		errs = append(errs, checkDaemonSettings(settings)...)
+		cfg.daemonSSHURL = settings.DaemonSSHURL
+	}
+	cfg.remoteSkipSubmodules = settings.RemoteSkipSubmodules
+	cfg.remoteCleanFlags = settings.RemoteCleanFlags
+	if err := cfg.checkRemoteCleanFlags(); err != nil {
+		errs = append(errs, err)
+	}
+	cfg.preflightCmd = settings.PreflightCmd
+	cfg.pullAutoStage = settings.PullAutoStage
+	cfg.detectRemoteDirty = settings.DetectRemoteDirty
+	cfg.explicitDeletes = settings.ExplicitDeletes
+	cfg.foregroundFetch = settings.ForegroundFetch
+	cfg.tagRemote = settings.TagRemote
+	cfg.remoteLockPath = settings.RemoteLockPath
+	cfg.remoteLockTimeout = settings.RemoteLockTimeout
+	cfg.sshConnectTimeout = settings.SSHConnectTimeout
+	cfg.sshControlPersist = settings.SSHControlPersist
+	cfg.sshServerAliveInterval = settings.SSHServerAliveInterval
+	cfg.sshControlPath = settings.SSHControlPath
+	if cfg.sshControlPath == gitapi.SSHControlPathRepo {
+		cfg.sshControlPath = repoControlPath(workdir)
+	}
+	// Only the ssh transport uses the control path.
+	if ru := cfg.shellURL(); ru != nil && len(cfg.remoteShell) == 0 {
+		if err := checkControlPathLength(cfg.sshControlPath, ru); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	cfg.sshStrictHostKeyChecking = settings.SSHStrictHostKeyChecking
+	cfg.sshExtraOptions = settings.SSHExtraOptions
+	cfg.fsmonitorLocalPath = settings.FsmonitorPath
+	cfg.fsmonitorMaxChanges = settings.FsmonitorMaxChanges
+	cfg.fsmonitorTimeout = time.Duration(settings.FsmonitorTimeoutMs) * time.Millisecond
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return &cfg, nil
+}
 
-	remoteURLKey := "remote." + cfg.remoteName + ".url"
-	cfg.remoteURL = strings.TrimSpace(gitConfig.Get(remoteURLKey))
-	if cfg.remoteURL == "" {
-		return nil, errors.Errorf("no url specified for remote name %q %#v", cfg.remoteName, gitConfig)
+// Check that the settings for an rsync daemon remote only use features it
+// supports. Without sync.daemonSSHURL nothing can run in the remote workdir.
+func checkDaemonSettings(settings *gitapi.SyncSettings) (errs gitapi.ConfigErrors) {
+	if settings.DaemonSSHURL != "" {
+		ru, err := parseRemoteURL(settings.DaemonSSHURL)
+		if err != nil {
+			return append(errs, errors.Wrap(err, "sync.daemonSSHURL"))
+		}
+		if ru.daemon {
+			return append(errs, errors.Errorf("sync.daemonSSHURL %q must be an ssh URL", settings.DaemonSSHURL))
+		}
+		return nil
+	}
+	needSSH := func(key string) {
+		errs = append(errs, errors.Errorf("%s needs ssh access to rsync daemon remote %s, set sync.daemonSSHURL", key, settings.RemoteName))
+	}
+	if settings.DetectRemoteDirty {
+		needSSH("sync.detectRemoteDirty")
+	}
+	if settings.ExplicitDeletes {
+		needSSH("sync.explicitDeletes")
+	}
+	if settings.TagRemote {
+		needSSH("sync.tagRemote")
 	}
+	if settings.CheckExcludes == checkExcludesRemote {
+		needSSH("sync.checkExcludes=remote")
+	}
+	return errs
+}
 
-	cfg.fsmonitorLocalPath = gitConfig.Get("core.fsmonitor")
+// git clean -X treats -e patterns as more ignored files, so sync.excludePaths
+// and sync.excludePathsFile would name files to remove rather than spare.
+func (cfg config) checkRemoteCleanFlags() error {
+	if cfg.remoteCleanFlags == remoteCleanIgnored && len(cfg.excludePaths) > 0 {
+		return errors.Errorf("sync.excludePaths can't be used with sync.remoteCleanFlags=%s on remote %s: git clean %s would remove the excluded files rather than spare them",
+			remoteCleanIgnored, cfg.remoteName, remoteCleanIgnored)
+	}
+	return nil
+}
 
-	return &cfg, nil
+// Check that the settings for a mirror remote only use features that work
+// without git on the remote.
+func checkMirrorSettings(settings *gitapi.SyncSettings) (errs gitapi.ConfigErrors) {
+	if settings.Mode != syncModeMirror {
+		return nil
+	}
+	needGit := func(key string) {
+		errs = append(errs, errors.Errorf("%s needs git on remote %s, which has sync.mode=mirror", key, settings.RemoteName))
+	}
+	if settings.DetectRemoteDirty {
+		needGit("sync.detectRemoteDirty")
+	}
+	if settings.ExplicitDeletes {
+		needGit("sync.explicitDeletes")
+	}
+	if settings.TagRemote {
+		needGit("sync.tagRemote")
+	}
+	if settings.CheckExcludes == checkExcludesRemote {
+		needGit("sync.checkExcludes=remote")
+	}
+	return errs
 }
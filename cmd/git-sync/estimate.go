@@ -0,0 +1,112 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/msolo/git-mg/gitapi"
+	"github.com/pkg/errors"
+)
+
+// The totals reported by rsync --stats.
+type rsyncStats struct {
+	FilesTransferred int64 `json:"files_transferred"`
+	// The size of all files in the manifest.
+	TotalFileSize int64 `json:"total_file_size"`
+	// The size of the files that differ and would be sent in full, before
+	// delta encoding and compression.
+	TransferredFileSize int64 `json:"transferred_file_size"`
+	// Bytes on the wire. A dry run computes no deltas, so these only cover
+	// the file list and protocol overhead.
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+}
+
+var rsyncStatsLine = regexp.MustCompile(`^([A-Za-z ]+): ([\d,.]+)`)
+
+// Parse the summary printed by rsync --stats. Older versions say "Number of
+// files transferred" and newer ones "Number of regular files transferred",
+// and newer versions separate thousands with commas.
+func parseRsyncStats(data []byte) (*rsyncStats, error) {
+	st := &rsyncStats{}
+	fields := map[string]*int64{
+		"Number of files transferred":         &st.FilesTransferred,
+		"Number of regular files transferred": &st.FilesTransferred,
+		"Total file size":                     &st.TotalFileSize,
+		"Total transferred file size":         &st.TransferredFileSize,
+		"Total bytes sent":                    &st.BytesSent,
+		"Total bytes received":                &st.BytesReceived,
+	}
+	found := false
+	for _, line := range strings.Split(string(data), "\n") {
+		m := rsyncStatsLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		dst, ok := fields[m[1]]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.Replace(m[2], ",", "", -1), 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rsync stats line: %q", line)
+		}
+		*dst = n
+		found = true
+	}
+	if !found {
+		return nil, errors.New("no stats in rsync output")
+	}
+	return st, nil
+}
+
+// The estimated cost of a push, as printed by push -estimate.
+type transferEstimate struct {
+	RemoteName string `json:"remote_name"`
+	RemoteURL  string `json:"remote_url"`
+	// Why the remote would be reset first, or empty for an incremental sync.
+	FullSyncReason string     `json:"full_sync_reason,omitempty"`
+	Files          []string   `json:"files"`
+	Stats          rsyncStats `json:"stats"`
+}
+
+// Estimate how much data a push would send by running rsync --dry-run
+// --stats over the manifest the push would use. Nothing on the remote is
+// modified. If the remote is due to be reset, it is compared as it is now,
+// so the estimate is only as good as the remote's current contents.
+func estimateSync(cfg *config, workdir string) (*transferEstimate, error) {
+	if err := cfg.checkRemoteDirAllowed(); err != nil {
+		return nil, err
+	}
+	st, err := getSyncStatus(cfg, workdir)
+	if err != nil {
+		return nil, err
+	}
+	est := &transferEstimate{
+		RemoteName:     cfg.remoteName,
+		RemoteURL:      cfg.remoteURL,
+		FullSyncReason: st.fullSyncReason,
+		Files:          dropSubmodules(workdir, filterPathspecs(cfg.pathspecs, st.changedFiles)),
+	}
+	if len(est.Files) == 0 {
+		return est, nil
+	}
+	out, err := outputWithRetry(cfg, rsyncTransportExitCodes, func() (*gitapi.Cmd, error) {
+		rsyncArgs, err := rsyncPushArgs(cfg, workdir, est.Files)
+		if err != nil {
+			return nil, err
+		}
+		rsyncArgs = append([]string{"--dry-run", "--stats"}, rsyncArgs...)
+		return cfg.transport.rsyncCmd(cfg, rsyncArgs), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats, err := parseRsyncStats(out)
+	if err != nil {
+		return nil, err
+	}
+	est.Stats = *stats
+	return est, nil
+}
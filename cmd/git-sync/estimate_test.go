@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestParseRsyncStats(t *testing.T) {
+	// rsync 3.1 and later separate thousands and count regular files.
+	newer := `
+Number of files: 4 (reg: 3, dir: 1)
+Number of created files: 1 (reg: 1)
+Number of deleted files: 0
+Number of regular files transferred: 2
+Total file size: 1,234,567 bytes
+Total transferred file size: 45,678 bytes
+Literal data: 0 bytes
+Matched data: 0 bytes
+File list size: 0
+File list generation time: 0.001 seconds
+File list transfer time: 0.000 seconds
+Total bytes sent: 312
+Total bytes received: 41
+
+sent 312 bytes  received 41 bytes  706.00 bytes/sec
+total size is 1,234,567  speedup is 3,497.36 (DRY RUN)
+`
+	st, err := parseRsyncStats([]byte(newer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rsyncStats{FilesTransferred: 2, TotalFileSize: 1234567, TransferredFileSize: 45678, BytesSent: 312, BytesReceived: 41}
+	if *st != want {
+		t.Errorf("got %+v, want %+v", *st, want)
+	}
+
+	older := `
+Number of files: 4
+Number of files transferred: 1
+Total file size: 2048 bytes
+Total transferred file size: 1024 bytes
+Total bytes sent: 98
+Total bytes received: 20
+`
+	st, err = parseRsyncStats([]byte(older))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.FilesTransferred != 1 || st.TransferredFileSize != 1024 {
+		t.Errorf("unexpected stats from older rsync: %+v", *st)
+	}
+
+	if _, err := parseRsyncStats([]byte("sending incremental file list\n")); err == nil {
+		t.Error("expected an error without stats")
+	}
+}
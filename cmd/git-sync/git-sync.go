@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/exec"
 	"strings"
 
 	"time"
 
+	isatty "github.com/mattn/go-isatty"
 	"github.com/msolo/git-mg/gitapi"
 	log "github.com/msolo/go-bis/glug"
 	"github.com/tebeka/atexit"
@@ -19,7 +22,9 @@ type predictGitRemoteName struct{}
 
 // Predict a single valid name for a git remote.
 func (*predictGitRemoteName) Predict(cargs cmdflag.Args) []string {
-	if cargs.LastCompleted != "push" && cargs.LastCompleted != "pull" {
+	switch cargs.LastCompleted {
+	case "push", "pull", "sync", "status", "bench", "clean-sockets", "explain-excludes", "check-lineage":
+	default:
 		return nil
 	}
 	cmd := exec.Command("git", "remote")
@@ -37,7 +42,199 @@ var cmdPush = &cmdflag.Command{
 	UsageLine: `Push a working directory to a remote working dir.`,
 	UsageLong: `Push a working directory to a remote working dir.
 
-  git-sync push [<remote name>]`,
+  git-sync push [-dry-run | -remote-dry-run | -estimate | -emit-script] [-fail-fast] [-allow-any-remote-dir] [-yes] [-force] [<remote name> ...] [-- <pathspec> ...]
+  git-sync push -commit <commit> [-force] [<remote name>]
+
+With -dry-run, find the changes and print the remote reset, rsync and
+remote git add commands the push would run, along with the rsync manifest,
+without running any of them. Only read-only local git commands run, and
+the sync cookie is left alone. As with -emit-script, sync.detectRemoteDirty
+and sync.preflightCmd are skipped.
+
+With -remote-dry-run, show the files the remote checkout would revert and
+the remote clean would remove, without changing the remote. Like -dry-run,
+-estimate and -emit-script, it takes at most one remote.
+
+With -estimate, run rsync --dry-run --stats over the files the push would
+send and report how many bytes would be transferred, without changing the
+remote. The estimate is the size of the files that differ, before delta
+encoding and compression, so it is an upper bound on a metered connection.
+When the push is due to reset the remote, files are compared against the
+remote as it is now.
+
+With -emit-script, print a bash script that performs the push instead: the
+remote reset, the rsync with its manifest embedded, and the remote git add,
+exactly as git-sync would run them. Nothing is run and the remote is not
+contacted, so sync.detectRemoteDirty and sync.preflightCmd are skipped, and
+running the script leaves the sync cookie alone.
+
+Given several remote names, push to each of them concurrently, at most
+sync.maxParallelRemotes at a time. Failures are reported together once
+every remote has been attempted, unless -fail-fast is set.
+
+With -allow-any-remote-dir, push even if the remote dir is not below one
+of sync.allowedRemoteDirs.
+
+The first push to a remote resets and cleans the remote dir. When run from
+a terminal, git-sync previews what would be reverted and removed and asks
+for confirmation first; -yes skips the prompt.
+
+With sync.detectRemoteDirty set, a push refuses to clobber changes made
+directly in the remote dir and lists them instead. -force skips the check
+and pushes anyway, discarding those changes.
+
+A push also refuses to run while a merge, rebase, am, cherry-pick or revert
+is in progress locally, since the remote would get the half-finished state.
+-force pushes anyway.
+
+With -commit, reset the remote to the parent of the given commit and apply
+only the changes made in that commit, taking file content from the commit.
+Local modifications and other commits are not shipped, and the next plain
+push does a full sync.
+
+Pathspecs after -- limit the push to matching files, as with git: a path
+matches itself and everything below it, and * and ? match across
+directories. A trailing /... is also accepted. If the remote has to be
+reset, the clean is limited to the pathspecs, but tracked files outside
+them are still checked out. The sync cookie is left alone, so the next
+push without pathspecs sends everything else that changed.
+
+With the global -json flag (git-sync -json push), print a single JSON object
+with the remote, the changed files, the changed files left out and why,
+and the elapsed time instead of the usual console output. -v lists the
+files left out as well. This applies to pull as well, but not to pushes to
+several remotes.`,
+	Flags: []cmdflag.Flag{
+		{"dry-run", cmdflag.FlagTypeBool, false, "print the commands the push would run without running them", nil},
+		{"remote-dry-run", cmdflag.FlagTypeBool, false, "preview the remote checkout and clean without running them", nil},
+		{"fail-fast", cmdflag.FlagTypeBool, false, "stop pushing to remaining remotes after the first failure", nil},
+		{"allow-any-remote-dir", cmdflag.FlagTypeBool, false, "ignore sync.allowedRemoteDirs", nil},
+		{"yes", cmdflag.FlagTypeBool, false, "don't ask before the first sync to a remote", nil},
+		{"commit", cmdflag.FlagTypeString, "", "push only the changes made in this commit", nil},
+		{"force", cmdflag.FlagTypeBool, false, "push over remote changes found by sync.detectRemoteDirty, or during a merge or rebase", nil},
+		{"estimate", cmdflag.FlagTypeBool, false, "report the bytes a push would transfer without sending them", nil},
+		{"emit-script", cmdflag.FlagTypeBool, false, "print the push as a bash script instead of running it", nil},
+	},
+}
+
+var cmdSync = &cmdflag.Command{
+	Name:      "sync",
+	Run:       runSync,
+	Args:      &predictGitRemoteName{},
+	UsageLine: `Push to a remote working dir, then pull its unstaged changes.`,
+	UsageLong: `Push to a remote working dir, then pull its unstaged changes.
+
+  git-sync sync [-allow-any-remote-dir] [-yes] [<remote name>]
+
+Equivalent to git-sync push && git-sync pull, but the sync lock is held
+across both phases so they can't race with another git-sync. The pull is
+skipped when the push sent no files and the remote was not reset.`,
+	Flags: []cmdflag.Flag{
+		{"allow-any-remote-dir", cmdflag.FlagTypeBool, false, "ignore sync.allowedRemoteDirs", nil},
+		{"yes", cmdflag.FlagTypeBool, false, "don't ask before the first sync to a remote", nil},
+	},
+}
+
+var cmdStatus = &cmdflag.Command{
+	Name:      "status",
+	Run:       runStatus,
+	Args:      &predictGitRemoteName{},
+	UsageLine: `Show the files a push would send, without contacting the remote.`,
+	UsageLong: `Show the files a push would send, without contacting the remote.
+
+  git-sync status [<remote name>]
+
+Read the sync cookie and list the changed files, found with fsmonitor if
+available, along with whether the push would reset and clean the remote.
+No SSH connections or rsync calls are made.`,
+}
+
+var cmdCleanSockets = &cmdflag.Command{
+	Name:      "clean-sockets",
+	Run:       runCleanSockets,
+	Args:      &predictGitRemoteName{},
+	UsageLine: `Close the SSH control master and prune stale control sockets.`,
+	UsageLong: `Close the SSH control master and prune stale control sockets.
+
+  git-sync clean-sockets [<remote name>]
+
+Exit the control master for the remote, then remove every socket matching
+the SSH control path template that no longer has a live master.`,
+}
+
+var cmdExplainExcludes = &cmdflag.Command{
+	Name:      "explain-excludes",
+	Run:       runExplainExcludes,
+	Args:      &predictGitRemoteName{},
+	UsageLine: `Show which remote files sync.excludePaths spares from git clean.`,
+	UsageLong: `Show which remote files sync.excludePaths spares from git clean.
+
+  git-sync explain-excludes [<remote name>]
+
+Run git clean -ndx on the remote with and without the configured excludes
+and list the files that are spared and the files a full sync would remove.
+Nothing on the remote is modified.`,
+}
+
+var cmdCheckLineage = &cmdflag.Command{
+	Name:      "check-lineage",
+	Run:       runCheckLineage,
+	Args:      &predictGitRemoteName{},
+	UsageLine: `Check that the remote repo shares history with the local one.`,
+	UsageLong: `Check that the remote repo shares history with the local one.
+
+  git-sync check-lineage [<remote name>]
+
+Every full sync checks out the local merge base on the remote. Check that
+the remote has that commit, fetching its origin if needed as a sync would,
+and fail with an explanation if it can't be found, say because the remote
+is a clone of a different repo. Run it before a first sync.`,
+}
+
+var cmdInspectRecording = &cmdflag.Command{
+	Name:      "inspect-recording",
+	Run:       runInspectRecording,
+	Args:      cmdflag.PredictDirs("*"),
+	UsageLine: `Show the commands and artifacts of a recorded session.`,
+	UsageLong: `Show the commands and artifacts of a recorded session.
+
+  git-sync inspect-recording [-output] <session dir>
+
+When GIT_SYNC_RECORD is set to a directory, git-sync records each run in a
+new session directory below it: the argv, environment, output and exit code
+of every command, along with the changed files, rsync manifests and sync
+cookies it computed. List them in order with their timing. With -output,
+also print captured output and artifact content.
+
+Recordings include the full environment and may contain secrets.`,
+	Flags: []cmdflag.Flag{
+		{"output", cmdflag.FlagTypeBool, false, "print captured output and artifacts", nil},
+	},
+}
+
+var cmdBench = &cmdflag.Command{
+	Name:      "bench",
+	Run:       runBench,
+	Args:      &predictGitRemoteName{},
+	UsageLine: `Time repeated pushes and report latency per phase.`,
+	UsageLong: `Time repeated pushes and report latency per phase.
+
+  git-sync bench [-n <iterations>] [-files <count>] [-json] [-allow-any-remote-dir] [-yes] [<remote name>]
+
+Push the working directory several times and report the min, median and
+p95 latency of each phase (changes, fetch, reset, delete, rsync, stage,
+tag).
+With -files, rewrite a synthetic change set of that many files in a new
+.git-sync-bench-* dir before every push; the dir is removed locally and on
+the remote afterwards. As with push, the first push to a remote asks for
+confirmation unless -yes is given.`,
+	Flags: []cmdflag.Flag{
+		{"n", cmdflag.FlagTypeInt, 5, "number of pushes to time", nil},
+		{"files", cmdflag.FlagTypeInt, 0, "size of the synthetic change set", nil},
+		{"json", cmdflag.FlagTypeBool, false, "print the report as JSON", nil},
+		{"allow-any-remote-dir", cmdflag.FlagTypeBool, false, "ignore sync.allowedRemoteDirs", nil},
+		{"yes", cmdflag.FlagTypeBool, false, "don't ask before the first sync to a remote", nil},
+	},
 }
 
 var cmdPull = &cmdflag.Command{
@@ -46,7 +243,19 @@ var cmdPull = &cmdflag.Command{
 	Args:      &predictGitRemoteName{},
 	UsageLine: `Pull unstaged changes from a remote working directory.`,
 	UsageLong: `Pull unstaged changes from a remote working directory.
-  git-sync pull [<remote name>]`,
+
+  git-sync pull [-dry-run] [-delete-excluded] [<remote name>]
+
+With -dry-run, ask the remote what changed with git status as usual, then
+print the rsync command and the files it would fetch without running it.
+
+Untracked remote files that sync.excludePaths spares from git clean are
+left out, and any local copies kept. With -delete-excluded those local
+copies are deleted, unless they are tracked locally.`,
+	Flags: []cmdflag.Flag{
+		{"dry-run", cmdflag.FlagTypeBool, false, "print the rsync command the pull would run without running it", nil},
+		{"delete-excluded", cmdflag.FlagTypeBool, false, "delete local copies of remote files spared by sync.excludePaths", nil},
+	},
 }
 
 func exitOnError(err error) {
@@ -55,30 +264,385 @@ func exitOnError(err error) {
 	}
 }
 
+// Subcommand flag values. cmdflag.Parse parses the subcommand's flags before
+// Run is called, so they are bound up front by bindSubcommandFlags.
+var (
+	pushFlags struct {
+		dryRun, remoteDryRun, estimate, emitScript, failFast, allowAnyRemoteDir, yes, force bool
+		commitRev                                                                           string
+	}
+	syncFlags struct {
+		allowAnyRemoteDir, yes bool
+	}
+	pullFlags struct {
+		dryRun, deleteExcluded bool
+	}
+	benchFlags struct {
+		iterations, numFiles           int
+		asJSON, allowAnyRemoteDir, yes bool
+	}
+	inspectRecordingFlags struct {
+		output bool
+	}
+)
+
+func bindSubcommandFlags() {
+	cmdPush.BindFlagSet(map[string]interface{}{
+		"dry-run":              &pushFlags.dryRun,
+		"remote-dry-run":       &pushFlags.remoteDryRun,
+		"fail-fast":            &pushFlags.failFast,
+		"allow-any-remote-dir": &pushFlags.allowAnyRemoteDir,
+		"yes":                  &pushFlags.yes,
+		"commit":               &pushFlags.commitRev,
+		"force":                &pushFlags.force,
+		"estimate":             &pushFlags.estimate,
+		"emit-script":          &pushFlags.emitScript,
+	})
+	cmdSync.BindFlagSet(map[string]interface{}{
+		"allow-any-remote-dir": &syncFlags.allowAnyRemoteDir,
+		"yes":                  &syncFlags.yes,
+	})
+	cmdPull.BindFlagSet(map[string]interface{}{
+		"dry-run":         &pullFlags.dryRun,
+		"delete-excluded": &pullFlags.deleteExcluded,
+	})
+	cmdBench.BindFlagSet(map[string]interface{}{
+		"n":                    &benchFlags.iterations,
+		"files":                &benchFlags.numFiles,
+		"json":                 &benchFlags.asJSON,
+		"allow-any-remote-dir": &benchFlags.allowAnyRemoteDir,
+		"yes":                  &benchFlags.yes,
+	})
+	cmdInspectRecording.BindFlagSet(map[string]interface{}{"output": &inspectRecordingFlags.output})
+}
+
 func runPush(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	dryRun, remoteDryRunFlag, estimate, emitScript := pushFlags.dryRun, pushFlags.remoteDryRun, pushFlags.estimate, pushFlags.emitScript
+	failFast, allowAnyRemoteDir, yes, force := pushFlags.failFast, pushFlags.allowAnyRemoteDir, pushFlags.yes, pushFlags.force
+	commitRev := pushFlags.commitRev
+	// args are unparsed. Split off pathspecs before picking out the remotes,
+	// since flag parsing swallows a leading --.
+	var pathspecArgs []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, pathspecArgs = args[:i], args[i+1:]
+			break
+		}
+	}
+	fs := cmd.FlagSet()
+	exitOnError(fs.Parse(args))
+	args = fs.Args()
+	// Modes that replace a plain push, at most one at a time.
+	var modes []string
+	for _, mode := range []struct {
+		flag string
+		set  bool
+	}{
+		{"-commit", commitRev != ""},
+		{"-dry-run", dryRun},
+		{"-remote-dry-run", remoteDryRunFlag},
+		{"-estimate", estimate},
+		{"-emit-script", emitScript},
+	} {
+		if mode.set {
+			modes = append(modes, mode.flag)
+		}
+	}
+	if len(modes) > 1 {
+		exitOnError(fmt.Errorf("%s cannot be combined", strings.Join(modes, " and ")))
+	}
+	if len(modes) == 1 && len(args) > 1 {
+		exitOnError(fmt.Errorf("%s requires a single remote", modes[0]))
+	}
+	var pathspecs []*pathspec
+	if len(pathspecArgs) > 0 {
+		if commitRev != "" {
+			exitOnError(fmt.Errorf("-commit cannot be combined with pathspecs"))
+		}
+		cwd, err := os.Getwd()
+		exitOnError(err)
+		pathspecs, err = parsePathspecs(gitapi.GitWorkdir(), cwd, pathspecArgs)
+		exitOnError(err)
+	}
+
+	if len(args) > 1 {
+		cfgs := make([]*config, 0, len(args))
+		for _, name := range args {
+			cfg, err := readConfigFromGit(name)
+			exitOnError(err)
+			cfg.allowAnyRemoteDir = allowAnyRemoteDir
+			cfg.force = force
+			cfg.pathspecs = pathspecs
+			cfgs = append(cfgs, cfg)
+		}
+		if !yes {
+			confirmFirstSyncs(cfgs, gitapi.GitWorkdir())
+		}
+		exitOnError(pushRemotes(ctx, gitapi.GitWorkdir(), cfgs, failFast))
+		return
+	}
+
 	remoteName := ""
 	if len(args) == 1 {
 		remoteName = args[0]
 	}
 	cfg, err := readConfigFromGit(remoteName)
 	exitOnError(err)
+	cfg.allowAnyRemoteDir = allowAnyRemoteDir
+	cfg.force = force
+	cfg.pathspecs = pathspecs
+	cfg.dryRun = dryRun
 
 	gitWorkdir := gitapi.GitWorkdir()
-	_, err = fullSync(cfg, gitWorkdir)
+	if remoteDryRunFlag {
+		out, err := remoteDryRun(cfg, gitWorkdir)
+		exitOnError(err)
+		fmt.Print(out)
+		return
+	}
+	if emitScript {
+		exitOnError(emitSyncScript(cfg, gitWorkdir, os.Stdout))
+		return
+	}
+	if estimate {
+		est, err := estimateSync(cfg, gitWorkdir)
+		exitOnError(err)
+		exitOnError(printEstimate(est))
+		return
+	}
+	if !yes && !dryRun {
+		confirmFirstSyncs([]*config{cfg}, gitWorkdir)
+	}
+	start := time.Now()
+	if commitRev != "" {
+		changedFiles, err := commitSync(cfg, gitWorkdir, commitRev)
+		exitOnError(err)
+		exitOnError(JSONPrintResult("push", cfg, changedFiles, nil, time.Since(start)))
+		return
+	}
+	result, err := fullSync(cfg, gitWorkdir)
 	exitOnError(err)
+	printSyncResult(result)
+	exitOnError(JSONPrintResult("push", cfg, result.ChangedFiles, result.SkippedFiles, time.Since(start)))
+}
+
+// Print a push -estimate result, as JSON in JSON mode.
+func printEstimate(est *transferEstimate) error {
+	if jsonOutput {
+		if est.Files == nil {
+			est.Files = []string{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(est)
+	}
+	fmt.Printf("remote: %s (%s)\n", est.RemoteName, est.RemoteURL)
+	if est.FullSyncReason != "" {
+		fmt.Printf("full sync: yes, %s\n", est.FullSyncReason)
+	}
+	fmt.Printf("files in manifest: %d\n", len(est.Files))
+	for _, fname := range est.Files {
+		VerbosePrintf("  %s\n", fname)
+	}
+	fmt.Printf("files to transfer: %d\n", est.Stats.FilesTransferred)
+	fmt.Printf("estimated bytes: %d of %d\n", est.Stats.TransferredFileSize, est.Stats.TotalFileSize)
+	return nil
+}
+
+// At -verbosity=2 and above, summarize how a push went.
+func printSyncResult(result *SyncResult) {
+	changeSource := "status"
+	if result.UsedFsMonitor {
+		changeSource = "fsmonitor"
+	}
+	VerbosePrintf("git-sync changes via %s: %d files, checkout %v, clean %v\n",
+		changeSource, len(result.ChangedFiles), result.DidCheckout, result.DidClean)
+	for _, phase := range []string{phaseChanges, phaseFetch, phaseReset, phaseDelete, phaseRsync, phaseStage, phaseTag} {
+		if d, ok := result.Durations[phase]; ok {
+			VerbosePrintf("  %-8s %s\n", phase, d.Round(time.Millisecond))
+		}
+	}
+	if result.RemoteFetchError != nil {
+		VerbosePrintf("  background fetch failed: %s\n", result.RemoteFetchError)
+	}
+
+}
+
+// When a person is watching, ask before the first sync to any remote since
+// it resets and cleans whatever the remote dir already contains. Exits if the
+// user declines.
+func confirmFirstSyncs(cfgs []*config, workdir string) {
+	if !isatty.IsTerminal(os.Stdout.Fd()) || !isatty.IsTerminal(os.Stdin.Fd()) {
+		return
+	}
+	for _, cfg := range cfgs {
+		firstSync, err := isFirstSync(cfg, workdir)
+		exitOnError(err)
+		// Nothing is reset or cleaned without a remote shell.
+		if !firstSync || !cfg.runsRemoteGit() {
+			continue
+		}
+		// Don't bother previewing a remote dir that will be refused anyway.
+		exitOnError(cfg.checkRemoteDirAllowed())
+		ok, err := confirmFirstSync(cfg, workdir, os.Stdin, os.Stdout)
+		exitOnError(err)
+		if !ok {
+			exitOnError(fmt.Errorf("push to %s aborted", cfg.remoteName))
+		}
+	}
+}
+
+func runSync(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	allowAnyRemoteDir, yes := syncFlags.allowAnyRemoteDir, syncFlags.yes
+	args = cmd.FlagSet().Args()
+
+	remoteName := ""
+	if len(args) == 1 {
+		remoteName = args[0]
+	}
+	cfg, err := readConfigFromGit(remoteName)
+	exitOnError(err)
+	cfg.allowAnyRemoteDir = allowAnyRemoteDir
+
+	gitWorkdir := gitapi.GitWorkdir()
+	if !yes {
+		confirmFirstSyncs([]*config{cfg}, gitWorkdir)
+	}
+	pushedFiles, pulledFiles, err := bidiSync(cfg, gitWorkdir)
+	exitOnError(err)
+	NoisyPrintf("git-sync pushed %d files, pulled %d files\n", len(pushedFiles), len(pulledFiles))
+}
+
+func runStatus(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	remoteName := ""
+	if len(args) == 1 {
+		remoteName = args[0]
+	}
+	cfg, err := readConfigFromGit(remoteName)
+	exitOnError(err)
+
+	st, err := getSyncStatus(cfg, gitapi.GitWorkdir())
+	exitOnError(err)
+	fmt.Printf("remote: %s (%s)\n", cfg.remoteName, cfg.remoteURL)
+	if st.fullSyncReason != "" {
+		fmt.Printf("full sync: yes, %s\n", st.fullSyncReason)
+	} else {
+		fmt.Printf("full sync: no\n")
+	}
+	fmt.Printf("changed files via %s (%d):\n", st.changeSource, len(st.changedFiles))
+	for _, fname := range st.changedFiles {
+		fmt.Printf("  %s\n", fname)
+	}
+}
+
+func runCleanSockets(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	remoteName := ""
+	if len(args) == 1 {
+		remoteName = args[0]
+	}
+	cfg, err := readConfigFromGit(remoteName)
+	exitOnError(err)
+
+	removedSockets, err := cleanSockets(cfg)
+	exitOnError(err)
+	for _, sockPath := range removedSockets {
+		VerbosePrintf("removed %s\n", sockPath)
+	}
+	NoisyPrintf("git-sync removed %d stale sockets\n", len(removedSockets))
+}
+
+func runInspectRecording(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	showOutput := inspectRecordingFlags.output
+	args = cmd.FlagSet().Args()
+	if len(args) != 1 {
+		exitOnError(fmt.Errorf("inspect-recording requires a single session dir"))
+	}
+	exitOnError(printRecording(os.Stdout, args[0], showOutput))
+}
+
+func runExplainExcludes(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	remoteName := ""
+	if len(args) == 1 {
+		remoteName = args[0]
+	}
+	cfg, err := readConfigFromGit(remoteName)
+	exitOnError(err)
+
+	removedFiles, sparedFiles, err := explainExcludes(cfg)
+	exitOnError(err)
+	unmatched, err := unmatchedRemoteExcludes(cfg)
+	exitOnError(err)
+	for _, xp := range unmatched {
+		fmt.Printf("warning: pattern %q matches nothing on the remote\n", xp)
+	}
+	fmt.Printf("excludes: %s\n", strings.Join(cfg.excludePaths, ":"))
+	fmt.Printf("spared by excludes (%d):\n", len(sparedFiles))
+	for _, fname := range sparedFiles {
+		fmt.Printf("  %s\n", fname)
+	}
+	fmt.Printf("would remove (%d):\n", len(removedFiles))
+	for _, fname := range removedFiles {
+		fmt.Printf("  %s\n", fname)
+	}
+}
+
+func runCheckLineage(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	remoteName := ""
+	if len(args) == 1 {
+		remoteName = args[0]
+	}
+	cfg, err := readConfigFromGit(remoteName)
+	exitOnError(err)
+
+	res, err := checkLineage(cfg, gitapi.GitWorkdir())
+	exitOnError(err)
+	if res.fetched {
+		fmt.Printf("merge base %s found on remote %s after fetching origin %s\n", res.mergeBaseHash, cfg.remoteName, cfg.upstreamBranch)
+	} else {
+		fmt.Printf("merge base %s found on remote %s\n", res.mergeBaseHash, cfg.remoteName)
+	}
+}
+
+func runBench(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	iterations, numFiles := benchFlags.iterations, benchFlags.numFiles
+	asJSON, allowAnyRemoteDir, yes := benchFlags.asJSON, benchFlags.allowAnyRemoteDir, benchFlags.yes
+	args = cmd.FlagSet().Args()
+	if iterations < 1 {
+		exitOnError(fmt.Errorf("invalid iteration count: %d", iterations))
+	}
+
+	remoteName := ""
+	if len(args) == 1 {
+		remoteName = args[0]
+	}
+	cfg, err := readConfigFromGit(remoteName)
+	exitOnError(err)
+	cfg.allowAnyRemoteDir = allowAnyRemoteDir
+
+	gitWorkdir := gitapi.GitWorkdir()
+	if !yes {
+		confirmFirstSyncs([]*config{cfg}, gitWorkdir)
+	}
+	report, err := benchSync(cfg, gitWorkdir, iterations, numFiles)
+	exitOnError(err)
+	exitOnError(printBenchReport(os.Stdout, report, asJSON || jsonOutput))
 }
 
 func runPull(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	dryRun, deleteExcluded := pullFlags.dryRun, pullFlags.deleteExcluded
+	args = cmd.FlagSet().Args()
 	remoteName := ""
 	if len(args) == 1 {
 		remoteName = args[0]
 	}
 	cfg, err := readConfigFromGit(remoteName)
 	exitOnError(err)
+	cfg.dryRun = dryRun
+	cfg.deleteExcluded = deleteExcluded
 
 	gitWorkdir := gitapi.GitWorkdir()
-	_, err = syncPull(cfg, gitWorkdir)
+	start := time.Now()
+	changedFiles, err := syncPull(cfg, gitWorkdir)
 	exitOnError(err)
+	exitOnError(JSONPrintResult("pull", cfg, changedFiles, nil, time.Since(start)))
 }
 
 var cmdMain = &cmdflag.Command{
@@ -96,7 +660,9 @@ it will clean, reset and checkout changes to ensure the source and
 destination working directories are equivalent.
 
 Config:
-git-sync reads a few variables from the [sync] section of the git config:
+git-sync reads a few variables from the [sync] section of the git config.
+Except for sync.remoteName, each can be overridden for a single remote as
+remote.<name>.sync<key>, e.g. remote.prod.syncExcludePaths.
 
 sync.remoteName (default "sync")
   This determines the remote target to use for syncing changes.
@@ -104,15 +670,188 @@ sync.remoteName (default "sync")
 sync.excludePaths (default empty)
   A colon-delimited list of patterns that will be passed to git clean
   on the remote target.  This allows some remote data to persist, even
-  if it does not exist on the source workdir.
+  if it does not exist on the source workdir. Braces expand as in the
+  shell, so build/{debug,release}/ is two patterns. git-sync pull leaves
+  out the untracked remote files they match, see pull -delete-excluded.
+
+sync.excludePathsFile (default empty)
+  A file, relative to the workdir, with more patterns for git clean, one
+  per line. Blank lines and lines starting with # are skipped. The
+  patterns are added to sync.excludePaths, braces expanded likewise.
+
+sync.allowedRemoteDirs (default empty)
+  A colon-delimited list of directories. If set, git-sync refuses to push
+  to a remote dir that is not strictly below one of them, since a full
+  sync cleans and checks out the remote dir. Override with
+  -allow-any-remote-dir.
 
 sync.rsyncRemotePath (default "/usr/local/bin/rsync")
   The path for the remote rsync binary.
 
+sync.rsyncBandwidthLimit (default 0)
+  Cap rsync pushes and pulls at this many KB/s with --bwlimit. Zero means
+  unlimited.
+
+sync.rsyncCompress (default true)
+  Compress rsync transfers with -z. Disable on a fast network, where
+  compression costs more CPU time than it saves.
+
+sync.rsyncCompressLevel (default 0)
+  Pass --compress-level to rsync when compressing. Zero leaves rsync's
+  default level.
+
+sync.rsyncBatchMode (default false)
+  When pushing to several remotes, push to the first one alone while
+  writing an rsync batch with --write-batch, then apply that batch to the
+  others with --read-batch so the delta is computed once. Meant for
+  identical remotes: one that needs different files, or whose files don't
+  match the batch, gets a normal push instead.
+
+sync.maxParallelRemotes (default 4)
+  The maximum number of remotes synced concurrently when pushing to
+  several remotes at once. Zero or less means no limit.
+
+sync.maxRetries (default 2)
+  How many times to retry the remote reset and the rsync push after a
+  transport failure, with exponential backoff from 500ms. Failures of the
+  remote command itself are never retried.
+
+sync.skipUnchangedOnReset (default true)
+  When the remote is reset, skip sending files whose content and
+  executable bit already match the commit the remote was reset to.
+
+sync.checkExcludes (default "off")
+  Before a push that will clean the remote, warn about any pattern in
+  sync.excludePaths that matches nothing in the "local" or "remote" workdir.
+
+sync.changeSource (default "both")
+  Find changed files with "status" (working tree and index changes), "diff"
+  (commits since the merge base) or "both". Dropping one saves a git
+  invocation, but only if your workflow never produces the other kind of
+  change.
+
+sync.remoteShell (default empty)
+  A command used in place of ssh to reach the remote, for instance
+  "docker exec -i". It is invoked as <remoteShell> <host> <shell string>
+  for remote git commands and is passed to rsync as -e. The value is split
+  into words like a shell would, so quote arguments containing spaces;
+  nothing is expanded. Like ssh, it must hand the trailing arguments to a
+  shell on the remote side.
+
+sync.daemonSSHURL (default empty)
+  For a remote URL of the form rsync://[user@]host[:port]/module/path,
+  which pushes to an rsync daemon, an ssh URL of the same workdir used for
+  the remote git commands. Without it the remote is treated as a mirror,
+  as with sync.mode=mirror, and bench and clean-sockets fail too.
+
+sync.mode (default "git")
+  With "mirror", the remote is a plain directory rather than a git workdir,
+  say for a deploy. A push never resets, cleans or stages it and only
+  rsyncs the changed files, deleting the ones gone locally. When the git
+  state changed, every tracked and untracked, unignored file is sent, and
+  rsync skips those already matching. pull, sync, explain-excludes,
+  check-lineage, push -commit and push -remote-dry-run fail, as do
+  sync.detectRemoteDirty, sync.checkExcludes=remote, sync.explicitDeletes
+  and sync.tagRemote.
+
+sync.sshConnectTimeout (default 5s)
+sync.sshControlPersist (default 15m)
+sync.sshServerAliveInterval (default 60s)
+  The matching ssh options, as seconds or a duration such as 30s. Raise
+  sync.sshConnectTimeout on high-latency links. A sync.sshControlPersist
+  of 0 keeps the control master around indefinitely.
+
+sync.sshControlPath (default "/tmp/ssh_mux_%h_%p_%r")
+  The ssh ControlPath template for the shared connection. "repo" gives
+  each repository and local user its own sockets in /tmp. A path too long
+  for a unix socket once expanded is rejected.
+
+sync.sshStrictHostKeyChecking (default false)
+  Check host keys against the usual known_hosts files rather than
+  running ssh with StrictHostKeyChecking=no and UserKnownHostsFile=/dev/null.
+
+sync.sshExtraOptions (default empty)
+  Extra ssh options as Key=Value pairs separated by ";", for instance
+  "ProxyJump=bastion;Ciphers=aes128-ctr". These win over the built-in
+  options.
+
+sync.remoteSkipSubmodules (default false)
+  After resetting a remote that has submodules, git-sync runs git submodule
+  update --init --recursive there, since checkout -f leaves them on their
+  old commits. Set to true to leave remote submodules alone. Submodules are
+  never pushed.
+
+sync.remoteCleanFlags (default "-x")
+  What git clean removes when the remote is reset: "-x" removes untracked
+  and ignored files, "-X" only ignored ones, such as build caches, and keeps
+  untracked files for a later pull. The remote then only mirrors the local
+  workdir's tracked and ignored files. "-X" can't be combined with
+  sync.excludePaths, and sync.detectRemoteDirty then only checks unstaged
+  changes.
+
+sync.detectRemoteDirty (default false)
+  Before each push, check the remote workdir for unstaged changes and
+  untracked files that are neither ignored nor spared by
+  sync.excludePaths, and refuse to push over them. Costs a round trip.
+
+sync.explicitDeletes (default false)
+  Remove files deleted locally with a remote git rm before rsync runs,
+  instead of sending them to rsync --delete-missing-args. Only the named
+  paths are removed, rather than the topmost missing directory. Needs git
+  on the remote.
+
+sync.foregroundFetch (default false)
+  Run the speculative fetch of origin on the remote before the push goes
+  on, waiting for any fetch already running, and fail the push if it
+  fails. By default it runs in the background and is skipped while another
+  fetch holds the lock.
+
+sync.tagRemote (default false)
+  After each push that sends files or moves the git state, point
+  refs/git-sync/last on the remote at the merge base it is checked out at.
+  Its reflog names the local HEAD of each push. Pushes with pathspecs leave
+  it alone. Needs git on the remote.
+
+sync.pullAutoStage (default false)
+  After a pull, git add exactly the pulled files, skipping any that
+  .gitignore ignores locally. Nothing else is staged.
+
+sync.preflightCmd (default empty)
+  A shell command run in the workdir before a push sends anything. The
+  files about to be pushed are written to its stdin, NUL-terminated, so
+  "git-preflight -files-from -" checks just those files. If it fails,
+  the push is aborted and the remote is left untouched. Not run for
+  push -commit.
+
+sync.remoteLockPath (default ".git/git-sync.lock")
+sync.remoteLockTimeout (default 30s)
+  The remote reset holds an flock on this file, relative to the remote dir
+  unless absolute, so concurrent pushes from different machines take turns
+  checking out and cleaning. Only the reset is serialized: the deletes,
+  rsync and staging that follow it are not. A push that can't get the lock
+  within the timeout, rounded up to whole seconds, fails without touching
+  the remote; a timeout of 0 fails at once. "none" disables the lock, as
+  does a remote without flock(1).
+
+sync.fsmonitorMaxChanges (default 100)
+  If fsmonitor reports more changes than this, find them with git status
+  instead, which is faster for large change sets. The count is logged at
+  INFO to help tune it. Zero means no limit. When set, the included
+  git-fsmonitor hook reports more changes than this to git as "everything
+  changed" too. Lowering it trades fsmonitor precision for fewer huge
+  manifests.
+
+sync.fsmonitorTimeoutMs (default 1000)
+  How long to wait for fsmonitor, in milliseconds, before finding changes
+  with git status instead. Raise it if a loaded machine keeps timing out.
+
 git-sync uses the remote name to determine the SSH URL that is used as
-the target for rsync operations.
+the target for rsync operations, or the rsync:// URL of an rsync daemon.
 
 If core.fsmonitor is configured it will be used to find changes quickly.
+
+Set GIT_SYNC_RECORD to a directory to record each run for debugging, see
+git-sync inspect-recording.
 `,
 	Flags: []cmdflag.Flag{
 		{"timeout", cmdflag.FlagTypeDuration, 0 * time.Millisecond, "timeout for command execution", nil},
@@ -123,6 +862,13 @@ If core.fsmonitor is configured it will be used to find changes quickly.
 var subcommands = []*cmdflag.Command{
 	cmdPush,
 	cmdPull,
+	cmdSync,
+	cmdStatus,
+	cmdBench,
+	cmdCleanSockets,
+	cmdExplainExcludes,
+	cmdCheckLineage,
+	cmdInspectRecording,
 }
 
 func main() {
@@ -138,8 +884,14 @@ func main() {
 	fs := cmdMain.BindFlagSet(map[string]interface{}{"timeout": &timeout})
 	log.RegisterFlags(fs)
 	RegisterFlags(fs)
+	bindSubcommandFlags()
 
 	cmd, args := cmdflag.Parse(cmdMain, subcommands)
+	if verbosity >= verbosityDebug {
+		// Command tracing is logged at INFO.
+		log.SetLevel("INFO")
+	}
+	exitOnError(startRecordingFromEnv())
 
 	ctx := context.Background()
 	if timeout > 0 {
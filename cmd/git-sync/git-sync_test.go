@@ -4,7 +4,9 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/msolo/git-mg/gitapi"
@@ -86,14 +88,14 @@ func repoSetup() (*repo, error) {
 	return &repo{tmpDir: tmpDir, upstreamDir: upstreamDir, localDir: localDir, syncDir: syncDir}, nil
 }
 
-func failOnErr(t *testing.T, err error) {
+func failOnErr(t testing.TB, err error) {
 	t.Helper()
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
-func failOnCmdError(t *testing.T, workdir string, bin string, args ...string) {
+func failOnCmdError(t testing.TB, workdir string, bin string, args ...string) {
 	t.Helper()
 	cmd := gitapi.Command(bin, args...)
 	cmd.Dir = workdir
@@ -157,3 +159,86 @@ func TestMain(m *testing.M) {
 	// call flag.Parse() here if TestMain uses flags
 	os.Exit(m.Run())
 }
+
+// Subcommand flags are parsed by cmdflag before the subcommand runs, so
+// exercise them through the built binary. The remote is reached through a
+// local shell standing in for ssh.
+func TestSubcommandFlags(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "git-sync-test")
+		}
+	}
+	tmpDir, err := ioutil.TempDir("", "git-sync-test-flags-")
+	failOnErr(t, err)
+	defer os.RemoveAll(tmpDir)
+	bin := path.Join(tmpDir, "git-sync")
+	failOnCmdError(t, ".", "go", "build", "-o", bin, ".")
+
+	upstreamDir := path.Join(tmpDir, "upstream")
+	localDir := path.Join(tmpDir, "local")
+	syncDir := path.Join(tmpDir, "sync")
+	failOnErr(t, os.MkdirAll(upstreamDir, 0775))
+	failOnCmdError(t, upstreamDir, "git", "init", "-q")
+	failOnErr(t, ioutil.WriteFile(path.Join(upstreamDir, "dummy"), []byte(""), 0664))
+	failOnCmdError(t, upstreamDir, "git", "add", "dummy")
+	failOnCmdError(t, upstreamDir, "git", "-c", "user.name=git-sync", "-c", "user.email=git-sync@localhost", "commit", "-q", "-m", "initial commit")
+	failOnCmdError(t, tmpDir, "git", "clone", "-q", upstreamDir, localDir)
+	failOnCmdError(t, tmpDir, "git", "clone", "-q", upstreamDir, syncDir)
+	failOnCmdError(t, localDir, "git", "remote", "add", "sync", "localhost:"+syncDir)
+	failOnCmdError(t, localDir, "git", "config", "sync.remoteShell", `sh -c 'shift; exec bash -c "$1"' -`)
+	failOnErr(t, ioutil.WriteFile(path.Join(syncDir, "stray"), []byte("foo"), 0644))
+
+	cmd := exec.Command(bin, "push", "-remote-dry-run")
+	cmd.Dir = localDir
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "stray") {
+		t.Fatalf("push -remote-dry-run failed: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(path.Join(syncDir, "stray")); err != nil {
+		t.Fatalf("push -remote-dry-run changed the remote: %v", err)
+	}
+
+	cmd = exec.Command(bin, "push", "-dry-run", "sync")
+	cmd.Dir = localDir
+	out, err = cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "dry run: push to sync") {
+		t.Fatalf("push -dry-run failed: %v\n%s", err, out)
+	}
+
+	// A preview never quietly falls back to the default remote.
+	cmd = exec.Command(bin, "push", "-remote-dry-run", "sync", "other")
+	cmd.Dir = localDir
+	out, err = cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "-remote-dry-run requires a single remote") {
+		t.Fatalf("push -remote-dry-run with two remotes not rejected: %v\n%s", err, out)
+	}
+}
+
+// Independent config problems are reported together so they can all be
+// fixed at once.
+func TestReadConfigReportsAllErrors(t *testing.T) {
+	localDir, _, _ := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	failOnCmdError(t, localDir, "git", "remote", "add", "sync", "fakehost:/tmp/sync")
+	failOnCmdError(t, localDir, "git", "config", "sync.maxRetries", "lots")
+	failOnCmdError(t, localDir, "git", "config", "sync.excludePathsFile", "missing-excludes")
+	failOnCmdError(t, localDir, "git", "config", "sync.mode", "mirror")
+	failOnCmdError(t, localDir, "git", "config", "sync.detectRemoteDirty", "true")
+
+	cwd, err := os.Getwd()
+	failOnErr(t, err)
+	failOnErr(t, os.Chdir(localDir))
+	defer os.Chdir(cwd)
+
+	_, err = readConfigFromGit("sync")
+	if err == nil {
+		t.Fatal("expected config errors")
+	}
+	for _, want := range []string{"sync.maxRetries", "missing-excludes", "sync.detectRemoteDirty"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s:\n%v", want, err)
+		}
+	}
+}
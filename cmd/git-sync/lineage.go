@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/msolo/git-mg/gitapi"
+	"github.com/pkg/errors"
+)
+
+// Exit codes of the check-lineage remote script.
+const (
+	lineageFetchFailedExitCode = 65
+	lineageMissingExitCode     = 66
+)
+
+// The result of checkLineage.
+type lineageResult struct {
+	mergeBaseHash string
+	// The remote had to fetch origin to find the merge base.
+	fetched bool
+}
+
+// Check that the remote workdir can reach the local merge base, which every
+// full sync checks out there. If the commit is missing the remote fetches its
+// origin, as a reset would. If it is still missing, the remote's root commits
+// tell an unrelated repo apart from a remote origin that lags behind.
+func checkLineage(cfg *config, workdir string) (*lineageResult, error) {
+	if err := cfg.requireRemoteGit("check-lineage"); err != nil {
+		return nil, err
+	}
+	mergeBaseHash, err := gitapi.GetMergeBase(workdir, "origin/"+cfg.upstreamBranch, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	gitCmd := cfg.gitRemotePath + " -C " + gitapi.BashQuote(cfg.remoteDir())[0]
+	commit := gitapi.BashQuote(mergeBaseHash + "^{commit}")[0]
+	script := []string{
+		"if " + gitCmd + " cat-file -e " + commit + " 2> /dev/null; then exit 0; fi;",
+		gitCmd + " fetch -q origin " + gitapi.BashQuote(cfg.upstreamBranch)[0] + " < /dev/null || exit " + strconv.Itoa(lineageFetchFailedExitCode) + ";",
+		"if " + gitCmd + " cat-file -e " + commit + " 2> /dev/null; then echo fetched; exit 0; fi;",
+		gitCmd + " rev-list --max-parents=0 HEAD;",
+		"exit " + strconv.Itoa(lineageMissingExitCode),
+	}
+	out, err := cfg.transport.remoteCmd(cfg, script).Output()
+	if err == nil {
+		return &lineageResult{mergeBaseHash: mergeBaseHash, fetched: strings.TrimSpace(string(out)) == "fetched"}, nil
+	}
+	rc, rcErr := gitapi.ExitStatus(err)
+	if rcErr != nil {
+		return nil, err
+	}
+	switch rc {
+	case lineageFetchFailedExitCode:
+		return nil, errors.Errorf("%s is missing on remote %s and fetching origin %s there failed", mergeBaseHash, cfg.remoteName, cfg.upstreamBranch)
+	case lineageMissingExitCode:
+		for _, rootHash := range strings.Fields(string(out)) {
+			if _, err := gitapi.ResolveCommitHash(workdir, rootHash); err == nil {
+				return nil, errors.Errorf("remote %s shares history with this repo but lacks the merge base %s, even after fetching origin %s there; check that the remote's origin has it",
+					cfg.remoteName, mergeBaseHash, cfg.upstreamBranch)
+			}
+		}
+		return nil, errors.Errorf("remote %s is not linked to this repo: it shares no root commit with it, so the merge base %s can never be found at %s",
+			cfg.remoteName, mergeBaseHash, cfg.remoteURL)
+	}
+	return nil, remoteResetError(cfg, err)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/msolo/git-mg/gitapi"
+	"github.com/pkg/errors"
+)
+
+// A command line pathspec limiting a push to part of the workdir. Like git,
+// a plain path matches itself and everything below it, and in a glob * and
+// ? match across directories. A trailing /... is accepted as a synonym for
+// the directory itself.
+type pathspec struct {
+	// The pattern relative to the top of the workdir, as passed to git.
+	pattern string
+	glob    *regexp.Regexp
+}
+
+// Parse pathspec arguments given relative to cwd, which must be inside
+// workdir.
+func parsePathspecs(workdir string, cwd string, args []string) ([]*pathspec, error) {
+	prefix, err := gitapi.RelativePath(workdir, cwd)
+	if err != nil {
+		return nil, err
+	}
+	pathspecs := make([]*pathspec, 0, len(args))
+	for _, arg := range args {
+		if strings.HasPrefix(arg, ":") {
+			return nil, errors.Errorf("pathspec magic is not supported: %q", arg)
+		}
+		pattern := strings.TrimSuffix(arg, "/...")
+		if pattern == "..." {
+			pattern = "."
+		}
+		pattern = path.Clean(path.Join(prefix, pattern))
+		if pattern == ".." || strings.HasPrefix(pattern, "../") {
+			return nil, errors.Errorf("pathspec %q is outside the workdir", arg)
+		}
+		ps := &pathspec{pattern: pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			ps.glob, err = globRegexp(pattern)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid pathspec %q", arg)
+			}
+		}
+		pathspecs = append(pathspecs, ps)
+	}
+	return pathspecs, nil
+}
+
+// Translate a git wildcard pattern, where * may match /, into a regexp.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	// A match may also name a directory containing the file.
+	sb.WriteString("(/.*)?$")
+	return regexp.Compile(sb.String())
+}
+
+func (ps *pathspec) match(fname string) bool {
+	fname = strings.TrimSuffix(fname, "/")
+	if ps.glob != nil {
+		return ps.glob.MatchString(fname)
+	}
+	return ps.pattern == "." || fname == ps.pattern || strings.HasPrefix(fname, ps.pattern+"/")
+}
+
+// Return the files matching any of the pathspecs, or all files if there are
+// no pathspecs.
+func filterPathspecs(pathspecs []*pathspec, fnames []string) []string {
+	if len(pathspecs) == 0 {
+		return fnames
+	}
+	matched := make([]string, 0, len(fnames))
+	for _, fname := range fnames {
+		for _, ps := range pathspecs {
+			if ps.match(fname) {
+				matched = append(matched, fname)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// Return the pathspec patterns, relative to the top of the workdir.
+func pathspecPatterns(pathspecs []*pathspec) []string {
+	patterns := make([]string, 0, len(pathspecs))
+	for _, ps := range pathspecs {
+		patterns = append(patterns, ps.pattern)
+	}
+	return patterns
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterPathspecs(t *testing.T) {
+	fnames := []string{"README", "src/server/main.go", "src/server/api/h.go", "src/serverless.go", "src/client/main.go", "docs/a.md"}
+	tests := []struct {
+		cwd  string
+		args []string
+		want []string
+	}{
+		{"/w", []string{"src/server"}, []string{"src/server/main.go", "src/server/api/h.go"}},
+		{"/w", []string{"src/server/..."}, []string{"src/server/main.go", "src/server/api/h.go"}},
+		{"/w", []string{"src/*.go"}, []string{"src/server/main.go", "src/server/api/h.go", "src/serverless.go", "src/client/main.go"}},
+		{"/w", []string{"docs", "README"}, []string{"README", "docs/a.md"}},
+		{"/w/src", []string{"client"}, []string{"src/client/main.go"}},
+		{"/w/src", []string{"..."}, []string{"src/server/main.go", "src/server/api/h.go", "src/serverless.go", "src/client/main.go"}},
+		{"/w/src", []string{"../docs"}, []string{"docs/a.md"}},
+	}
+	for _, tc := range tests {
+		pathspecs, err := parsePathspecs("/w", tc.cwd, tc.args)
+		if err != nil {
+			t.Fatalf("%v: %s", tc.args, err)
+		}
+		if got := filterPathspecs(pathspecs, fnames); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s %v: got %v, want %v", tc.cwd, tc.args, got, tc.want)
+		}
+	}
+
+	for _, args := range [][]string{{"../outside"}, {":(glob)*.go"}, {"src/[a"}} {
+		if _, err := parsePathspecs("/w", "/w", args); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/msolo/git-mg/gitapi"
+	"github.com/pkg/errors"
+)
+
+// Run sync.preflightCmd in the workdir before anything is sent to the
+// remote. The files about to be pushed are written to its stdin,
+// NUL-terminated, so git-preflight -files-from - can check exactly those
+// files without finding changes again. A failure aborts the push. Nothing
+// is run if sync.preflightCmd is unset or there are no files.
+func runPreflightCmd(cfg *config, workdir string, fnames []string) error {
+	if cfg.preflightCmd == "" || len(fnames) == 0 {
+		return nil
+	}
+	cmd := gitapi.Command("/bin/sh", "-c", cfg.preflightCmd)
+	cmd.Dir = workdir
+	cmd.Env = append(os.Environ(),
+		"GIT_SYNC_REMOTE_NAME="+cfg.remoteName,
+		"GIT_SYNC_REMOTE_URL="+cfg.remoteURL)
+	cmd.Stdin = bytes.NewReader([]byte(gitapi.JoinNullTerminated(fnames)))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "sync.preflightCmd failed, not pushing to %s", cfg.remoteName)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/msolo/git-mg/gitapi"
+	log "github.com/msolo/go-bis/glug"
+	"github.com/pkg/errors"
+)
+
+// Set to a directory to record every command git-sync runs, along with the
+// manifests and cookies it computes, for later inspection.
+const recordEnvVar = "GIT_SYNC_RECORD"
+
+func startRecordingFromEnv() error {
+	dir := os.Getenv(recordEnvVar)
+	if dir == "" {
+		return nil
+	}
+	sessionDir, err := gitapi.StartRecording(dir)
+	if err != nil {
+		return err
+	}
+	log.Infof("recording session to %s", sessionDir)
+	gitapi.RecordArtifact("argv", []byte(strings.Join(gitapi.BashQuote(os.Args...), " ")+"\n"))
+	return nil
+}
+
+// Print a recorded session in order. With showOutput, the captured output of
+// each command and the content of each artifact follows its summary line.
+func printRecording(w io.Writer, dir string, showOutput bool) error {
+	entries, err := gitapi.ReadRecording(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return errors.Errorf("no recorded entries in %s", dir)
+	}
+	// Commands start in sequence order, but artifacts and commands
+	// run concurrently may interleave.
+	startNs := entries[0].StartNs
+	for _, entry := range entries {
+		offset := time.Duration(entry.StartNs - startNs)
+		switch entry.Kind {
+		case gitapi.RecordKindCmd:
+			status := fmt.Sprintf("exit %d", entry.ExitCode)
+			if entry.ExitCode < 0 {
+				status = "error"
+			}
+			fmt.Fprintf(w, "%06d +%.3fs %8.1fms %-7s %s\n", entry.Seq, offset.Seconds(),
+				durationMs(time.Duration(entry.DurationNs)), status,
+				strings.Join(gitapi.BashQuote(entry.Args...), " "))
+			if entry.Error != "" && entry.ExitCode < 0 {
+				fmt.Fprintf(w, "  %s\n", entry.Error)
+			}
+			if showOutput {
+				if err := printRecordedFile(w, dir, "stdout", entry.StdoutFile); err != nil {
+					return err
+				}
+				if err := printRecordedFile(w, dir, "stderr", entry.StderrFile); err != nil {
+					return err
+				}
+			}
+		case gitapi.RecordKindArtifact:
+			fmt.Fprintf(w, "%06d +%.3fs artifact %s\n", entry.Seq, offset.Seconds(), entry.Name)
+			if showOutput {
+				if err := printRecordedFile(w, dir, "data", entry.DataFile); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func printRecordedFile(w io.Writer, dir string, label string, fname string) error {
+	if fname == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, fname))
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	// Manifests are null terminated.
+	text := strings.TrimRight(strings.Replace(string(data), "\x00", "\n", -1), "\n")
+	fmt.Fprintf(w, "  %s:\n", label)
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+	return nil
+}
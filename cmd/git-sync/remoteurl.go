@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A remote URL, either in the scp-like [user@]host:path form or as
+// ssh://[user@]host[:port]/path. An IPv6 host must be in brackets, as in
+// [::1]:src. An rsync daemon is reached with rsync://[user@]host[:port]/module/path
+// or host::module/path instead.
+type remoteURL struct {
+	user string
+	// The host without brackets.
+	host string
+	// Empty unless the URL gives a port.
+	port string
+	// For a daemon, the module followed by the path within it.
+	dir string
+	// Set for an rsync daemon, which has no shell to run git in.
+	daemon bool
+}
+
+// Return the address to pass to ssh, [user@]host.
+func (ru *remoteURL) sshAddr() string {
+	if ru.user != "" {
+		return ru.user + "@" + ru.host
+	}
+	return ru.host
+}
+
+// Return the URL in the scp-like form rsync understands. rsync has no
+// ssh:// syntax, so the port must be given to ssh separately. A daemon URL
+// is returned in the rsync:// form, which carries its own port.
+func (ru *remoteURL) rsyncURL() string {
+	host := ru.host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if ru.daemon {
+		if ru.port != "" {
+			host += ":" + ru.port
+		}
+		if ru.user != "" {
+			host = ru.user + "@" + host
+		}
+		return "rsync://" + host + "/" + ru.dir
+	}
+	if ru.user != "" {
+		host = ru.user + "@" + host
+	}
+	return host + ":" + ru.dir
+}
+
+// The error returned for a remote URL git-sync can't use.
+type remoteURLError struct {
+	URL    string
+	Reason string
+}
+
+func (e *remoteURLError) Error() string {
+	return fmt.Sprintf("invalid remote URL %q: %s, expected [user@]host:path, ssh://[user@]host[:port]/path or rsync://[user@]host[:port]/module/path", e.URL, e.Reason)
+}
+
+func parseRemoteURL(url string) (*remoteURL, error) {
+	fail := func(reason string) (*remoteURL, error) {
+		return nil, &remoteURLError{URL: url, Reason: reason}
+	}
+	if url == "" {
+		return fail("empty URL")
+	}
+	if strings.HasPrefix(url, "ssh://") {
+		return parseSchemeURL(url, "ssh://", fail)
+	}
+	if strings.HasPrefix(url, "rsync://") {
+		return parseSchemeURL(url, "rsync://", fail)
+	}
+	if i := strings.Index(url, "://"); i >= 0 {
+		return fail(url[:i] + ":// URLs are not supported")
+	}
+	ru := &remoteURL{}
+	rest := url
+	if i := strings.Index(rest, "@"); i >= 0 && !strings.ContainsAny(rest[:i], ":/[") {
+		ru.user, rest = rest[:i], rest[i+1:]
+		if ru.user == "" {
+			return fail("empty user")
+		}
+	}
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return fail("unterminated [ in host")
+		}
+		ru.host, rest = rest[1:end], rest[end+1:]
+		if !strings.HasPrefix(rest, ":") {
+			return fail("missing ':' after host")
+		}
+		ru.dir = rest[1:]
+	} else {
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			return fail("missing ':' between host and path")
+		}
+		ru.host, ru.dir = rest[:i], rest[i+1:]
+		if strings.Contains(ru.host, "/") {
+			// git and rsync treat this as a local path.
+			return fail("local paths are not supported")
+		}
+	}
+	if strings.HasPrefix(ru.dir, ":") {
+		// rsync's host::module/path daemon syntax.
+		ru.dir = ru.dir[1:]
+		ru.daemon = true
+	}
+	if ru.host == "" {
+		return fail("missing host")
+	}
+	if ru.dir == "" {
+		return fail("missing path")
+	}
+	return ru, nil
+}
+
+// Parse ssh://[user@]host[:port]/path or rsync://[user@]host[:port]/module/path.
+// As with git, an ssh path starting with /~/ is relative to the home
+// directory. A daemon path is relative to the daemon, so its leading / is
+// dropped.
+func parseSchemeURL(url string, scheme string, fail func(reason string) (*remoteURL, error)) (*remoteURL, error) {
+	ru := &remoteURL{daemon: scheme == "rsync://"}
+	rest := strings.TrimPrefix(url, scheme)
+	slash := strings.Index(rest, "/")
+	if slash < 0 {
+		return fail("missing path")
+	}
+	authority, dir := rest[:slash], rest[slash:]
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		ru.user, authority = authority[:i], authority[i+1:]
+		if ru.user == "" {
+			return fail("empty user")
+		}
+	}
+	if strings.HasPrefix(authority, "[") {
+		end := strings.Index(authority, "]")
+		if end < 0 {
+			return fail("unterminated [ in host")
+		}
+		ru.host, authority = authority[1:end], authority[end+1:]
+		if authority != "" && !strings.HasPrefix(authority, ":") {
+			return fail("unexpected text after host")
+		}
+		ru.port = strings.TrimPrefix(authority, ":")
+	} else {
+		switch strings.Count(authority, ":") {
+		case 0:
+			ru.host = authority
+		case 1:
+			i := strings.Index(authority, ":")
+			ru.host, ru.port = authority[:i], authority[i+1:]
+		default:
+			return fail("an IPv6 host must be in brackets")
+		}
+	}
+	if ru.host == "" {
+		return fail("missing host")
+	}
+	if ru.port != "" {
+		if n, err := strconv.Atoi(ru.port); err != nil || n < 1 || n > 65535 {
+			return fail("invalid port " + strconv.Quote(ru.port))
+		}
+	}
+	if ru.daemon {
+		dir = strings.TrimLeft(dir, "/")
+	} else if strings.HasPrefix(dir, "/~/") {
+		dir = strings.TrimPrefix(dir, "/~/")
+	}
+	if dir == "/" || dir == "" {
+		return fail("missing path")
+	}
+	ru.dir = dir
+	return ru, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRemoteURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		sshAddr  string
+		port     string
+		dir      string
+		rsyncURL string
+	}{
+		{"host:src/repo", "host", "", "src/repo", "host:src/repo"},
+		{"host:/srv/repo", "host", "", "/srv/repo", "host:/srv/repo"},
+		{"me@host:/srv/repo", "me@host", "", "/srv/repo", "me@host:/srv/repo"},
+		{"[::1]:/srv/repo", "::1", "", "/srv/repo", "[::1]:/srv/repo"},
+		{"me@[fe80::1%eth0]:src", "me@fe80::1%eth0", "", "src", "me@[fe80::1%eth0]:src"},
+		{"host:/srv/a:b", "host", "", "/srv/a:b", "host:/srv/a:b"},
+		{"ssh://host/srv/repo", "host", "", "/srv/repo", "host:/srv/repo"},
+		{"ssh://me@host:2222/srv/mirror", "me@host", "2222", "/srv/mirror", "me@host:/srv/mirror"},
+		{"ssh://me@[::1]:2222/srv/mirror", "me@::1", "2222", "/srv/mirror", "me@[::1]:/srv/mirror"},
+		{"ssh://[::1]/srv/mirror", "::1", "", "/srv/mirror", "[::1]:/srv/mirror"},
+		{"ssh://host/~/src/repo", "host", "", "src/repo", "host:src/repo"},
+		{"rsync://host/mod/repo", "host", "", "mod/repo", "rsync://host/mod/repo"},
+		{"rsync://me@[::1]:8873/mod", "me@::1", "8873", "mod", "rsync://me@[::1]:8873/mod"},
+		{"host::mod/repo", "host", "", "mod/repo", "rsync://host/mod/repo"},
+	}
+	for _, tt := range tests {
+		ru, err := parseRemoteURL(tt.url)
+		if err != nil {
+			t.Errorf("%s: %s", tt.url, err)
+			continue
+		}
+		if ru.sshAddr() != tt.sshAddr || ru.port != tt.port || ru.dir != tt.dir {
+			t.Errorf("%s: got %q %q %q, want %q %q %q", tt.url, ru.sshAddr(), ru.port, ru.dir, tt.sshAddr, tt.port, tt.dir)
+		}
+		if ru.rsyncURL() != tt.rsyncURL {
+			t.Errorf("%s: rsync URL %q, want %q", tt.url, ru.rsyncURL(), tt.rsyncURL)
+		}
+	}
+
+	for _, url := range []string{
+		"",
+		"host",
+		"/srv/repo",
+		"https://host/srv/repo",
+		"ssh://host",
+		"ssh://host/",
+		"rsync://host/",
+		"rsync://host:rsync/mod",
+		"ssh://host:ssh/srv/repo",
+		"ssh://host:70000/srv/repo",
+		"ssh://::1/srv/repo",
+		"ssh://@host/srv/repo",
+		"::1:/srv/repo",
+		"[::1]/srv/repo",
+		"[::1:/srv/repo",
+		"host:",
+		"@host:src",
+		"./local:dir",
+	} {
+		_, err := parseRemoteURL(url)
+		if _, ok := err.(*remoteURLError); !ok {
+			t.Errorf("%q: expected a remoteURLError, got %v", url, err)
+		}
+	}
+}
+
+func TestRemoteURLPort(t *testing.T) {
+	cfg := defaultConfig
+	cfg.remoteURL = "ssh://me@host:2222/srv/mirror"
+	args := strings.Join(makeSSHArgs(&cfg, cfg.remoteSSHAddr(), nil), " ")
+	if !strings.Contains(args, "-p 2222 ") || !strings.HasSuffix(args, " me@host") {
+		t.Errorf("port not passed to ssh: %s", args)
+	}
+	if rsh := rsyncRemoteShell(&cfg); !strings.HasPrefix(rsh, "ssh -F /dev/null -p 2222 ") {
+		t.Errorf("port not passed to rsync -e: %s", rsh)
+	}
+
+	cfg.remoteURL = "me@host:/srv/mirror"
+	if args := makeSSHArgs(&cfg, cfg.remoteSSHAddr(), nil); strings.Contains(strings.Join(args, " "), "-p ") {
+		t.Errorf("unexpected port for an scp-style URL: %s", args)
+	}
+}
+
+func TestRsyncDaemonRemote(t *testing.T) {
+	cfg := defaultConfig
+	cfg.remoteURL = "rsync://host:8873/mod/repo"
+	if rsyncRemotePathArgs(&cfg) != nil {
+		t.Errorf("--rsync-path passed to an rsync daemon")
+	}
+	if cfg.hasRemoteShell() || cfg.remoteDir() != "" || cfg.requireRemoteShell("pull") == nil {
+		t.Errorf("rsync daemon has a remote shell")
+	}
+
+	// Remote commands use sync.daemonSSHURL, including its port.
+	cfg.daemonSSHURL = "ssh://me@host:2222/srv/repo"
+	if cfg.remoteSSHAddr() != "me@host" || cfg.remoteDir() != "/srv/repo" || cfg.remotePort() != "2222" {
+		t.Errorf("daemon ssh URL not used: %s %s %s", cfg.remoteSSHAddr(), cfg.remoteDir(), cfg.remotePort())
+	}
+	if cfg.rsyncRemoteURL() != "rsync://host:8873/mod/repo" {
+		t.Errorf("unexpected rsync URL %s", cfg.rsyncRemoteURL())
+	}
+	if err := cfg.requireRemoteShell("pull"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/msolo/git-mg/gitapi"
+)
+
+// The commands a push would run now, as found by planPush. A nil command is
+// a step the push would skip.
+type pushPlan struct {
+	status *syncStatus
+	// The files rsync would send, in manifest order.
+	transferFiles []string
+	manifest      []string
+	resetCmd      *gitapi.Cmd
+	// With sync.explicitDeletes, the removal of the files deleted locally,
+	// which rsync then doesn't send.
+	deleteCmd *gitapi.Cmd
+	rsyncCmd  *gitapi.Cmd
+	stageCmd  *gitapi.Cmd
+	// With sync.tagRemote, the update of remoteTagRef.
+	tagCmd *gitapi.Cmd
+}
+
+// Work out the push fullSync would do now: the remote reset, the rsync and
+// the remote git add. Changes are found locally and the commands are built
+// as usual, but nothing is run and the remote is never contacted, so checks
+// that need the remote, like sync.detectRemoteDirty, are left out, as is
+// sync.preflightCmd. For a mirror, see runsRemoteGit, only the rsync is
+// planned.
+func planPush(cfg *config, workdir string) (*pushPlan, error) {
+	if err := cfg.checkRemoteDirAllowed(); err != nil {
+		return nil, err
+	}
+	st, err := getSyncStatus(cfg, workdir)
+	if err != nil {
+		return nil, err
+	}
+	plan := &pushPlan{status: st}
+	sc := st.cookie
+	transferFiles := st.changedFiles
+	if st.changeSource != "fsmonitor" && sc.gitStateChanged() && cfg.skipUnchangedOnReset && cfg.runsRemoteGit() {
+		transferFiles, err = dropUnchangedFiles(workdir, sc.mergeBaseHash, st.changedFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	plan.transferFiles = dropSubmodules(workdir, filterPathspecs(cfg.pathspecs, transferFiles))
+
+	// fullSync resets the remote whenever it could not use fsmonitor.
+	if st.changeSource != "fsmonitor" && cfg.runsRemoteGit() {
+		plan.resetCmd, err = gitSyncCmd(cfg, sc, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sendFiles := plan.transferFiles
+	if cfg.explicitDeletes && cfg.runsRemoteGit() {
+		var deletedFiles []string
+		sendFiles, deletedFiles = splitDeletedFiles(workdir, plan.transferFiles)
+		if len(deletedFiles) > 0 {
+			plan.deleteCmd = remoteDeleteCmd(cfg, deletedFiles)
+		}
+	}
+	if len(sendFiles) > 0 {
+		rsyncArgs, err := rsyncPushArgs(cfg, workdir, sendFiles)
+		if err != nil {
+			return nil, err
+		}
+		plan.rsyncCmd = cfg.transport.rsyncCmd(cfg, rsyncArgs)
+		plan.manifest, err = pushManifest(workdir, sendFiles)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.runsRemoteGit() {
+			plan.stageCmd, err = sshStageRemoteChangesCmd(cfg, sendFiles)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// As in fullSync, the remote is only tagged when the cookie would move.
+	if cfg.tagRemote && cfg.runsRemoteGit() && len(cfg.pathspecs) == 0 && (len(st.changedFiles) > 0 || sc.gitStateChanged()) {
+		plan.tagCmd = remoteTagCmd(cfg, sc)
+	}
+	return plan, nil
+}
+
+// Write a bash script that performs the push fullSync would do now, see
+// planPush. The rsync manifest is embedded in the script, which is
+// self-contained apart from ssh and rsync themselves.
+func emitSyncScript(cfg *config, workdir string, w io.Writer) error {
+	plan, err := planPush(cfg, workdir)
+	if err != nil {
+		return err
+	}
+	st := plan.status
+	lines := []string{
+		"#!/bin/bash",
+		fmt.Sprintf("# git-sync push to %s (%s), emitted by git-sync push -emit-script.", cfg.remoteName, cfg.remoteURL),
+		fmt.Sprintf("# Changes found via %s: %d files to send.", st.changeSource, len(plan.transferFiles)),
+	}
+	if st.fullSyncReason != "" && cfg.runsRemoteGit() {
+		lines = append(lines, fmt.Sprintf("# The remote is reset to %s and cleaned: %s.", st.cookie.mergeBaseHash, st.fullSyncReason))
+	}
+	lines = append(lines,
+		"# Running this does not update the sync cookie, so the next git-sync push",
+		"# sends these changes again.",
+		"set -euo pipefail",
+	)
+
+	if plan.resetCmd != nil {
+		lines = append(lines, "", "# Reset the remote workdir.", gitapi.BashQuoteCmd(plan.resetCmd.Args...))
+	}
+	if plan.deleteCmd != nil {
+		lines = append(lines, "", "# Delete the files gone locally.", gitapi.BashQuoteCmd(plan.deleteCmd.Args...))
+	}
+	if plan.rsyncCmd != nil {
+		lines = append(lines,
+			"",
+			"# The NUL-terminated rsync manifest.",
+			`manifest=$(mktemp "${TMPDIR:-/tmp}/git-sync-file-manifest-XXXXXX")`,
+			`trap 'rm -f "$manifest"' EXIT`,
+			"printf '%s\\0' \\",
+		)
+		for _, fname := range plan.manifest {
+			lines = append(lines, "  "+gitapi.BashQuoteCmd(fname)+" \\")
+		}
+		lines = append(lines,
+			`  > "$manifest"`,
+			"",
+			"# Send the changed files.",
+			manifestCmdLine(plan.rsyncCmd.Args),
+		)
+	}
+	if plan.stageCmd != nil {
+		lines = append(lines, "", "# Stage them on the remote.", gitapi.BashQuoteCmd(plan.stageCmd.Args...))
+	}
+	if plan.tagCmd != nil {
+		lines = append(lines, "", "# Point "+remoteTagRef+" at the merge base.", gitapi.BashQuoteCmd(plan.tagCmd.Args...))
+	}
+	_, err = io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+// Print the push fullSync would do now, see planPush, for push -dry-run.
+// The rsync manifest is listed below the rsync command, which reads it from
+// $manifest.
+func printPushPlan(cfg *config, plan *pushPlan) {
+	st := plan.status
+	NoisyPrintf("dry run: push to %s (%s), changes via %s: %d files to send\n",
+		cfg.remoteName, cfg.remoteURL, st.changeSource, len(plan.transferFiles))
+	if plan.resetCmd != nil {
+		if st.fullSyncReason != "" {
+			NoisyPrintf("would reset the remote to %s and clean it, %s:\n", st.cookie.mergeBaseHash, st.fullSyncReason)
+		} else {
+			NoisyPrintf("would run the remote reset, which only checks out %s if the remote moved:\n", st.cookie.mergeBaseHash)
+		}
+		NoisyPrintf("  %s\n", gitapi.BashQuoteCmd(plan.resetCmd.Args...))
+	}
+	if plan.deleteCmd != nil {
+		NoisyPrintf("would delete on the remote:\n  %s\n", gitapi.BashQuoteCmd(plan.deleteCmd.Args...))
+	}
+	if plan.rsyncCmd != nil {
+		NoisyPrintf("would send:\n  %s\n", manifestCmdLine(plan.rsyncCmd.Args))
+		NoisyPrintf("with $manifest holding:\n")
+		for _, fname := range plan.manifest {
+			NoisyPrintf("  %s\n", fname)
+		}
+	}
+	if plan.stageCmd != nil {
+		NoisyPrintf("would stage them on the remote:\n  %s\n", gitapi.BashQuoteCmd(plan.stageCmd.Args...))
+	}
+	if plan.tagCmd != nil {
+		NoisyPrintf("would point %s on the remote at %s:\n  %s\n", remoteTagRef, st.cookie.mergeBaseHash, gitapi.BashQuoteCmd(plan.tagCmd.Args...))
+	}
+}
+
+// Quote a command, pointing its --files-from at the script's $manifest
+// rather than the temporary file written for it.
+func manifestCmdLine(args []string) string {
+	words := gitapi.BashQuote(args...)
+	for i, arg := range args[:len(args)-1] {
+		if arg == "--files-from" {
+			words[i+1] = `"$manifest"`
+		}
+	}
+	return strings.Join(words, " ")
+}
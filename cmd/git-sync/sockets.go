@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/msolo/git-mg/gitapi"
+	log "github.com/msolo/go-bis/glug"
+	"github.com/pkg/errors"
+)
+
+// ssh creates the control socket under a temporary name, the ControlPath
+// followed by a dot and 16 random characters, and renames it into place, so
+// that name must fit in a unix socket address too.
+const controlPathTmpSuffixLen = 17
+
+// Return the control path template for sync.sshControlPath=repo. Each
+// repository, shared by its worktrees, gets its own sockets, which also
+// differ per local user. %C is ssh's hash of the local host, remote host, port
+// and remote user. The path is in /tmp rather than $TMPDIR, which is too long
+// for a socket on some systems.
+func repoControlPath(workdir string) string {
+	sum := sha1.Sum([]byte(gitapi.GitCommonDir(workdir)))
+	return "/tmp/git-sync-%u-" + hex.EncodeToString(sum[:])[:12] + "-%C"
+}
+
+// Expand the tokens of an ssh ControlPath template as ssh would for the
+// remote, as far as needed to know the length of the result. %C is a hex
+// SHA1, so a placeholder of the same length stands in for it.
+func expandControlPath(controlPath string, ru *remoteURL) string {
+	localUser := os.Getenv("USER")
+	remoteUser := ru.user
+	if remoteUser == "" {
+		remoteUser = localUser
+	}
+	port := ru.port
+	if port == "" {
+		port = "22"
+	}
+	hostname, _ := os.Hostname()
+	homeDir, _ := os.UserHomeDir()
+	tokens := map[byte]string{
+		'%': "%",
+		'C': strings.Repeat("0", 2*sha1.Size),
+		'd': homeDir,
+		'h': ru.host,
+		'i': strconv.Itoa(os.Getuid()),
+		'L': strings.SplitN(hostname, ".", 2)[0],
+		'l': hostname,
+		'n': ru.host,
+		'p': port,
+		'r': remoteUser,
+		'u': localUser,
+	}
+	var b strings.Builder
+	for i := 0; i < len(controlPath); i++ {
+		c := controlPath[i]
+		if c == '%' && i+1 < len(controlPath) {
+			i++
+			if val, ok := tokens[controlPath[i]]; ok {
+				b.WriteString(val)
+			} else {
+				b.WriteByte('%')
+				b.WriteByte(controlPath[i])
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// Refuse a control path too long for a unix socket address, which ssh only
+// reports once it fails to set up the master, and then only as a failure to
+// connect.
+func checkControlPathLength(controlPath string, ru *remoteURL) error {
+	maxLen := len(syscall.RawSockaddrUnix{}.Path)
+	expanded := expandControlPath(controlPath, ru)
+	if len(expanded)+controlPathTmpSuffixLen >= maxLen {
+		return errors.Errorf("sync.sshControlPath %q expands to %q, which leaves no room for ssh's temporary suffix in a unix socket address (%d bytes), use a shorter path",
+			controlPath, expanded, maxLen)
+	}
+	return nil
+}
+
+// Convert an ssh ControlPath template into a glob matching every socket it
+// could expand to. Each %-token becomes a wildcard.
+func controlPathGlob(controlPath string) string {
+	var b strings.Builder
+	for i := 0; i < len(controlPath); i++ {
+		c := controlPath[i]
+		if c == '%' && i+1 < len(controlPath) {
+			i++
+			if controlPath[i] == '%' {
+				b.WriteByte('%')
+			} else {
+				b.WriteByte('*')
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// Return an ssh control command (ssh -O <op>). Since ssh honors the first
+// value given for an option, extraArgs take precedence over our defaults.
+func sshControlCmd(cfg *config, op string, addr string, extraArgs ...string) *gitapi.Cmd {
+	args := make([]string, 0, 32)
+	args = append(args, extraArgs...)
+	args = append(args, makeSSHArgs(cfg, "", nil)...)
+	args = append(args, "-O", op, addr)
+	cmd := gitapi.Command("ssh", args...)
+	cmd.Env = gitapi.GetRestrictedEnv()
+	return cmd
+}
+
+// Close the control master for the current remote and remove any socket
+// matching the sshControlPath template that no longer has a live master
+// behind it. Live sockets for other hosts are left alone.
+func cleanSockets(cfg *config) (removedSockets []string, err error) {
+	if len(cfg.remoteShell) > 0 {
+		return nil, errors.New("clean-sockets requires the ssh transport, but sync.remoteShell is set")
+	}
+	if err := cfg.requireRemoteShell("clean-sockets"); err != nil {
+		return nil, err
+	}
+
+	if _, err := sshControlCmd(cfg, "exit", cfg.remoteSSHAddr()).Output(); err != nil {
+		// Most likely there was no master running for this host.
+		log.Infof("no control master closed for %s: %s", cfg.remoteSSHAddr(), err)
+	} else {
+		VerbosePrintf("closed control master for %s\n", cfg.remoteSSHAddr())
+	}
+
+	sockPaths, err := filepath.Glob(controlPathGlob(cfg.sshControlPath))
+	if err != nil {
+		return nil, err
+	}
+	for _, sockPath := range sockPaths {
+		fi, err := os.Lstat(sockPath)
+		if err != nil || fi.Mode()&os.ModeSocket == 0 {
+			continue
+		}
+		// The host is irrelevant when the control path is explicit, but ssh
+		// requires one.
+		checkCmd := sshControlCmd(cfg, "check", "localhost", "-oControlPath="+sockPath)
+		if _, err := checkCmd.Output(); err == nil {
+			continue
+		}
+		if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+			return removedSockets, err
+		}
+		removedSockets = append(removedSockets, sockPath)
+	}
+	return removedSockets, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/msolo/go-bis/glug"
+)
+
+// What a push would do, computed without contacting the remote.
+type syncStatus struct {
+	changedFiles []string
+	// How the changes were found, either fsmonitor or the sync.changeSource.
+	changeSource string
+	// Why the remote would be reset and cleaned, or empty for an incremental sync.
+	fullSyncReason string
+	cookie         *syncCookie
+}
+
+func getSyncStatus(cfg *config, workdir string) (*syncStatus, error) {
+	sc, err := readSyncCookie(cfg, workdir)
+	if err != nil {
+		return nil, err
+	}
+	st := &syncStatus{cookie: sc}
+	switch {
+	case sc.NeedsReset:
+		st.fullSyncReason = "push -commit left the remote out of step with this workdir"
+	case sc.LastHeadHash == "":
+		st.fullSyncReason = "no previous sync to this remote"
+	case sc.remoteChanged():
+		st.fullSyncReason = fmt.Sprintf("last sync was to %s (%s)", sc.LastRemoteName, sc.LastRemoteURL)
+	case sc.LastHeadHash != sc.headHash:
+		st.fullSyncReason = fmt.Sprintf("HEAD moved from %s to %s", sc.LastHeadHash, sc.headHash)
+	case sc.LastMergeBaseHash != sc.mergeBaseHash:
+		st.fullSyncReason = fmt.Sprintf("merge base moved from %s to %s", sc.LastMergeBaseHash, sc.mergeBaseHash)
+	}
+
+	if !sc.gitStateChanged() && cfg.fsmonitorEnabled() {
+		changedFiles, err := getChangesViaFsMonitor(cfg, workdir, sc, nil)
+		if err == nil {
+			st.changedFiles = changedFiles
+			st.changeSource = "fsmonitor"
+			return st, nil
+		}
+		if err != errFsMonitorNoList {
+			log.Warningf("git fsmonitor failed to return results: %s", err)
+		}
+	}
+	st.changedFiles, err = getChangesViaGit(cfg, workdir, sc)
+	if err != nil {
+		return nil, err
+	}
+	st.changeSource = cfg.changeSource
+	return st, nil
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
@@ -25,25 +31,48 @@ import (
 	"github.com/tebeka/atexit"
 )
 
+// ssh takes its timeouts in seconds.
+func sshSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Second), 10)
+}
+
 func makeSSHArgs(cfg *config, addr string, bashCmdArgs []string) []string {
 	sshOptions := map[string]string{
-		"ConnectTimeout": "5",
+		"ConnectTimeout": sshSeconds(cfg.sshConnectTimeout),
 		"ControlMaster":  "auto", // auto|no
 		"ControlPath":    cfg.sshControlPath,
-		"ControlPersist": "15m",
+		"ControlPersist": sshSeconds(cfg.sshControlPersist),
 		// Forwarding the agent is almost certainly required since both local and remote
 		// workdirs must talk to the same central server.
 		"ForwardAgent": "yes",
 		// If we use control sockets, we need to set loglevel=quiet so that we don"t
 		// litter lines like "Shared connection to <host> closed." after every command.
 		"LogLevel":              "quiet",
-		"ServerAliveInterval":   "60",
+		"ServerAliveInterval":   sshSeconds(cfg.sshServerAliveInterval),
 		"StrictHostKeyChecking": "no",
 		"TCPKeepAlive":          "yes",
 		"UserKnownHostsFile":    "/dev/null",
 	}
+	if cfg.sshStrictHostKeyChecking {
+		// Fall back to the default known_hosts files.
+		sshOptions["StrictHostKeyChecking"] = "yes"
+		delete(sshOptions, "UserKnownHostsFile")
+	}
+	for k, v := range cfg.sshExtraOptions {
+		// ssh option names are case insensitive, so replace any built-in
+		// option however it is spelled.
+		for defaultKey := range sshOptions {
+			if strings.EqualFold(defaultKey, k) {
+				delete(sshOptions, defaultKey)
+			}
+		}
+		sshOptions[k] = v
+	}
 
 	sshArgs := []string{"-F", "/dev/null"}
+	if port := cfg.remotePort(); port != "" {
+		sshArgs = append(sshArgs, "-p", port)
+	}
 	if os.Getenv("GIT_SYNC_DEBUG") != "" {
 		sshArgs = append(sshArgs, "-vvv")
 	}
@@ -64,50 +93,164 @@ func makeSSHArgs(cfg *config, addr string, bashCmdArgs []string) []string {
 	}
 
 	if len(bashCmdArgs) > 0 {
-		bashCmd := "/bin/bash --noprofile --norc -c " + gitapi.BashQuote(strings.Join(bashCmdArgs, " "))[0]
-		sshArgs = append(sshArgs, bashCmd)
+		sshArgs = append(sshArgs, remoteBashCmd(bashCmdArgs))
 	}
 	return sshArgs
 }
 
+// Return a single shell string that runs the given args under a clean bash on
+// the remote side. Like ssh, the transport must hand this to a shell.
+func remoteBashCmd(bashCmdArgs []string) string {
+	return "/bin/bash --noprofile --norc -c " + gitapi.BashQuote(strings.Join(bashCmdArgs, " "))[0]
+}
+
+// Return the command used to reach the remote, suitable for rsync's -e. This
+// is either ssh with our standard options or the configured sync.remoteShell.
+func rsyncRemoteShell(cfg *config) string {
+	if len(cfg.remoteShell) > 0 {
+		return strings.Join(gitapi.BashQuote(cfg.remoteShell...), " ")
+	}
+	sshArgs := []string{"ssh"}
+	sshArgs = append(sshArgs, gitapi.BashQuote(makeSSHArgs(cfg, "", nil)...)...)
+	return strings.Join(sshArgs, " ")
+}
+
 func makeSSHCmd(cfg *config, addr string, bashCmdArgs []string) *gitapi.Cmd {
+	if len(cfg.remoteShell) > 0 {
+		// A custom transport is invoked exactly like rsync would invoke it:
+		// <remote shell> <host> <shell string>
+		args := make([]string, 0, len(cfg.remoteShell)+1)
+		args = append(args, cfg.remoteShell[1:]...)
+		args = append(args, addr)
+		if len(bashCmdArgs) > 0 {
+			args = append(args, remoteBashCmd(bashCmdArgs))
+		}
+		cmd := gitapi.Command(cfg.remoteShell[0], args...)
+		cmd.Env = gitapi.GetRestrictedEnv()
+		return cmd
+	}
 	cmd := gitapi.Command("ssh", makeSSHArgs(cfg, addr, bashCmdArgs)...)
 	cmd.Env = gitapi.GetRestrictedEnv()
 	return cmd
 }
 
+// A transport constructs the commands that reach the remote workdir. The
+// default uses ssh (or sync.remoteShell) and rsync. Tests substitute a fake
+// that records commands rather than running them against a real host.
+type transport interface {
+	// Return a command that runs bashCmdArgs in a shell on the remote.
+	remoteCmd(cfg *config, bashCmdArgs []string) *gitapi.Cmd
+	// Return an rsync command for the given arguments, which already name the
+	// source and destination. The transport supplies the remote shell.
+	rsyncCmd(cfg *config, rsyncArgs []string) *gitapi.Cmd
+}
+
+type sshTransport struct{}
+
+func (sshTransport) remoteCmd(cfg *config, bashCmdArgs []string) *gitapi.Cmd {
+	return makeSSHCmd(cfg, cfg.remoteSSHAddr(), bashCmdArgs)
+}
+
+func (sshTransport) rsyncCmd(cfg *config, rsyncArgs []string) *gitapi.Cmd {
+	args := make([]string, 0, len(rsyncArgs)+2)
+	// rsync connects to a daemon itself.
+	if !cfg.isDaemon() {
+		args = append(args, "-e", rsyncRemoteShell(cfg))
+	}
+	args = append(args, rsyncArgs...)
+	cmd := gitapi.Command(cfg.rsyncLocalPath, args...)
+	cmd.Env = gitapi.GetRestrictedEnv()
+	return cmd
+}
+
 type syncCookie struct {
 	LastHeadHash      string
 	LastMergeBaseHash string
 	LastSyncStartNs   int64 `json:",string"`
-	headHash          string
-	mergeBaseHash     string
-	syncStartNs       int64
+	LastRemoteName    string
+	LastRemoteURL     string
+	// NeedsReset is set when the remote was left out of step with the
+	// workdir, as by push -commit, so the next push resets it.
+	NeedsReset    bool `json:",omitempty"`
+	headHash      string
+	mergeBaseHash string
+	syncStartNs   int64
+	remoteName    string
+	remoteURL     string
+	needsReset    bool
 }
 
 func (sc syncCookie) gitStateChanged() bool {
+	if sc.NeedsReset || sc.remoteChanged() {
+		return true
+	}
 	return !(sc.LastHeadHash != "" && sc.LastHeadHash == sc.headHash && sc.LastMergeBaseHash == sc.mergeBaseHash)
 }
 
+// A cookie written by a sync to a different remote says nothing about the
+// state of this one, so the fast path cannot be trusted.
+func (sc syncCookie) remoteChanged() bool {
+	return sc.LastRemoteName != sc.remoteName || sc.LastRemoteURL != sc.remoteURL
+}
+
+// Each remote keeps its own cookie so alternating between remotes doesn't
+// throw away the incremental state of the other. The cookie records the state
+// of one workdir, so linked worktrees each keep their own in their git dir.
+// Remote names may contain a slash, so the name is escaped.
+func syncCookiePath(workdir string, remoteName string) string {
+	return path.Join(gitapi.GitDir(workdir), "git-sync-cookie-"+url.PathEscape(remoteName)+".json")
+}
+
+// Before cookies were kept per remote, a single cookie recorded the last
+// remote synced. If that was remoteName, move it into place so an upgrade
+// doesn't force a reset and the first sync prompt.
+func migrateLegacySyncCookie(workdir string, remoteName string) error {
+	fname := syncCookiePath(workdir, remoteName)
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		return err
+	}
+	legacyPath := path.Join(gitapi.GitDir(workdir), "git-sync-cookie.json")
+	data, err := ioutil.ReadFile(legacyPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sc := &syncCookie{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return errors.Wrapf(err, "invalid sync cookie %s", legacyPath)
+	}
+	if sc.LastRemoteName != remoteName {
+		return nil
+	}
+	return os.Rename(legacyPath, fname)
+}
+
 // Read sync cookie and current working directory state. Cookie may be a stupid name.
-func readSyncCookie(workdir string) (sc *syncCookie, err error) {
+func readSyncCookie(cfg *config, workdir string) (sc *syncCookie, err error) {
+	remoteName, remoteURL := cfg.remoteName, cfg.remoteURL
 	headHash, err := gitapi.GetHeadCommitHash(workdir)
 	if err != nil {
 		return nil, err
 	}
-	mergeBaseHash, err := gitapi.GetMergeBaseCommitHash(workdir)
+	mergeBaseHash, err := gitapi.GetMergeBase(workdir, "origin/"+cfg.upstreamBranch, "HEAD")
 	if err != nil {
 		return nil, err
 	}
+	if err := migrateLegacySyncCookie(workdir, remoteName); err != nil {
+		return nil, err
+	}
 	sc = &syncCookie{
 		// Round down to seconds since that's what watchman uses internally.
 		syncStartNs:   time.Now().Unix() * 1e9,
 		headHash:      headHash,
 		mergeBaseHash: mergeBaseHash,
+		remoteName:    remoteName,
+		remoteURL:     remoteURL,
 	}
-	fname := path.Join(workdir, ".git/git-sync-cookie.json")
-	data, err := ioutil.ReadFile(fname)
+	data, err := ioutil.ReadFile(syncCookiePath(workdir, remoteName))
 	if err == nil {
+		gitapi.RecordArtifact("sync-cookie-read-"+remoteName, data)
 		if err := json.Unmarshal(data, sc); err != nil {
 			return nil, err
 		}
@@ -118,28 +261,130 @@ func readSyncCookie(workdir string) (sc *syncCookie, err error) {
 }
 
 func writeSyncCookie(workdir string, sc *syncCookie) error {
-	fname := path.Join(workdir, ".git/git-sync-cookie.json")
+	fname := syncCookiePath(workdir, sc.remoteName)
 	tmpSc := &syncCookie{LastHeadHash: sc.headHash,
 		LastMergeBaseHash: sc.mergeBaseHash,
 		LastSyncStartNs:   sc.syncStartNs,
+		LastRemoteName:    sc.remoteName,
+		LastRemoteURL:     sc.remoteURL,
+		NeedsReset:        sc.needsReset,
 	}
 	data, err := json.Marshal(tmpSc)
 	if err != nil {
 		return errors.Wrap(err, "failed marshaling sync cookie")
 	}
+	gitapi.RecordArtifact("sync-cookie-write-"+sc.remoteName, data)
 	return ioutil.WriteFile(fname, data, 0644)
 }
 
-func isDir(fname string) bool {
-	fi, err := os.Stat(fname)
-	if err != nil {
+// Drop submodule checkouts from a push manifest. rsync would only copy the
+// directory entry and staging it would record the remote submodule's HEAD,
+// so submodules are left to the remote reset instead.
+func dropSubmodules(workdir string, fnames []string) []string {
+	kept := make([]string, 0, len(fnames))
+	for _, fname := range fnames {
+		if _, err := os.Lstat(path.Join(workdir, fname, ".git")); err == nil {
+			log.Infof("skipping submodule %s", fname)
+			continue
+		}
+		kept = append(kept, fname)
+	}
+	return kept
+}
+
+// Check whether clean paths are directories, memoizing the answer for their
+// parents. A path whose parent is not a directory is missing, so a deleted
+// tree costs one stat rather than one per path below it. Lstat is used so a
+// symlink to a directory counts as a file, as git tracks it.
+type dirCache map[string]bool
+
+func lstatIsDir(fname string) bool {
+	fi, err := os.Lstat(fname)
+	return err == nil && fi.IsDir()
+}
+
+func (dc dirCache) isDir(fname string) bool {
+	// Slice off the parent rather than use path.Dir, which allocates, since
+	// this runs for every path.
+	if i := strings.LastIndexByte(fname, '/'); i > 0 && !dc.isParentDir(fname[:i]) {
 		return false
 	}
-	return fi.IsDir()
+	return lstatIsDir(fname)
+}
+
+func (dc dirCache) isParentDir(dir string) bool {
+	if d, ok := dc[dir]; ok {
+		return d
+	}
+	d := dc.isDir(dir)
+	dc[dir] = d
+	return d
+}
+
+// Reasons a changed file is left out of a push, see SyncResult.SkippedFiles.
+const (
+	skipReasonDir       = "directory"
+	skipReasonGitDir    = "inside .git"
+	skipReasonIgnored   = "ignored by git"
+	skipReasonUnchanged = "unchanged since the merge base"
+	skipReasonPathspec  = "outside the pathspecs"
+	skipReasonSubmodule = "submodule"
+)
+
+// A changed file a push left out, and why.
+type SkippedFile struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// Collects the files dropped by the filters a push runs. A nil list records
+// nothing, for callers that don't report them.
+type skipList struct {
+	files []SkippedFile
+}
+
+func (sl *skipList) add(fname string, reason string) {
+	if sl != nil {
+		sl.files = append(sl.files, SkippedFile{fname, reason})
+	}
+}
+
+// Record the files a filter dropped: those in before but not in after.
+func (sl *skipList) addDropped(before []string, after []string, reason string) {
+	if sl == nil || len(before) == len(after) {
+		return
+	}
+	kept := make(map[string]bool, len(after))
+	for _, fname := range after {
+		kept[fname] = true
+	}
+	for _, fname := range before {
+		if !kept[fname] {
+			sl.add(fname, reason)
+		}
+	}
+}
+
+// Return the fsmonitor paths that name files worth syncing, dropping
+// directories and anything in .git. The result is a set, since fsmonitor
+// can report a path more than once.
+func filterFsMonitorPaths(workdir string, filePaths []string, isDir func(string) bool) map[string]bool {
+	fileSet := make(map[string]bool, len(filePaths))
+	for _, fname := range filePaths {
+		if fname != "" && fname != ".git" && !strings.HasPrefix(fname, ".git/") && !fileSet[fname] && !isDir(path.Join(workdir, fname)) {
+			fileSet[fname] = true
+		}
+	}
+	return fileSet
 }
 
+// Returned by getChangesViaFsMonitor when fsmonitor answered but didn't list
+// the changes: it reported that everything may have changed, or more than
+// sync.fsmonitorMaxChanges. git has to find them instead.
+var errFsMonitorNoList = errors.New("fsmonitor did not list the changes")
+
 // Use file system notifications to find changed files rather than git.
-func getChangesViaFsMonitor(cfg *config, workdir string, sc *syncCookie) (changedFiles []string, err error) {
+func getChangesViaFsMonitor(cfg *config, workdir string, sc *syncCookie, skipped *skipList) (changedFiles []string, err error) {
 	// To catch fast edits, we have to rewind one full second - the internal
 	// granularity of watchman.  The API to git-fsmonitor-watchman falsely suggests
 	// nanosecond granularity.
@@ -151,37 +396,51 @@ func getChangesViaFsMonitor(cfg *config, workdir string, sc *syncCookie) (change
 	// Watchman has some awful performance characteristics in the wild.  It's unclear
 	// if this is watchman, fseventsd, CPU overload or what.  We can limit expected
 	// worst-case behavior, but realistically there are some people for whom we
-	// should just shut off watchman altogether.
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	// should just shut off watchman altogether. On a loaded machine, raise
+	// sync.fsmonitorTimeoutMs instead.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.fsmonitorTimeout)
 	defer cancel()
 	fsMonCmd := gitapi.CommandContext(ctx, cfg.fsmonitorLocalPath, "1", strconv.FormatInt(ts, 10))
 	fsMonCmd.Env = gitapi.GetRestrictedEnv()
 	fsMonCmd.Dir = workdir
 	out, err := fsMonCmd.Output()
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Infof("git fsmonitor timed out after %s, sync.fsmonitorTimeoutMs is %d", cfg.fsmonitorTimeout, cfg.fsmonitorTimeout/time.Millisecond)
+		}
 		log.Warningf("git fsmonitor failed: %s", err)
 		return nil, err
 	}
 
 	filePaths := gitapi.SplitNullTerminated(string(out))
+	log.Infof("git fsmonitor returned %d changes", len(filePaths))
 	// Too many changes, just do a full sync by pretending we couldn't get
-	// results.
-	if len(filePaths) > 100 {
-		log.Warningf("git fsmonitor returned too many changes: %d", len(filePaths))
-		return nil, nil
+	// results. git-fsmonitor itself reports "/" above the same limit.
+	if cfg.fsmonitorMaxChanges > 0 && len(filePaths) > cfg.fsmonitorMaxChanges {
+		log.Warningf("git fsmonitor returned too many changes: %d > sync.fsmonitorMaxChanges %d", len(filePaths), cfg.fsmonitorMaxChanges)
+		return nil, errFsMonitorNoList
 	}
 
 	// The crazy git protocol can return / to mean "everything might have
 	// changed".
 	if len(filePaths) == 1 && filePaths[0] == "/" {
-		return nil, nil
+		log.Infof("git fsmonitor reported that everything may have changed")
+		return nil, errFsMonitorNoList
 	}
 
-	// This filter is expensive because of the directory checking.
-	filteredFileSet := make(map[string]bool, len(filePaths))
-	for _, fname := range filePaths {
-		if fname != "" && fname != ".git" && !strings.HasPrefix(fname, ".git/") && !isDir(path.Join(workdir, fname)) {
-			filteredFileSet[fname] = true
+	// This filter is expensive because of the directory checking, so the
+	// stats are cached.
+	filteredFileSet := filterFsMonitorPaths(workdir, filePaths, dirCache{}.isDir)
+	if skipped != nil {
+		for _, fname := range filePaths {
+			if fname == "" || filteredFileSet[fname] {
+				continue
+			}
+			if fname == ".git" || strings.HasPrefix(fname, ".git/") {
+				skipped.add(fname, skipReasonGitDir)
+			} else {
+				skipped.add(fname, skipReasonDir)
+			}
 		}
 	}
 	if len(filteredFileSet) > 0 {
@@ -191,6 +450,7 @@ func getChangesViaFsMonitor(cfg *config, workdir string, sc *syncCookie) (change
 		}
 		for _, fname := range ignoredFilePaths {
 			delete(filteredFileSet, fname)
+			skipped.add(fname, skipReasonIgnored)
 		}
 	}
 	return stringSet2Slice(filteredFileSet), nil
@@ -207,7 +467,9 @@ func stringSet2Slice(ss map[string]bool) []string {
 	return sl
 }
 
-func gitSyncCmd(cfg *config, sc *syncCookie) (*gitapi.Cmd, error) {
+// Build the remote reset command. If dryRun is set, the destructive commands
+// are replaced with their preview forms and nothing on the remote is modified.
+func gitSyncCmd(cfg *config, sc *syncCookie, dryRun bool) (*gitapi.Cmd, error) {
 	bashCmdArgs := make([]string, 0, 16)
 	// Plumb some handy profiling variables through.
 	for _, env := range os.Environ() {
@@ -216,18 +478,23 @@ func gitSyncCmd(cfg *config, sc *syncCookie) (*gitapi.Cmd, error) {
 		}
 	}
 
-	excludePaths := make([]string, 0, len(cfg.excludePaths))
-	for _, xp := range cfg.excludePaths {
-		excludePaths = append(excludePaths, "--exclude="+xp)
-	}
-
 	cmdFmt := remoteGitCmdFmt{
 		GitRemotePath:    cfg.gitRemotePath,
 		CheckoutRequired: "1",
 		CleanRequired:    "1",
 		RemoteDir:        cfg.remoteDir(),
 		CommitHash:       sc.mergeBaseHash,
-		ExcludePaths:     strings.Join(excludePaths, " "),
+		UpstreamBranch:   gitapi.BashQuote(cfg.upstreamBranch)[0],
+		ExcludePaths:     strings.Join(excludeArgs(cfg), " "),
+		CleanFlag:        cfg.remoteCleanFlag(),
+		CleanPathspecs:   strings.Join(gitapi.BashQuote(pathspecPatterns(cfg.pathspecs)...), " "),
+		UpdateSubmodules: !cfg.remoteSkipSubmodules,
+		DryRun:           dryRun,
+		LockTimeout:      lockTimeoutSecs(cfg.remoteLockTimeout),
+		LockExitCode:     remoteLockedExitCode,
+	}
+	if lockFile := cfg.remoteLockFile(); lockFile != "" {
+		cmdFmt.LockFile = gitapi.BashQuote(lockFile)[0]
 	}
 	if !sc.gitStateChanged() {
 		cmdFmt.CheckoutRequired = "0"
@@ -241,22 +508,289 @@ func gitSyncCmd(cfg *config, sc *syncCookie) (*gitapi.Cmd, error) {
 		return nil, err
 	}
 	bashCmdArgs = append(bashCmdArgs, buf.String())
-	sshCmd := makeSSHCmd(cfg, cfg.remoteSSHAddr(), bashCmdArgs)
+	sshCmd := cfg.transport.remoteCmd(cfg, bashCmdArgs)
 	return sshCmd, nil
 }
 
+// Return the git clean arguments that spare sync.excludePaths on the remote.
+func excludeArgs(cfg *config) []string {
+	excludePaths := make([]string, 0, len(cfg.excludePaths))
+	for _, xp := range cfg.excludePaths {
+		excludePaths = append(excludePaths, "--exclude="+xp)
+	}
+	return excludePaths
+}
+
+func remoteCleanPreview(cfg *config, cleanArgs []string) ([]string, error) {
+	bashCmdArgs := []string{cfg.gitRemotePath, "-C", gitapi.BashQuote(cfg.remoteDir())[0], "clean", "-nd" + cfg.remoteCleanFlag()}
+	bashCmdArgs = append(bashCmdArgs, cleanArgs...)
+	out, err := cfg.transport.remoteCmd(cfg, bashCmdArgs).Output()
+	if err != nil {
+		return nil, err
+	}
+	fnames := make([]string, 0, 64)
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if fname := strings.TrimPrefix(line, "Would remove "); fname != line {
+			fnames = append(fnames, fname)
+		}
+	}
+	return fnames, nil
+}
+
+// Return the sync.excludePaths patterns that match nothing in the local
+// workdir. These are likely typos that leave remote data unprotected.
+func unmatchedLocalExcludes(cfg *config, workdir string) ([]string, error) {
+	unmatched := make([]string, 0, len(cfg.excludePaths))
+	for _, xp := range cfg.excludePaths {
+		fnames, err := gitapi.GetUntrackedMatching(workdir, xp)
+		if err != nil {
+			return nil, err
+		}
+		if len(fnames) == 0 {
+			unmatched = append(unmatched, xp)
+		}
+	}
+	return unmatched, nil
+}
+
+// Return the sync.excludePaths patterns that match nothing in the remote
+// workdir, checked with a single remote command.
+func unmatchedRemoteExcludes(cfg *config) ([]string, error) {
+	if len(cfg.excludePaths) == 0 {
+		return nil, nil
+	}
+	gitCmd := cfg.gitRemotePath + " -C " + gitapi.BashQuote(cfg.remoteDir())[0]
+	script := make([]string, 0, len(cfg.excludePaths))
+	for _, xp := range cfg.excludePaths {
+		qxp := gitapi.BashQuote(xp)[0]
+		script = append(script, "if [[ -z $("+gitCmd+" ls-files --others --ignored --directory --exclude="+qxp+" | head -n 1) ]]; then echo "+qxp+"; fi;")
+	}
+	out, err := cfg.transport.remoteCmd(cfg, script).Output()
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := strings.TrimSpace(string(out)); trimmed != "" {
+		return strings.Split(trimmed, "\n"), nil
+	}
+	return nil, nil
+}
+
+// Warn about exclude patterns that match nothing before a clean can remove
+// data they were meant to protect. This costs extra git calls, so it only
+// runs when sync.checkExcludes is set and a remote clean is about to happen.
+func warnUnmatchedExcludes(cfg *config, workdir string) {
+	var unmatched []string
+	var err error
+	switch cfg.checkExcludes {
+	case checkExcludesLocal:
+		unmatched, err = unmatchedLocalExcludes(cfg, workdir)
+	case checkExcludesRemote:
+		unmatched, err = unmatchedRemoteExcludes(cfg)
+	default:
+		return
+	}
+	if err != nil {
+		log.Warningf("unable to check sync.excludePaths: %s", err)
+		return
+	}
+	for _, xp := range unmatched {
+		log.Warningf("sync.excludePaths pattern %q matches nothing in the %s workdir", xp, cfg.checkExcludes)
+	}
+}
+
+// Preview the remote clean against the real remote tree. Return the paths a
+// full sync would remove and the paths sync.excludePaths spares.
+func explainExcludes(cfg *config) (removedFiles []string, sparedFiles []string, err error) {
+	if err := cfg.requireRemoteGit("explain-excludes"); err != nil {
+		return nil, nil, err
+	}
+	removedFiles, err = remoteCleanPreview(cfg, excludeArgs(cfg))
+	if err != nil {
+		return nil, nil, err
+	}
+	allFiles, err := remoteCleanPreview(cfg, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	removedSet := make(map[string]bool, len(removedFiles))
+	for _, fname := range removedFiles {
+		removedSet[fname] = true
+	}
+	for _, fname := range allFiles {
+		if !removedSet[fname] {
+			sparedFiles = append(sparedFiles, fname)
+		}
+	}
+	return removedFiles, sparedFiles, nil
+}
+
+// Return the remote files changed behind git-sync's back. Every push stages
+// what it sends, so on an untampered remote the working tree matches the
+// index. Anything else, an unstaged change or an untracked file that is
+// neither ignored nor spared by sync.excludePaths, was made on the remote and
+// would be clobbered by the next push. With sync.remoteCleanFlags=-X the
+// reset leaves untracked files alone, so only unstaged changes count.
+func remoteDirtyFiles(cfg *config) ([]string, error) {
+	gitCmd := cfg.gitRemotePath + " -C " + gitapi.BashQuote(cfg.remoteDir())[0]
+	script := []string{gitCmd, "diff", "-z", "--no-renames", "--name-only"}
+	if cfg.remoteCleanFlags != remoteCleanIgnored {
+		script = append(script, "&&", gitCmd, "ls-files", "-z", "--others", "--exclude-standard")
+		for _, xp := range cfg.excludePaths {
+			script = append(script, "--exclude="+gitapi.BashQuote(xp)[0])
+		}
+	}
+	out, err := outputWithRetry(cfg, sshTransportExitCodes, func() (*gitapi.Cmd, error) {
+		return cfg.transport.remoteCmd(cfg, script), nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(remoteResetError(cfg, err), "unable to check the remote workdir for changes")
+	}
+	dirtyFiles := gitapi.SplitNullTerminated(string(out))
+	sort.Strings(dirtyFiles)
+	return dirtyFiles, nil
+}
+
+// With sync.detectRemoteDirty, refuse to push over changes made directly in
+// the remote workdir, unless forced.
+func checkRemoteDirty(cfg *config) error {
+	if !cfg.detectRemoteDirty {
+		return nil
+	}
+	if cfg.force {
+		log.Infof("-force set, not checking %s for remote changes", cfg.remoteName)
+		return nil
+	}
+	dirtyFiles, err := remoteDirtyFiles(cfg)
+	if err != nil {
+		return err
+	}
+	if len(dirtyFiles) == 0 {
+		return nil
+	}
+	return errors.Errorf("remote workdir %s has %d changes not made by git-sync, pull or discard them, or push with -force to clobber them:\n  %s",
+		cfg.remoteURL, len(dirtyFiles), strings.Join(dirtyFiles, "\n  "))
+}
+
+// Refuse to push a workdir in the middle of a merge, rebase or the like,
+// since the remote would get its conflicted files, unless forced.
+func checkOperationInProgress(cfg *config, workdir string) error {
+	operation, err := gitapi.RepoOperationInProgress(workdir)
+	if err != nil {
+		return err
+	}
+	if operation == "" {
+		return nil
+	}
+	if cfg.force {
+		log.Warningf("-force set, pushing %s in the middle of a git %s", workdir, operation)
+		return nil
+	}
+	return errors.Errorf("git %s in progress in %s, finish or abort it first, or push with -force", operation, workdir)
+}
+
+// Split the files to push into those to send and those deleted locally, for
+// sync.explicitDeletes. A path is deleted if it or one of its parents is
+// gone, see isMissingPath.
+func splitDeletedFiles(workdir string, filePaths []string) (sendFiles []string, deletedFiles []string) {
+	sendFiles = make([]string, 0, len(filePaths))
+	for _, fname := range filePaths {
+		if _, err := os.Lstat(path.Join(workdir, fname)); isMissingPath(err) {
+			deletedFiles = append(deletedFiles, fname)
+		} else {
+			sendFiles = append(sendFiles, fname)
+		}
+	}
+	return sendFiles, deletedFiles
+}
+
+// Return the command that removes files deleted locally from the remote
+// workdir and its index, for sync.explicitDeletes. Each path is removed as
+// named, so unlike the rsync manifest, see pushManifest, there is no need to
+// find the topmost missing directory. git rm also removes the directories it
+// leaves empty; those left by untracked files go at the next remote clean.
+func remoteDeleteCmd(cfg *config, deletedFiles []string) *gitapi.Cmd {
+	remoteDir := gitapi.BashQuote(cfg.remoteDir())[0]
+	quotedFiles := gitapi.BashQuote(deletedFiles...)
+	bashCmdArgs := make([]string, 0, 2*len(deletedFiles)+16)
+	bashCmdArgs = append(bashCmdArgs, cfg.gitRemotePath, "--literal-pathspecs", "-C", remoteDir, "rm", "-r", "-q", "-f", "--ignore-unmatch", "--")
+	bashCmdArgs = append(bashCmdArgs, quotedFiles...)
+	// Untracked files are left alone by git rm.
+	bashCmdArgs = append(bashCmdArgs, "&&", "cd", remoteDir, "&&", "rm", "-rf", "--")
+	bashCmdArgs = append(bashCmdArgs, quotedFiles...)
+	return cfg.transport.remoteCmd(cfg, bashCmdArgs)
+}
+
+// The ref sync.tagRemote keeps on the remote.
+const remoteTagRef = "refs/git-sync/last"
+
+// Point remoteTagRef on the remote at the merge base it is checked out at,
+// for sync.tagRemote. The ref's reflog names the local HEAD of each push, so
+// git reflog there shows what was pushed when.
+func remoteTagCmd(cfg *config, sc *syncCookie) *gitapi.Cmd {
+	msg := "git-sync push of " + sc.headHash
+	bashCmdArgs := []string{cfg.gitRemotePath, "-C", gitapi.BashQuote(cfg.remoteDir())[0],
+		"update-ref", "--create-reflog", "-m", gitapi.BashQuote(msg)[0], remoteTagRef, sc.mergeBaseHash}
+	return cfg.transport.remoteCmd(cfg, bashCmdArgs)
+}
+
 func sshStageRemoteChangesCmd(cfg *config, changedFiles []string) (*gitapi.Cmd, error) {
 	bashCmdArgs := make([]string, 0, 16)
 	bashCmdArgs = append(bashCmdArgs, cfg.gitRemotePath, "-C", cfg.remoteDir(), "add", "$(")
 	bashCmdArgs = append(bashCmdArgs, cfg.gitRemotePath, "-C", cfg.remoteDir(), "ls-files", "-c", "-o")
 	bashCmdArgs = append(bashCmdArgs, changedFiles...)
 	bashCmdArgs = append(bashCmdArgs, ")")
-	sshCmd := makeSSHCmd(cfg, cfg.remoteSSHAddr(), bashCmdArgs)
+	sshCmd := cfg.transport.remoteCmd(cfg, bashCmdArgs)
 	return sshCmd, nil
 }
 
+// Find the changes to push when fsmonitor can't be used. A mirror can't be
+// reset when the git state changed, so every file it may lack is listed
+// instead.
+func getChangesViaGit(cfg *config, workdir string, sc *syncCookie) ([]string, error) {
+	if sc.gitStateChanged() && !cfg.runsRemoteGit() {
+		return getMirrorChanges(workdir, sc)
+	}
+	return getChangesViaStatus(workdir, sc, cfg.changeSource)
+}
+
+// List all tracked files and the untracked ones that aren't ignored, plus
+// the files changed by the commits since the last sync so those deleted are
+// removed from the mirror too. rsync -c skips any whose content already
+// matches, but still has to checksum them all.
+func getMirrorChanges(workdir string, sc *syncCookie) ([]string, error) {
+	defer log.Tracef("perf: {{.traceDurationStr}} changes via ls-files", map[string]interface{}{}).Finish()
+	trackedFiles, err := gitapi.GetGitTrackedFiles(workdir)
+	if err != nil {
+		return nil, err
+	}
+	untrackedFiles, err := gitapi.GetGitUntrackedFiles(workdir)
+	if err != nil {
+		return nil, err
+	}
+	fileSet := make(map[string]bool, len(trackedFiles)+len(untrackedFiles))
+	for _, fname := range append(trackedFiles, untrackedFiles...) {
+		fileSet[fname] = true
+	}
+	if sc.LastHeadHash != "" && !sc.remoteChanged() && sc.LastHeadHash != sc.headHash {
+		rangeFiles, err := gitapi.GetGitRangeChanges(workdir, sc.LastHeadHash, sc.headHash)
+		if err != nil {
+			// The last synced commit may be gone after a gc.
+			log.Warningf("unable to find files changed since %s, deletions will not be mirrored: %s", sc.LastHeadHash, err)
+		}
+		for _, fname := range rangeFiles {
+			fileSet[fname] = true
+		}
+	}
+	changedFiles := stringSet2Slice(fileSet)
+	sort.Strings(changedFiles)
+	return changedFiles, nil
+}
+
 // Use git to find all files that have changed on top of the git merge base.
-func getChangesViaStatus(workdir string, sc *syncCookie) (changedFiles []string, err error) {
+// The changeSource selects which of git status and git diff are consulted.
+func getChangesViaStatus(workdir string, sc *syncCookie, changeSource string) (changedFiles []string, err error) {
+	defer log.Tracef("perf: {{.traceDurationStr}} changes via {{.changeSource}}", map[string]interface{}{"changeSource": changeSource}).Finish()
 	fileSet := make(map[string]bool)
 	mu := &sync.Mutex{}
 	updateSet := func(fnames []string) {
@@ -285,8 +819,12 @@ func getChangesViaStatus(workdir string, sc *syncCookie) (changedFiles []string,
 		return nil
 	}
 	eg := &errgroup.Group{}
-	eg.Go(x)
-	eg.Go(y)
+	if changeSource != changeSourceDiff {
+		eg.Go(x)
+	}
+	if changeSource != changeSourceStatus {
+		eg.Go(y)
+	}
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
@@ -298,39 +836,71 @@ func getChangesViaStatus(workdir string, sc *syncCookie) (changedFiles []string,
 	return changedFiles, nil
 }
 
+// Fetch origin on the remote so that a later reset rarely has to.
+// By default this runs in the background and is skipped if another fetch
+// holds the lock. With sync.foregroundFetch the command waits for the lock
+// and the fetch, and reports a failure on stderr.
 func remoteGitFetchCmd(cfg *config, workdir string) (*gitapi.Cmd, error) {
-	shCmd := "flock --nonblock {{.RemoteDir}}/.git/FETCH_HEAD {{.GitRemotePath}} -C {{.RemoteDir}} fetch -q origin master < /dev/null > /dev/null 2>&1 &"
+	shCmd := "flock --nonblock {{.RemoteDir}}/.git/FETCH_HEAD {{.GitRemotePath}} -C {{.RemoteDir}} fetch -q origin {{.UpstreamBranch}} < /dev/null > /dev/null 2>&1 &"
+	if cfg.foregroundFetch {
+		shCmd = "flock {{.RemoteDir}}/.git/FETCH_HEAD {{.GitRemotePath}} -C {{.RemoteDir}} fetch -q origin {{.UpstreamBranch}} < /dev/null > /dev/null"
+	}
 	tmpl := template.Must(template.New("remoteGitFetchCmd").Parse(shCmd)).Option("missingkey=error")
 	shCmdFmt := struct {
-		RemoteDir     string
-		GitRemotePath string
-	}{gitapi.BashQuote(cfg.remoteDir())[0], cfg.gitRemotePath}
+		RemoteDir      string
+		GitRemotePath  string
+		UpstreamBranch string
+	}{gitapi.BashQuote(cfg.remoteDir())[0], cfg.gitRemotePath, gitapi.BashQuote(cfg.upstreamBranch)[0]}
 	buf := bytes.NewBuffer(make([]byte, 0, 1024))
 	if err := tmpl.Execute(buf, shCmdFmt); err != nil {
 		return nil, err
 	}
-	cmd := makeSSHCmd(cfg, cfg.remoteSSHAddr(), []string{buf.String()})
+	cmd := cfg.transport.remoteCmd(cfg, []string{buf.String()})
 	return cmd, nil
 }
 
+// Return true if a path is gone, either removed outright or shadowed by a
+// parent that is no longer a directory.
+func isMissingPath(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+// Return the topmost component of fname that is missing below the workdir.
+// A component that is now a file where fname expects a directory is returned
+// as is, so the file is sent and the remote directory is replaced.
 func topmostMissingDir(workdir string, fname string) (string, error) {
 	dir := workdir
 	names := strings.Split(strings.Trim(fname, "/"), "/")
-	for _, name := range names {
+	for i, name := range names {
 		dir = path.Join(dir, name)
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			// rsync wants relative paths.  We also append / to conform with
-			// rsync's convention for directory names.
-			relPath, err := filepath.Rel(workdir, dir)
-			if err != nil {
-				return "", err
-			}
+		fi, err := os.Stat(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		// rsync wants relative paths.
+		relPath, relErr := filepath.Rel(workdir, dir)
+		if relErr != nil {
+			return "", relErr
+		}
+		if os.IsNotExist(err) {
+			// Append / to conform with rsync's convention for directory names.
 			return relPath + "/", nil
 		}
+		if !fi.IsDir() && i < len(names)-1 {
+			return relPath, nil
+		}
 	}
-	// This is probably only possible during file system races where something
-	// is modifying the directory structure while we are trying to sync it.
-	panic("not missing components for path")
+	// Every component exists, most likely because a file was replaced by a
+	// directory of the same name while we were looking. Sending the path
+	// itself transfers whatever is there now.
+	log.Infof("no missing components for path %s", fname)
+	return strings.Trim(fname, "/"), nil
 }
 
 func tmpdir() string {
@@ -341,15 +911,16 @@ func tmpdir() string {
 	return dir
 }
 
-func rsyncPushCmd(cfg *config, workdir string, filePaths []string) (*gitapi.Cmd, error) {
-	// Replace file paths that are children of deleted directories with the top-most deleted
-	// directory below the workdir.  It's not clear that this is always safe behavior for rsync,
-	// but it should be safe for our use case.  This is related to an rsync bug, but the patch
-	// attached to the report does not look correct.
-	// See https://bugzilla.samba.org/show_bug.cgi?id=12569.
+// Return the sorted paths to push for filePaths. Replace file paths that are
+// children of deleted directories with the top-most deleted directory below
+// the workdir.  It's not clear that this is always safe behavior for rsync,
+// but it should be safe for our use case.  This is related to an rsync bug,
+// but the patch attached to the report does not look correct.
+// See https://bugzilla.samba.org/show_bug.cgi?id=12569.
+func pushManifest(workdir string, filePaths []string) ([]string, error) {
 	sanitizedFileSet := make(map[string]bool)
 	for _, fpath := range filePaths {
-		if _, err := os.Stat(path.Join(workdir, fpath)); os.IsNotExist(err) {
+		if _, err := os.Stat(path.Join(workdir, fpath)); isMissingPath(err) {
 			fpath, err = topmostMissingDir(workdir, fpath)
 			if err != nil {
 				return nil, err
@@ -359,6 +930,23 @@ func rsyncPushCmd(cfg *config, workdir string, filePaths []string) (*gitapi.Cmd,
 	}
 	sanitizedFilePaths := stringSet2Slice(sanitizedFileSet)
 	sort.Strings(sanitizedFilePaths)
+	return sanitizedFilePaths, nil
+}
+
+func rsyncPushCmd(cfg *config, workdir string, filePaths []string) (*gitapi.Cmd, error) {
+	rsyncCmdArgs, err := rsyncPushArgs(cfg, workdir, filePaths)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.transport.rsyncCmd(cfg, rsyncCmdArgs), nil
+}
+
+// Return the rsync arguments that push filePaths from workdir to the remote.
+func rsyncPushArgs(cfg *config, workdir string, filePaths []string) ([]string, error) {
+	sanitizedFilePaths, err := pushManifest(workdir, filePaths)
+	if err != nil {
+		return nil, err
+	}
 
 	tmpFile, err := ioutil.TempFile(tmpdir(), "git-sync-file-manifest-")
 	if err != nil {
@@ -368,30 +956,56 @@ func rsyncPushCmd(cfg *config, workdir string, filePaths []string) (*gitapi.Cmd,
 		_ = os.Remove(tmpFile.Name())
 	})
 
-	_, err = tmpFile.WriteString(gitapi.JoinNullTerminated(sanitizedFilePaths))
+	manifest := gitapi.JoinNullTerminated(sanitizedFilePaths)
+	gitapi.RecordArtifact("push-manifest", []byte(manifest))
+	_, err = tmpFile.WriteString(manifest)
 	if err != nil {
 		return nil, err
 	}
 
-	sshArgs := []string{"ssh"}
-	sshArgs = append(sshArgs, gitapi.BashQuote(makeSSHArgs(cfg, "", nil)...)...)
 	rsyncCmdArgs := []string{
-		"-czlptgo",
-		"-e", strings.Join(sshArgs, " "),
+		rsyncShortFlags(cfg),
 		"--delete-missing-args",
 		// Sanitized files can be non-empty directories on the remote side.
 		"--force",
 		"--from0",
 		"--files-from", tmpFile.Name(),
 	}
-	if cfg.rsyncRemotePath != "" {
-		rsyncCmdArgs = append(rsyncCmdArgs, "--rsync-path", cfg.rsyncRemotePath)
+	rsyncCmdArgs = append(rsyncCmdArgs, rsyncRemotePathArgs(cfg)...)
+	rsyncCmdArgs = append(rsyncCmdArgs, rsyncTuningArgs(cfg)...)
+	rsyncCmdArgs = append(rsyncCmdArgs, workdir, cfg.rsyncRemoteURL())
+	return rsyncCmdArgs, nil
+}
+
+// Return the short flags shared by pushes and pulls: checksum, links,
+// permissions, times, group and owner, plus compression if enabled.
+func rsyncShortFlags(cfg *config) string {
+	flags := "-c"
+	if cfg.rsyncCompress {
+		flags += "z"
 	}
-	rsyncCmdArgs = append(rsyncCmdArgs, workdir, cfg.remoteURL)
+	return flags + "lptgo"
+}
 
-	cmd := gitapi.Command(cfg.rsyncLocalPath, rsyncCmdArgs...)
-	cmd.Env = gitapi.GetRestrictedEnv()
-	return cmd, nil
+// Return the option naming the remote rsync binary. A daemon runs its own
+// rsync, so it gets none.
+func rsyncRemotePathArgs(cfg *config) []string {
+	if cfg.rsyncRemotePath == "" || cfg.isDaemon() {
+		return nil
+	}
+	return []string{"--rsync-path", cfg.rsyncRemotePath}
+}
+
+// Return the long options that tune transfer speed.
+func rsyncTuningArgs(cfg *config) []string {
+	args := []string{}
+	if cfg.rsyncCompress && cfg.rsyncCompressLevel > 0 {
+		args = append(args, "--compress-level="+strconv.Itoa(cfg.rsyncCompressLevel))
+	}
+	if cfg.rsyncBandwidthLimit > 0 {
+		args = append(args, "--bwlimit="+strconv.Itoa(cfg.rsyncBandwidthLimit))
+	}
+	return args
 }
 
 func rsyncPullCmd(cfg *config, workdir string, filePaths []string) (*gitapi.Cmd, error) {
@@ -415,138 +1029,722 @@ func rsyncPullCmd(cfg *config, workdir string, filePaths []string) (*gitapi.Cmd,
 		_ = os.Remove(tmpFile.Name())
 	})
 
-	_, err = tmpFile.WriteString(gitapi.JoinNullTerminated(sanitizedFilePaths))
+	manifest := gitapi.JoinNullTerminated(sanitizedFilePaths)
+	gitapi.RecordArtifact("pull-manifest", []byte(manifest))
+	_, err = tmpFile.WriteString(manifest)
 	if err != nil {
 		return nil, err
 	}
 
-	sshArgs := []string{"ssh"}
-	sshArgs = append(sshArgs, gitapi.BashQuote(makeSSHArgs(cfg, "", nil)...)...)
 	rsyncCmdArgs := []string{
-		"-czlptgo",
-		"-e", strings.Join(sshArgs, " "),
+		rsyncShortFlags(cfg),
 		"--delete-missing-args",
 		"--from0",
 		"--files-from", tmpFile.Name(),
 	}
-	if cfg.rsyncRemotePath != "" {
-		rsyncCmdArgs = append(rsyncCmdArgs, "--rsync-path", cfg.rsyncRemotePath)
+	rsyncCmdArgs = append(rsyncCmdArgs, rsyncRemotePathArgs(cfg)...)
+	rsyncCmdArgs = append(rsyncCmdArgs, rsyncTuningArgs(cfg)...)
+	rsyncCmdArgs = append(rsyncCmdArgs, cfg.rsyncRemoteURL(), workdir)
+
+	return cfg.transport.rsyncCmd(cfg, rsyncCmdArgs), nil
+}
+
+// Phases of a push, as timed by phaseTimes.
+const (
+	phaseChanges = "changes"
+	phaseFetch   = "fetch"
+	phaseReset   = "reset"
+	phaseDelete  = "delete"
+	phaseRsync   = "rsync"
+	phaseStage   = "stage"
+	phaseTag     = "tag"
+)
+
+// Accumulate wall-clock durations for the phases of a sync. Phases may
+// overlap and be timed from different goroutines.
+type phaseTimes struct {
+	mu        sync.Mutex
+	durations map[string]time.Duration
+}
+
+func newPhaseTimes() *phaseTimes {
+	return &phaseTimes{durations: make(map[string]time.Duration)}
+}
+
+// Start timing a phase. Call the returned function when the phase ends.
+func (pt *phaseTimes) start(phase string) func() {
+	start := time.Now()
+	return func() {
+		pt.mu.Lock()
+		pt.durations[phase] += time.Since(start)
+		pt.mu.Unlock()
 	}
-	rsyncCmdArgs = append(rsyncCmdArgs, cfg.remoteURL, workdir)
+}
 
-	cmd := gitapi.Command(cfg.rsyncLocalPath, rsyncCmdArgs...)
-	cmd.Env = gitapi.GetRestrictedEnv()
-	return cmd, nil
+// The outcome of a push, for callers that want more than the changed files.
+type SyncResult struct {
+	// All files changed locally. A subset may have been sent if the remote was
+	// reset and some files already matched.
+	ChangedFiles  []string
+	UsedFsMonitor bool
+	// Whether the remote was checked out and cleaned, rather than only sent files.
+	DidCheckout bool
+	DidClean    bool
+	// The speculative background fetch is best effort, so its failure is only
+	// reported here.
+	RemoteFetchError error
+	// Wall-clock time spent in each phase: changes, fetch, reset, delete,
+	// rsync, stage and tag.
+	Durations map[string]time.Duration
+	// Changed files that were not sent, sorted by path.
+	SkippedFiles []SkippedFile
 }
 
 // A full sync means resetting the remote workdir to the last shared
 // commit and rsyncing any subsequent local commits and local
 // modifications.
-func fullSync(cfg *config, workdir string) (changedFiles []string, err error) {
+func fullSync(cfg *config, workdir string) (*SyncResult, error) {
+	if cfg.dryRun {
+		return dryRunSync(cfg, workdir)
+	}
+	if err := cfg.checkRemoteDirAllowed(); err != nil {
+		return nil, err
+	}
 	// Use a lock file to guard against git races on the remote side.
-	flock, err := flock.Open(path.Join(workdir, ".git/git-sync.mutex"))
+	flock, err := flock.Open(syncLockPath(workdir, cfg.remoteName))
 	if err != nil {
 		return nil, err
 	}
 	defer flock.Close()
 
-	sc, err := readSyncCookie(workdir)
+	return fullSyncLocked(cfg, workdir)
+}
+
+// Print the commands fullSync would run without running them. Only local,
+// read-only git commands run, and the sync cookie is read but not written.
+func dryRunSync(cfg *config, workdir string) (*SyncResult, error) {
+	plan, err := planPush(cfg, workdir)
 	if err != nil {
 		return nil, err
 	}
-	foundResults := false
-	if !sc.gitStateChanged() && cfg.fsmonitorEnabled() {
-		// If the git state changed, we cannot rely on the fast list of changes
-		// because the remote mirror working directory will need its state reset.
-		changedFiles, err = getChangesViaFsMonitor(cfg, workdir, sc)
-		if err != nil {
-			log.Warningf("git fsmonitor failed to return results: %s", err)
-		} else {
-			foundResults = true
-		}
+	printPushPlan(cfg, plan)
+	return &SyncResult{ChangedFiles: plan.status.changedFiles, Durations: map[string]time.Duration{}}, nil
+}
+
+// The body of fullSync, for callers already holding the sync lock.
+func fullSyncLocked(cfg *config, workdir string) (*SyncResult, error) {
+	pt := newPhaseTimes()
+	result := &SyncResult{Durations: pt.durations}
+	var changedFiles []string
+	skipped := &skipList{}
+	sc, err := readSyncCookie(cfg, workdir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOperationInProgress(cfg, workdir); err != nil {
+		return nil, err
+	}
+	if err := checkRemoteDirty(cfg); err != nil {
+		return nil, err
+	}
+	if sc.remoteChanged() && sc.LastRemoteURL != "" {
+		log.Infof("last sync was to %s (%s), forcing a full sync", sc.LastRemoteName, sc.LastRemoteURL)
+	}
+	// A mirror is never reset or staged, see getChangesViaGit.
+	canReset := cfg.runsRemoteGit()
+	if sc.gitStateChanged() && canReset {
+		warnUnmatchedExcludes(cfg, workdir)
+	}
+	foundResults := false
+	// The files actually shipped, which may be a subset of changedFiles.
+	var transferFiles []string
+	if !sc.gitStateChanged() && cfg.fsmonitorEnabled() {
+		// If the git state changed, we cannot rely on the fast list of changes
+		// because the remote mirror working directory will need its state reset.
+		endPhase := pt.start(phaseChanges)
+		changedFiles, err = getChangesViaFsMonitor(cfg, workdir, sc, skipped)
+		endPhase()
+		if err != nil {
+			if err != errFsMonitorNoList {
+				log.Warningf("git fsmonitor failed to return results: %s", err)
+			}
+			// git finds the changes instead, through its own filters.
+			skipped.files = nil
+		} else {
+			foundResults = true
+			result.UsedFsMonitor = true
+			transferFiles = changedFiles
+			gitapi.RecordArtifact("changed-files", []byte(gitapi.JoinNullTerminated(changedFiles)))
+			if err := runPreflightCmd(cfg, workdir, filterPathspecs(cfg.pathspecs, changedFiles)); err != nil {
+				return nil, err
+			}
+		}
 	}
 	bgGroup := &errgroup.Group{}
-	if len(changedFiles) > 0 {
+	if len(changedFiles) > 0 && canReset {
 		// If we are going to ship some files, do a speculative fetch to
 		// improve performance.
 		cmd, err := remoteGitFetchCmd(cfg, workdir)
 		if err != nil {
 			return nil, err
 		}
-		bgGroup.Go(func() error {
+		if cfg.foregroundFetch {
+			endPhase := pt.start(phaseFetch)
 			_, err := cmd.Output()
-			return err
-		})
+			endPhase()
+			if err != nil {
+				return nil, errors.Wrapf(remoteResetError(cfg, err), "remote fetch of origin %s failed", cfg.upstreamBranch)
+			}
+		} else {
+			bgGroup.Go(func() error {
+				_, err := cmd.Output()
+				return err
+			})
+		}
 	}
 
+	// Wait for the remote reset, if one was started.
+	waitReset := func() error { return nil }
 	if !foundResults {
 		// This is hiding the implementation of sync for peformance.
-		syncCmd, err := gitSyncCmd(cfg, sc)
-		if err != nil {
-			return nil, err
+		syncErr := make(chan error, 1)
+		startReset := func() {
+			if !canReset {
+				syncErr <- nil
+				return
+			}
+			go func() {
+				endPhase := pt.start(phaseReset)
+				_, err := outputWithRetry(cfg, sshTransportExitCodes, func() (*gitapi.Cmd, error) {
+					return gitSyncCmd(cfg, sc, false)
+				})
+				endPhase()
+				syncErr <- err
+			}()
+		}
+		// A failed preflight must leave the remote untouched, so the reset
+		// can't overlap finding changes when there is one.
+		if cfg.preflightCmd == "" {
+			startReset()
 		}
 
-		syncErr := make(chan error)
-		go func() {
-			_, err := syncCmd.Output()
-			syncErr <- err
-		}()
-
-		changedFiles, err = getChangesViaStatus(workdir, sc)
+		endPhase := pt.start(phaseChanges)
+		changedFiles, err = getChangesViaGit(cfg, workdir, sc)
+		endPhase()
 		if err != nil {
 			// At this point if we are unable to get changes, it's fatal.
 			return nil, err
 		}
+		transferFiles = changedFiles
+		gitapi.RecordArtifact("changed-files", []byte(gitapi.JoinNullTerminated(changedFiles)))
+		if cfg.preflightCmd != "" {
+			if err := runPreflightCmd(cfg, workdir, filterPathspecs(cfg.pathspecs, changedFiles)); err != nil {
+				return nil, err
+			}
+			startReset()
+		}
+		if sc.gitStateChanged() && cfg.skipUnchangedOnReset && canReset {
+			// Overlap the hashing with the remote reset.
+			transferFiles, err = dropUnchangedFiles(workdir, sc.mergeBaseHash, changedFiles)
+			if err != nil {
+				log.Warningf("unable to filter unchanged files: %s", err)
+				transferFiles = changedFiles
+			}
+			skipped.addDropped(changedFiles, transferFiles, skipReasonUnchanged)
+		}
 
-		if err = <-syncErr; err != nil {
-			if rc, rcErr := gitapi.ExitStatus(err); rcErr == nil && rc == 255 {
-				// SSH transport errors are common enough to need handling.
-				return nil, errors.Errorf("ssh unable to connect to host %s", cfg.remoteSSHAddr())
+		waitReset = func() error {
+			if err := <-syncErr; err != nil {
+				return remoteResetError(cfg, err)
 			}
-			return nil, err
+			result.DidCheckout = sc.gitStateChanged() && canReset
+			result.DidClean = sc.gitStateChanged() && canReset
+			return nil
 		}
 	}
 
-	if len(changedFiles) > 0 {
-		cmd, err := rsyncPushCmd(cfg, workdir, changedFiles)
-		if err == nil {
-			_, err = cmd.Output()
+	// The remote steps are strictly ordered: the reset must finish before
+	// rsync or its checkout would overwrite pushed files, and staging must
+	// follow rsync since ls-files -o only sees files once they exist and
+	// git add hashes their new content. What can overlap the reset is the
+	// local work of building the manifest, which stats every file.
+	if len(cfg.pathspecs) > 0 {
+		changedFiles = filterPathspecs(cfg.pathspecs, changedFiles)
+		filteredFiles := filterPathspecs(cfg.pathspecs, transferFiles)
+		skipped.addDropped(transferFiles, filteredFiles, skipReasonPathspec)
+		transferFiles = filteredFiles
+	}
+	filteredFiles := dropSubmodules(workdir, transferFiles)
+	skipped.addDropped(transferFiles, filteredFiles, skipReasonSubmodule)
+	transferFiles = filteredFiles
+	sort.Slice(skipped.files, func(i, j int) bool { return skipped.files[i].Path < skipped.files[j].Path })
+	result.SkippedFiles = skipped.files
+	// With sync.explicitDeletes rsync only sends the files that exist.
+	sendFiles, deletedFiles := transferFiles, []string(nil)
+	if cfg.explicitDeletes && canReset {
+		sendFiles, deletedFiles = splitDeletedFiles(workdir, transferFiles)
+	}
+	var rsyncArgs []string
+	if len(sendFiles) > 0 {
+		// The manifest is reused if the push is retried.
+		rsyncArgs, err = rsyncPushArgs(cfg, workdir, sendFiles)
+		if err != nil {
+			return nil, err
 		}
+	}
+	if err := waitReset(); err != nil {
+		return nil, err
+	}
+	// Deleting first lets rsync put a file where a deleted directory was.
+	if len(deletedFiles) > 0 {
+		endPhase := pt.start(phaseDelete)
+		_, err := outputWithRetry(cfg, sshTransportExitCodes, func() (*gitapi.Cmd, error) {
+			return remoteDeleteCmd(cfg, deletedFiles), nil
+		})
+		endPhase()
+		if err != nil {
+			return nil, errors.Wrap(remoteResetError(cfg, err), "unable to delete files on the remote")
+		}
+	}
+	if len(sendFiles) > 0 {
+		endPhase := pt.start(phaseRsync)
+		err := rsyncPush(cfg, rsyncArgs, sendFiles)
+		endPhase()
 		if err != nil {
 			return nil, err
 		}
-		cmd, err = sshStageRemoteChangesCmd(cfg, changedFiles)
+	}
+	// git rm already staged the deletions.
+	if len(sendFiles) > 0 && canReset {
+		endPhase := pt.start(phaseStage)
+		cmd, err := sshStageRemoteChangesCmd(cfg, sendFiles)
 		if err == nil {
 			_, err = cmd.Output()
 		}
+		endPhase()
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// Only update the sync cookie if we actually sent some changes.
-	updateSyncCookie := (len(changedFiles) > 0 || sc.gitStateChanged())
+	// Only update the sync cookie if we actually sent some changes. After a
+	// pathspec push the remote no longer mirrors the whole workdir, so the
+	// old cookie is kept and the next push sends everything changed since.
+	updateSyncCookie := (len(changedFiles) > 0 || sc.gitStateChanged()) && len(cfg.pathspecs) == 0
 	if updateSyncCookie {
 		if err := writeSyncCookie(workdir, sc); err != nil {
 			log.Warningf("failed to write sync cookie: %s", err)
 		}
 	}
+	// The files are already pushed, so a failure to tag only warns.
+	if updateSyncCookie && cfg.tagRemote && canReset {
+		endPhase := pt.start(phaseTag)
+		_, err := remoteTagCmd(cfg, sc).Output()
+		endPhase()
+		if err != nil {
+			log.Warningf("unable to update %s on remote %s: %s", remoteTagRef, cfg.remoteName, remoteResetError(cfg, err))
+		}
+	}
 	if err := bgGroup.Wait(); err != nil {
 		// If we scheduled a background fetch, just wait to prevent zombies.
 		// We don't care if there was an error.
 		log.Warningf("background remote fetch failed: %s", err)
+		result.RemoteFetchError = err
 	}
 
 	if len(changedFiles) > 0 {
-		NoisyPrintf("git-sync %d files\n", len(changedFiles))
-		log.Infof("file manifest %s", strings.Join(changedFiles, ", "))
+		NoisyPrintf("git-sync %d files\n", len(transferFiles))
+		for _, fname := range transferFiles {
+			VerbosePrintf("  %s\n", fname)
+		}
+		log.Infof("file manifest %s", strings.Join(transferFiles, ", "))
+	}
+	for _, sf := range result.SkippedFiles {
+		VerbosePrintf("  %s (skipped, %s)\n", sf.Path, sf.Reason)
 	}
 
 	// Return all changed files. This can be used to detect files
 	// that changed on remote back to the checked-in version.
+	result.ChangedFiles = changedFiles
+	return result, nil
+}
+
+// flock -w takes whole seconds. Round up so a sub-second timeout still waits
+// rather than failing at once like 0.
+func lockTimeoutSecs(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// The remote reset exits with this when sync.remoteLockPath stays locked
+// past sync.remoteLockTimeout.
+const remoteLockedExitCode = 252
+
+// An rsync batch shared by the remotes of a fan-out push with
+// sync.rsyncBatchMode. The first remote writes it while pushing and the rest
+// apply it, so the delta is only computed once.
+type rsyncBatch struct {
+	// The batch file. rsync also writes a script next to it, with a .sh
+	// suffix.
+	file string
+	// The files pushed when the batch was written, or nil before then.
+	files []string
+}
+
+func newRsyncBatch() (*rsyncBatch, error) {
+	f, err := ioutil.TempFile(tmpdir(), "git-sync-rsync-batch-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	atexit.Register(func() {
+		_ = os.Remove(f.Name())
+		_ = os.Remove(f.Name() + ".sh")
+	})
+	return &rsyncBatch{file: f.Name()}, nil
+}
+
+func (b *rsyncBatch) written() bool {
+	return b.files != nil
+}
+
+// Return the arguments that apply the batch to the remote. The rest of the
+// options were stored in the batch when it was written.
+func rsyncReadBatchArgs(cfg *config, b *rsyncBatch) []string {
+	args := []string{"--read-batch=" + b.file}
+	args = append(args, rsyncRemotePathArgs(cfg)...)
+	if cfg.rsyncBandwidthLimit > 0 {
+		args = append(args, "--bwlimit="+strconv.Itoa(cfg.rsyncBandwidthLimit))
+	}
+	return append(args, cfg.rsyncRemoteURL())
+}
+
+// Push transferFiles with rsyncArgs. With a batch from cfg.rsyncBatch, apply
+// it instead if it holds the same files, or write it if it is still empty.
+// A batch only applies cleanly to a remote that matched the first one before
+// the push, so if rsync rejects it the files are pushed normally.
+func rsyncPush(cfg *config, rsyncArgs []string, transferFiles []string) error {
+	b := cfg.rsyncBatch
+	if b != nil && b.written() {
+		if reflect.DeepEqual(b.files, transferFiles) {
+			_, err := outputWithRetry(cfg, rsyncTransportExitCodes, func() (*gitapi.Cmd, error) {
+				return cfg.transport.rsyncCmd(cfg, rsyncReadBatchArgs(cfg, b)), nil
+			})
+			if err == nil {
+				return nil
+			}
+			log.Warningf("unable to apply rsync batch to %s, pushing instead: %s", cfg.remoteName, err)
+		} else {
+			log.Infof("%s needs different files than the rsync batch, pushing instead", cfg.remoteName)
+		}
+		b = nil
+	}
+	if b != nil {
+		rsyncArgs = append([]string{"--write-batch=" + b.file}, rsyncArgs...)
+	}
+	_, err := outputWithRetry(cfg, rsyncTransportExitCodes, func() (*gitapi.Cmd, error) {
+		return cfg.transport.rsyncCmd(cfg, rsyncArgs), nil
+	})
+	if err == nil && b != nil {
+		b.files = transferFiles
+	}
+	return err
+}
+
+// ssh exits with 255 when it fails to reach the remote, as opposed to the
+// remote command failing.
+var sshTransportExitCodes = map[int]bool{255: true}
+
+// rsync exit codes for socket, protocol stream and timeout failures, along
+// with 255 passed through from a failed remote shell.
+var rsyncTransportExitCodes = map[int]bool{10: true, 12: true, 30: true, 35: true, 255: true}
+
+const retryInitialBackoff = 500 * time.Millisecond
+
+// Replaced in tests to avoid waiting.
+var retrySleep = time.Sleep
+
+// Run the command built by newCmd and return its output. If it fails with
+// one of transportExitCodes, build and run it again, up to sync.maxRetries
+// more times with exponential backoff. Commands are rebuilt since an
+// exec.Cmd can't be reused. Any other failure is returned immediately.
+func outputWithRetry(cfg *config, transportExitCodes map[int]bool, newCmd func() (*gitapi.Cmd, error)) ([]byte, error) {
+	backoff := retryInitialBackoff
+	for attempt := 0; ; attempt++ {
+		cmd, err := newCmd()
+		if err != nil {
+			return nil, err
+		}
+		out, err := cmd.Output()
+		if err == nil {
+			return out, nil
+		}
+		rc, rcErr := gitapi.ExitStatus(err)
+		if rcErr != nil || !transportExitCodes[rc] || attempt >= cfg.maxRetries {
+			return out, err
+		}
+		log.Warningf("%s failed with exit status %d, retrying in %s", path.Base(cmd.Args[0]), rc, backoff)
+		retrySleep(backoff)
+		backoff *= 2
+	}
+}
+
+// SSH transport errors are common enough to need handling.
+func remoteResetError(cfg *config, err error) error {
+	rc, rcErr := gitapi.ExitStatus(err)
+	if rcErr != nil {
+		return err
+	}
+	switch rc {
+	case 255:
+		return errors.Errorf("ssh unable to connect to host %s", cfg.remoteSSHAddr())
+	case remoteLockedExitCode:
+		return errors.Errorf("remote %s is locked by another git-sync, gave up after %s waiting on %s",
+			cfg.remoteName, cfg.remoteLockTimeout, cfg.remoteLockFile())
+	}
+	return err
+}
+
+// Reset the remote to the parent of a commit and apply only the changes made
+// in that commit. File content is taken from the commit itself, so neither
+// local modifications nor later commits are shipped. The remote then no
+// longer mirrors the local workdir, so the sync cookie is marked for a reset
+// and the next push does a full sync.
+func commitSync(cfg *config, workdir string, rev string) (changedFiles []string, err error) {
+	if err := cfg.requireRemoteGit("push -commit"); err != nil {
+		return nil, err
+	}
+	if err := cfg.checkRemoteDirAllowed(); err != nil {
+		return nil, err
+	}
+	flock, err := flock.Open(syncLockPath(workdir, cfg.remoteName))
+	if err != nil {
+		return nil, err
+	}
+	defer flock.Close()
+	if err := checkRemoteDirty(cfg); err != nil {
+		return nil, err
+	}
+
+	commitHash, err := gitapi.ResolveCommitHash(workdir, rev)
+	if err != nil {
+		return nil, err
+	}
+	parentHash, err := gitapi.ResolveCommitHash(workdir, commitHash+"^")
+	if err != nil {
+		return nil, err
+	}
+	commitFiles, err := gitapi.GetGitCommitChanges(workdir, commitHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// A cookie without history forces a checkout and clean, here of the parent.
+	sc := &syncCookie{mergeBaseHash: parentHash, remoteName: cfg.remoteName, remoteURL: cfg.remoteURL}
+	_, err = outputWithRetry(cfg, sshTransportExitCodes, func() (*gitapi.Cmd, error) {
+		return gitSyncCmd(cfg, sc, false)
+	})
+	if err != nil {
+		return nil, remoteResetError(cfg, err)
+	}
+
+	exportDir, err := ioutil.TempDir(tmpdir(), "git-sync-commit-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(exportDir)
+	entries, err := gitapi.GetTreeEntries(workdir, commitHash, commitFiles)
+	if err != nil {
+		return nil, err
+	}
+	exportFiles := make([]string, 0, len(commitFiles))
+	for _, fname := range commitFiles {
+		entry, ok := entries[fname]
+		if !ok {
+			// Deleted in this commit. Create the parent so only the file
+			// itself is removed on the remote, not its whole directory.
+			if err := os.MkdirAll(path.Join(exportDir, path.Dir(fname)), 0755); err != nil {
+				return nil, err
+			}
+		} else if entry.Type == "blob" {
+			exportFiles = append(exportFiles, fname)
+		} else {
+			// Submodule updates aren't synced.
+			continue
+		}
+		changedFiles = append(changedFiles, fname)
+	}
+	if err := gitapi.ExportFiles(workdir, commitHash, exportFiles, exportDir); err != nil {
+		return nil, err
+	}
+
+	if len(changedFiles) > 0 {
+		_, err := outputWithRetry(cfg, rsyncTransportExitCodes, func() (*gitapi.Cmd, error) {
+			return rsyncPushCmd(cfg, exportDir, changedFiles)
+		})
+		if err != nil {
+			return nil, err
+		}
+		cmd, err := sshStageRemoteChangesCmd(cfg, changedFiles)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := cmd.Output(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Removing the cookie would also force a reset, but the next push would
+	// then ask to confirm it as a first sync.
+	resetSc := &syncCookie{remoteName: cfg.remoteName, remoteURL: cfg.remoteURL, needsReset: true}
+	if err := writeSyncCookie(workdir, resetSc); err != nil {
+		return nil, err
+	}
+	NoisyPrintf("git-sync %d files from %s\n", len(changedFiles), commitHash)
+	for _, fname := range changedFiles {
+		VerbosePrintf("  %s\n", fname)
+	}
 	return changedFiles, nil
 }
 
+// Beyond this many files, hashing costs more than it is likely to save.
+const maxUnchangedFilterFiles = 1000
+
+// After the remote is reset to commitHash, any file whose working tree content
+// and executable bit match the commit is already correct on the remote. The
+// checkout rewrites mtimes, so rsync would otherwise send them again. Return
+// filePaths without those files.
+func dropUnchangedFiles(workdir string, commitHash string, filePaths []string) ([]string, error) {
+	if len(filePaths) == 0 || len(filePaths) > maxUnchangedFilterFiles {
+		return filePaths, nil
+	}
+	treeEntries, err := gitapi.GetTreeEntries(workdir, commitHash, filePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]string, 0, len(treeEntries))
+	for _, fname := range filePaths {
+		entry, ok := treeEntries[fname]
+		if !ok || entry.Type != "blob" {
+			continue
+		}
+		fi, err := os.Lstat(path.Join(workdir, fname))
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		isExec := fi.Mode()&0111 != 0
+		if isExec != (entry.Mode == "100755") {
+			continue
+		}
+		candidates = append(candidates, fname)
+	}
+	if len(candidates) == 0 {
+		return filePaths, nil
+	}
+
+	hashes, err := gitapi.HashFiles(workdir, candidates)
+	if err != nil {
+		return nil, err
+	}
+	unchangedSet := make(map[string]bool, len(candidates))
+	for i, fname := range candidates {
+		if hashes[i] == treeEntries[fname].Hash {
+			unchangedSet[fname] = true
+		}
+	}
+	if len(unchangedSet) == 0 {
+		return filePaths, nil
+	}
+	log.Infof("skipping %d files unchanged since %s", len(unchangedSet), commitHash)
+	transferFiles := make([]string, 0, len(filePaths)-len(unchangedSet))
+	for _, fname := range filePaths {
+		if !unchangedSet[fname] {
+			transferFiles = append(transferFiles, fname)
+		}
+	}
+	return transferFiles, nil
+}
+
+// Each remote gets its own lock so syncs to different remotes can proceed
+// concurrently while syncs to the same remote are serialized. Linked worktrees
+// push to the same remotes, so the lock is in the common dir they share.
+func syncLockPath(workdir string, remoteName string) string {
+	return path.Join(gitapi.GitCommonDir(workdir), "git-sync-"+remoteName+".mutex")
+}
+
+// Push to several remotes, running at most sync.maxParallelRemotes syncs at
+// once. Unless failFast is set, every remote is attempted and all failures are
+// reported together at the end.
+func pushRemotes(ctx context.Context, workdir string, cfgs []*config, failFast bool) error {
+	maxParallel := cfgs[0].maxParallelRemotes
+	if maxParallel <= 0 || maxParallel > len(cfgs) {
+		maxParallel = len(cfgs)
+	}
+	syncErrs := make([]error, len(cfgs))
+	// The first remote pushes alone so the rest can share its rsync batch.
+	// Only a written batch is handed on, so at most one push writes it.
+	first := 0
+	if cfgs[0].rsyncBatchMode {
+		batch, err := newRsyncBatch()
+		if err != nil {
+			return err
+		}
+		cfgs[0].rsyncBatch = batch
+		if _, err := fullSync(cfgs[0], workdir); err != nil {
+			syncErrs[0] = errors.WithMessage(err, cfgs[0].remoteName)
+			if failFast {
+				return syncErrs[0]
+			}
+		}
+		for _, cfg := range cfgs[1:] {
+			if batch.written() {
+				cfg.rsyncBatch = batch
+			}
+		}
+		first = 1
+	}
+	sem := make(chan struct{}, maxParallel)
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i, cfg := range cfgs[first:] {
+		i, cfg := first+i, cfg
+		eg.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-egCtx.Done():
+				syncErrs[i] = errors.WithMessage(egCtx.Err(), cfg.remoteName)
+				return nil
+			}
+			if err := egCtx.Err(); err != nil {
+				// Another remote failed while we were waiting for a slot.
+				syncErrs[i] = errors.WithMessage(err, cfg.remoteName)
+				return nil
+			}
+			if _, err := fullSync(cfg, workdir); err != nil {
+				syncErrs[i] = errors.WithMessage(err, cfg.remoteName)
+				if failFast {
+					return syncErrs[i]
+				}
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	msgs := make([]string, 0, len(syncErrs))
+	for _, err := range syncErrs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.Errorf("%d of %d remotes failed to sync:\n%s", len(msgs), len(cfgs), strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
 // We send a complex bash script to the remote git workdir. The complexity comes from
 // trying to avoid costly operations. For instance, git fetch is slow and frequently not required
 // on incremental changes.
@@ -557,11 +1755,22 @@ func fullSync(cfg *config, workdir string) (changedFiles []string, err error) {
 //
 // In most cases, a clean is needed even if the merge-base is unchanged. This keeps max_power mode
 // correct, up until there is out-of-band tampering with the remote workdir. Unfortunately, there is
-// no simple, cheap way to detect tampering.
+// no simple, cheap way to detect tampering; sync.detectRemoteDirty does it at the cost of a round
+// trip, see remoteDirtyFiles.
 const remoteGitCmd = `
 set -u
 set -o pipefail
-
+{{if and .LockFile (not .DryRun)}}
+# Serialize resets from concurrent git-syncs, possibly on other machines. The
+# lock is held until this script exits. Hosts without flock go unprotected.
+if command -v flock > /dev/null; then
+  exec 9>> {{.LockFile}} || exit 1
+  if ! flock -w {{.LockTimeout}} 9; then
+    echo "ERROR: {{.LockFile}} is held by another git-sync" >&2
+    exit {{.LockExitCode}}
+  fi
+fi
+{{end}}
 CHECKOUT_REQUIRED={{.CheckoutRequired}}
 CLEAN_REQUIRED={{.CleanRequired}}
 SERIALIZED_CHECKOUT_REQUIRED=0
@@ -574,18 +1783,38 @@ fi
 
 if [[ $head_hash != {{.CommitHash}} ]]; then
   if ! {{.GitRemotePath}} -C {{.RemoteDir}} cat-file -e {{.CommitHash}}; then
-    {{.GitRemotePath}} -C {{.RemoteDir}} fetch -q origin master || exit 1
+{{- if .DryRun}}
+    echo "would fetch origin "{{.UpstreamBranch}}": {{.CommitHash}} is missing"
+{{- else}}
+    {{.GitRemotePath}} -C {{.RemoteDir}} fetch -q origin {{.UpstreamBranch}} || exit 1
     # If the hash still does not exist, we try to error out with a nice error message
     if ! {{.GitRemotePath}} -C {{.RemoteDir}} cat-file -e {{.CommitHash}}; then
-      echo "ERROR: {{.CommitHash}} does not exist on {{.RemoteDir}}. Did you link your local repo to the correct remote repo?" >&2
+      echo "ERROR: {{.CommitHash}} does not exist on {{.RemoteDir}}. Did you link your local repo to the correct remote repo? See git-sync check-lineage." >&2
       exit 1
     fi
+{{- end}}
   fi
   # If the remote hash does not match we need to serialize the clean operation until
   # after checkout returns.
   SERIALIZED_CHECKOUT_REQUIRED=1
 fi
-
+{{if .DryRun}}
+# Preview mode: report what checkout and clean would change, then stop.
+if [[ $SERIALIZED_CHECKOUT_REQUIRED == 1 || $CHECKOUT_REQUIRED == 1 ]]; then
+  echo "would checkout -f {{.CommitHash}}, reverting:"
+  {{.GitRemotePath}} -C {{.RemoteDir}} diff --name-status {{.CommitHash}} 2> /dev/null
+{{- if .UpdateSubmodules}}
+  if [[ -f {{.RemoteDir}}/.gitmodules ]]; then
+    echo "would update submodules"
+  fi
+{{- end}}
+fi
+if [[ $CLEAN_REQUIRED == 1 ]]; then
+  echo "would clean:"
+  {{.GitRemotePath}} -C {{.RemoteDir}} clean -nd{{.CleanFlag}} {{.ExcludePaths}}{{if .CleanPathspecs}} -- {{.CleanPathspecs}}{{end}}
+fi
+exit 0
+{{end}}
 pids=""
 if [[ $SERIALIZED_CHECKOUT_REQUIRED == 1 ]]; then
   {{.GitRemotePath}} -C {{.RemoteDir}} checkout -qf {{.CommitHash}} || exit
@@ -597,7 +1826,7 @@ fi
 if [[ $CLEAN_REQUIRED == 1 ]]; then
   # git clean can slow significantly if the index is not "tidy" - which is
   # difficult to quantify. Usually an update-index improves performance.
-  {{.GitRemotePath}} -C {{.RemoteDir}} clean -qfdx {{.ExcludePaths}} &
+  {{.GitRemotePath}} -C {{.RemoteDir}} clean -qfd{{.CleanFlag}} {{.ExcludePaths}}{{if .CleanPathspecs}} -- {{.CleanPathspecs}}{{end}} &
   pids+=" $!"
 fi
 rc=0
@@ -606,7 +1835,13 @@ for pid in $pids; do
     rc=254
   fi
 done
-
+{{if .UpdateSubmodules}}
+# checkout -f leaves submodules on whatever commit they had, and clean never
+# removes them, so bring them in line with the new superproject commit.
+if [[ $rc == 0 && ( $SERIALIZED_CHECKOUT_REQUIRED == 1 || $CHECKOUT_REQUIRED == 1 ) && -f {{.RemoteDir}}/.gitmodules ]]; then
+  {{.GitRemotePath}} -C {{.RemoteDir}} submodule update -q --init --recursive || rc=253
+fi
+{{end}}
 exit $rc
 `
 
@@ -617,19 +1852,90 @@ type remoteGitCmdFmt struct {
 	GitRemotePath    string
 	RemoteDir        string
 	CommitHash       string
-	ExcludePaths     string
+	// The quoted branch of origin the merge base is fetched from.
+	UpstreamBranch string
+	ExcludePaths   string
+	// x or X, see remoteCleanFlag.
+	CleanFlag        string
+	CleanPathspecs   string
+	UpdateSubmodules bool
+	DryRun           bool
+	// The quoted remote lock file, or empty to skip locking.
+	LockFile     string
+	LockTimeout  int
+	LockExitCode int
+}
+
+// Return the output of the remote reset script run in preview mode. This shows
+// what a push would checkout and clean on the remote without doing either.
+func remoteDryRun(cfg *config, workdir string) (string, error) {
+	if err := cfg.requireRemoteGit("-remote-dry-run"); err != nil {
+		return "", err
+	}
+	sc, err := readSyncCookie(cfg, workdir)
+	if err != nil {
+		return "", err
+	}
+	syncCmd, err := gitSyncCmd(cfg, sc, true)
+	if err != nil {
+		return "", err
+	}
+	out, err := syncCmd.Output()
+	return string(out), err
+}
+
+// Return true if this workdir has never been synced to the remote.
+func isFirstSync(cfg *config, workdir string) (bool, error) {
+	if err := migrateLegacySyncCookie(workdir, cfg.remoteName); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(syncCookiePath(workdir, cfg.remoteName))
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// Before the first sync to a remote, show what the reset and clean would
+// destroy and ask the user to confirm. Anything but y or yes declines.
+func confirmFirstSync(cfg *config, workdir string, in io.Reader, out io.Writer) (bool, error) {
+	preview, err := remoteDryRun(cfg, workdir)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(out, "First sync to %s (%s). The remote dir will be reset and cleaned:\n", cfg.remoteName, cfg.remoteURL)
+	fmt.Fprint(out, preview)
+	fmt.Fprintf(out, "Continue? [y/N] ")
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
 }
 
 // Pull unstaged changes from the remote workdir into the local workdir.
 func syncPull(cfg *config, workdir string) (changedFiles []string, err error) {
 	// Use a lock file to guard against git races on the remote side.
-	flock, err := flock.Open(path.Join(workdir, ".git/git-sync.mutex"))
+	flock, err := flock.Open(syncLockPath(workdir, cfg.remoteName))
 	if err != nil {
 		return nil, err
 	}
 	defer flock.Close()
 
-	cmd := makeSSHCmd(cfg, cfg.remoteSSHAddr(), []string{
+	return syncPullLocked(cfg, workdir)
+}
+
+// The body of syncPull, for callers already holding the sync lock.
+func syncPullLocked(cfg *config, workdir string) (changedFiles []string, err error) {
+	// Only git on the remote knows what changed there.
+	if err := cfg.requireRemoteGit("pull"); err != nil {
+		return nil, err
+	}
+	cmd := cfg.transport.remoteCmd(cfg, []string{
 		cfg.gitRemotePath, "-C", cfg.remoteDir(), "status",
 		"-z", "--porcelain", "--untracked-file=all",
 	})
@@ -644,16 +1950,178 @@ func syncPull(cfg *config, workdir string) (changedFiles []string, err error) {
 		return nil, err
 	}
 
+	excludedFiles, err := remoteExcludedFiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[string]bool, len(excludedFiles))
+	for _, fname := range excludedFiles {
+		excluded[fname] = true
+	}
 	changedFiles = make([]string, 0, len(untrackedFiles)+len(unstagedFiles))
-	changedFiles = append(changedFiles, untrackedFiles...)
+	// The excluded files git status reports. Those also ignored are never
+	// pulled anyway.
+	skippedFiles := make([]string, 0, len(excludedFiles))
+	for _, fname := range untrackedFiles {
+		if excluded[fname] {
+			VerbosePrintf("  %s (skipped, spared by sync.excludePaths)\n", fname)
+			skippedFiles = append(skippedFiles, fname)
+			continue
+		}
+		changedFiles = append(changedFiles, fname)
+	}
 	changedFiles = append(changedFiles, unstagedFiles...)
 
+	var deleteFiles []string
+	if cfg.deleteExcluded && len(skippedFiles) > 0 {
+		deleteFiles, err = localExcludedFiles(workdir, skippedFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	cmd, err = rsyncPullCmd(cfg, workdir, changedFiles)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.dryRun {
+		// git status is read-only, so only the rsync is left out.
+		NoisyPrintf("dry run: pull from %s (%s), %d files to fetch\n", cfg.remoteName, cfg.remoteURL, len(changedFiles))
+		NoisyPrintf("would fetch:\n  %s\n", manifestCmdLine(cmd.Args))
+		NoisyPrintf("with $manifest holding:\n")
+		for _, fname := range changedFiles {
+			NoisyPrintf("  %s\n", fname)
+		}
+		if cfg.pullAutoStage {
+			NoisyPrintf("would stage them locally\n")
+		}
+		if len(deleteFiles) > 0 {
+			NoisyPrintf("would delete these excluded files locally:\n")
+			for _, fname := range deleteFiles {
+				NoisyPrintf("  %s\n", fname)
+			}
+		}
+		return changedFiles, nil
+	}
 	if err := cmd.Run(); err != nil {
 		return nil, err
 	}
+	for _, fname := range deleteFiles {
+		if err := os.Remove(path.Join(workdir, fname)); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "unable to delete an excluded file")
+		}
+		VerbosePrintf("  %s (deleted, spared by sync.excludePaths)\n", fname)
+	}
+	if cfg.pullAutoStage {
+		if err := stagePulledFiles(workdir, changedFiles); err != nil {
+			return nil, err
+		}
+	}
+	for _, fname := range changedFiles {
+		VerbosePrintf("  %s\n", fname)
+	}
 	return changedFiles, nil
 }
+
+// Return the untracked remote files that sync.excludePaths spares from git
+// clean. These are data kept on the remote alone, such as build caches, so a
+// pull leaves them out. Asking costs a round trip, made only if there are
+// exclude patterns.
+func remoteExcludedFiles(cfg *config) ([]string, error) {
+	if len(cfg.excludePaths) == 0 {
+		return nil, nil
+	}
+	// Without --exclude-standard only the given patterns count as ignored.
+	script := []string{cfg.gitRemotePath, "-C", gitapi.BashQuote(cfg.remoteDir())[0], "ls-files", "-z", "--others", "--ignored"}
+	for _, xp := range cfg.excludePaths {
+		script = append(script, "--exclude="+gitapi.BashQuote(xp)[0])
+	}
+	out, err := cfg.transport.remoteCmd(cfg, script).Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the remote files spared by sync.excludePaths")
+	}
+	return gitapi.SplitNullTerminated(string(out)), nil
+}
+
+// Return the local copies of excludedFiles that pull -delete-excluded would
+// remove. Files tracked locally are kept, since git has them either way.
+func localExcludedFiles(workdir string, excludedFiles []string) ([]string, error) {
+	trackedFiles, err := gitapi.FilterTracked(workdir, excludedFiles)
+	if err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]bool, len(trackedFiles))
+	for _, fname := range trackedFiles {
+		tracked[fname] = true
+	}
+	deleteFiles := make([]string, 0, len(excludedFiles))
+	for _, fname := range excludedFiles {
+		if tracked[fname] {
+			log.Warningf("not deleting %s, spared by sync.excludePaths on the remote but tracked locally", fname)
+			continue
+		}
+		if fi, err := os.Lstat(path.Join(workdir, fname)); err == nil && !fi.IsDir() {
+			deleteFiles = append(deleteFiles, fname)
+		}
+	}
+	return deleteFiles, nil
+}
+
+// Stage exactly the pulled files, less any the local .gitignore rules
+// ignore, so the local index matches the changes made on the remote.
+func stagePulledFiles(workdir string, pulledFiles []string) error {
+	ignoredFiles, err := gitapi.GitCheckIgnore(workdir, pulledFiles)
+	if err != nil {
+		return err
+	}
+	ignored := make(map[string]bool, len(ignoredFiles))
+	for _, fname := range ignoredFiles {
+		ignored[fname] = true
+	}
+	stageFiles := make([]string, 0, len(pulledFiles))
+	for _, fname := range pulledFiles {
+		if ignored[fname] {
+			DebugPrintf("  %s (not staged, ignored)\n", fname)
+			continue
+		}
+		stageFiles = append(stageFiles, fname)
+	}
+	if err := gitapi.GitAdd(workdir, stageFiles); err != nil {
+		return errors.Wrap(err, "unable to stage pulled files")
+	}
+	return nil
+}
+
+// Push local changes to the remote, then pull back unstaged changes made on
+// the remote, holding the sync lock across both so nothing can sneak in
+// between. The pull is skipped if the push sent nothing and the remote was
+// not reset.
+func bidiSync(cfg *config, workdir string) (pushedFiles []string, pulledFiles []string, err error) {
+	// Fail before pushing rather than at the pull.
+	if err := cfg.requireRemoteGit("sync"); err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.checkRemoteDirAllowed(); err != nil {
+		return nil, nil, err
+	}
+	flock, err := flock.Open(syncLockPath(workdir, cfg.remoteName))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer flock.Close()
+
+	result, err := fullSyncLocked(cfg, workdir)
+	if err != nil {
+		return nil, nil, err
+	}
+	pushedFiles = result.ChangedFiles
+	if len(pushedFiles) == 0 && !result.DidCheckout {
+		log.Infof("nothing pushed, skipping pull")
+		return pushedFiles, nil, nil
+	}
+	pulledFiles, err = syncPullLocked(cfg, workdir)
+	if err != nil {
+		return pushedFiles, nil, err
+	}
+	return pushedFiles, pulledFiles, nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/msolo/git-mg/gitapi"
+)
+
+// Return the -o options from ssh args as a map.
+func sshOptionsFromArgs(args []string) map[string]string {
+	opts := make(map[string]string)
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-o") {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(arg, "-o"), "=", 2)
+		opts[kv[0]] = kv[1]
+	}
+	return opts
+}
+
+func TestMakeSSHArgs(t *testing.T) {
+	cfg := defaultConfig
+	opts := sshOptionsFromArgs(makeSSHArgs(&cfg, "host", nil))
+	if opts["StrictHostKeyChecking"] != "no" || opts["UserKnownHostsFile"] != "/dev/null" {
+		t.Errorf("unexpected host key defaults: %v", opts)
+	}
+	if opts["ConnectTimeout"] != "5" || opts["ControlPersist"] != "900" {
+		t.Errorf("unexpected timeout defaults: %v", opts)
+	}
+
+	cfg.sshStrictHostKeyChecking = true
+	opts = sshOptionsFromArgs(makeSSHArgs(&cfg, "host", nil))
+	if opts["StrictHostKeyChecking"] != "yes" {
+		t.Errorf("StrictHostKeyChecking = %q, want yes", opts["StrictHostKeyChecking"])
+	}
+	if _, ok := opts["UserKnownHostsFile"]; ok {
+		t.Errorf("UserKnownHostsFile still overridden: %v", opts)
+	}
+
+	// User options win over both the defaults and sync.sshStrictHostKeyChecking,
+	// however they are capitalized.
+	cfg.sshExtraOptions = map[string]string{
+		"stricthostkeychecking": "accept-new",
+		"UserKnownHostsFile":    "~/.ssh/managed_hosts",
+		"ProxyJump":             "bastion",
+	}
+	opts = sshOptionsFromArgs(makeSSHArgs(&cfg, "host", nil))
+	want := map[string]string{
+		"stricthostkeychecking": "accept-new",
+		"UserKnownHostsFile":    "~/.ssh/managed_hosts",
+		"ProxyJump":             "bastion",
+	}
+	for k, v := range want {
+		if opts[k] != v {
+			t.Errorf("option %s = %q, want %q", k, opts[k], v)
+		}
+	}
+	if _, ok := opts["StrictHostKeyChecking"]; ok {
+		t.Errorf("built-in StrictHostKeyChecking not replaced: %v", opts)
+	}
+	if opts["ForwardAgent"] != "yes" {
+		t.Errorf("unrelated default lost: %v", opts)
+	}
+}
+
+func TestControlPathLength(t *testing.T) {
+	defer os.Setenv("USER", os.Getenv("USER"))
+	os.Setenv("USER", "me")
+	ru, err := parseRemoteURL("ssh://builder@devbox:2222/srv/repo")
+	failOnErr(t, err)
+	if got, want := expandControlPath("/tmp/ssh_mux_%h_%p_%r_%u_%%", ru), "/tmp/ssh_mux_devbox_2222_builder_me_%"; got != want {
+		t.Errorf("expanded %q, want %q", got, want)
+	}
+	repoPath := repoControlPath("/src/repo")
+	if repoPath == repoControlPath("/src/other") || !strings.HasSuffix(repoPath, "-%C") {
+		t.Errorf("unexpected repo control path %q", repoPath)
+	}
+	for _, controlPath := range []string{defaultConfig.sshControlPath, repoPath} {
+		if err := checkControlPathLength(controlPath, ru); err != nil {
+			t.Errorf("control path %q rejected: %v", controlPath, err)
+		}
+	}
+	// The repo template under a macOS $TMPDIR.
+	if err := checkControlPathLength("/var/folders/zz/zyxvpxvq6csfxvn_n0000000000000/T/git-sync-%u-0123456789ab-%C", ru); err == nil {
+		t.Errorf("overlong control path accepted")
+	}
+}
+
+func TestRsyncBandwidthLimit(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "git-sync-bwlimit-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	if err := ioutil.WriteFile(path.Join(workdir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hasBwlimit := func(cfg *config) (push bool, pull bool) {
+		ft := newFakeTransport()
+		cfg.transport = ft
+		if _, err := rsyncPushCmd(cfg, workdir, []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rsyncPullCmd(cfg, workdir, []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+		has := func(args []string) bool {
+			for _, arg := range args {
+				if arg == "--bwlimit=512" {
+					return true
+				}
+				if strings.HasPrefix(arg, "--bwlimit") {
+					t.Fatalf("unexpected %s", arg)
+				}
+			}
+			return false
+		}
+		return has(ft.rsyncCmds[0]), has(ft.rsyncCmds[1])
+	}
+
+	cfg := defaultConfig
+	cfg.remoteURL = "host:/src"
+	if push, pull := hasBwlimit(&cfg); push || pull {
+		t.Errorf("--bwlimit set without sync.rsyncBandwidthLimit")
+	}
+	cfg.rsyncBandwidthLimit = 512
+	if push, pull := hasBwlimit(&cfg); !push || !pull {
+		t.Errorf("--bwlimit missing: push %v, pull %v", push, pull)
+	}
+}
+
+func TestRsyncCompress(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "git-sync-compress-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	// Return the leading rsync flags and any --compress-level for a push and a
+	// pull.
+	compressArgs := func(cfg *config) [][]string {
+		ft := newFakeTransport()
+		cfg.transport = ft
+		if _, err := rsyncPushCmd(cfg, workdir, []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rsyncPullCmd(cfg, workdir, []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+		argvs := make([][]string, 0, 2)
+		for _, rsyncArgs := range ft.rsyncCmds {
+			argv := []string{rsyncArgs[0]}
+			for _, arg := range rsyncArgs[1:] {
+				if strings.HasPrefix(arg, "--compress") || strings.HasPrefix(arg, "-z") {
+					argv = append(argv, arg)
+				}
+			}
+			argvs = append(argvs, argv)
+		}
+		return argvs
+	}
+	check := func(cfg *config, want ...string) {
+		t.Helper()
+		for _, argv := range compressArgs(cfg) {
+			if !reflect.DeepEqual(argv, want) {
+				t.Errorf("compress %v level %d: got %q, want %q", cfg.rsyncCompress, cfg.rsyncCompressLevel, argv, want)
+			}
+		}
+	}
+
+	cfg := defaultConfig
+	cfg.remoteURL = "host:/src"
+	check(&cfg, "-czlptgo")
+	cfg.rsyncCompressLevel = 1
+	check(&cfg, "-czlptgo", "--compress-level=1")
+	cfg.rsyncCompress = false
+	check(&cfg, "-clptgo")
+}
+
+func TestRemoteLock(t *testing.T) {
+	if _, err := exec.LookPath("flock"); err != nil {
+		t.Skip("flock not installed")
+	}
+	remoteDir, err := ioutil.TempDir("", "git-sync-remote-lock-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteDir)
+	if err := os.Mkdir(path.Join(remoteDir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig
+	cfg.remoteURL = "host:" + remoteDir
+	cfg.remoteLockTimeout = 0
+	resetScript := func(dryRun bool) string {
+		ft := newFakeTransport()
+		cfg.transport = ft
+		if _, err := gitSyncCmd(&cfg, &syncCookie{}, dryRun); err != nil {
+			t.Fatal(err)
+		}
+		return ft.remoteCmds[0]
+	}
+
+	// Hold the lock as a concurrent git-sync would, then run the reset script
+	// locally in place of the remote.
+	lockFile := path.Join(remoteDir, ".git", "git-sync.lock")
+	f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	_, err = exec.Command("/bin/bash", "-c", resetScript(false)).Output()
+	if rc, rcErr := gitapi.ExitStatus(err); rcErr != nil || rc != remoteLockedExitCode {
+		t.Fatalf("reset ran despite the lock: %v", err)
+	}
+	if err := remoteResetError(&cfg, err); !strings.Contains(err.Error(), "locked by another git-sync") {
+		t.Errorf("unexpected reset error: %s", err)
+	}
+
+	if strings.Contains(resetScript(true), "flock") {
+		t.Errorf("dry run takes the remote lock")
+	}
+	cfg.remoteLockPath = "none"
+	if strings.Contains(resetScript(false), "flock") {
+		t.Errorf("remote lock taken with sync.remoteLockPath=none")
+	}
+
+	for d, want := range map[time.Duration]int{0: 0, 500 * time.Millisecond: 1, time.Second: 1, 1500 * time.Millisecond: 2} {
+		if got := lockTimeoutSecs(d); got != want {
+			t.Errorf("lockTimeoutSecs(%s) = %d, want %d", d, got, want)
+		}
+	}
+}
+
+func TestFilterFsMonitorPaths(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "git-sync-fsmonitor-filter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	for _, dir := range []string{"src", "big/tree"} {
+		if err := os.MkdirAll(path.Join(workdir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(workdir, "src/a.go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// git tracks a symlink to a directory as a file.
+	if err := os.Symlink("big", path.Join(workdir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{"", ".git", ".git/index", "src", "src/a.go", "src/a.go", "link", "gone", "gone/b.go", "gone/c/d.go"}
+	got := stringSet2Slice(filterFsMonitorPaths(workdir, paths, dirCache{}.isDir))
+	sort.Strings(got)
+	want := []string{"gone", "gone/b.go", "gone/c/d.go", "link", "src/a.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Only the top of a missing tree is looked up.
+	dc := dirCache{workdir: true}
+	dc.isDir(path.Join(workdir, "gone/c/d.go"))
+	if len(dc) != 3 || dc[path.Join(workdir, "gone")] {
+		t.Errorf("unexpected cache entries for a missing tree: %v", dc)
+	}
+}
+
+// A synthetic 1000-path fsmonitor reply: directories, the files in them, and
+// a deleted tree, with some paths reported twice.
+func benchFsMonitorReply(b *testing.B) (workdir string, paths []string) {
+	workdir, err := ioutil.TempDir("", "git-sync-fsmonitor-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for d := 0; d < 10; d++ {
+		dir := fmt.Sprintf("dir%d", d)
+		if err := os.Mkdir(path.Join(workdir, dir), 0755); err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, dir)
+		for f := 0; f < 50; f++ {
+			fname := fmt.Sprintf("%s/f%d", dir, f)
+			if err := ioutil.WriteFile(path.Join(workdir, fname), nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+			paths = append(paths, fname, fname)
+		}
+	}
+	for len(paths) < 1000 {
+		paths = append(paths, fmt.Sprintf("deleted/d%d/f%d", len(paths)%10, len(paths)))
+	}
+	return workdir, paths
+}
+
+// The filter before caching, with a plain stat per path.
+func statIsDir(fname string) bool {
+	fi, err := os.Stat(fname)
+	return err == nil && fi.IsDir()
+}
+
+func BenchmarkFilterFsMonitorPaths(b *testing.B) {
+	workdir, paths := benchFsMonitorReply(b)
+	defer os.RemoveAll(workdir)
+	b.Run("stat", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			filterFsMonitorPaths(workdir, paths, statIsDir)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			filterFsMonitorPaths(workdir, paths, dirCache{}.isDir)
+		}
+	})
+}
+
+func TestGetChangesViaFsMonitorNoList(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "git-sync-fsmonitor-no-list-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	// The hook runs with a restricted env, which needs these set.
+	for _, key := range []string{"USER", "LOGNAME", "HOME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "unset")
+			defer os.Unsetenv(key)
+		}
+	}
+	hook := path.Join(workdir, "fsmonitor")
+	cfg := &config{fsmonitorLocalPath: hook, fsmonitorTimeout: 10 * time.Second, fsmonitorMaxChanges: 2}
+	for _, reply := range []string{`/\0`, `a\0b\0c\0`} {
+		script := "#!/bin/sh\nprintf '" + reply + "'\n"
+		if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := getChangesViaFsMonitor(cfg, workdir, &syncCookie{}, nil); err != errFsMonitorNoList {
+			t.Errorf("fsmonitor reply %q: got %v, want errFsMonitorNoList", reply, err)
+		}
+	}
+}
@@ -0,0 +1,1018 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msolo/git-mg/gitapi"
+)
+
+// fakeTransport records the commands git-sync would send to the remote and
+// simulates the remote working directory in memory. Every command is replaced
+// by a trivial local process, so no ssh or rsync is required.
+type fakeTransport struct {
+	mu          sync.Mutex
+	remoteCmds  []string
+	rsyncCmds   [][]string
+	remoteFiles map[string]string
+	// The permission bits of each remote file, as preserved by rsync -p.
+	remoteModes map[string]os.FileMode
+	// respond, if set, returns the stdout and exit status of a remote command.
+	respond func(script string) (string, int)
+	// Exit statuses for the next pushes to fail with, without applying them.
+	rsyncFailures []int
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		remoteFiles: make(map[string]string),
+		remoteModes: make(map[string]os.FileMode),
+	}
+}
+
+func (ft *fakeTransport) remoteCmd(cfg *config, bashCmdArgs []string) *gitapi.Cmd {
+	script := strings.Join(bashCmdArgs, " ")
+	ft.mu.Lock()
+	ft.remoteCmds = append(ft.remoteCmds, script)
+	respond := ft.respond
+	ft.mu.Unlock()
+
+	stdout, rc := "", 0
+	if respond != nil {
+		stdout, rc = respond(script)
+	}
+	return fakeCmd(stdout, rc)
+}
+
+// Apply pushes to the in-memory remote as rsync would, including deletions
+// via --delete-missing-args. A batch written with --write-batch holds the
+// pushed files as JSON, for --read-batch to apply to another remote.
+func (ft *fakeTransport) rsyncCmd(cfg *config, rsyncArgs []string) *gitapi.Cmd {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.rsyncCmds = append(ft.rsyncCmds, rsyncArgs)
+
+	dst := rsyncArgs[len(rsyncArgs)-1]
+	if dst != cfg.rsyncRemoteURL() {
+		return fakeCmd("", 0)
+	}
+	if len(ft.rsyncFailures) > 0 {
+		rc := ft.rsyncFailures[0]
+		ft.rsyncFailures = ft.rsyncFailures[1:]
+		return fakeCmd("", rc)
+	}
+	manifest, writeBatch := "", ""
+	for i, arg := range rsyncArgs[:len(rsyncArgs)-1] {
+		switch {
+		case arg == "--files-from":
+			manifest = rsyncArgs[i+1]
+		case strings.HasPrefix(arg, "--write-batch="):
+			writeBatch = strings.TrimPrefix(arg, "--write-batch=")
+		case strings.HasPrefix(arg, "--read-batch="):
+			data, err := ioutil.ReadFile(strings.TrimPrefix(arg, "--read-batch="))
+			if err != nil {
+				return fakeCmd(err.Error(), 1)
+			}
+			var entries []fakePushEntry
+			if err := json.Unmarshal(data, &entries); err != nil {
+				return fakeCmd(err.Error(), 1)
+			}
+			for _, e := range entries {
+				ft.apply(e)
+			}
+			return fakeCmd("", 0)
+		}
+	}
+	src := rsyncArgs[len(rsyncArgs)-2]
+	data, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return fakeCmd(err.Error(), 1)
+	}
+	entries := make([]fakePushEntry, 0, 8)
+	for _, fname := range gitapi.SplitNullTerminated(string(data)) {
+		e := fakePushEntry{Name: fname}
+		if content, err := ioutil.ReadFile(path.Join(src, fname)); err == nil {
+			e.Content = string(content)
+			if fi, err := os.Stat(path.Join(src, fname)); err == nil {
+				e.Mode = fi.Mode().Perm()
+			}
+		} else {
+			e.Missing = true
+		}
+		entries = append(entries, e)
+		ft.apply(e)
+	}
+	if writeBatch != "" {
+		data, err := json.Marshal(entries)
+		if err == nil {
+			err = ioutil.WriteFile(writeBatch, data, 0644)
+		}
+		if err != nil {
+			return fakeCmd(err.Error(), 1)
+		}
+	}
+	return fakeCmd("", 0)
+}
+
+// A path sent by a fake push.
+type fakePushEntry struct {
+	Name    string
+	Content string
+	Mode    os.FileMode
+	Missing bool
+}
+
+func (ft *fakeTransport) apply(e fakePushEntry) {
+	fname := e.Name
+	if !e.Missing {
+		if e.Mode != 0 {
+			ft.remoteModes[fname] = e.Mode
+		}
+		// A file replaces a directory of the same name, as with --force.
+		for rname := range ft.remoteFiles {
+			if strings.HasPrefix(rname, fname+"/") {
+				delete(ft.remoteFiles, rname)
+			}
+		}
+		ft.remoteFiles[fname] = e.Content
+		return
+	}
+	// Missing paths are sent as their topmost missing directory.
+	fname = strings.TrimSuffix(fname, "/")
+	for rname := range ft.remoteFiles {
+		if rname == fname || strings.HasPrefix(rname, fname+"/") {
+			delete(ft.remoteFiles, rname)
+		}
+	}
+}
+
+func fakeCmd(stdout string, rc int) *gitapi.Cmd {
+	// Arguments can't hold NUL bytes, so escape them for printf %b.
+	stdout = strings.Replace(stdout, `\`, `\\`, -1)
+	stdout = strings.Replace(stdout, "\x00", `\0000`, -1)
+	return gitapi.Command("/bin/sh", "-c", `printf '%b' "$1"; exit "$2"`, "sh", stdout, strconv.Itoa(rc))
+}
+
+// Set up an upstream repo and a local clone, without any sync remote. The
+// returned config targets the fake transport.
+func fakeRepoSetup(t testing.TB) (localDir string, cfg *config, ft *fakeTransport) {
+	t.Helper()
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "git-sync-test")
+		}
+	}
+	tmpDir, err := ioutil.TempDir("", "git-sync-fake-repo-")
+	failOnErr(t, err)
+	upstreamDir := path.Join(tmpDir, "upstream")
+	localDir = path.Join(tmpDir, "local")
+	gitCmd := func(dir string, args ...string) {
+		t.Helper()
+		args = append([]string{"-C", dir, "-c", "user.name=git-sync", "-c", "user.email=git-sync@localhost", "-c", "init.defaultBranch=master"}, args...)
+		failOnCmdError(t, tmpDir, "git", args...)
+	}
+	failOnErr(t, os.MkdirAll(upstreamDir, 0775))
+	gitCmd(upstreamDir, "init", "-q")
+	failOnErr(t, ioutil.WriteFile(path.Join(upstreamDir, "dummy"), []byte(""), 0664))
+	gitCmd(upstreamDir, "add", "dummy")
+	gitCmd(upstreamDir, "commit", "-q", "-m", "initial commit")
+	gitCmd(tmpDir, "clone", "-q", upstreamDir, localDir)
+
+	ft = newFakeTransport()
+	c := defaultConfig
+	c.remoteURL = "fakehost:" + path.Join(tmpDir, "sync")
+	c.transport = ft
+	return localDir, &c, ft
+}
+
+func TestFullSyncFakeTransport(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	result, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if changedFiles := result.ChangedFiles; len(changedFiles) != 1 || changedFiles[0] != "a" {
+		t.Fatalf("unexpected changed files: %v", changedFiles)
+	}
+	if !result.DidCheckout || !result.DidClean || result.UsedFsMonitor {
+		t.Fatalf("unexpected sync result: %+v", result)
+	}
+	if ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("file not pushed to remote: %v", ft.remoteFiles)
+	}
+	// The first sync must reset the remote before shipping files.
+	if len(ft.remoteCmds) == 0 || !strings.Contains(ft.remoteCmds[0], "checkout -qf") {
+		t.Fatalf("missing remote reset: %v", ft.remoteCmds)
+	}
+
+	// Simulate the checked-out remote tree, then delete a tracked file.
+	ft.remoteFiles["dummy"] = ""
+	failOnErr(t, os.Remove(path.Join(localDir, "dummy")))
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if _, ok := ft.remoteFiles["dummy"]; ok {
+		t.Fatalf("deleted file still on remote: %v", ft.remoteFiles)
+	}
+}
+
+func TestFullSyncRsyncDaemon(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	cfg.remoteURL = "rsync://fakehost/mod/sync"
+
+	// Without a shell, files are copied and nothing else reaches the remote.
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	result, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("file not pushed to remote: %v", ft.remoteFiles)
+	}
+	if len(ft.remoteCmds) != 0 || result.DidCheckout || result.DidClean {
+		t.Fatalf("remote commands sent to an rsync daemon: %v", ft.remoteCmds)
+	}
+	if _, err := syncPull(cfg, localDir); err == nil {
+		t.Fatalf("pull from an rsync daemon succeeded")
+	}
+	args := sshTransport{}.rsyncCmd(cfg, ft.rsyncCmds[0]).Args
+	if strings.Contains(strings.Join(args, " "), " -e ") || args[len(args)-1] != "rsync://fakehost/mod/sync" {
+		t.Fatalf("unexpected rsync daemon command: %s", args)
+	}
+
+	// With sync.daemonSSHURL the push stages over ssh.
+	cfg.daemonSSHURL = "fakehost:/srv/sync"
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("bar"), 0644))
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if ft.remoteFiles["a"] != "bar" || len(ft.remoteCmds) == 0 || !strings.Contains(ft.remoteCmds[len(ft.remoteCmds)-1], "/srv/sync add") {
+		t.Fatalf("push not staged over ssh: %v", ft.remoteCmds)
+	}
+}
+
+func TestFullSyncMirror(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	cfg.mode = syncModeMirror
+
+	// The first push sends the whole tree, since nothing resets the remote.
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	result, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if _, ok := ft.remoteFiles["dummy"]; !ok || ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("tree not mirrored: %v", ft.remoteFiles)
+	}
+	if len(ft.remoteCmds) != 0 || result.DidCheckout || result.DidClean {
+		t.Fatalf("git run on a mirror: %v", ft.remoteCmds)
+	}
+
+	// A file deleted by a commit is deleted from the mirror.
+	failOnCmdError(t, localDir, "git", "rm", "-q", "dummy")
+	failOnCmdError(t, localDir, "git", "-c", "user.name=git-sync", "-c", "user.email=git-sync@localhost", "commit", "-q", "-m", "drop dummy")
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if _, ok := ft.remoteFiles["dummy"]; ok || ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("deletion not mirrored: %v", ft.remoteFiles)
+	}
+	if len(ft.remoteCmds) != 0 {
+		t.Fatalf("git run on a mirror: %v", ft.remoteCmds)
+	}
+	if _, err := syncPull(cfg, localDir); err == nil {
+		t.Fatalf("pull from a mirror succeeded")
+	}
+}
+
+func TestFullSyncRemoteSwitch(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if last := ft.remoteCmds[len(ft.remoteCmds)-1]; !strings.Contains(last, "CHECKOUT_REQUIRED=0") {
+		t.Fatalf("expected incremental sync to the same remote: %s", last)
+	}
+
+	origURL := cfg.remoteURL
+	cfg.remoteName = "other"
+	cfg.remoteURL = "otherhost:/src"
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if last := ft.remoteCmds[len(ft.remoteCmds)-1]; !strings.Contains(last, "CHECKOUT_REQUIRED=1") {
+		t.Fatalf("expected full sync after switching remotes: %s", last)
+	}
+
+	// Switching back picks up the original remote's cookie.
+	cfg.remoteName = defaultConfig.remoteName
+	cfg.remoteURL = origURL
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if last := ft.remoteCmds[len(ft.remoteCmds)-1]; !strings.Contains(last, "CHECKOUT_REQUIRED=0") {
+		t.Fatalf("expected incremental sync after switching back: %s", last)
+	}
+}
+
+func TestCommitSyncCookie(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	failOnCmdError(t, localDir, "git", "add", "a")
+	failOnCmdError(t, localDir, "git", "-c", "user.name=git-sync", "-c", "user.email=git-sync@localhost", "commit", "-q", "-m", "add a")
+	changedFiles, err := commitSync(cfg, localDir, "HEAD")
+	failOnErr(t, err)
+	if len(changedFiles) != 1 || changedFiles[0] != "a" {
+		t.Fatalf("unexpected changed files: %v", changedFiles)
+	}
+
+	// The next push resets the remote, but isn't taken for a first sync.
+	if first, err := isFirstSync(cfg, localDir); err != nil || first {
+		t.Fatalf("push after -commit taken for a first sync: %v %v", first, err)
+	}
+	n := len(ft.remoteCmds)
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if cmds := strings.Join(ft.remoteCmds[n:], "\n"); !strings.Contains(cmds, "CHECKOUT_REQUIRED=1") {
+		t.Fatalf("expected full sync after push -commit: %s", cmds)
+	}
+	n = len(ft.remoteCmds)
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if cmds := strings.Join(ft.remoteCmds[n:], "\n"); !strings.Contains(cmds, "CHECKOUT_REQUIRED=0") {
+		t.Fatalf("expected incremental sync once reset: %s", cmds)
+	}
+}
+
+func TestBenchSync(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	// A file of the user's that happens to look like bench output.
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, ".git-sync-bench"), []byte("mine"), 0644))
+
+	report, err := benchSync(cfg, localDir, 2, 3)
+	failOnErr(t, err)
+	if report.Iterations != 2 || report.Files != 3 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	benchFiles := 0
+	for fname := range ft.remoteFiles {
+		if strings.HasPrefix(fname, benchDirPrefix) {
+			benchFiles++
+		}
+	}
+	if benchFiles != 3 {
+		t.Fatalf("expected 3 synthetic files pushed: %v", ft.remoteFiles)
+	}
+	if last := ft.remoteCmds[len(ft.remoteCmds)-1]; !strings.Contains(last, "rm -rf "+path.Join(cfg.remoteDir(), benchDirPrefix)) {
+		t.Fatalf("synthetic files not removed from the remote: %s", last)
+	}
+	left, err := filepath.Glob(path.Join(localDir, benchDirPrefix+"*"))
+	failOnErr(t, err)
+	if len(left) != 0 {
+		t.Fatalf("synthetic files left in the workdir: %v", left)
+	}
+	if data, err := ioutil.ReadFile(path.Join(localDir, ".git-sync-bench")); err != nil || string(data) != "mine" {
+		t.Fatalf("bench clobbered an existing file: %q, %v", data, err)
+	}
+}
+
+func TestSyncCookieMigration(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	// Older versions kept a single cookie for whichever remote was last synced.
+	legacyPath := path.Join(localDir, ".git/git-sync-cookie.json")
+	failOnErr(t, os.Rename(syncCookiePath(localDir, cfg.remoteName), legacyPath))
+
+	// It is no use to another remote.
+	if first, err := isFirstSync(&config{remoteName: "other"}, localDir); err != nil || !first {
+		t.Fatalf("legacy cookie used for another remote: %v %v", first, err)
+	}
+	if first, err := isFirstSync(cfg, localDir); err != nil || first {
+		t.Fatalf("legacy cookie not migrated: %v %v", first, err)
+	}
+	if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Fatalf("legacy cookie left behind: %v", err)
+	}
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if last := ft.remoteCmds[len(ft.remoteCmds)-1]; !strings.Contains(last, "CHECKOUT_REQUIRED=0") {
+		t.Fatalf("expected incremental sync after migrating the cookie: %s", last)
+	}
+
+	if fname := syncCookiePath(localDir, "team/box"); path.Dir(fname) != path.Join(localDir, ".git") {
+		t.Fatalf("remote name not escaped: %s", fname)
+	}
+}
+
+func TestFullSyncFileDirTransition(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	// Replace the tracked file dummy with a directory.
+	ft.remoteFiles["dummy"] = ""
+	failOnErr(t, os.Remove(path.Join(localDir, "dummy")))
+	failOnErr(t, os.Mkdir(path.Join(localDir, "dummy"), 0755))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "dummy/a"), []byte("foo"), 0644))
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if _, ok := ft.remoteFiles["dummy"]; ok || ft.remoteFiles["dummy/a"] != "foo" {
+		t.Fatalf("file not replaced by directory on remote: %v", ft.remoteFiles)
+	}
+
+	// Commit the directory, then replace it with a file.
+	failOnCmdError(t, localDir, "git", "add", "-A")
+	failOnCmdError(t, localDir, "git", "-c", "user.name=git-sync", "-c", "user.email=git-sync@localhost", "commit", "-q", "-m", "file to dir")
+	failOnErr(t, os.RemoveAll(path.Join(localDir, "dummy")))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "dummy"), []byte("bar"), 0644))
+	fpath, err := topmostMissingDir(localDir, "dummy/a")
+	failOnErr(t, err)
+	if fpath != "dummy" {
+		t.Fatalf("unexpected topmost missing path: %s", fpath)
+	}
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if _, ok := ft.remoteFiles["dummy/a"]; ok || ft.remoteFiles["dummy"] != "bar" {
+		t.Fatalf("directory not replaced by file on remote: %v", ft.remoteFiles)
+	}
+}
+
+func TestFullSyncExplicitDeletes(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	cfg.explicitDeletes = true
+
+	ft.remoteFiles["dummy"] = ""
+	failOnErr(t, os.Remove(path.Join(localDir, "dummy")))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	// The fake rsync would have removed dummy had it been in the manifest.
+	if _, ok := ft.remoteFiles["dummy"]; !ok || ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("unexpected remote files: %v", ft.remoteFiles)
+	}
+	deleted := false
+	for _, script := range ft.remoteCmds {
+		deleted = deleted || strings.Contains(script, "rm -r -q -f --ignore-unmatch -- dummy && cd ")
+	}
+	if !deleted {
+		t.Fatalf("no remote git rm: %v", ft.remoteCmds)
+	}
+}
+
+func TestFullSyncTagRemote(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	cfg.tagRemote = true
+
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	mergeBaseHash, err := gitapi.GetMergeBase(localDir, "origin/master", "HEAD")
+	failOnErr(t, err)
+	last := ft.remoteCmds[len(ft.remoteCmds)-1]
+	if !strings.Contains(last, "update-ref --create-reflog") || !strings.HasSuffix(last, remoteTagRef+" "+mergeBaseHash) {
+		t.Fatalf("remote not tagged last: %v", ft.remoteCmds)
+	}
+
+	// A failed tag doesn't fail the push.
+	ft.respond = func(script string) (string, int) {
+		if strings.Contains(script, "update-ref") {
+			return "", 1
+		}
+		return "", 0
+	}
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("bar"), 0644))
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if ft.remoteFiles["a"] != "bar" {
+		t.Fatalf("unexpected remote files: %v", ft.remoteFiles)
+	}
+}
+
+func TestFullSyncRetry(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	var sleeps []time.Duration
+	origSleep := retrySleep
+	retrySleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	defer func() { retrySleep = origSleep }()
+
+	// Fail the remote reset with the given statuses, then succeed.
+	resets := 0
+	resetFailures := []int{255}
+	ft.respond = func(script string) (string, int) {
+		if !strings.Contains(script, "CHECKOUT_REQUIRED") {
+			return "", 0
+		}
+		resets++
+		if len(resetFailures) > 0 {
+			rc := resetFailures[0]
+			resetFailures = resetFailures[1:]
+			return "", rc
+		}
+		return "", 0
+	}
+	ft.rsyncFailures = []int{12}
+
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if resets != 2 || ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("transport failures not retried: %d resets, remote %v", resets, ft.remoteFiles)
+	}
+	if len(sleeps) != 2 || sleeps[0] != retryInitialBackoff || sleeps[1] != retryInitialBackoff {
+		t.Fatalf("unexpected backoff: %v", sleeps)
+	}
+
+	// Remote command failures are not retried.
+	resets, sleeps = 0, nil
+	resetFailures = []int{1}
+	_, err = fullSync(cfg, localDir)
+	if err == nil || resets != 1 || len(sleeps) != 0 {
+		t.Fatalf("non-transport failure retried: err %v, %d resets, backoff %v", err, resets, sleeps)
+	}
+
+	// Give up after sync.maxRetries, backing off exponentially.
+	resets, sleeps = 0, nil
+	resetFailures = []int{255, 255, 255}
+	_, err = fullSync(cfg, localDir)
+	if err == nil || resets != 1+cfg.maxRetries {
+		t.Fatalf("expected failure after %d retries: err %v, %d resets", cfg.maxRetries, err, resets)
+	}
+	if len(sleeps) != 2 || sleeps[1] != 2*retryInitialBackoff {
+		t.Fatalf("unexpected backoff: %v", sleeps)
+	}
+}
+
+func TestFullSyncPathspecs(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	failOnErr(t, os.Mkdir(path.Join(localDir, "src"), 0755))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "src/a"), []byte("a"), 0644))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "b"), []byte("b"), 0644))
+	pathspecs, err := parsePathspecs(localDir, localDir, []string{"src"})
+	failOnErr(t, err)
+	cfg.pathspecs = pathspecs
+	result, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if len(result.ChangedFiles) != 1 || result.ChangedFiles[0] != "src/a" {
+		t.Fatalf("unexpected changed files: %v", result.ChangedFiles)
+	}
+	if _, ok := ft.remoteFiles["b"]; ok || ft.remoteFiles["src/a"] != "a" {
+		t.Fatalf("pathspec not applied: %v", ft.remoteFiles)
+	}
+	if want := []SkippedFile{{"b", skipReasonPathspec}}; !reflect.DeepEqual(result.SkippedFiles, want) {
+		t.Fatalf("skipped files %v, want %v", result.SkippedFiles, want)
+	}
+	scoped := false
+	for _, script := range ft.remoteCmds {
+		scoped = scoped || strings.Contains(script, "-- src &") && strings.Contains(script, "clean -qfdx")
+	}
+	if !scoped {
+		t.Fatalf("remote clean not scoped: %q", ft.remoteCmds)
+	}
+	if _, err := os.Stat(syncCookiePath(localDir, cfg.remoteName)); !os.IsNotExist(err) {
+		t.Fatalf("sync cookie written by a pathspec push: %v", err)
+	}
+
+	// A full push afterwards sends the rest.
+	cfg.pathspecs = nil
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if ft.remoteFiles["b"] != "b" {
+		t.Fatalf("file outside the pathspec not pushed later: %v", ft.remoteFiles)
+	}
+}
+
+func TestFullSyncExecBitChange(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+
+	// An explicit core.fileMode=false is respected.
+	failOnCmdError(t, localDir, "git", "-C", localDir, "config", "core.fileMode", "false")
+	failOnErr(t, os.Chmod(path.Join(localDir, "dummy"), 0775))
+	result, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if len(result.ChangedFiles) != 0 {
+		t.Fatalf("exec bit change synced with core.fileMode=false: %v", result.ChangedFiles)
+	}
+
+	// git defaults core.fileMode to true when it is unset.
+	failOnCmdError(t, localDir, "git", "-C", localDir, "config", "--unset", "core.fileMode")
+	result, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if len(result.ChangedFiles) != 1 || result.ChangedFiles[0] != "dummy" {
+		t.Fatalf("exec bit change not detected: %v", result.ChangedFiles)
+	}
+	if mode, ok := ft.remoteModes["dummy"]; !ok || mode&0111 == 0 {
+		t.Fatalf("remote mode not updated: %v", ft.remoteModes)
+	}
+}
+
+func TestFullSyncPreflightCmd(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+
+	// A failed preflight leaves the remote untouched.
+	cfg.preflightCmd = "cat > /dev/null; exit 1"
+	if _, err := fullSync(cfg, localDir); err == nil {
+		t.Fatal("push not aborted by a failed preflight")
+	}
+	if len(ft.remoteCmds) != 0 || len(ft.rsyncCmds) != 0 {
+		t.Fatalf("remote touched after a failed preflight: %q %q", ft.remoteCmds, ft.rsyncCmds)
+	}
+
+	manifestPath := path.Join(path.Dir(localDir), "manifest")
+	cfg.preflightCmd = "cat > " + manifestPath
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	data, err := ioutil.ReadFile(manifestPath)
+	failOnErr(t, err)
+	if string(data) != "a\x00" {
+		t.Fatalf("unexpected preflight manifest: %q", data)
+	}
+	if ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("file not pushed after preflight: %v", ft.remoteFiles)
+	}
+}
+
+func TestSyncPullAutoStage(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	cfg.pullAutoStage = true
+
+	// The fake rsync doesn't copy anything, so put the pulled files in place.
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, ".gitignore"), []byte("*.o\n"), 0644))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "dummy"), []byte("changed"), 0644))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "new"), []byte("new"), 0644))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "gen.o"), []byte("gen"), 0644))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "local-only"), []byte("mine"), 0644))
+	ft.respond = func(script string) (string, int) {
+		return " M dummy\x00?? new\x00?? gen.o\x00", 0
+	}
+	_, err := syncPull(cfg, localDir)
+	failOnErr(t, err)
+
+	staged, err := gitapi.GetGitStagedChanges(localDir)
+	failOnErr(t, err)
+	if strings.Join(staged, " ") != "dummy new" {
+		t.Fatalf("unexpected staged files: %v", staged)
+	}
+}
+
+func TestSyncPullDeleteExcluded(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	cfg.excludePaths = []string{"cache/"}
+	cfg.deleteExcluded = true
+
+	failOnErr(t, os.Mkdir(path.Join(localDir, "cache"), 0755))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "cache", "a"), []byte("stale"), 0644))
+	ft.respond = func(script string) (string, int) {
+		if strings.Contains(script, "ls-files -z --others --ignored") {
+			return "cache/a\x00", 0
+		}
+		return " M dummy\x00?? new\x00?? cache/a\x00", 0
+	}
+	changedFiles, err := syncPull(cfg, localDir)
+	failOnErr(t, err)
+	if strings.Join(changedFiles, " ") != "new dummy" {
+		t.Fatalf("unexpected pulled files: %v", changedFiles)
+	}
+	if _, err := os.Stat(path.Join(localDir, "cache", "a")); !os.IsNotExist(err) {
+		t.Fatalf("excluded file not deleted: %v", err)
+	}
+}
+
+func TestCheckLineage(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	rootHash, err := gitapi.GetMergeBase(localDir, "origin/master", "HEAD")
+	failOnErr(t, err)
+
+	ft.respond = func(script string) (string, int) { return "fetched\n", 0 }
+	res, err := checkLineage(cfg, localDir)
+	failOnErr(t, err)
+	if res.mergeBaseHash != rootHash || !res.fetched {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	ft.respond = func(script string) (string, int) { return rootHash + "\n", lineageMissingExitCode }
+	if _, err := checkLineage(cfg, localDir); err == nil || !strings.Contains(err.Error(), "shares history") {
+		t.Fatalf("lagging origin not reported: %v", err)
+	}
+	ft.respond = func(script string) (string, int) { return strings.Repeat("f", 40) + "\n", lineageMissingExitCode }
+	if _, err := checkLineage(cfg, localDir); err == nil || !strings.Contains(err.Error(), "not linked") {
+		t.Fatalf("unrelated repo not reported: %v", err)
+	}
+}
+
+func TestFullSyncDetectRemoteDirty(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	cfg.detectRemoteDirty = true
+	cfg.excludePaths = []string{"build"}
+
+	dirty := "dummy\x00notes.txt\x00"
+	ft.respond = func(script string) (string, int) {
+		if strings.Contains(script, "ls-files -z --others") {
+			return dirty, 0
+		}
+		return "", 0
+	}
+	_, err := fullSync(cfg, localDir)
+	if err == nil || !strings.Contains(err.Error(), "notes.txt") {
+		t.Fatalf("remote changes not reported: %v", err)
+	}
+	if len(ft.remoteCmds) != 1 || len(ft.rsyncCmds) != 0 {
+		t.Fatalf("remote touched despite remote changes: %q %q", ft.remoteCmds, ft.rsyncCmds)
+	}
+	if !strings.Contains(ft.remoteCmds[0], "--exclude=build") {
+		t.Fatalf("sync.excludePaths not applied to the check: %q", ft.remoteCmds[0])
+	}
+
+	// -force pushes over the remote changes without looking.
+	cfg.force = true
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("file not pushed with -force: %v", ft.remoteFiles)
+	}
+	checks := 0
+	for _, script := range ft.remoteCmds {
+		if strings.Contains(script, "ls-files -z --others") {
+			checks++
+		}
+	}
+	if checks != 1 {
+		t.Fatalf("remote checked despite -force: %q", ft.remoteCmds)
+	}
+
+	cfg.force = false
+	dirty = ""
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("bar"), 0644))
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if ft.remoteFiles["a"] != "bar" {
+		t.Fatalf("file not pushed to a clean remote: %v", ft.remoteFiles)
+	}
+}
+
+const benchChangedFiles = 10000
+
+// Write n untracked files spread over 100 directories.
+func writeBenchChangedFiles(b *testing.B, workdir string, n int) []string {
+	fnames := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		fname := fmt.Sprintf("d%02d/f%05d", i%100, i)
+		fpath := path.Join(workdir, fname)
+		failOnErr(b, os.MkdirAll(path.Dir(fpath), 0755))
+		failOnErr(b, ioutil.WriteFile(fpath, []byte(fname), 0644))
+		fnames = append(fnames, fname)
+	}
+	return fnames
+}
+
+// Building the push manifest is the local work that overlaps the remote
+// reset in fullSync.
+func BenchmarkRsyncPushArgs10k(b *testing.B) {
+	localDir, cfg, _ := fakeRepoSetup(b)
+	defer os.RemoveAll(path.Dir(localDir))
+	fnames := writeBenchChangedFiles(b, localDir, benchChangedFiles)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := rsyncPushArgs(cfg, localDir, fnames); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A full sync of 10k changed files, resetting the remote every time.
+func BenchmarkFullSync10k(b *testing.B) {
+	localDir, cfg, ft := fakeRepoSetup(b)
+	defer os.RemoveAll(path.Dir(localDir))
+	writeBenchChangedFiles(b, localDir, benchChangedFiles)
+	defer func(v int) { verbosity = v }(verbosity)
+	verbosity = verbositySilent
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		// Without a cookie every push takes the reset path.
+		if err := os.Remove(syncCookiePath(localDir, cfg.remoteName)); err != nil && !os.IsNotExist(err) {
+			b.Fatal(err)
+		}
+		ft.remoteCmds = nil
+		ft.rsyncCmds = nil
+		b.StartTimer()
+		result, err := fullSync(cfg, localDir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(result.ChangedFiles) != benchChangedFiles {
+			b.Fatalf("got %d changed files, want %d", len(result.ChangedFiles), benchChangedFiles)
+		}
+	}
+}
+
+func TestEmitSyncScript(t *testing.T) {
+	localDir, cfg, _ := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	// Building ssh and rsync commands doesn't run them.
+	cfg.transport = sshTransport{}
+
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "it's"), []byte("foo"), 0644))
+	buf := &strings.Builder{}
+	failOnErr(t, emitSyncScript(cfg, localDir, buf))
+	script := buf.String()
+	for _, want := range []string{
+		"reset to ",
+		"checkout -qf",
+		`  'it'"'"'s' \`,
+		`--files-from "$manifest"`,
+		"ls-files -c -o",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script lacks %q:\n%s", want, script)
+		}
+	}
+	if out, err := exec.Command("/bin/bash", "-n", "-c", script).CombinedOutput(); err != nil {
+		t.Fatalf("invalid script: %s\n%s", err, out)
+	}
+	if _, err := os.Stat(syncCookiePath(localDir, cfg.remoteName)); !os.IsNotExist(err) {
+		t.Fatalf("sync cookie written: %v", err)
+	}
+}
+
+func TestFullSyncDryRun(t *testing.T) {
+	localDir, cfg, _ := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	// Any ssh or rsync to fakehost that did run would fail.
+	cfg.transport = sshTransport{}
+	cfg.dryRun = true
+
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "foo.txt"), []byte("foo"), 0644))
+	res, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if !reflect.DeepEqual(res.ChangedFiles, []string{"foo.txt"}) {
+		t.Errorf("changed files: %v", res.ChangedFiles)
+	}
+	if _, err := os.Stat(syncCookiePath(localDir, cfg.remoteName)); !os.IsNotExist(err) {
+		t.Fatalf("sync cookie written: %v", err)
+	}
+}
+
+func TestPushRemotesRsyncBatch(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+	cfg.rsyncBatchMode = true
+	cfg2 := *cfg
+	cfg2.remoteName = "sync2"
+	cfg2.remoteURL = "fakehost:" + path.Join(path.Dir(localDir), "sync2")
+	ft2 := newFakeTransport()
+	cfg2.transport = ft2
+	hasArg := func(args []string, prefix string) bool {
+		for _, arg := range args {
+			if strings.HasPrefix(arg, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	failOnErr(t, pushRemotes(context.Background(), localDir, []*config{cfg, &cfg2}, false))
+	if len(ft.rsyncCmds) != 1 || !hasArg(ft.rsyncCmds[0], "--write-batch=") {
+		t.Fatalf("first remote didn't write a batch: %q", ft.rsyncCmds)
+	}
+	if len(ft2.rsyncCmds) != 1 || !hasArg(ft2.rsyncCmds[0], "--read-batch=") {
+		t.Fatalf("second remote didn't read the batch: %q", ft2.rsyncCmds)
+	}
+	if ft.remoteFiles["a"] != "foo" || ft2.remoteFiles["a"] != "foo" {
+		t.Fatalf("file not pushed to both remotes: %v %v", ft.remoteFiles, ft2.remoteFiles)
+	}
+
+	// A remote that rejects the batch is pushed to normally.
+	ft2.rsyncCmds = nil
+	ft2.rsyncFailures = []int{23}
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("bar"), 0644))
+	failOnErr(t, pushRemotes(context.Background(), localDir, []*config{cfg, &cfg2}, false))
+	if len(ft2.rsyncCmds) != 2 || hasArg(ft2.rsyncCmds[1], "--read-batch=") {
+		t.Fatalf("no fallback push after a rejected batch: %q", ft2.rsyncCmds)
+	}
+	if ft2.remoteFiles["a"] != "bar" {
+		t.Fatalf("fallback push not applied: %v", ft2.remoteFiles)
+	}
+}
+
+func TestFullSyncOperationInProgress(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	head, err := gitapi.GetHeadCommitHash(localDir)
+	failOnErr(t, err)
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, ".git/MERGE_HEAD"), []byte(head+"\n"), 0644))
+	if _, err := fullSync(cfg, localDir); err == nil || !strings.Contains(err.Error(), "git merge in progress") {
+		t.Fatalf("push during a merge: got %v", err)
+	}
+	if len(ft.rsyncCmds) != 0 || len(ft.remoteCmds) != 0 {
+		t.Fatalf("remote touched during a merge: %v %v", ft.rsyncCmds, ft.remoteCmds)
+	}
+
+	cfg.force = true
+	_, err = fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("forced push not sent: %v", ft.remoteFiles)
+	}
+}
+
+func TestFullSyncLinkedWorktree(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	worktreeDir := path.Join(path.Dir(localDir), "worktree")
+	failOnCmdError(t, localDir, "git", "worktree", "add", "-q", "-b", "worktree", worktreeDir)
+	failOnErr(t, ioutil.WriteFile(path.Join(worktreeDir, "a"), []byte("foo"), 0644))
+	_, err := fullSync(cfg, worktreeDir)
+	failOnErr(t, err)
+	if ft.remoteFiles["a"] != "foo" {
+		t.Fatalf("file not pushed from worktree: %v", ft.remoteFiles)
+	}
+	// The cookie belongs to the worktree, the lock to the whole repository.
+	cookiePath := syncCookiePath(worktreeDir, cfg.remoteName)
+	if !strings.HasPrefix(cookiePath, path.Join(localDir, ".git", "worktrees")+"/") {
+		t.Fatalf("cookie outside the worktree git dir: %s", cookiePath)
+	}
+	if _, err := os.Stat(cookiePath); err != nil {
+		t.Fatalf("no cookie written: %v", err)
+	}
+	if _, err := os.Stat(syncCookiePath(localDir, cfg.remoteName)); !os.IsNotExist(err) {
+		t.Fatalf("worktree sync wrote the main workdir cookie: %v", err)
+	}
+	if got, want := syncLockPath(worktreeDir, cfg.remoteName), syncLockPath(localDir, cfg.remoteName); got != want {
+		t.Fatalf("worktree lock %s, want %s", got, want)
+	}
+}
+
+func TestFullSyncRemoteCleanIgnored(t *testing.T) {
+	localDir, cfg, ft := fakeRepoSetup(t)
+	defer os.RemoveAll(path.Dir(localDir))
+
+	cfg.remoteCleanFlags = remoteCleanIgnored
+	failOnErr(t, ioutil.WriteFile(path.Join(localDir, "a"), []byte("foo"), 0644))
+	_, err := fullSync(cfg, localDir)
+	failOnErr(t, err)
+	if len(ft.remoteCmds) == 0 || !strings.Contains(ft.remoteCmds[0], "clean -qfdX") || strings.Contains(ft.remoteCmds[0], "clean -qfdx") {
+		t.Fatalf("remote clean doesn't keep untracked files: %v", ft.remoteCmds)
+	}
+
+	// The excludes would be removed rather than spared.
+	cfg.excludePaths = []string{"build/"}
+	if err := cfg.checkRemoteCleanFlags(); err == nil {
+		t.Fatalf("sync.excludePaths accepted with sync.remoteCleanFlags=-X")
+	}
+}
+
+func TestRemoteGitFetchCmdForeground(t *testing.T) {
+	cfg := defaultConfig
+	cfg.remoteURL = "fakehost:/src/sync"
+	ft := newFakeTransport()
+	cfg.transport = ft
+
+	for _, foreground := range []bool{false, true} {
+		cfg.foregroundFetch = foreground
+		if _, err := remoteGitFetchCmd(&cfg, "/src/local"); err != nil {
+			t.Fatal(err)
+		}
+		script := ft.remoteCmds[len(ft.remoteCmds)-1]
+		background := strings.HasSuffix(script, "&") || strings.Contains(script, "--nonblock")
+		if background == foreground {
+			t.Errorf("foregroundFetch=%v: unexpected fetch script %q", foreground, script)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package gitapi
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 const safeUnquoted = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789@%_-+=:,./"
 
@@ -26,6 +30,12 @@ func bashQuoteWord(s string) string {
 	return "'" + strings.Replace(s, "'", "'\"'\"'", -1) + "'"
 }
 
+// Return the words of a command, each quoted with BashQuote, as a single line
+// that can be pasted into a shell or written to a script.
+func BashQuoteCmd(args ...string) string {
+	return strings.Join(BashQuote(args...), " ")
+}
+
 func BashQuote(args ...string) []string {
 	out := make([]string, len(args))
 	for i, x := range args {
@@ -33,3 +43,67 @@ func BashQuote(args ...string) []string {
 	}
 	return out
 }
+
+// Split s into words the way bash would, honoring single quotes, double
+// quotes and backslashes, so words quoted with BashQuote read back the same.
+// Nothing is expanded: $, ` and globs are kept literally.
+func BashSplit(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, errors.Errorf("trailing backslash in %q", s)
+			}
+			i++
+			// An escaped newline joins lines.
+			if s[i] == '\n' {
+				continue
+			}
+			word.WriteByte(s[i])
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.Errorf("unterminated single quote in %q", s)
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				// Within double quotes a backslash only escapes these.
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, errors.Errorf("unterminated double quote in %q", s)
+			}
+		default:
+			word.WriteByte(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
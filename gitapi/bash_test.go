@@ -0,0 +1,43 @@
+package gitapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBashSplit(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{"  docker  exec\t-i ", []string{"docker", "exec", "-i"}},
+		{`ssh -o 'ProxyCommand=nc %h %p'`, []string{"ssh", "-o", "ProxyCommand=nc %h %p"}},
+		{`a "b \"c\" \$d \x" e`, []string{"a", `b "c" $d \x`, "e"}},
+		{`it\'s ''`, []string{"it's", ""}},
+		{"a \\\n b", []string{"a", "b"}},
+		{`x"y"'z'`, []string{"xyz"}},
+		{`kubectl exec -i pod -c "my container" --`, []string{"kubectl", "exec", "-i", "pod", "-c", "my container", "--"}},
+	} {
+		got, err := BashSplit(tc.s)
+		if err != nil {
+			t.Errorf("%q: %s", tc.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.s, got, tc.want)
+		}
+	}
+
+	args := []string{"kubectl", "exec", "-c", "my container", "it's", "$HOME", ""}
+	if got, err := BashSplit(strings.Join(BashQuote(args...), " ")); err != nil || !reflect.DeepEqual(got, args) {
+		t.Errorf("round trip: got %q, %v", got, err)
+	}
+
+	for _, s := range []string{`'a`, `"a`, `a\`} {
+		if got, err := BashSplit(s); err == nil {
+			t.Errorf("%q: expected an error, got %q", s, got)
+		}
+	}
+}
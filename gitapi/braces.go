@@ -0,0 +1,128 @@
+package gitapi
+
+import (
+	"github.com/pkg/errors"
+)
+
+// A pattern may expand to at most this many patterns, so a typo can't turn
+// into millions of git clean arguments.
+const MaxBraceExpansions = 256
+
+// Expand shell-style braces in a pattern, so build/{debug,release}/ becomes
+// build/debug/ and build/release/. Braces nest, an alternative may be empty
+// and a backslash keeps the next character literal. As in bash, braces
+// without a comma are left alone. Unbalanced braces, an empty result and more
+// than MaxBraceExpansions patterns are errors.
+func ExpandBraces(pattern string) ([]string, error) {
+	expanded, err := expandBraces(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range expanded {
+		if p == "" {
+			return nil, errors.Errorf("%q expands to an empty pattern", pattern)
+		}
+	}
+	return expanded, nil
+}
+
+func expandBraces(s string) ([]string, error) {
+	open := indexUnescaped(s, '{')
+	if open < 0 {
+		if indexUnescaped(s, '}') >= 0 {
+			return nil, errors.Errorf("unbalanced } in %q", s)
+		}
+		return []string{s}, nil
+	}
+	if indexUnescaped(s[:open], '}') >= 0 {
+		return nil, errors.Errorf("unbalanced } in %q", s)
+	}
+
+	// Find the matching brace and the commas at its level.
+	depth := 0
+	close := -1
+	parts := make([]string, 0, 4)
+	start := open + 1
+	for i := open; i < len(s) && close < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				close = i
+			}
+		case ',':
+			if depth == 1 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if close < 0 {
+		return nil, errors.Errorf("unbalanced { in %q", s)
+	}
+
+	alts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		expanded, err := expandBraces(part)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 1 {
+			// A single alternative is literal, though it may hold a group.
+			for i := range expanded {
+				expanded[i] = "{" + expanded[i] + "}"
+			}
+		}
+		alts = append(alts, expanded...)
+		if len(alts) > MaxBraceExpansions {
+			return nil, errors.Errorf("%q expands to more than %d patterns", s, MaxBraceExpansions)
+		}
+	}
+	rest, err := expandBraces(s[close+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(alts)*len(rest) > MaxBraceExpansions {
+		return nil, errors.Errorf("%q expands to more than %d patterns", s, MaxBraceExpansions)
+	}
+
+	prefix := s[:open]
+	expanded := make([]string, 0, len(alts)*len(rest))
+	for _, alt := range alts {
+		for _, r := range rest {
+			expanded = append(expanded, prefix+alt+r)
+		}
+	}
+	return expanded, nil
+}
+
+// Return the index of the first c not escaped with a backslash, or -1.
+func indexUnescaped(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+// Expand the braces in each pattern, keeping their order.
+func ExpandBracesAll(patterns []string) ([]string, error) {
+	expanded := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		ps, err := ExpandBraces(pattern)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, ps...)
+	}
+	return expanded, nil
+}
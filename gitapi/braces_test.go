@@ -0,0 +1,36 @@
+package gitapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandBraces(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"build", []string{"build"}},
+		{"build/{debug,release}/", []string{"build/debug/", "build/release/"}},
+		{"{a,b}/{c,d}", []string{"a/c", "a/d", "b/c", "b/d"}},
+		{"out{,-{arm,x86}}", []string{"out", "out-arm", "out-x86"}},
+		{"{single}", []string{"{single}"}},
+		{`lit\{a,b\}`, []string{`lit\{a,b\}`}},
+	} {
+		got, err := ExpandBraces(tc.pattern)
+		if err != nil {
+			t.Errorf("%q: %s", tc.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.pattern, got, tc.want)
+		}
+	}
+
+	for _, pattern := range []string{"{a,b", "a,b}", "}{a,b}", "{,}", strings.Repeat("{a,b,c,d}", 5)} {
+		if got, err := ExpandBraces(pattern); err == nil {
+			t.Errorf("%q: expected an error, got %q", pattern, got)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"path"
 	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/msolo/go-bis/glug"
 	"github.com/pkg/errors"
@@ -16,6 +17,13 @@ import (
 type Cmd struct {
 	*exec.Cmd
 	trace bool
+
+	// State for recording, see record.go.
+	recordSeq         int
+	startTime         time.Time
+	stdoutCapture     *capturedOutput
+	stderrCapture     *capturedOutput
+	restoreExitStderr bool
 }
 
 var trace bool
@@ -72,18 +80,37 @@ func (cmd *Cmd) Run() error {
 	if cmd.trace {
 		defer log.Tracef("perf: {{.traceDurationStr}} exec: {{.cmdStr}}", map[string]interface{}{"cmdStr": cmd.bashString()}).Finish()
 	}
-	return wrapErr(cmd.Cmd.Run(), cmd.Cmd)
+	cmd.startRecording(true, true)
+	err := cmd.Cmd.Run()
+	cmd.finishRecording(nil, err)
+	return wrapErr(err, cmd.Cmd)
+}
+
+func (cmd *Cmd) Start() error {
+	// Stdout is usually a pipe read by the caller, so it is not recorded.
+	cmd.startRecording(false, true)
+	err := cmd.Cmd.Start()
+	if err != nil {
+		cmd.finishRecording(nil, err)
+	}
+	return err
 }
 
 func (cmd *Cmd) Wait() error {
-	return wrapErr(cmd.Cmd.Wait(), cmd.Cmd)
+	err := cmd.Cmd.Wait()
+	cmd.finishRecording(nil, err)
+	return wrapErr(err, cmd.Cmd)
 }
 
 func (cmd *Cmd) Output() ([]byte, error) {
 	if cmd.trace {
 		defer log.Tracef("perf: {{.traceDurationStr}} exec: {{.cmdStr}}", map[string]interface{}{"cmdStr": cmd.bashString()}).Finish()
 	}
+	// Output only keeps stderr for the error when nothing else reads it.
+	cmd.restoreExitStderr = cmd.Stderr == nil
+	cmd.startRecording(false, true)
 	data, err := cmd.Cmd.Output()
+	cmd.finishRecording(data, err)
 	err = wrapErr(err, cmd.Cmd)
 	return data, err
 }
@@ -92,7 +119,10 @@ func (cmd *Cmd) CombinedOutput() ([]byte, error) {
 	if cmd.trace {
 		defer log.Tracef("perf: {{.traceDurationStr}} exec: {{.cmdStr}}", map[string]interface{}{"cmdStr": cmd.bashString()}).Finish()
 	}
+	// Stdout and stderr must be unset, so only the combined output is recorded.
+	cmd.startRecording(false, false)
 	data, err := cmd.Cmd.CombinedOutput()
+	cmd.finishRecording(data, err)
 	err = wrapErr(err, cmd.Cmd)
 	return data, err
 }
@@ -1,17 +1,26 @@
 package gitapi
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"io"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/msolo/go-bis/glug"
 	"github.com/pkg/errors"
 )
 
+// Return the workdir containing the current dir, found by walking up to the
+// first .git. That is a dir in the main worktree and a file in a linked one,
+// see GitDir. Outside of a workdir, say in a bare repository, it is "".
 func GitWorkdir() string {
 	//	args := []string{"git", "rev-parse", "--show-toplevel"}
 	wd, err := os.Getwd()
@@ -31,6 +40,42 @@ func GitWorkdir() string {
 	return ""
 }
 
+// Return the current dir relative to workdir, as a slash-separated path that
+// is "." at the top. Like git, this is the prefix for pathspecs given on the
+// command line.
+func RelativePathFromRoot(workdir string) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return RelativePath(workdir, cwd)
+}
+
+// Return dir relative to workdir, see RelativePathFromRoot. Either may have
+// been reached through a symlink, so if dir isn't below workdir as given, it
+// is checked again with symlinks resolved in both.
+func RelativePath(workdir string, dir string) (string, error) {
+	relPath, err := filepath.Rel(workdir, dir)
+	if err != nil || isOutside(relPath) {
+		resolvedWorkdir, wdErr := filepath.EvalSymlinks(workdir)
+		resolvedDir, dirErr := filepath.EvalSymlinks(dir)
+		if wdErr == nil && dirErr == nil {
+			relPath, err = filepath.Rel(resolvedWorkdir, resolvedDir)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if isOutside(relPath) {
+		return "", errors.Errorf("%s is outside the workdir %s", dir, workdir)
+	}
+	return filepath.ToSlash(relPath), nil
+}
+
+func isOutside(relPath string) bool {
+	return relPath == ".." || strings.HasPrefix(relPath, "../")
+}
+
 type gitWorkDir struct {
 	dir string
 }
@@ -59,7 +104,12 @@ func (gc gitConfig) Get(key string) string {
 }
 
 func (wd *gitWorkDir) GitConfig() (GitConfig, error) {
-	gitCmd := wd.gitCommand("config", "-z", "-l")
+	return wd.GitConfigContext(context.Background())
+}
+
+// Like GitConfig, but git is killed if ctx is done first.
+func (wd *gitWorkDir) GitConfigContext(ctx context.Context) (GitConfig, error) {
+	gitCmd := wd.gitCommandContext(ctx, "config", "-z", "-l")
 	output, err := gitCmd.Output()
 	if err != nil {
 		return nil, errors.WithMessage(err, "git config failed")
@@ -96,31 +146,123 @@ func GetRestrictedEnv() []string {
 	return env
 }
 
-func (wd *gitWorkDir) gitCommand(args ...string) *Cmd {
+func (wd *gitWorkDir) gitCommandContext(ctx context.Context, args ...string) *Cmd {
 	gitArgs := []string{}
 	if wd.dir != "" {
 		gitArgs = append(gitArgs, "-C", wd.dir)
 	}
 	gitArgs = append(gitArgs, args...)
-	cmd := Command("git", gitArgs...)
+	cmd := CommandContext(ctx, "git", gitArgs...)
 	cmd.Stderr = os.Stderr
 	cmd.Env = GetRestrictedEnv()
 	return cmd
 }
 
-func GetMergeBaseCommitHash(workdir string) (string, error) {
+// NoMergeBaseError is returned by GetMergeBase when the refs share no
+// history, as opposed to a failure to run git or resolve a ref.
+type NoMergeBaseError struct {
+	RefA string
+	RefB string
+}
+
+func (e *NoMergeBaseError) Error() string {
+	return "no merge base for " + e.RefA + " and " + e.RefB
+}
+
+// Return the hash of the best common ancestor of two refs. If they have none
+// the error is a *NoMergeBaseError.
+func GetMergeBase(workdir string, refA string, refB string) (string, error) {
+	return GetMergeBaseContext(context.Background(), workdir, refA, refB)
+}
+
+// Like GetMergeBase, but git is killed if ctx is done first.
+func GetMergeBaseContext(ctx context.Context, workdir string, refA string, refB string) (string, error) {
 	gwd := gitWorkDir{workdir}
-	gitCmd := gwd.gitCommand("merge-base", "origin/master", "HEAD")
+	gitCmd := gwd.gitCommandContext(ctx, "merge-base", refA, refB)
 	out, err := gitCmd.Output()
 	if err != nil {
+		// git merge-base exits 1 without output for unrelated histories and
+		// with 128 for everything else.
+		if rc, rcErr := ExitStatus(err); rcErr == nil && rc == 1 {
+			return "", &NoMergeBaseError{refA, refB}
+		}
 		return "", err
 	}
 	return string(bytes.TrimSpace(out)), nil
 }
 
+// ErrNoUpstream is returned by GetUpstreamRef when the current branch has no
+// upstream configured, its upstream is gone from the remote, or HEAD is not on
+// a branch at all.
+var ErrNoUpstream = errors.New("no upstream configured")
+
+// Return the upstream of the current branch, such as "origin/main". If there
+// is none the error is ErrNoUpstream, so callers can fall back to a default.
+func GetUpstreamRef(workdir string) (string, error) {
+	return GetUpstreamRefContext(context.Background(), workdir)
+}
+
+// Like GetUpstreamRef, but git is killed if ctx is done first.
+func GetUpstreamRefContext(ctx context.Context, workdir string) (string, error) {
+	gwd := &gitWorkDir{workdir}
+	gitCmd := gwd.gitCommandContext(ctx, "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{upstream}")
+	// A missing upstream is expected, so git's complaint is kept for the
+	// error rather than printed.
+	gitCmd.Stderr = nil
+	out, err := gitCmd.Output()
+	if err == nil {
+		return string(bytes.TrimSpace(out)), nil
+	}
+	// rev-parse exits 128 for any failure, so the branch config tells a
+	// missing upstream apart from a broken one.
+	// git symbolic-ref and git config both exit 1 for a missing entry.
+	out, refErr := gwd.gitCommandContext(ctx, "symbolic-ref", "-q", "--short", "HEAD").Output()
+	if refErr != nil {
+		if rc, rcErr := ExitStatus(refErr); rcErr == nil && rc == 1 {
+			return "", ErrNoUpstream
+		}
+		return "", refErr
+	}
+	branch := string(bytes.TrimSpace(out))
+	if _, cfgErr := gwd.gitCommandContext(ctx, "config", "branch."+branch+".merge").Output(); cfgErr != nil {
+		if rc, rcErr := ExitStatus(cfgErr); rcErr == nil && rc == 1 {
+			return "", ErrNoUpstream
+		}
+	}
+	// A remote branch deleted and pruned since leaves the config behind, and
+	// is no more use than no upstream at all.
+	track, trackErr := gwd.gitCommandContext(ctx, "for-each-ref", "--format=%(upstream:track)", "refs/heads/"+branch).Output()
+	if trackErr == nil && string(bytes.TrimSpace(track)) == "[gone]" {
+		return "", ErrNoUpstream
+	}
+	return "", errors.Wrapf(err, "unable to resolve the upstream of %s", branch)
+}
+
+// Return the merge base of HEAD and the upstream of the current branch, or
+// origin/master if it has none.
+func GetMergeBaseCommitHash(workdir string) (string, error) {
+	return GetMergeBaseCommitHashContext(context.Background(), workdir)
+}
+
+// Like GetMergeBaseCommitHash, but git is killed if ctx is done first.
+func GetMergeBaseCommitHashContext(ctx context.Context, workdir string) (string, error) {
+	upstream, err := GetUpstreamRefContext(ctx, workdir)
+	if err == ErrNoUpstream {
+		upstream = "origin/master"
+	} else if err != nil {
+		return "", err
+	}
+	return GetMergeBaseContext(ctx, workdir, upstream, "HEAD")
+}
+
 func GetHeadCommitHash(workdir string) (string, error) {
+	return GetHeadCommitHashContext(context.Background(), workdir)
+}
+
+// Like GetHeadCommitHash, but git is killed if ctx is done first.
+func GetHeadCommitHashContext(ctx context.Context, workdir string) (string, error) {
 	gwd := gitWorkDir{workdir}
-	gitCmd := gwd.gitCommand("rev-parse", "HEAD")
+	gitCmd := gwd.gitCommandContext(ctx, "rev-parse", "HEAD")
 	out, err := gitCmd.Output()
 	if err != nil {
 		return "", err
@@ -128,15 +270,200 @@ func GetHeadCommitHash(workdir string) (string, error) {
 	return string(bytes.TrimSpace(out)), nil
 }
 
-func ParsePorcelainStatus(data []byte) (modifiedFiles []string, untrackedFiles []string, renamedFiles []string, unstagedFiles []string, err error) {
+// Resolve a revision, such as a branch name or abbreviated hash, to the full
+// hash of a commit.
+func ResolveCommitHash(workdir string, rev string) (string, error) {
+	return ResolveCommitHashContext(context.Background(), workdir, rev)
+}
+
+// Like ResolveCommitHash, but git is killed if ctx is done first.
+func ResolveCommitHashContext(ctx context.Context, workdir string, rev string) (string, error) {
+	gwd := gitWorkDir{workdir}
+	gitCmd := gwd.gitCommandContext(ctx, "rev-parse", "--verify", "-q", rev+"^{commit}")
+	out, err := gitCmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to resolve commit %q", rev)
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// A position a ref held, as recorded in its reflog.
+type ReflogEntry struct {
+	Hash string
+	// When the ref moved there, not when the commit was made.
+	Time time.Time
+	// Why it moved, such as "checkout: moving from main to topic".
+	Message string
+}
+
+// Return the last n entries of the reflog for ref, newest first, so entry i
+// is ref@{i}. If n <= 0 the whole reflog is returned.
+func GetReflog(workdir string, ref string, n int) ([]ReflogEntry, error) {
+	return GetReflogContext(context.Background(), workdir, ref, n)
+}
+
+// Like GetReflog, but git is killed if ctx is done first.
+func GetReflogContext(ctx context.Context, workdir string, ref string, n int) ([]ReflogEntry, error) {
+	gwd := gitWorkDir{workdir}
+	// With --date=unix the selector is ref@{<unix time>}.
+	args := []string{"reflog", "show", "--date=unix", "--format=%H %gd %gs"}
+	if n > 0 {
+		args = append(args, "-n", strconv.Itoa(n))
+	}
+	args = append(args, ref, "--")
+	out, err := gwd.gitCommandContext(ctx, args...).Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the reflog for %q", ref)
+	}
+	var entries []ReflogEntry
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			return nil, errors.Errorf("invalid reflog entry: %q", line)
+		}
+		selector := fields[1]
+		i := strings.LastIndex(selector, "@{")
+		if i < 0 || !strings.HasSuffix(selector, "}") {
+			return nil, errors.Errorf("invalid reflog selector: %q", line)
+		}
+		ts, err := strconv.ParseInt(selector[i+2:len(selector)-1], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid reflog time: %q", line)
+		}
+		entry := ReflogEntry{Hash: fields[0], Time: time.Unix(ts, 0)}
+		if len(fields) == 3 {
+			entry.Message = fields[2]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Operations that git can leave unfinished in a workdir, as returned by
+// RepoOperationInProgress.
+const (
+	OperationMerge      = "merge"
+	OperationRebase     = "rebase"
+	OperationAm         = "am"
+	OperationCherryPick = "cherry-pick"
+	OperationRevert     = "revert"
+)
+
+// Return the operation in progress in the workdir, such as a merge or a
+// rebase stopped on a conflict, or "" if there is none.
+func RepoOperationInProgress(workdir string) (string, error) {
+	return RepoOperationInProgressContext(context.Background(), workdir)
+}
+
+// Like RepoOperationInProgress, but git is killed if ctx is done first.
+func RepoOperationInProgressContext(ctx context.Context, workdir string) (string, error) {
+	gwd := &gitWorkDir{workdir}
+	out, err := gwd.gitCommandContext(ctx, "rev-parse", "--absolute-git-dir").Output()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find the git dir")
+	}
+	gitDir := string(bytes.TrimSpace(out))
+	// A rebase can stop on a merge or a cherry-pick of its own, so it is
+	// checked first.
+	markers := []struct {
+		fname     string
+		operation string
+	}{
+		{"rebase-merge", OperationRebase},
+		{"rebase-apply/applying", OperationAm},
+		{"rebase-apply", OperationRebase},
+		{"MERGE_HEAD", OperationMerge},
+		{"CHERRY_PICK_HEAD", OperationCherryPick},
+		{"REVERT_HEAD", OperationRevert},
+	}
+	for _, m := range markers {
+		_, err := os.Stat(path.Join(gitDir, m.fname))
+		if err == nil {
+			return m.operation, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// Return the hash of the tree for ref, or for the index if ref is empty. Two
+// checkouts with the same tree hash have identical tracked contents, which
+// makes it a cheap way to compare them.
+func GetTreeHash(workdir string, ref string) (string, error) {
+	return GetTreeHashContext(context.Background(), workdir, ref)
+}
+
+// Like GetTreeHash, but git is killed if ctx is done first.
+func GetTreeHashContext(ctx context.Context, workdir string, ref string) (string, error) {
+	gwd := gitWorkDir{workdir}
+	var gitCmd *Cmd
+	if ref == "" {
+		gitCmd = gwd.gitCommandContext(ctx, "write-tree")
+	} else {
+		gitCmd = gwd.gitCommandContext(ctx, "rev-parse", "--verify", "-q", ref+"^{tree}")
+	}
+	out, err := gitCmd.Output()
+	if err != nil {
+		if ref == "" {
+			return "", errors.Wrap(err, "unable to write the index tree")
+		}
+		return "", errors.Wrapf(err, "unable to resolve tree %q", ref)
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// The files git status reports, by kind. A file can be in several of the
+// lists, and Modified holds all of them.
+type GitStatus struct {
+	// Every changed or untracked file, including both sides of a rename.
+	Modified []string
+	// Files git doesn't track.
+	Untracked []string
+	// The original paths of renamed files.
+	Renamed []string
+	// Tracked files changed in the worktree since they were last added. A
+	// rename is only reported as such.
+	Unstaged []string
+	// Files with changes added to the index, including the new path of a
+	// rename or copy.
+	Staged []string
+}
+
+// Parse the output of git status -z --porcelain. Output cut short, say by a
+// git killed mid-write, is an error: every record ends with a NUL, has a two
+// letter status, a space and a path, and a rename has its original path in
+// the record that follows. A copy has its source there too, but the source
+// is unchanged so it is not reported. A type change, T, is reported like a
+// modification.
+func ParseGitStatus(data []byte) (*GitStatus, error) {
+	if len(data) > 0 && data[len(data)-1] != 0 {
+		return nil, errors.New("truncated git status output, the last entry has no NUL")
+	}
 	entries := SplitNullTerminated(string(data))
-	modifiedFiles = make([]string, 0, 16)
-	unstagedFiles = make([]string, 0, 16)
-	untrackedFiles = make([]string, 0, 16)
-	renamedFiles = make([]string, 0, 16)
+	st := &GitStatus{
+		Modified:  make([]string, 0, 16),
+		Untracked: make([]string, 0, 16),
+		Renamed:   make([]string, 0, 16),
+		Unstaged:  make([]string, 0, 16),
+		Staged:    make([]string, 0, 16),
+	}
 	for i := 0; i < len(entries); i++ {
-		entry := entries[i]
-		status, fname := entry[:2], entry[3:]
+		cf, err := parseStatusEntry(entries[i], func() (string, bool) {
+			if i+1 >= len(entries) {
+				return "", false
+			}
+			i++
+			return entries[i], true
+		})
+		if err != nil {
+			return nil, err
+		}
+		status, fname := cf.Status, cf.Path
 		if status == "UU" {
 			// Ignore merge conflicts. They have to be resolved by hand
 			// anyway, which will require another sync.
@@ -144,39 +471,168 @@ func ParsePorcelainStatus(data []byte) (modifiedFiles []string, untrackedFiles [
 			continue
 		}
 
-		modifiedFiles = append(modifiedFiles, fname)
-		if status[0] == 'R' {
-			// Rename is encoded strangely in null-terminated mode:
-			// R  twinsies -> twinsies-2
-			// R  twinsies-2\0twinsies\0
-			i++
-			renamedFile := entries[i]
-			modifiedFiles = append(modifiedFiles, renamedFile)
-			renamedFiles = append(renamedFiles, renamedFile)
+		st.Modified = append(st.Modified, fname)
+		if status[0] != ' ' && status[0] != '?' {
+			st.Staged = append(st.Staged, fname)
+		}
+		if status[0] == 'R' || status[0] == 'C' {
+			// The source of a copy is left as it was.
+			if status[0] == 'R' {
+				st.Modified = append(st.Modified, cf.OrigPath)
+				st.Renamed = append(st.Renamed, cf.OrigPath)
+			}
 		} else if status == "??" {
-			untrackedFiles = append(untrackedFiles, fname)
+			st.Untracked = append(st.Untracked, fname)
 		} else if status[1] != ' ' {
-			unstagedFiles = append(unstagedFiles, fname)
+			st.Unstaged = append(st.Unstaged, fname)
 		}
 	}
-	return modifiedFiles, untrackedFiles, renamedFiles, unstagedFiles, nil
+	return st, nil
 }
 
+// Like ParseGitStatus, but the lists are returned separately and staged
+// files are left out.
+func ParsePorcelainStatus(data []byte) (modifiedFiles []string, untrackedFiles []string, renamedFiles []string, unstagedFiles []string, err error) {
+	st, err := ParseGitStatus(data)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return st.Modified, st.Untracked, st.Renamed, st.Unstaged, nil
+}
+
+// Return the files git status reports as changed or untracked. A chmod alone
+// is reported unless core.fileMode is false, git's default being true, so an
+// explicit false is left to mean the executable bit isn't to be trusted.
 func GetGitStatus(workdir string) (changedFiles []string, err error) {
+	return GetGitStatusContext(context.Background(), workdir)
+}
+
+// Like GetGitStatus, but git is killed if ctx is done first.
+func GetGitStatusContext(ctx context.Context, workdir string) (changedFiles []string, err error) {
+	st, err := GetGitStatusDetailedContext(ctx, workdir)
+	if err != nil {
+		return nil, err
+	}
+	return st.Modified, nil
+}
+
+// Like GetGitStatus, but the files are broken down by kind.
+func GetGitStatusDetailed(workdir string) (*GitStatus, error) {
+	return GetGitStatusDetailedContext(context.Background(), workdir)
+}
+
+// Like GetGitStatusDetailed, but git is killed if ctx is done first.
+func GetGitStatusDetailedContext(ctx context.Context, workdir string) (*GitStatus, error) {
 	gwd := &gitWorkDir{workdir}
-	cmd := gwd.gitCommand("status", "-z", "--porcelain", "--untracked-files=all")
+	cmd := gwd.gitCommandContext(ctx, "status", "-z", "--porcelain", "--untracked-files=all")
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, err
 	}
-	changedFiles, _, _, _, err = ParsePorcelainStatus(stdout)
-	return changedFiles, err
+	return ParseGitStatus(stdout)
+}
+
+// A single entry from git status --porcelain.
+type ChangedFile struct {
+	// Two letter status code, such as "M ", " D" or "??".
+	Status string
+	Path   string
+	// The source path of a rename or copy, otherwise empty.
+	OrigPath string
+}
+
+// Parse a single git status -z --porcelain entry. Rather than the
+// "R  twinsies -> twinsies-2" of plain porcelain, the source of a rename or
+// copy follows as an entry of its own, "R  twinsies-2\0twinsies\0", so it is
+// read with next.
+func parseStatusEntry(entry string, next func() (string, bool)) (ChangedFile, error) {
+	if len(entry) < 4 || entry[2] != ' ' {
+		return ChangedFile{}, errors.Errorf("malformed git status entry %q", entry)
+	}
+	cf := ChangedFile{Status: entry[:2], Path: entry[3:]}
+	if cf.Status[0] == 'R' || cf.Status[0] == 'C' {
+		origPath, ok := next()
+		if !ok || origPath == "" {
+			return ChangedFile{}, errors.Errorf("git status entry %q is missing its original path", entry)
+		}
+		cf.OrigPath = origPath
+	}
+	return cf, nil
+}
+
+// Split on the null terminators used by git's -z output.
+func scanNullTerminated(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return 0, nil, errors.Errorf("unterminated status entry: %q", data)
+	}
+	return 0, nil, nil
+}
+
+// Read git status -z --porcelain output from r, invoking fn for each entry.
+func scanGitStatus(r io.Reader, fn func(ChangedFile) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(scanNullTerminated)
+	for scanner.Scan() {
+		cf, err := parseStatusEntry(scanner.Text(), func() (string, bool) {
+			if !scanner.Scan() {
+				return "", false
+			}
+			return scanner.Text(), true
+		})
+		if err != nil {
+			if scanErr := scanner.Err(); scanErr != nil {
+				return scanErr
+			}
+			return err
+		}
+		if err := fn(cf); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Run git status and invoke fn for each entry as it is parsed, rather than
+// buffering the full output. Unlike GetGitStatus, unmerged entries are passed
+// through. If fn returns an error, git is killed and that error is returned.
+func StreamGitStatus(ctx context.Context, workdir string, fn func(ChangedFile) error) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	gwd := &gitWorkDir{workdir}
+	cmd := gwd.gitCommandContext(ctx, "status", "-z", "--porcelain", "--untracked-files=all")
+	if cmd.trace {
+		defer log.Tracef("perf: {{.traceDurationStr}} exec: {{.cmdStr}}", map[string]interface{}{"cmdStr": cmd.bashString()}).Finish()
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if parseErr := scanGitStatus(stdout, fn); parseErr != nil {
+		// Stop git rather than draining the rest of its output.
+		cancel()
+		cmd.Wait()
+		return parseErr
+	}
+	return cmd.Wait()
 }
 
 // Return all files that were changed in a given commit.
 func GetGitCommitChanges(workdir string, commitHash string) (changedFiles []string, err error) {
+	return GetGitCommitChangesContext(context.Background(), workdir, commitHash)
+}
+
+// Like GetGitCommitChanges, but git is killed if ctx is done first.
+func GetGitCommitChangesContext(ctx context.Context, workdir string, commitHash string) (changedFiles []string, err error) {
 	gwd := &gitWorkDir{workdir}
-	cmd := gwd.gitCommand("diff-tree", "--no-commit-id", "-z", "-r", "--name-only", commitHash)
+	cmd := gwd.gitCommandContext(ctx, "diff-tree", "--no-commit-id", "-z", "-r", "--name-only", commitHash)
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -187,8 +643,30 @@ func GetGitCommitChanges(workdir string, commitHash string) (changedFiles []stri
 
 // Return all files that have been changed on HEAD relative to the merge base.
 func GetGitDiffChanges(workdir string, mergeBaseHash string) (changedFiles []string, err error) {
+	return GetGitDiffChangesContext(context.Background(), workdir, mergeBaseHash)
+}
+
+// Like GetGitDiffChanges, but git is killed if ctx is done first.
+func GetGitDiffChangesContext(ctx context.Context, workdir string, mergeBaseHash string) (changedFiles []string, err error) {
 	gwd := &gitWorkDir{workdir}
-	cmd := gwd.gitCommand("diff", "-z", "--no-renames", "--name-only", "HEAD", mergeBaseHash)
+	cmd := gwd.gitCommandContext(ctx, "diff", "-z", "--no-renames", "--name-only", "HEAD", mergeBaseHash)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	changedFiles = SplitNullTerminated(string(stdout))
+	return changedFiles, nil
+}
+
+// Return all files that differ between two arbitrary commits.
+func GetGitRangeChanges(workdir string, fromHash string, toHash string) (changedFiles []string, err error) {
+	return GetGitRangeChangesContext(context.Background(), workdir, fromHash, toHash)
+}
+
+// Like GetGitRangeChanges, but git is killed if ctx is done first.
+func GetGitRangeChangesContext(ctx context.Context, workdir string, fromHash string, toHash string) (changedFiles []string, err error) {
+	gwd := &gitWorkDir{workdir}
+	cmd := gwd.gitCommandContext(ctx, "diff", "-z", "--no-renames", "--name-only", fromHash, toHash)
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -198,8 +676,13 @@ func GetGitDiffChanges(workdir string, mergeBaseHash string) (changedFiles []str
 }
 
 func GetGitStagedChanges(workdir string) (changedFiles []string, err error) {
+	return GetGitStagedChangesContext(context.Background(), workdir)
+}
+
+// Like GetGitStagedChanges, but git is killed if ctx is done first.
+func GetGitStagedChangesContext(ctx context.Context, workdir string) (changedFiles []string, err error) {
 	gwd := &gitWorkDir{workdir}
-	cmd := gwd.gitCommand("diff", "-z", "--no-renames", "--name-only", "--staged")
+	cmd := gwd.gitCommandContext(ctx, "diff", "-z", "--no-renames", "--name-only", "--staged")
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -209,8 +692,13 @@ func GetGitStagedChanges(workdir string) (changedFiles []string, err error) {
 }
 
 func GetGitUnstagedChanges(workdir string) (changedFiles []string, err error) {
+	return GetGitUnstagedChangesContext(context.Background(), workdir)
+}
+
+// Like GetGitUnstagedChanges, but git is killed if ctx is done first.
+func GetGitUnstagedChangesContext(ctx context.Context, workdir string) (changedFiles []string, err error) {
 	gwd := &gitWorkDir{workdir}
-	cmd := gwd.gitCommand("diff", "-z", "--no-renames", "--name-only")
+	cmd := gwd.gitCommandContext(ctx, "diff", "-z", "--no-renames", "--name-only")
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -219,22 +707,109 @@ func GetGitUnstagedChanges(workdir string) (changedFiles []string, err error) {
 	return changedFiles, nil
 }
 
-// Return a list of ignored files.
+// Return all files in the index, relative to workdir, including those
+// deleted from the working tree but not yet staged.
+func GetGitTrackedFiles(workdir string) (trackedFiles []string, err error) {
+	return GetGitTrackedFilesContext(context.Background(), workdir)
+}
+
+// Like GetGitTrackedFiles, but git is killed if ctx is done first.
+func GetGitTrackedFilesContext(ctx context.Context, workdir string) (trackedFiles []string, err error) {
+	gwd := &gitWorkDir{workdir}
+	cmd := gwd.gitCommandContext(ctx, "ls-files", "-z", "--cached")
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	trackedFiles = SplitNullTerminated(string(stdout))
+	return trackedFiles, nil
+}
+
+// Return all untracked files that are not ignored, relative to workdir.
+// Unlike git status, files in untracked directories are listed individually.
+func GetGitUntrackedFiles(workdir string) (untrackedFiles []string, err error) {
+	return GetGitUntrackedFilesContext(context.Background(), workdir)
+}
+
+// Like GetGitUntrackedFiles, but git is killed if ctx is done first.
+func GetGitUntrackedFilesContext(ctx context.Context, workdir string) (untrackedFiles []string, err error) {
+	gwd := &gitWorkDir{workdir}
+	cmd := gwd.gitCommandContext(ctx, "ls-files", "-z", "--others", "--exclude-standard")
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	untrackedFiles = SplitNullTerminated(string(stdout))
+	return untrackedFiles, nil
+}
+
+const (
+	// GitCheckIgnore gives up after this long. Callers with a different
+	// budget pass their own deadline to GitCheckIgnoreContext.
+	checkIgnoreTimeout = 5 * time.Second
+	// Paths are fed to check-ignore in chunks of roughly this many bytes so a
+	// huge file set can't stall on a single enormous stdin write.
+	checkIgnoreChunkSize = 64 * 1024
+)
+
+// Stage the given files, including deletions of files that no longer exist
+// in the working tree.
+func GitAdd(workdir string, filePaths []string) error {
+	return GitAddContext(context.Background(), workdir, filePaths)
+}
+
+// Like GitAdd, but git is killed if ctx is done first.
+func GitAddContext(ctx context.Context, workdir string, filePaths []string) error {
+	if len(filePaths) == 0 {
+		return nil
+	}
+	gwd := &gitWorkDir{workdir}
+	args := append([]string{"add", "-A", "--"}, filePaths...)
+	_, err := gwd.gitCommandContext(ctx, args...).Output()
+	return err
+}
+
+// Return a list of ignored files, giving up after 5 seconds.
 func GitCheckIgnore(workdir string, filePaths []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkIgnoreTimeout)
+	defer cancel()
+	return GitCheckIgnoreContext(ctx, workdir, filePaths)
+}
+
+// Return a list of ignored files, giving up when ctx is done.
+func GitCheckIgnoreContext(ctx context.Context, workdir string, filePaths []string) ([]string, error) {
+	ignoredFiles := make([]string, 0, 16)
+	for start := 0; start < len(filePaths); {
+		end, size := start, 0
+		for end < len(filePaths) && (end == start || size+len(filePaths[end])+1 <= checkIgnoreChunkSize) {
+			size += len(filePaths[end]) + 1
+			end++
+		}
+		chunk, err := gitCheckIgnoreChunk(ctx, workdir, filePaths[start:end])
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, errors.Errorf("git check-ignore did not finish filtering %d paths: %s", len(filePaths), ctx.Err())
+			}
+			return nil, err
+		}
+		ignoredFiles = append(ignoredFiles, chunk...)
+		start = end
+	}
+	return ignoredFiles, nil
+}
+
+func gitCheckIgnoreChunk(ctx context.Context, workdir string, filePaths []string) ([]string, error) {
 	data := JoinNullTerminated(filePaths)
 	// NOTE: --no-index makes this call ~5ms instead of 150ms, but we have
 	// false positives due to what we store in the tree.
 	gwd := gitWorkDir{workdir}
-	cmd := gwd.gitCommand("check-ignore", "-z", "--stdin", "--no-index")
+	cmd := gwd.gitCommandContext(ctx, "check-ignore", "-z", "--stdin", "--no-index")
 	cmd.Stdin = bytes.NewReader([]byte(data))
 	out, err := cmd.Output()
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			switch exitErr.ProcessState.Sys().(syscall.WaitStatus).ExitStatus() {
-			case 0, 1:
-			default:
-				return nil, err
-			}
+		// Exit status 1 just means none of the paths are ignored.
+		if rc, rcErr := ExitStatus(err); rcErr != nil || rc != 1 {
+			return nil, err
 		}
 	}
 	return SplitNullTerminated(string(out)), nil
@@ -242,10 +817,15 @@ func GitCheckIgnore(workdir string, filePaths []string) ([]string, error) {
 
 // Return a list of files that were renamed.
 func GitRenamedFiles(workdir string, filePaths []string) ([]string, error) {
+	return GitRenamedFilesContext(context.Background(), workdir, filePaths)
+}
+
+// Like GitRenamedFiles, but git is killed if ctx is done first.
+func GitRenamedFilesContext(ctx context.Context, workdir string, filePaths []string) ([]string, error) {
 	gwd := &gitWorkDir{workdir}
 	args := []string{"status", "-z", "--porcelain", "--untracked-files=normal"}
 	args = append(args, filePaths...)
-	cmd := gwd.gitCommand(args...)
+	cmd := gwd.gitCommandContext(ctx, args...)
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -254,9 +834,282 @@ func GitRenamedFiles(workdir string, filePaths []string) ([]string, error) {
 	return renamedFiles, err
 }
 
+// Return untracked paths matching a single gitignore-style pattern, ignoring
+// the standard exclude files. Wholly untracked directories are listed once.
+func GetUntrackedMatching(workdir string, pattern string) ([]string, error) {
+	return GetUntrackedMatchingContext(context.Background(), workdir, pattern)
+}
+
+// Like GetUntrackedMatching, but git is killed if ctx is done first.
+func GetUntrackedMatchingContext(ctx context.Context, workdir string, pattern string) ([]string, error) {
+	gwd := &gitWorkDir{workdir}
+	cmd := gwd.gitCommandContext(ctx, "ls-files", "-z", "--others", "--ignored", "--directory", "--exclude="+pattern)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return SplitNullTerminated(string(stdout)), nil
+}
+
+// An entry in a git tree object, as reported by ls-tree.
+type TreeEntry struct {
+	Mode string
+	Type string
+	Hash string
+}
+
+// Return the tree entries for the given paths in a commit. Paths that do not
+// exist in the commit are omitted.
+func GetTreeEntries(workdir string, treeish string, filePaths []string) (map[string]TreeEntry, error) {
+	return GetTreeEntriesContext(context.Background(), workdir, treeish, filePaths)
+}
+
+// Like GetTreeEntries, but git is killed if ctx is done first.
+func GetTreeEntriesContext(ctx context.Context, workdir string, treeish string, filePaths []string) (map[string]TreeEntry, error) {
+	gwd := &gitWorkDir{workdir}
+	args := []string{"ls-tree", "-z", "--full-tree", treeish, "--"}
+	args = append(args, filePaths...)
+	stdout, err := gwd.gitCommandContext(ctx, args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]TreeEntry, len(filePaths))
+	for _, line := range SplitNullTerminated(string(stdout)) {
+		// <mode> SP <type> SP <object> TAB <file>
+		tabFields := strings.SplitN(line, "\t", 2)
+		fields := strings.Fields(tabFields[0])
+		if len(tabFields) != 2 || len(fields) != 3 {
+			return nil, errors.Errorf("invalid ls-tree entry: %q", line)
+		}
+		entries[tabFields[1]] = TreeEntry{Mode: fields[0], Type: fields[1], Hash: fields[2]}
+	}
+	return entries, nil
+}
+
+// Write the given files as they exist in treeish below destDir, preserving
+// the executable bit and symlinks. The working tree is not consulted.
+func ExportFiles(workdir string, treeish string, filePaths []string, destDir string) error {
+	return ExportFilesContext(context.Background(), workdir, treeish, filePaths, destDir)
+}
+
+// Like ExportFiles, but git is killed if ctx is done first.
+func ExportFilesContext(ctx context.Context, workdir string, treeish string, filePaths []string, destDir string) error {
+	if len(filePaths) == 0 {
+		// Without paths git archive would export the entire tree.
+		return nil
+	}
+	gwd := &gitWorkDir{workdir}
+	args := []string{"archive", "--format=tar", treeish, "--"}
+	args = append(args, filePaths...)
+	archiveCmd := gwd.gitCommandContext(ctx, args...)
+	tarCmd := CommandContext(ctx, "tar", "-x", "-f", "-", "-C", destDir)
+	tarCmd.Stderr = os.Stderr
+	stdout, err := archiveCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	tarCmd.Stdin = stdout
+	if err := tarCmd.Start(); err != nil {
+		return err
+	}
+	if err := archiveCmd.Run(); err != nil {
+		tarCmd.Wait()
+		return err
+	}
+	return tarCmd.Wait()
+}
+
+// Return the blob hash git would assign to each working tree file, in the
+// same order as filePaths. Clean filters are applied as for git add.
+func HashFiles(workdir string, filePaths []string) ([]string, error) {
+	return HashFilesContext(context.Background(), workdir, filePaths)
+}
+
+// Like HashFiles, but git is killed if ctx is done first.
+func HashFilesContext(ctx context.Context, workdir string, filePaths []string) ([]string, error) {
+	for _, fname := range filePaths {
+		if strings.Contains(fname, "\n") {
+			return nil, errors.Errorf("unable to hash path containing a newline: %q", fname)
+		}
+	}
+	gwd := &gitWorkDir{workdir}
+	cmd := gwd.gitCommandContext(ctx, "hash-object", "--stdin-paths")
+	cmd.Stdin = strings.NewReader(strings.Join(filePaths, "\n") + "\n")
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	hashes := strings.Fields(string(stdout))
+	if len(hashes) != len(filePaths) {
+		return nil, errors.Errorf("hash-object returned %d hashes for %d paths", len(hashes), len(filePaths))
+	}
+	return hashes, nil
+}
+
+// Lists of at least statBatchSize files are split across statParallelism
+// goroutines; shorter ones are stated in order.
+const (
+	statParallelism = 8
+	statBatchSize   = 256
+)
+
+// Return the on-disk size of each working tree file, in bytes. Symlinks are
+// not followed, so a link counts as the length of its target, as rsync sends
+// it. Deleted files, directories and other special files count as 0.
+func GetChangedFileSizes(workdir string, filePaths []string) (map[string]int64, error) {
+	sizes := make([]int64, len(filePaths))
+	statRange := func(start, end int) error {
+		for i := start; i < end; i++ {
+			fi, err := os.Lstat(path.Join(workdir, filePaths[i]))
+			if err != nil {
+				// A parent replaced by a file fails with ENOTDIR.
+				if pathErr, ok := err.(*os.PathError); os.IsNotExist(err) || ok && pathErr.Err == syscall.ENOTDIR {
+					continue
+				}
+				return err
+			}
+			if fi.Mode().IsRegular() || fi.Mode()&os.ModeSymlink != 0 {
+				sizes[i] = fi.Size()
+			}
+		}
+		return nil
+	}
+
+	if len(filePaths) < statBatchSize {
+		if err := statRange(0, len(filePaths)); err != nil {
+			return nil, err
+		}
+	} else {
+		// Stats are cheap but not free, especially on a network filesystem, so
+		// spread large lists over a few goroutines.
+		var wg sync.WaitGroup
+		errs := make([]error, statParallelism)
+		chunk := (len(filePaths) + statParallelism - 1) / statParallelism
+		for w := 0; w < statParallelism; w++ {
+			start, end := w*chunk, (w+1)*chunk
+			if end > len(filePaths) {
+				end = len(filePaths)
+			}
+			if start >= end {
+				break
+			}
+			wg.Add(1)
+			go func(w, start, end int) {
+				defer wg.Done()
+				errs[w] = statRange(start, end)
+			}(w, start, end)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sizeMap := make(map[string]int64, len(filePaths))
+	for i, fname := range filePaths {
+		sizeMap[fname] = sizes[i]
+	}
+	return sizeMap, nil
+}
+
+// Paths are passed to ls-files on the command line in batches of this size to
+// stay under the argument length limit.
+const lsFilesBatchSize = 1000
+
+// Return the subset of filePaths tracked in the index, in the order given.
+// Paths are matched literally, so a directory is never reported as tracked
+// even if it contains tracked files.
+func FilterTracked(workdir string, filePaths []string) ([]string, error) {
+	return FilterTrackedContext(context.Background(), workdir, filePaths)
+}
+
+// Like FilterTracked, but git is killed if ctx is done first.
+func FilterTrackedContext(ctx context.Context, workdir string, filePaths []string) ([]string, error) {
+	gwd := &gitWorkDir{workdir}
+	trackedSet := make(map[string]bool, len(filePaths))
+	for start := 0; start < len(filePaths); start += lsFilesBatchSize {
+		end := start + lsFilesBatchSize
+		if end > len(filePaths) {
+			end = len(filePaths)
+		}
+		args := []string{"--literal-pathspecs", "ls-files", "-z", "--full-name", "--"}
+		args = append(args, filePaths[start:end]...)
+		stdout, err := gwd.gitCommandContext(ctx, args...).Output()
+		if err != nil {
+			return nil, err
+		}
+		for _, fname := range SplitNullTerminated(string(stdout)) {
+			trackedSet[fname] = true
+		}
+	}
+	trackedFiles := make([]string, 0, len(trackedSet))
+	for _, fname := range filePaths {
+		if trackedSet[fname] {
+			trackedFiles = append(trackedFiles, fname)
+		}
+	}
+	return trackedFiles, nil
+}
+
+// Return the default branch of a remote, such as "main", from
+// refs/remotes/<remote>/HEAD. That symref is only set by clone or git remote
+// set-head, so if it is missing the remote itself is asked, which needs
+// network access.
+func GetDefaultBranch(workdir string, remote string) (string, error) {
+	return GetDefaultBranchContext(context.Background(), workdir, remote)
+}
+
+// Like GetDefaultBranch, but git is killed if ctx is done first.
+func GetDefaultBranchContext(ctx context.Context, workdir string, remote string) (string, error) {
+	gwd := &gitWorkDir{workdir}
+	out, err := gwd.gitCommandContext(ctx, "symbolic-ref", "-q", "refs/remotes/"+remote+"/HEAD").Output()
+	if err == nil {
+		ref := string(bytes.TrimSpace(out))
+		if branch := strings.TrimPrefix(ref, "refs/remotes/"+remote+"/"); branch != ref {
+			return branch, nil
+		}
+	} else if rc, rcErr := ExitStatus(err); rcErr != nil || rc != 1 {
+		return "", err
+	}
+
+	out, err = gwd.gitCommandContext(ctx, "ls-remote", "--symref", remote, "HEAD").Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to query the default branch of %s", remote)
+	}
+	// The symref comes first: ref: refs/heads/main<TAB>HEAD
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" {
+			return strings.TrimPrefix(fields[1], "refs/heads/"), nil
+		}
+	}
+	return "", errors.Errorf("remote %s has no default branch", remote)
+}
+
+// Return true if the path is tracked in the index.
+func IsTracked(workdir string, filePath string) (bool, error) {
+	return IsTrackedContext(context.Background(), workdir, filePath)
+}
+
+// Like IsTracked, but git is killed if ctx is done first.
+func IsTrackedContext(ctx context.Context, workdir string, filePath string) (bool, error) {
+	trackedFiles, err := FilterTrackedContext(ctx, workdir, []string{filePath})
+	if err != nil {
+		return false, err
+	}
+	return len(trackedFiles) == 1, nil
+}
+
 func GetGitRemoteNames(workdir string) (remoteNames []string, err error) {
+	return GetGitRemoteNamesContext(context.Background(), workdir)
+}
+
+// Like GetGitRemoteNames, but git is killed if ctx is done first.
+func GetGitRemoteNamesContext(ctx context.Context, workdir string) (remoteNames []string, err error) {
 	gwd := &gitWorkDir{workdir}
-	cmd := gwd.gitCommand("remote")
+	cmd := gwd.gitCommandContext(ctx, "remote")
 	stdout, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -0,0 +1,803 @@
+package gitapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetDefaultBranch(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-branch-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstreamDir := path.Join(dir, "upstream")
+	localDir := path.Join(dir, "local")
+	git := func(args ...string) {
+		args = append([]string{"-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	git("init", "-q", upstreamDir)
+	git("-C", upstreamDir, "checkout", "-q", "-b", "trunk")
+	git("-C", upstreamDir, "commit", "-q", "--allow-empty", "-m", "initial commit")
+	git("clone", "-q", upstreamDir, localDir)
+
+	branch, err := GetDefaultBranch(localDir, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "trunk" {
+		t.Fatalf("default branch %q, want trunk", branch)
+	}
+
+	// Without the local symref the remote is asked.
+	git("-C", localDir, "remote", "set-head", "origin", "-d")
+	branch, err = GetDefaultBranch(localDir, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "trunk" {
+		t.Fatalf("default branch from the remote %q, want trunk", branch)
+	}
+}
+
+func TestGetTreeHash(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-tree-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	if err := ioutil.WriteFile(path.Join(dir, "a"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "a")
+	git("commit", "-q", "-m", "initial commit")
+
+	headTree, err := GetTreeHash(dir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexTree, err := GetTreeHash(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headTree != indexTree || len(headTree) != 40 {
+		t.Fatalf("HEAD tree %q, index tree %q", headTree, indexTree)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "a"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "a")
+	if indexTree, err = GetTreeHash(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if indexTree == headTree {
+		t.Errorf("staged change not reflected in the index tree")
+	}
+	if _, err := GetTreeHash(dir, "no-such-ref"); err == nil {
+		t.Errorf("tree of a missing ref resolved")
+	}
+}
+
+func TestGetMergeBase(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-merge-base-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("checkout", "-q", "-b", "trunk")
+	git("commit", "-q", "--allow-empty", "-m", "base")
+	base, err := GetHeadCommitHash(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	git("checkout", "-q", "-b", "topic")
+	git("commit", "-q", "--allow-empty", "-m", "topic")
+	git("checkout", "-q", "trunk")
+	git("commit", "-q", "--allow-empty", "-m", "trunk")
+	git("checkout", "-q", "--orphan", "unrelated")
+	git("commit", "-q", "--allow-empty", "-m", "unrelated")
+
+	mergeBase, err := GetMergeBase(dir, "trunk", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mergeBase != base {
+		t.Fatalf("merge base %s, want %s", mergeBase, base)
+	}
+
+	_, err = GetMergeBase(dir, "trunk", "unrelated")
+	if _, ok := err.(*NoMergeBaseError); !ok {
+		t.Fatalf("unrelated histories: got %v, want a *NoMergeBaseError", err)
+	}
+	_, err = GetMergeBase(dir, "trunk", "no-such-ref")
+	if _, ok := err.(*NoMergeBaseError); ok || err == nil {
+		t.Fatalf("missing ref: got %v, want another error", err)
+	}
+}
+
+func TestGetChangedFileSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitapi-sizes-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "a"), []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", path.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int64{"a": 5, "link": 1, "sub": 0, "deleted": 0, "a/under-a-file": 0}
+	fnames := []string{"a", "link", "sub", "deleted", "a/under-a-file"}
+	sizes, err := GetChangedFileSizes(dir, fnames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("got %v, want %v", sizes, want)
+	}
+
+	// Large lists are split across goroutines.
+	for i := 0; i < statBatchSize; i++ {
+		fname := fmt.Sprintf("f%d", i)
+		if err := ioutil.WriteFile(path.Join(dir, fname), make([]byte, i), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fnames = append(fnames, fname)
+		want[fname] = int64(i)
+	}
+	if sizes, err = GetChangedFileSizes(dir, fnames); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("batched sizes differ: got %d entries, want %d", len(sizes), len(want))
+	}
+}
+
+func TestParsePorcelainStatus(t *testing.T) {
+	modified, untracked, renamed, unstaged, err := ParsePorcelainStatus([]byte("M  a\x00 M b\x00?? c\x00R  d-2\x00d\x00UU e\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(modified, []string{"a", "b", "c", "d-2", "d"}) ||
+		!reflect.DeepEqual(untracked, []string{"c"}) ||
+		!reflect.DeepEqual(renamed, []string{"d"}) ||
+		!reflect.DeepEqual(unstaged, []string{"b"}) {
+		t.Fatalf("unexpected status: %v %v %v %v", modified, untracked, renamed, unstaged)
+	}
+	st, err := ParseGitStatus([]byte("M  a\x00 M b\x00?? c\x00R  d-2\x00d\x00UU e\x00MM f\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(st.Staged, []string{"a", "d-2", "f"}) || !reflect.DeepEqual(st.Unstaged, []string{"b", "f"}) {
+		t.Fatalf("unexpected staged and unstaged files: %+v", st)
+	}
+
+	// From git -c status.renames=copies status -z --porcelain after copying a
+	// to b, then modifying c and turning the symlink l into a file.
+	data, err := ioutil.ReadFile("testdata/status-copy-z.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified, untracked, renamed, unstaged, err = ParsePorcelainStatus(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(modified, []string{"a", "b", "c", "l"}) || len(untracked) != 0 || len(renamed) != 0 ||
+		!reflect.DeepEqual(unstaged, []string{"c"}) {
+		t.Fatalf("unexpected status with a copy: %v %v %v %v", modified, untracked, renamed, unstaged)
+	}
+
+	if modified, _, _, _, err := ParsePorcelainStatus(nil); err != nil || len(modified) != 0 {
+		t.Errorf("empty status: got %v, %v", modified, err)
+	}
+
+	// Output cut short anywhere must fail rather than panic.
+	for _, data := range []string{
+		"\x00",
+		"M",
+		"M\x00",
+		" M \x00",
+		"MM_a\x00",
+		"M  a",
+		"M  a\x00 M b",
+		"R  d-2\x00",
+		"R  d-2\x00\x00",
+		"C  b\x00",
+	} {
+		if _, _, _, _, err := ParsePorcelainStatus([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+		if err := scanGitStatus(strings.NewReader(data), func(ChangedFile) error { return nil }); err == nil {
+			t.Errorf("%q: expected an error when streamed", data)
+		}
+	}
+}
+
+func TestScanGitStatus(t *testing.T) {
+	// From git -c status.renames=copies status -z --porcelain after copying a
+	// to b, then modifying a, renaming "old name" and adding d.
+	data, err := ioutil.ReadFile("testdata/status-rename-copy-z.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []ChangedFile
+	err = scanGitStatus(bytes.NewReader(data), func(cf ChangedFile) error {
+		files = append(files, cf)
+		return nil
+	})
+	want := []ChangedFile{
+		{Status: "M ", Path: "a"},
+		{Status: "C ", Path: "b", OrigPath: "a"},
+		{Status: "R ", Path: "new name", OrigPath: "old name"},
+		{Status: "??", Path: "d"},
+	}
+	if err != nil || !reflect.DeepEqual(files, want) {
+		t.Fatalf("streamed status: got %+v, %v", files, err)
+	}
+
+	st, err := ParseGitStatus(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(st.Modified, []string{"a", "b", "new name", "old name", "d"}) ||
+		!reflect.DeepEqual(st.Renamed, []string{"old name"}) ||
+		!reflect.DeepEqual(st.Untracked, []string{"d"}) {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+}
+
+func TestStreamGitStatus(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-stream-status-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	for _, name := range []string{"a", "old name"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("add", ".")
+	git("commit", "-q", "-m", "base")
+	if err := ioutil.WriteFile(path.Join(dir, "a"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("mv", "old name", "new\nname")
+	if err := ioutil.WriteFile(path.Join(dir, "untracked file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var files []ChangedFile
+	err = StreamGitStatus(context.Background(), dir, func(cf ChangedFile) error {
+		files = append(files, cf)
+		return nil
+	})
+	want := []ChangedFile{
+		{Status: " M", Path: "a"},
+		{Status: "R ", Path: "new\nname", OrigPath: "old name"},
+		{Status: "??", Path: "untracked file"},
+	}
+	if err != nil || !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %q, %v", files, err)
+	}
+
+	// An error from fn stops the stream and is returned as is.
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err = StreamGitStatus(context.Background(), dir, func(ChangedFile) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("got %v after %d calls", err, calls)
+	}
+}
+
+func TestGetGitRangeChanges(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-range-changes-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) string {
+		args = append([]string{"-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	write := func(fname, content string) {
+		if err := ioutil.WriteFile(path.Join(dir, fname), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	write("deleted", "deleted\n")
+	write("modified", "modified\n")
+	write("old name", "renamed\n")
+	write("unchanged", "unchanged\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "base")
+	fromHash := git("rev-parse", "HEAD")
+
+	git("rm", "-q", "deleted")
+	write("modified", "changed\n")
+	git("mv", "old name", "new name")
+	write("added", "added\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+	// A second commit in the range is included too.
+	write("added later", "added\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "second")
+	toHash := git("rev-parse", "HEAD")
+
+	// Renames are reported as a deletion and an addition.
+	changedFiles, err := GetGitRangeChanges(dir, fromHash, toHash)
+	want := []string{"added", "added later", "deleted", "modified", "new name", "old name"}
+	if err != nil || !reflect.DeepEqual(changedFiles, want) {
+		t.Fatalf("got %q, %v", changedFiles, err)
+	}
+	if changedFiles, err := GetGitRangeChanges(dir, toHash, toHash); err != nil || len(changedFiles) != 0 {
+		t.Fatalf("empty range: got %q, %v", changedFiles, err)
+	}
+	if _, err := GetGitRangeChanges(dir, fromHash, "no-such-rev"); err == nil {
+		t.Fatal("expected an error for an unknown revision")
+	}
+}
+
+func TestGetGitUntrackedFiles(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-untracked-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	if err := os.Mkdir(path.Join(dir, "new dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for fname, content := range map[string]string{
+		".gitignore":    "*.log\n",
+		"tracked":       "",
+		"ignored.log":   "",
+		"with space":    "",
+		"with\nnewline": "",
+		"new dir/a":     "",
+		"new dir/b.log": "",
+	} {
+		if err := ioutil.WriteFile(path.Join(dir, fname), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("add", ".gitignore", "tracked")
+	git("commit", "-q", "-m", "base")
+
+	// Files in an untracked dir are listed one by one, and names git would
+	// otherwise quote come back as is.
+	untrackedFiles, err := GetGitUntrackedFiles(dir)
+	want := []string{"new dir/a", "with\nnewline", "with space"}
+	if err != nil || !reflect.DeepEqual(untrackedFiles, want) {
+		t.Fatalf("got %q, %v", untrackedFiles, err)
+	}
+}
+
+func TestFilterTracked(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-tracked-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	if err := os.Mkdir(path.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range []string{".gitignore", "sub/tracked", "tracked*", "untracked", "ignored.log"} {
+		content := ""
+		if fname == ".gitignore" {
+			content = "*.log\n"
+		}
+		if err := ioutil.WriteFile(path.Join(dir, fname), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("add", ".gitignore", "sub/tracked", "tracked*")
+	git("commit", "-q", "-m", "base")
+
+	// A glob character is matched literally and a dir isn't a tracked file.
+	filePaths := []string{"untracked", "tracked*", "ignored.log", "missing", "sub", "sub/tracked"}
+	trackedFiles, err := FilterTracked(dir, filePaths)
+	if err != nil || !reflect.DeepEqual(trackedFiles, []string{"tracked*", "sub/tracked"}) {
+		t.Fatalf("got %q, %v", trackedFiles, err)
+	}
+
+	// More paths than fit in one git ls-files.
+	many := make([]string, 0, lsFilesBatchSize+2)
+	for i := 0; i <= lsFilesBatchSize; i++ {
+		many = append(many, fmt.Sprintf("missing-%d", i))
+	}
+	many = append(many, "sub/tracked")
+	if trackedFiles, err := FilterTracked(dir, many); err != nil || !reflect.DeepEqual(trackedFiles, []string{"sub/tracked"}) {
+		t.Fatalf("batched: got %q, %v", trackedFiles, err)
+	}
+
+	for fname, want := range map[string]bool{"sub/tracked": true, "untracked": false, "ignored.log": false, "missing": false} {
+		if tracked, err := IsTracked(dir, fname); err != nil || tracked != want {
+			t.Errorf("IsTracked(%q) = %v, %v, want %v", fname, tracked, err, want)
+		}
+	}
+}
+
+func TestGitCheckIgnore(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-check-ignore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if out, err := exec.Command("git", "-C", dir, "init", "-q").CombinedOutput(); err != nil {
+		t.Fatalf("git init: %s\n%s", err, out)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, ".gitignore"), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough paths for several chunks, every other one ignored. The paths
+	// don't have to exist.
+	var filePaths, want []string
+	for i := 0; len(filePaths) < 3*checkIgnoreChunkSize/20; i++ {
+		fname := fmt.Sprintf("dir-%04d/file.txt", i)
+		if i%2 == 1 {
+			fname = fmt.Sprintf("dir-%04d/file.log", i)
+			want = append(want, fname)
+		}
+		filePaths = append(filePaths, fname)
+	}
+	ignoredFiles, err := GitCheckIgnore(dir, filePaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ignoredFiles, want) {
+		t.Fatalf("got %d ignored files, want %d", len(ignoredFiles), len(want))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := GitCheckIgnoreContext(ctx, dir, filePaths); err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+}
+
+func TestRepoOperationInProgress(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-operation-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("checkout", "-q", "-b", "trunk")
+	if err := ioutil.WriteFile(path.Join(dir, "f"), []byte("base\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "f")
+	git("commit", "-q", "-m", "base")
+	git("checkout", "-q", "-b", "topic")
+	if err := ioutil.WriteFile(path.Join(dir, "f"), []byte("topic\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("commit", "-q", "-am", "topic")
+	git("checkout", "-q", "trunk")
+	if err := ioutil.WriteFile(path.Join(dir, "f"), []byte("trunk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("commit", "-q", "-am", "trunk")
+
+	if op, err := RepoOperationInProgress(dir); err != nil || op != "" {
+		t.Fatalf("clean workdir: got %q, %v", op, err)
+	}
+	// The merge stops on the conflict, which is the point.
+	exec.Command("git", "-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost", "merge", "-q", "topic").Run()
+	if op, err := RepoOperationInProgress(dir); err != nil || op != OperationMerge {
+		t.Fatalf("conflicted merge: got %q, %v", op, err)
+	}
+	git("merge", "--abort")
+	exec.Command("git", "-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost", "rebase", "-q", "topic").Run()
+	if op, err := RepoOperationInProgress(dir); err != nil || op != OperationRebase {
+		t.Fatalf("conflicted rebase: got %q, %v", op, err)
+	}
+}
+
+func TestGitDirWorktree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitapi-worktree-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// git reports resolved paths, and the temp dir may be behind a symlink.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	mainDir := path.Join(dir, "main")
+	linkedDir := path.Join(dir, "linked")
+	bareDir := path.Join(dir, "bare.git")
+	git := func(args ...string) string {
+		args = append([]string{"-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q", mainDir)
+	git("-C", mainDir, "commit", "-q", "--allow-empty", "-m", "base")
+	git("-C", mainDir, "worktree", "add", "-q", "-b", "linked", linkedDir)
+	git("init", "-q", "--bare", bareDir)
+
+	for _, wd := range []string{mainDir, linkedDir} {
+		if got, want := GitDir(wd), git("-C", wd, "rev-parse", "--absolute-git-dir"); got != want {
+			t.Errorf("GitDir(%s): got %s, want %s", wd, got, want)
+		}
+		if got, want := GitCommonDir(wd), path.Join(mainDir, ".git"); got != want {
+			t.Errorf("GitCommonDir(%s): got %s, want %s", wd, got, want)
+		}
+	}
+	if GitDir(linkedDir) == GitDir(mainDir) {
+		t.Errorf("linked worktree shares the main git dir %s", GitDir(mainDir))
+	}
+	if got := GitDir(bareDir); got != bareDir {
+		t.Errorf("GitDir(%s): got %s", bareDir, got)
+	}
+	if got := GitCommonDir(bareDir); got != bareDir {
+		t.Errorf("GitCommonDir(%s): got %s", bareDir, got)
+	}
+
+	// Submodules write a relative gitdir.
+	relDir := path.Join(dir, "relative")
+	if err := os.Mkdir(relDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(relDir, ".git"), []byte("gitdir: ../main/.git\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := GitDir(relDir), path.Join(mainDir, ".git"); got != want {
+		t.Errorf("relative gitdir: got %s, want %s", got, want)
+	}
+}
+
+func TestGetUpstreamRef(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-upstream-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("checkout", "-q", "-b", "trunk")
+	git("commit", "-q", "--allow-empty", "-m", "base")
+
+	if ref, err := GetUpstreamRef(dir); err != ErrNoUpstream {
+		t.Fatalf("no upstream: got %q, %v", ref, err)
+	}
+	git("checkout", "-q", "-b", "topic", "--track", "trunk")
+	if ref, err := GetUpstreamRef(dir); err != nil || ref != "trunk" {
+		t.Fatalf("tracking trunk: got %q, %v", ref, err)
+	}
+	git("checkout", "-q", "--detach")
+	if ref, err := GetUpstreamRef(dir); err != ErrNoUpstream {
+		t.Fatalf("detached HEAD: got %q, %v", ref, err)
+	}
+	// An upstream that doesn't resolve is broken, not missing.
+	git("checkout", "-q", "topic")
+	git("config", "branch.topic.remote", "origin")
+	git("config", "branch.topic.merge", "refs/heads/gone")
+	if ref, err := GetUpstreamRef(dir); err == nil || err == ErrNoUpstream {
+		t.Fatalf("unresolvable upstream: got %q, %v", ref, err)
+	}
+	// A remote branch that is gone counts as no upstream.
+	git("remote", "add", "origin", dir)
+	git("update-ref", "refs/remotes/origin/topic", "HEAD")
+	git("config", "branch.topic.merge", "refs/heads/topic")
+	if ref, err := GetUpstreamRef(dir); err != nil || ref != "origin/topic" {
+		t.Fatalf("tracking origin/topic: got %q, %v", ref, err)
+	}
+	git("update-ref", "-d", "refs/remotes/origin/topic")
+	if ref, err := GetUpstreamRef(dir); err != ErrNoUpstream {
+		t.Fatalf("gone upstream: got %q, %v", ref, err)
+	}
+}
+
+func TestGetReflog(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-reflog-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=gitapi", "-c", "user.email=gitapi@localhost"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("checkout", "-q", "-b", "trunk")
+	git("commit", "-q", "--allow-empty", "-m", "base")
+	git("commit", "-q", "--allow-empty", "-m", "second")
+	git("checkout", "-q", "-b", "topic", "HEAD~")
+
+	entries, err := GetReflog(dir, "HEAD", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := ResolveCommitHash(dir, "trunk~")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2: %v", len(entries), entries)
+	}
+	if entries[0].Hash != base || entries[0].Message != "checkout: moving from trunk to topic" || entries[0].Time.IsZero() {
+		t.Errorf("newest entry: %+v", entries[0])
+	}
+	if entries[1].Message != "commit: second" {
+		t.Errorf("second entry: %+v", entries[1])
+	}
+	if entries, err := GetReflog(dir, "HEAD", 0); err != nil || len(entries) != 3 {
+		t.Errorf("whole reflog: %v, %v", entries, err)
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitapi-relpath-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workdir := path.Join(dir, "w")
+	if err := os.MkdirAll(path.Join(workdir, "a/b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := path.Join(dir, "link")
+	if err := os.Symlink(workdir, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ workdir, dir, want string }{
+		{workdir, workdir, "."},
+		{workdir, path.Join(workdir, "a/b"), "a/b"},
+		{link, path.Join(workdir, "a"), "a"},
+		{workdir, path.Join(link, "a"), "a"},
+	} {
+		if got, err := RelativePath(tc.workdir, tc.dir); err != nil || got != tc.want {
+			t.Errorf("RelativePath(%s, %s): got %q, %v, want %q", tc.workdir, tc.dir, got, err, tc.want)
+		}
+	}
+	if got, err := RelativePath(path.Join(workdir, "a"), workdir); err == nil {
+		t.Errorf("outside the workdir: got %q", got)
+	}
+}
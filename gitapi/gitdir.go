@@ -0,0 +1,93 @@
+package gitapi
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// In a linked worktree, see git-worktree(1), .git is a file holding
+// "gitdir: <path>" that names the worktree's own git dir, and that dir has a
+// commondir file naming the dir shared by every worktree of the repository.
+// Per-worktree state, like HEAD, the index and COMMIT_EDITMSG, lives in the
+// git dir, while refs, objects and config live in the common dir. In the main
+// worktree both are the .git dir. A bare repository is its own git dir.
+//
+// These are resolved by reading the files rather than running git rev-parse,
+// since they are needed on every sync to place cookies and locks.
+
+const gitFilePrefix = "gitdir:"
+
+// Return the git dir of a workdir or bare repository. If the layout isn't
+// recognized, workdir/.git is returned and git itself reports the problem
+// when it next runs.
+func GitDir(workdir string) string {
+	dotGit := path.Join(workdir, ".git")
+	fi, err := os.Stat(dotGit)
+	if err != nil {
+		if isBareRepo(workdir) {
+			return workdir
+		}
+		return dotGit
+	}
+	if fi.IsDir() {
+		return dotGit
+	}
+	gitDir, err := readGitFile(dotGit)
+	if err != nil {
+		return dotGit
+	}
+	return gitDir
+}
+
+// Return the git dir shared by all worktrees of the repository workdir
+// belongs to. Outside of a linked worktree this is the same as GitDir.
+func GitCommonDir(workdir string) string {
+	gitDir := GitDir(workdir)
+	data, err := ioutil.ReadFile(path.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	commonDir := strings.TrimSpace(string(data))
+	if commonDir == "" {
+		return gitDir
+	}
+	if !path.IsAbs(commonDir) {
+		commonDir = path.Join(gitDir, commonDir)
+	}
+	return path.Clean(commonDir)
+}
+
+// Return the git dir named by a .git file. A relative path is relative to the
+// dir holding the file, as git writes for submodules.
+func readGitFile(fname string) (string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	if !strings.HasPrefix(line, gitFilePrefix) {
+		return "", errors.Errorf("invalid gitfile format: %s", fname)
+	}
+	gitDir := strings.TrimSpace(strings.TrimPrefix(line, gitFilePrefix))
+	if gitDir == "" {
+		return "", errors.Errorf("no path in gitfile: %s", fname)
+	}
+	if !path.IsAbs(gitDir) {
+		gitDir = path.Join(path.Dir(fname), gitDir)
+	}
+	return path.Clean(gitDir), nil
+}
+
+// A bare repository has no workdir, the git dir entries are at the top.
+func isBareRepo(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(path.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
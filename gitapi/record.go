@@ -0,0 +1,232 @@
+package gitapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/msolo/go-bis/glug"
+	"github.com/pkg/errors"
+)
+
+// Kinds of entries in a recording.
+const (
+	RecordKindCmd      = "cmd"
+	RecordKindArtifact = "artifact"
+)
+
+// One command or artifact in a recording. Each entry is stored as
+// <seq>.json in the recording directory, with any captured output and
+// artifact data in sibling files named by StdoutFile, StderrFile and
+// DataFile.
+type RecordEntry struct {
+	Seq  int
+	Kind string
+	// Name of an artifact.
+	Name       string   `json:",omitempty"`
+	Args       []string `json:",omitempty"`
+	Dir        string   `json:",omitempty"`
+	Env        []string `json:",omitempty"`
+	ExitCode   int
+	Error      string `json:",omitempty"`
+	StartNs    int64  `json:",string"`
+	DurationNs int64  `json:",string"`
+	StdoutFile string `json:",omitempty"`
+	StderrFile string `json:",omitempty"`
+	DataFile   string `json:",omitempty"`
+}
+
+// A recorder captures every command run through Cmd, along with any
+// artifacts callers add, into a directory so a session can be inspected
+// after the fact. Recordings include the full environment of each command
+// and may contain secrets.
+type recorder struct {
+	dir string
+	mu  sync.Mutex
+	seq int
+}
+
+var activeRecorder *recorder
+
+// Start recording into a new session directory below dir and return its
+// path. This is meant to be called once, before any commands are run.
+func StartRecording(dir string) (string, error) {
+	sessionDir := path.Join(dir, fmt.Sprintf("session-%s-%d", time.Now().Format("20060102-150405"), os.Getpid()))
+	if err := os.MkdirAll(sessionDir, 0700); err != nil {
+		return "", errors.Wrap(err, "unable to create recording dir")
+	}
+	activeRecorder = &recorder{dir: sessionDir}
+	return sessionDir, nil
+}
+
+func (r *recorder) nextSeq() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	return r.seq
+}
+
+func (r *recorder) writeFile(seq int, suffix string, data []byte) string {
+	fname := fmt.Sprintf("%06d.%s", seq, suffix)
+	if err := ioutil.WriteFile(path.Join(r.dir, fname), data, 0600); err != nil {
+		log.Warningf("failed to record %s: %s", fname, err)
+		return ""
+	}
+	return fname
+}
+
+func (r *recorder) writeEntry(entry *RecordEntry) {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		log.Warningf("failed to marshal record entry: %s", err)
+		return
+	}
+	r.writeFile(entry.Seq, "json", data)
+}
+
+// Save data under name in the active recording. This is a no-op unless
+// recording was started.
+func RecordArtifact(name string, data []byte) {
+	r := activeRecorder
+	if r == nil {
+		return
+	}
+	entry := &RecordEntry{Seq: r.nextSeq(), Kind: RecordKindArtifact, Name: name, StartNs: time.Now().UnixNano()}
+	entry.DataFile = r.writeFile(entry.Seq, "data", data)
+	r.writeEntry(entry)
+}
+
+// Only output bound for nowhere or the terminal is captured. Pipes set up by
+// the caller must be left alone or exec would close them out from under us.
+func capturable(w io.Writer) bool {
+	return w == nil || w == os.Stdout || w == os.Stderr
+}
+
+// Output is captured directly into files rather than through an
+// io.MultiWriter. Otherwise exec copies it in a goroutine and Wait hangs
+// until every process holding the pipe exits, which for ssh with
+// ControlPersist is the backgrounded master.
+type capturedOutput struct {
+	file *os.File
+	// Where the output would have gone, replayed once the command exits.
+	orig io.Writer
+}
+
+func (r *recorder) capture(seq int, suffix string, w *io.Writer) *capturedOutput {
+	fname := path.Join(r.dir, fmt.Sprintf("%06d.%s", seq, suffix))
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Warningf("failed to record %s: %s", fname, err)
+		return nil
+	}
+	co := &capturedOutput{file: f, orig: *w}
+	*w = f
+	return co
+}
+
+// Close the capture file, copy its content to the original destination and
+// return the content and file name.
+func (co *capturedOutput) finish() ([]byte, string) {
+	if co == nil {
+		return nil, ""
+	}
+	defer co.file.Close()
+	if _, err := co.file.Seek(0, io.SeekStart); err != nil {
+		log.Warningf("failed to read %s: %s", co.file.Name(), err)
+		return nil, ""
+	}
+	data, err := ioutil.ReadAll(co.file)
+	if err != nil {
+		log.Warningf("failed to read %s: %s", co.file.Name(), err)
+	}
+	if co.orig != nil {
+		_, _ = co.orig.Write(data)
+	}
+	return data, path.Base(co.file.Name())
+}
+
+// Prepare to record cmd. Output is only captured here when the caller
+// doesn't read it some other way.
+func (cmd *Cmd) startRecording(captureStdout, captureStderr bool) {
+	r := activeRecorder
+	if r == nil {
+		return
+	}
+	cmd.recordSeq = r.nextSeq()
+	cmd.startTime = time.Now()
+	if captureStdout && capturable(cmd.Stdout) {
+		cmd.stdoutCapture = r.capture(cmd.recordSeq, "stdout", &cmd.Stdout)
+	}
+	if captureStderr && capturable(cmd.Stderr) {
+		cmd.stderrCapture = r.capture(cmd.recordSeq, "stderr", &cmd.Stderr)
+	}
+}
+
+// Write the record for a finished cmd. A non-nil stdout is recorded in
+// place of anything captured by startRecording.
+func (cmd *Cmd) finishRecording(stdout []byte, err error) {
+	r := activeRecorder
+	if r == nil || cmd.startTime.IsZero() {
+		return
+	}
+	entry := &RecordEntry{
+		Seq:        cmd.recordSeq,
+		Kind:       RecordKindCmd,
+		Args:       cmd.Args,
+		Dir:        cmd.Dir,
+		Env:        cmd.Env,
+		StartNs:    cmd.startTime.UnixNano(),
+		DurationNs: int64(time.Since(cmd.startTime)),
+	}
+	if entry.Env == nil {
+		entry.Env = os.Environ()
+	}
+	_, entry.StdoutFile = cmd.stdoutCapture.finish()
+	if stdout != nil {
+		entry.StdoutFile = r.writeFile(entry.Seq, "stdout", stdout)
+	}
+	stderr, stderrFile := cmd.stderrCapture.finish()
+	entry.StderrFile = stderrFile
+	if err != nil {
+		entry.Error = err.Error()
+		entry.ExitCode = -1
+		if exitErr, ok := errors.Cause(err).(*exec.ExitError); ok {
+			entry.ExitCode = exitErr.ExitCode()
+			// Capturing stderr stops Output from saving it for the error message.
+			if cmd.restoreExitStderr && len(exitErr.Stderr) == 0 {
+				exitErr.Stderr = stderr
+			}
+		}
+	}
+	r.writeEntry(entry)
+}
+
+// Read the entries of a recording session in the order they were recorded.
+func ReadRecording(dir string) ([]*RecordEntry, error) {
+	fnames, err := filepath.Glob(path.Join(dir, "[0-9]*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*RecordEntry, 0, len(fnames))
+	for _, fname := range fnames {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		entry := &RecordEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, errors.Wrapf(err, "invalid record entry %s", fname)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries, nil
+}
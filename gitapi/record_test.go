@@ -0,0 +1,80 @@
+package gitapi
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitapi-record-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sessionDir, err := StartRecording(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { activeRecorder = nil }()
+
+	if err := Command("sh", "-c", "echo out; echo err >&2").Run(); err != nil {
+		t.Fatal(err)
+	}
+	RecordArtifact("manifest", []byte("a\x00b\x00"))
+	_, err = Command("sh", "-c", "echo oops >&2; exit 3").Output()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	// Recording must not lose the stderr Output keeps for the error.
+	if !strings.Contains(err.Error(), "oops") {
+		t.Errorf("error lacks stderr: %s", err)
+	}
+
+	entries, err := ReadRecording(sessionDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	readFile := func(fname string) string {
+		data, err := ioutil.ReadFile(path.Join(sessionDir, fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	run := entries[0]
+	if run.Kind != RecordKindCmd || run.Args[0] != "sh" || run.ExitCode != 0 {
+		t.Errorf("unexpected run entry: %+v", run)
+	}
+	if out := readFile(run.StdoutFile); out != "out\n" {
+		t.Errorf("run stdout = %q", out)
+	}
+	if out := readFile(run.StderrFile); out != "err\n" {
+		t.Errorf("run stderr = %q", out)
+	}
+	if len(run.Env) == 0 {
+		t.Errorf("run env not recorded")
+	}
+
+	artifact := entries[1]
+	if artifact.Kind != RecordKindArtifact || artifact.Name != "manifest" {
+		t.Errorf("unexpected artifact entry: %+v", artifact)
+	}
+	if data := readFile(artifact.DataFile); data != "a\x00b\x00" {
+		t.Errorf("artifact data = %q", data)
+	}
+
+	failed := entries[2]
+	if failed.ExitCode != 3 || failed.Error == "" {
+		t.Errorf("unexpected failed entry: %+v", failed)
+	}
+	if out := readFile(failed.StderrFile); out != "oops\n" {
+		t.Errorf("failed stderr = %q", out)
+	}
+}
@@ -0,0 +1,121 @@
+package gitapi
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A single entry from git stash list.
+type StashEntry struct {
+	// Ref is the reflog selector, e.g. stash@{0}. It shifts as stashes are
+	// pushed and dropped, so Hash is the stable way to refer to an entry.
+	Ref     string
+	Hash    string
+	Time    time.Time
+	Message string
+}
+
+// Return the arguments to git that stash all local changes, optionally
+// including untracked files. The args are exported so the same stash can
+// be taken on a remote workdir over ssh.
+func StashPushArgs(message string, includeUntracked bool) []string {
+	args := []string{"stash", "push", "-q"}
+	if includeUntracked {
+		args = append(args, "--include-untracked")
+	}
+	if message != "" {
+		args = append(args, "-m", message)
+	}
+	return args
+}
+
+const stashListFormat = "%gd%x00%H%x00%ct%x00%gs"
+
+// Return the arguments to git that list stashes in the form read by
+// ParseStashList.
+func StashListArgs() []string {
+	return []string{"stash", "list", "--format=" + stashListFormat}
+}
+
+// Parse the output of git with StashListArgs, newest stash first.
+func ParseStashList(data []byte) ([]StashEntry, error) {
+	entries := make([]StashEntry, 0, 8)
+	for _, line := range strings.Split(string(bytes.TrimRight(data, "\n")), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\000", 4)
+		if len(fields) != 4 {
+			return nil, errors.Errorf("invalid stash list entry: %q", line)
+		}
+		ts, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid stash list entry: %q", line)
+		}
+		entries = append(entries, StashEntry{
+			Ref:     fields[0],
+			Hash:    fields[1],
+			Time:    time.Unix(ts, 0),
+			Message: fields[3],
+		})
+	}
+	return entries, nil
+}
+
+// Return the hash of the newest stash, or "" if there are none.
+func getStashHash(ctx context.Context, gwd *gitWorkDir) (string, error) {
+	out, err := gwd.gitCommandContext(ctx, "rev-parse", "-q", "--verify", "refs/stash").Output()
+	if err != nil {
+		if rc, rcErr := ExitStatus(err); rcErr == nil && rc == 1 {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// Stash all local changes in workdir, leaving it clean, and return the hash
+// of the new stash. If there was nothing to stash, the hash is "".
+func GitStashPush(workdir string, message string, includeUntracked bool) (string, error) {
+	return GitStashPushContext(context.Background(), workdir, message, includeUntracked)
+}
+
+// Like GitStashPush, but git is killed if ctx is done first.
+func GitStashPushContext(ctx context.Context, workdir string, message string, includeUntracked bool) (string, error) {
+	gwd := &gitWorkDir{workdir}
+	before, err := getStashHash(ctx, gwd)
+	if err != nil {
+		return "", err
+	}
+	if _, err := gwd.gitCommandContext(ctx, StashPushArgs(message, includeUntracked)...).Output(); err != nil {
+		return "", errors.Wrap(err, "unable to stash changes")
+	}
+	after, err := getStashHash(ctx, gwd)
+	if err != nil {
+		return "", err
+	}
+	if after == before {
+		return "", nil
+	}
+	return after, nil
+}
+
+// List the stashes in workdir, newest first.
+func GitStashList(workdir string) ([]StashEntry, error) {
+	return GitStashListContext(context.Background(), workdir)
+}
+
+// Like GitStashList, but git is killed if ctx is done first.
+func GitStashListContext(ctx context.Context, workdir string) ([]StashEntry, error) {
+	gwd := &gitWorkDir{workdir}
+	out, err := gwd.gitCommandContext(ctx, StashListArgs()...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return ParseStashList(out)
+}
@@ -0,0 +1,77 @@
+package gitapi
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestGitStash(t *testing.T) {
+	// GetRestrictedEnv insists on a complete environment.
+	for _, key := range []string{"USER", "LOGNAME", "SSH_AUTH_SOCK"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, "gitapi-test")
+		}
+	}
+	dir, err := ioutil.TempDir("", "gitapi-stash-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		args = append([]string{"-C", dir}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	writeFile := func(fname, data string) {
+		if err := ioutil.WriteFile(path.Join(dir, fname), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	// GitStashPush runs git without -c, so the identity must be in the repo.
+	git("config", "user.name", "gitapi")
+	git("config", "user.email", "gitapi@localhost")
+	writeFile("a", "a\n")
+	git("add", "a")
+	git("commit", "-q", "-m", "initial commit")
+
+	hash, err := GitStashPush(dir, "nothing", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "" {
+		t.Fatalf("clean workdir stashed as %s", hash)
+	}
+
+	writeFile("a", "changed\n")
+	writeFile("b", "untracked\n")
+	hash, err = GitStashPush(dir, "before reset", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == "" {
+		t.Fatal("no stash created")
+	}
+	if _, err := os.Stat(path.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Fatalf("untracked file not stashed: %v", err)
+	}
+
+	entries, err := GitStashList(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d stashes, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Ref != "stash@{0}" || entry.Hash != hash || entry.Time.IsZero() {
+		t.Errorf("unexpected stash entry: %+v", entry)
+	}
+	if entry.Message != "On master: before reset" && entry.Message != "On main: before reset" {
+		t.Errorf("unexpected stash message: %q", entry.Message)
+	}
+}
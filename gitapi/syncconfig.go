@@ -0,0 +1,407 @@
+package gitapi
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Values for SyncSettings.ChangeSource.
+const (
+	ChangeSourceStatus = "status"
+	ChangeSourceDiff   = "diff"
+	ChangeSourceBoth   = "both"
+)
+
+// Values for SyncSettings.CheckExcludes.
+const (
+	CheckExcludesOff    = "off"
+	CheckExcludesLocal  = "local"
+	CheckExcludesRemote = "remote"
+)
+
+// Values for SyncSettings.Mode.
+const (
+	// The remote is a git workdir, reset to match the local one.
+	SyncModeGit = "git"
+	// The remote is a plain directory that only receives files.
+	SyncModeMirror = "mirror"
+)
+
+// Values for SyncSettings.RemoteCleanFlags.
+const (
+	// The remote clean removes untracked and ignored files.
+	RemoteCleanUntracked = "-x"
+	// The remote clean only removes ignored files.
+	RemoteCleanIgnored = "-X"
+)
+
+// SSHControlPathRepo as SyncSettings.SSHControlPath gives each repository
+// its own ssh control sockets.
+const SSHControlPathRepo = "repo"
+
+// ConfigErrors holds every problem found in a config.
+type ConfigErrors []error
+
+func (ce ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(ce))
+	for _, err := range ce {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// SyncSettings holds the typed git-sync configuration for one remote. Every
+// sync.<key> except sync.remoteName can be overridden for a single remote
+// with remote.<name>.sync<key>, for instance remote.prod.syncExcludePaths.
+type SyncSettings struct {
+	RemoteName   string
+	RemoteURL    string
+	ExcludePaths []string
+	// ExcludePathsFile names a file, relative to the workdir, with more
+	// exclude patterns one per line.
+	ExcludePathsFile  string
+	AllowedRemoteDirs []string
+	RsyncRemotePath   string
+	// RsyncBandwidthLimit caps rsync transfers in KB/s. Zero means unlimited.
+	RsyncBandwidthLimit int
+	// RsyncCompress compresses rsync transfers with -z.
+	RsyncCompress bool
+	// RsyncCompressLevel is passed as --compress-level. Zero leaves rsync's
+	// default.
+	RsyncCompressLevel int
+	// RsyncBatchMode shares one rsync delta among the remotes of a push to
+	// several remotes.
+	RsyncBatchMode bool
+	// MaxParallelRemotes caps concurrent syncs when pushing to several remotes.
+	MaxParallelRemotes int
+	// MaxRetries bounds retries of ssh and rsync after transport failures.
+	MaxRetries int
+	// SkipUnchangedOnReset drops files matching the reset commit from the manifest.
+	SkipUnchangedOnReset bool
+	ChangeSource         string
+	CheckExcludes        string
+	Mode                 string
+	// RemoteShell replaces ssh as the transport when set, e.g. docker exec.
+	RemoteShell []string
+	// DaemonSSHURL reaches the workdir of an rsync daemon remote over ssh,
+	// for the git commands the daemon can't run.
+	DaemonSSHURL string
+	// RemoteSkipSubmodules leaves remote submodules alone after a reset.
+	RemoteSkipSubmodules bool
+	// RemoteCleanFlags is the git clean flag picking what the remote reset
+	// removes, RemoteCleanUntracked or RemoteCleanIgnored.
+	RemoteCleanFlags string
+	// PreflightCmd is run by the shell before a push, with the files to be
+	// sent on stdin. A failure aborts the push.
+	PreflightCmd string
+	// PullAutoStage stages pulled files with git add.
+	PullAutoStage bool
+	// DetectRemoteDirty refuses to push over changes made on the remote.
+	DetectRemoteDirty bool
+	// ExplicitDeletes removes files deleted locally with a remote git rm
+	// rather than through rsync.
+	ExplicitDeletes bool
+	// ForegroundFetch runs the speculative remote fetch before the push goes
+	// on, rather than in the background.
+	ForegroundFetch bool
+	// TagRemote points a ref on the remote at the merge base of each push.
+	TagRemote bool
+	// RemoteLockPath is flocked on the remote around the reset, relative to
+	// the remote dir unless absolute. "none" disables the lock.
+	RemoteLockPath string
+	// RemoteLockTimeout is how long to wait for a contended remote lock.
+	RemoteLockTimeout time.Duration
+	// SSH options, in whole seconds.
+	SSHConnectTimeout      time.Duration
+	SSHControlPersist      time.Duration
+	SSHServerAliveInterval time.Duration
+	// SSHControlPath is the ssh ControlPath template, or SSHControlPathRepo.
+	SSHControlPath string
+	// SSHStrictHostKeyChecking verifies host keys against known_hosts.
+	SSHStrictHostKeyChecking bool
+	// SSHExtraOptions are passed to ssh as -o Key=Value, overriding the
+	// built-in options.
+	SSHExtraOptions map[string]string
+	// FsmonitorPath comes from core.fsmonitor.
+	FsmonitorPath string
+	// FsmonitorMaxChanges is the most changes fsmonitor may report before a
+	// push falls back to git status. Zero means no limit.
+	FsmonitorMaxChanges int
+	// FsmonitorTimeoutMs bounds the fsmonitor query before a push falls back
+	// to git status.
+	FsmonitorTimeoutMs int
+}
+
+// Settings used when a key is absent from the git config.
+var DefaultSyncSettings = SyncSettings{
+	RemoteName:             "sync",
+	RsyncRemotePath:        "rsync",
+	RsyncCompress:          true,
+	MaxParallelRemotes:     4,
+	MaxRetries:             2,
+	SkipUnchangedOnReset:   true,
+	ChangeSource:           ChangeSourceBoth,
+	CheckExcludes:          CheckExcludesOff,
+	Mode:                   SyncModeGit,
+	RemoteCleanFlags:       RemoteCleanUntracked,
+	RemoteLockPath:         ".git/git-sync.lock",
+	RemoteLockTimeout:      30 * time.Second,
+	SSHConnectTimeout:      5 * time.Second,
+	SSHControlPersist:      15 * time.Minute,
+	SSHServerAliveInterval: 60 * time.Second,
+	SSHControlPath:         "/tmp/ssh_mux_%h_%p_%r",
+	FsmonitorMaxChanges:    100,
+	FsmonitorTimeoutMs:     1000,
+}
+
+// Read the sync settings for a remote from the git config. If remoteName is
+// empty, sync.remoteName or the default is used.
+func (wd *gitWorkDir) SyncConfig(remoteName string) (*SyncSettings, error) {
+	return wd.SyncConfigContext(context.Background(), remoteName)
+}
+
+// Like SyncConfig, but git is killed if ctx is done first.
+func (wd *gitWorkDir) SyncConfigContext(ctx context.Context, remoteName string) (*SyncSettings, error) {
+	gitConfig, err := wd.GitConfigContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSyncSettings(gitConfig, remoteName)
+}
+
+// Type the sync settings found in gitConfig, applying defaults and
+// per-remote overrides. If any key is invalid the error is a ConfigErrors
+// listing every problem, and the settings are still returned, with defaults
+// in place of the invalid keys, so callers can check the rest.
+func ParseSyncSettings(gitConfig GitConfig, remoteName string) (*SyncSettings, error) {
+	ss := DefaultSyncSettings
+	if remoteName == "" {
+		remoteName = gitConfig.Get("sync.remotename")
+	}
+	if remoteName != "" {
+		ss.RemoteName = remoteName
+	}
+
+	// Return the per-remote value of a key if set, otherwise the global one.
+	get := func(key string) string {
+		if val := gitConfig.Get("remote." + ss.RemoteName + ".sync" + key); val != "" {
+			return val
+		}
+		return gitConfig.Get("sync." + key)
+	}
+
+	// Every problem is collected so they can all be fixed at once.
+	var errs ConfigErrors
+	// Each parser takes the documented name of a key, such as
+	// sync.maxRetries, and leaves the default alone if the key is unset.
+	getNamed := func(name string) string {
+		return get(strings.ToLower(strings.TrimPrefix(name, "sync.")))
+	}
+	parseBool := func(name string, dst *bool) {
+		if val := getNamed(name); val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "invalid %s", name))
+				return
+			}
+			*dst = b
+		}
+	}
+	// check, if not nil, explains what is wrong with a value.
+	parseInt := func(name string, dst *int, check func(n int) string) {
+		if val := getNamed(name); val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "invalid %s", name))
+				return
+			}
+			if check != nil {
+				if problem := check(n); problem != "" {
+					errs = append(errs, errors.Errorf("invalid %s %d, %s", name, n, problem))
+					return
+				}
+			}
+			*dst = n
+		}
+	}
+	nonNegative := func(n int) string {
+		if n < 0 {
+			return "must not be negative"
+		}
+		return ""
+	}
+	parseChoice := func(name string, dst *string, choices ...string) {
+		if val := getNamed(name); val != "" {
+			for _, choice := range choices {
+				if val == choice {
+					*dst = val
+					return
+				}
+			}
+			errs = append(errs, errors.Errorf("invalid %s %q, expected %s or %s", name, val,
+				strings.Join(choices[:len(choices)-1], ", "), choices[len(choices)-1]))
+		}
+	}
+
+	if val := get("excludepaths"); val != "" {
+		excludePaths, err := ExpandBracesAll(strings.Split(strings.TrimSpace(val), ":"))
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "invalid sync.excludePaths"))
+		} else {
+			ss.ExcludePaths = excludePaths
+		}
+	}
+
+	if val := get("excludepathsfile"); val != "" {
+		ss.ExcludePathsFile = val
+	}
+
+	if val := get("allowedremotedirs"); val != "" {
+		ss.AllowedRemoteDirs = strings.Split(strings.TrimSpace(val), ":")
+	}
+
+	if val := get("rsyncremotepath"); val != "" {
+		ss.RsyncRemotePath = val
+	}
+
+	parseInt("sync.rsyncBandwidthLimit", &ss.RsyncBandwidthLimit, nonNegative)
+	parseBool("sync.rsyncCompress", &ss.RsyncCompress)
+	parseInt("sync.rsyncCompressLevel", &ss.RsyncCompressLevel, func(n int) string {
+		if n < 0 || n > 9 {
+			return "expected 0 to 9"
+		}
+		return ""
+	})
+	parseBool("sync.rsyncBatchMode", &ss.RsyncBatchMode)
+	parseInt("sync.maxParallelRemotes", &ss.MaxParallelRemotes, nil)
+	parseInt("sync.maxRetries", &ss.MaxRetries, nonNegative)
+	parseBool("sync.skipUnchangedOnReset", &ss.SkipUnchangedOnReset)
+	parseChoice("sync.changeSource", &ss.ChangeSource, ChangeSourceStatus, ChangeSourceDiff, ChangeSourceBoth)
+	parseChoice("sync.checkExcludes", &ss.CheckExcludes, CheckExcludesOff, CheckExcludesLocal, CheckExcludesRemote)
+	parseChoice("sync.mode", &ss.Mode, SyncModeGit, SyncModeMirror)
+	parseChoice("sync.remoteCleanFlags", &ss.RemoteCleanFlags, RemoteCleanUntracked, RemoteCleanIgnored)
+
+	if val := get("remoteshell"); val != "" {
+		args, err := BashSplit(val)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "invalid sync.remoteShell"))
+		} else {
+			ss.RemoteShell = args
+		}
+	}
+
+	if val := get("daemonsshurl"); val != "" {
+		ss.DaemonSSHURL = strings.TrimSpace(val)
+	}
+
+	if val := get("remotelockpath"); val != "" {
+		ss.RemoteLockPath = val
+	}
+
+	if val := get("preflightcmd"); val != "" {
+		ss.PreflightCmd = val
+	}
+
+	parseBool("sync.pullAutoStage", &ss.PullAutoStage)
+	parseBool("sync.detectRemoteDirty", &ss.DetectRemoteDirty)
+	parseBool("sync.explicitDeletes", &ss.ExplicitDeletes)
+	parseBool("sync.foregroundFetch", &ss.ForegroundFetch)
+	parseBool("sync.tagRemote", &ss.TagRemote)
+	parseBool("sync.remoteSkipSubmodules", &ss.RemoteSkipSubmodules)
+	parseInt("sync.fsmonitorMaxChanges", &ss.FsmonitorMaxChanges, nonNegative)
+	parseInt("sync.fsmonitorTimeoutMs", &ss.FsmonitorTimeoutMs, func(n int) string {
+		if n <= 0 {
+			return "must be positive"
+		}
+		return ""
+	})
+
+	for _, opt := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"sync.sshConnectTimeout", &ss.SSHConnectTimeout},
+		{"sync.sshControlPersist", &ss.SSHControlPersist},
+		{"sync.sshServerAliveInterval", &ss.SSHServerAliveInterval},
+		{"sync.remoteLockTimeout", &ss.RemoteLockTimeout},
+	} {
+		if val := getNamed(opt.name); val != "" {
+			d, err := parseSSHDuration(opt.name, val)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			*opt.dst = d
+		}
+	}
+
+	parseBool("sync.sshStrictHostKeyChecking", &ss.SSHStrictHostKeyChecking)
+
+	if val := get("sshcontrolpath"); val != "" {
+		ss.SSHControlPath = strings.TrimSpace(val)
+	}
+
+	if val := get("sshextraoptions"); val != "" {
+		opts, err := parseSSHOptions(val)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			ss.SSHExtraOptions = opts
+		}
+	}
+
+	ss.RemoteURL = strings.TrimSpace(gitConfig.Get("remote." + ss.RemoteName + ".url"))
+	if ss.RemoteURL == "" {
+		errs = append(errs, errors.Errorf("no url specified for remote name %q", ss.RemoteName))
+	}
+	ss.FsmonitorPath = gitConfig.Get("core.fsmonitor")
+
+	if len(errs) > 0 {
+		return &ss, errs
+	}
+	return &ss, nil
+}
+
+// Parse a duration for an ssh option. Like ssh, a bare number is seconds,
+// but Go durations such as 30s or 15m are accepted too. ssh only deals in
+// whole seconds.
+func parseSSHDuration(name string, val string) (time.Duration, error) {
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		n, atoiErr := strconv.Atoi(val)
+		if atoiErr != nil {
+			return 0, errors.Errorf("invalid %s %q, expected seconds or a duration like 30s", name, val)
+		}
+		d = time.Duration(n) * time.Second
+	}
+	if d < 0 {
+		return 0, errors.Errorf("invalid %s %q, must not be negative", name, val)
+	}
+	if d%time.Second != 0 {
+		return 0, errors.Errorf("invalid %s %q, must be a whole number of seconds", name, val)
+	}
+	return d, nil
+}
+
+// Parse Key=Value ssh options separated by semicolons. Commas and colons
+// turn up in option values, for instance in Ciphers and ProxyCommand.
+func parseSSHOptions(val string) (map[string]string, error) {
+	opts := make(map[string]string)
+	for _, opt := range strings.Split(val, ";") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, errors.Errorf("invalid sync.sshExtraOptions entry %q, expected Key=Value", opt)
+		}
+		opts[key] = strings.TrimSpace(kv[1])
+	}
+	return opts, nil
+}
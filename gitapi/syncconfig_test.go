@@ -0,0 +1,155 @@
+package gitapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyncSettings(t *testing.T) {
+	// Keys as git config -l reports them: section and key lowercased.
+	fixture := gitConfig{
+		"sync.remotename":                      "dev",
+		"sync.excludepaths":                    "build:.cache",
+		"sync.maxparallelremotes":              "2",
+		"sync.changesource":                    "status",
+		"remote.prod.syncrsynccompress":        "false",
+		"sync.rsynccompresslevel":              "3",
+		"remote.dev.url":                       "devbox:src/repo",
+		"remote.prod.url":                      "prodbox:/srv/repo",
+		"remote.prod.syncexcludepaths":         "logs",
+		"sync.excludepathsfile":                ".sync-excludes",
+		"remote.prod.syncremoteshell":          "docker exec -i",
+		"remote.prod.syncremoteskipsubmodules": "true",
+		"sync.preflightcmd":                    "git-preflight -files-from -",
+		"sync.pullautostage":                   "true",
+		"remote.prod.syncdetectremotedirty":    "true",
+		"sync.sshconnecttimeout":               "30",
+		"remote.prod.syncsshcontrolpersist":    "1h",
+		"remote.prod.syncsshextraoptions":      "ProxyJump=bastion; Ciphers=aes128-ctr,aes256-ctr",
+		"core.fsmonitor":                       "git-fsmonitor",
+		"remote.prod.syncfsmonitormaxchanges":  "0",
+		"sync.fsmonitortimeoutms":              "2500",
+	}
+
+	ss, err := ParseSyncSettings(fixture, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultSyncSettings
+	want.RemoteName = "dev"
+	want.RemoteURL = "devbox:src/repo"
+	want.ExcludePaths = []string{"build", ".cache"}
+	want.ExcludePathsFile = ".sync-excludes"
+	want.MaxParallelRemotes = 2
+	want.ChangeSource = ChangeSourceStatus
+	want.FsmonitorPath = "git-fsmonitor"
+	want.SSHConnectTimeout = 30 * time.Second
+	want.RsyncCompressLevel = 3
+	want.PreflightCmd = "git-preflight -files-from -"
+	want.PullAutoStage = true
+	want.FsmonitorTimeoutMs = 2500
+	if !reflect.DeepEqual(*ss, want) {
+		t.Fatalf("unexpected settings:\n got %+v\nwant %+v", *ss, want)
+	}
+
+	// Per-remote keys override the global ones.
+	ss, err = ParseSyncSettings(fixture, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ss.ExcludePaths, []string{"logs"}) {
+		t.Fatalf("per-remote excludes not applied: %v", ss.ExcludePaths)
+	}
+	if !reflect.DeepEqual(ss.RemoteShell, []string{"docker", "exec", "-i"}) {
+		t.Fatalf("per-remote shell not applied: %v", ss.RemoteShell)
+	}
+	if ss.SSHControlPersist != time.Hour || ss.SSHConnectTimeout != 30*time.Second {
+		t.Fatalf("unexpected ssh durations: %s %s", ss.SSHControlPersist, ss.SSHConnectTimeout)
+	}
+	wantOpts := map[string]string{"ProxyJump": "bastion", "Ciphers": "aes128-ctr,aes256-ctr"}
+	if !reflect.DeepEqual(ss.SSHExtraOptions, wantOpts) {
+		t.Fatalf("unexpected ssh options: %v", ss.SSHExtraOptions)
+	}
+	if ss.RsyncCompress || ss.RsyncCompressLevel != 3 {
+		t.Fatalf("unexpected rsync compression: %v %d", ss.RsyncCompress, ss.RsyncCompressLevel)
+	}
+	if !ss.DetectRemoteDirty {
+		t.Fatal("per-remote sync.detectRemoteDirty not applied")
+	}
+	if !ss.RemoteSkipSubmodules {
+		t.Fatal("per-remote sync.remoteSkipSubmodules not applied")
+	}
+	if ss.FsmonitorMaxChanges != 0 {
+		t.Fatalf("per-remote sync.fsmonitorMaxChanges not applied: %d", ss.FsmonitorMaxChanges)
+	}
+	if ss.MaxParallelRemotes != 2 {
+		t.Fatalf("global setting not inherited: %d", ss.MaxParallelRemotes)
+	}
+
+	if _, err := ParseSyncSettings(fixture, "missing"); err == nil {
+		t.Fatal("expected an error for a remote without a url")
+	}
+	fixture["sync.rsyncbandwidthlimit"] = "-1"
+	if _, err := ParseSyncSettings(fixture, ""); err == nil {
+		t.Fatal("expected an error for a negative sync.rsyncBandwidthLimit")
+	}
+	delete(fixture, "sync.rsyncbandwidthlimit")
+	fixture["sync.rsynccompresslevel"] = "10"
+	if _, err := ParseSyncSettings(fixture, ""); err == nil {
+		t.Fatal("expected an error for sync.rsyncCompressLevel out of range")
+	}
+	fixture["sync.rsynccompresslevel"] = "3"
+	for _, val := range []string{"soon", "-5s", "1500ms"} {
+		fixture["sync.sshserveraliveinterval"] = val
+		if _, err := ParseSyncSettings(fixture, ""); err == nil {
+			t.Fatalf("expected an error for sync.sshServerAliveInterval %q", val)
+		}
+	}
+	delete(fixture, "sync.sshserveraliveinterval")
+	fixture["sync.sshextraoptions"] = "ProxyJump"
+	if _, err := ParseSyncSettings(fixture, ""); err == nil {
+		t.Fatal("expected an error for an option without a value")
+	}
+	delete(fixture, "sync.sshextraoptions")
+	fixture["sync.changesource"] = "bogus"
+	if _, err := ParseSyncSettings(fixture, ""); err == nil {
+		t.Fatal("expected an error for an invalid sync.changeSource")
+	}
+
+	// Every problem is reported, not just the first.
+	fixture["sync.maxretries"] = "-1"
+	fixture["sync.pullautostage"] = "sometimes"
+	_, err = ParseSyncSettings(fixture, "")
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 config errors, got %v", err)
+	}
+	for i, name := range []string{"sync.maxRetries", "sync.changeSource", "sync.pullAutoStage"} {
+		if !strings.Contains(errs[i].Error(), name) {
+			t.Errorf("error %d = %q, want one for %s", i, errs[i], name)
+		}
+	}
+}
+
+func TestRemoteShellWords(t *testing.T) {
+	fixture := gitConfig{
+		"remote.dev.url":   "pod:/src/repo",
+		"sync.remotename":  "dev",
+		"sync.remoteshell": `kubectl exec -i pod -c "my container" --`,
+	}
+	ss, err := ParseSyncSettings(fixture, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"kubectl", "exec", "-i", "pod", "-c", "my container", "--"}
+	if !reflect.DeepEqual(ss.RemoteShell, want) {
+		t.Fatalf("got %q, want %q", ss.RemoteShell, want)
+	}
+
+	fixture["sync.remoteshell"] = `docker exec -i 'unterminated`
+	if _, err := ParseSyncSettings(fixture, ""); err == nil || !strings.Contains(err.Error(), "sync.remoteShell") {
+		t.Fatalf("expected an error for an unterminated quote, got %v", err)
+	}
+}